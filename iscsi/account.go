@@ -0,0 +1,176 @@
+package iscsi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// CreateAccount will create a CHAP account in tgtd. Accounts are global to
+// tgtd and can be bound to multiple targets.
+func CreateAccount(user, password string) error {
+	return CreateAccountContext(context.Background(), user, password)
+}
+
+// CreateAccountContext is like CreateAccount but takes a context.
+func CreateAccountContext(ctx context.Context, user, password string) error {
+	return DefaultTgtd().CreateAccountContext(ctx, user, password)
+}
+
+// CreateAccountContext will create a CHAP account in tgtd. Accounts are global
+// to tgtd and can be bound to multiple targets.
+func (t *Tgtd) CreateAccountContext(ctx context.Context, user, password string) error {
+	if user == "" || password == "" {
+		return fmt.Errorf("empty user or password for the account")
+	}
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "new",
+		"--mode", "account",
+		"--user", user,
+		"--password", password,
+	}
+	_, err := t.tgtadm(ctx, opts, password)
+	return err
+}
+
+// DeleteAccount will remove a CHAP account from tgtd, and unbind it from all
+// targets.
+func DeleteAccount(user string) error {
+	return DeleteAccountContext(context.Background(), user)
+}
+
+// DeleteAccountContext is like DeleteAccount but takes a context.
+func DeleteAccountContext(ctx context.Context, user string) error {
+	return DefaultTgtd().DeleteAccountContext(ctx, user)
+}
+
+// DeleteAccountContext will remove a CHAP account from tgtd, and unbind it from
+// all targets.
+func (t *Tgtd) DeleteAccountContext(ctx context.Context, user string) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "delete",
+		"--mode", "account",
+		"--user", user,
+	}
+	_, err := t.tgtadm(ctx, opts)
+	return err
+}
+
+// ListAccounts returns the user names of all CHAP accounts in tgtd.
+func ListAccounts() ([]string, error) {
+	return ListAccountsContext(context.Background())
+}
+
+// ListAccountsContext is like ListAccounts but takes a context.
+func ListAccountsContext(ctx context.Context) ([]string, error) {
+	return DefaultTgtd().ListAccountsContext(ctx)
+}
+
+// ListAccountsContext returns the user names of all CHAP accounts in tgtd.
+func (t *Tgtd) ListAccountsContext(ctx context.Context) ([]string, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "account",
+	}
+	output, err := t.tgtadm(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseAccounts(output)
+}
+
+// BindAccount will bind a CHAP account to a target. An incoming account is
+// used by the target to authenticate the initiators, while an outgoing account
+// is used by the initiators to authenticate the target, a.k.a. mutual CHAP.
+// A target can have at most one outgoing account.
+func BindAccount(tid int, user string, outgoing bool) error {
+	return BindAccountContext(context.Background(), tid, user, outgoing)
+}
+
+// BindAccountContext is like BindAccount but takes a context.
+func BindAccountContext(ctx context.Context, tid int, user string, outgoing bool) error {
+	return DefaultTgtd().BindAccountContext(ctx, tid, user, outgoing)
+}
+
+// BindAccountContext will bind a CHAP account to a target. An incoming account
+// is used by the target to authenticate the initiators, while an outgoing
+// account is used by the initiators to authenticate the target, a.k.a. mutual
+// CHAP. A target can have at most one outgoing account.
+func (t *Tgtd) BindAccountContext(ctx context.Context, tid int, user string, outgoing bool) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "bind",
+		"--mode", "account",
+		"--tid", strconv.Itoa(tid),
+		"--user", user,
+	}
+	if outgoing {
+		opts = append(opts, "--outgoing")
+	}
+	_, err := t.tgtadm(ctx, opts)
+	return err
+}
+
+// UnbindAccount will unbind a CHAP account from a target.
+func UnbindAccount(tid int, user string, outgoing bool) error {
+	return UnbindAccountContext(context.Background(), tid, user, outgoing)
+}
+
+// UnbindAccountContext is like UnbindAccount but takes a context.
+func UnbindAccountContext(ctx context.Context, tid int, user string, outgoing bool) error {
+	return DefaultTgtd().UnbindAccountContext(ctx, tid, user, outgoing)
+}
+
+// UnbindAccountContext will unbind a CHAP account from a target.
+func (t *Tgtd) UnbindAccountContext(ctx context.Context, tid int, user string, outgoing bool) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "unbind",
+		"--mode", "account",
+		"--tid", strconv.Itoa(tid),
+		"--user", user,
+	}
+	if outgoing {
+		opts = append(opts, "--outgoing")
+	}
+	_, err := t.tgtadm(ctx, opts)
+	return err
+}
+
+/*
+parseAccounts parses the output of `tgtadm --op show --mode account`, which looks like:
+
+	Account list:
+	    user1
+	    user2
+*/
+func parseAccounts(output string) ([]string, error) {
+	users := []string{}
+	inList := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "Account list:" {
+			inList = true
+			continue
+		}
+		if !inList {
+			return nil, fmt.Errorf("invalid output format, found %q before account list", line)
+		}
+		users = append(users, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to parse accounts")
+	}
+	return users, nil
+}
@@ -0,0 +1,34 @@
+package iscsi
+
+import (
+	"github.com/cockroachdb/errors"
+
+	. "gopkg.in/check.v1"
+)
+
+type AccountSuite struct{}
+
+var _ = Suite(&AccountSuite{})
+
+func (s *AccountSuite) TestParseAccounts(c *C) {
+	users, err := parseAccounts("Account list:\n    user1\n    user2\n")
+	c.Assert(err, IsNil)
+	c.Assert(users, DeepEquals, []string{"user1", "user2"})
+
+	users, err = parseAccounts("Account list:\n")
+	c.Assert(err, IsNil)
+	c.Assert(users, HasLen, 0)
+
+	_, err = parseAccounts("user1\n")
+	c.Assert(err, NotNil)
+}
+
+func (s *AccountSuite) TestTgtadmErrorRedactsPassword(c *C) {
+	opts := []string{"--op", "new", "--mode", "account", "--user", "user1", "--password", "s3cr3t"}
+	cause := errors.New("failed to execute: /usr/sbin/tgtadm [tgtadm --op new --mode account --user user1 --password s3cr3t], output , stderr tgtadm: this account already exists")
+
+	err := newTgtadmError(opts, cause, "s3cr3t")
+	c.Assert(err.Error(), Not(Matches), ".*s3cr3t.*")
+	c.Assert(err.Args[len(err.Args)-1], Not(Equals), "s3cr3t")
+	c.Assert(err.Output, Equals, "tgtadm: this account already exists")
+}
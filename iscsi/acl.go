@@ -0,0 +1,232 @@
+package iscsi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/types"
+
+	lhtypes "github.com/longhorn/go-common-libs/types"
+)
+
+const (
+	// ACLAll is the wildcard initiator address, which allows all initiators
+	ACLAll = "ALL"
+
+	InitiatorNameFile = "/etc/iscsi/initiatorname.iscsi"
+)
+
+type ACLType string
+
+const (
+	// ACLTypeAddress matches the initiator by IP address or CIDR, i.e. `tgtadm -I`
+	ACLTypeAddress = ACLType("address")
+	// ACLTypeName matches the initiator by its iSCSI name, i.e. `tgtadm -Q`
+	ACLTypeName = ACLType("name")
+)
+
+// ACL is an access control rule of a target. tgtd rejects the login if the
+// initiator address doesn't match any address ACL, or if the target has name
+// ACLs and the initiator name doesn't match any of them.
+type ACL struct {
+	Type  ACLType
+	Value string
+}
+
+func (acl ACL) String() string {
+	return acl.Value
+}
+
+// NewAddressACL returns an ACL for the initiator address, which can be an IP
+// address, a CIDR or ACLAll.
+func NewAddressACL(address string) (ACL, error) {
+	if address != ACLAll && net.ParseIP(address) == nil {
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			return ACL{}, fmt.Errorf("invalid initiator address %v", address)
+		}
+	}
+	return ACL{Type: ACLTypeAddress, Value: address}, nil
+}
+
+// NewNameACL returns an ACL for the initiator iSCSI name.
+func NewNameACL(name string) (ACL, error) {
+	if !isISCSIName(name) {
+		return ACL{}, fmt.Errorf("invalid initiator name %v", name)
+	}
+	return ACL{Type: ACLTypeName, Value: name}, nil
+}
+
+// ParseACL returns the ACL for an initiator address or name.
+func ParseACL(value string) (ACL, error) {
+	if isISCSIName(value) {
+		return NewNameACL(value)
+	}
+	return NewAddressACL(value)
+}
+
+func isISCSIName(value string) bool {
+	return strings.HasPrefix(value, "iqn.") || strings.HasPrefix(value, "eui.") || strings.HasPrefix(value, "naa.")
+}
+
+// BindACL will add the ACL to the target.
+func BindACL(tid int, acl ACL) error {
+	return BindACLContext(context.Background(), tid, acl)
+}
+
+// BindACLContext is like BindACL but takes a context.
+func BindACLContext(ctx context.Context, tid int, acl ACL) error {
+	return DefaultTgtd().BindACLContext(ctx, tid, acl)
+}
+
+// BindACLContext will add the ACL to the target.
+func (t *Tgtd) BindACLContext(ctx context.Context, tid int, acl ACL) error {
+	opts, err := aclOpts("bind", tid, acl)
+	if err != nil {
+		return err
+	}
+	_, err = t.tgtadm(ctx, opts)
+	return err
+}
+
+// UnbindACL will remove the ACL from the target.
+func UnbindACL(tid int, acl ACL) error {
+	return UnbindACLContext(context.Background(), tid, acl)
+}
+
+// UnbindACLContext is like UnbindACL but takes a context.
+func UnbindACLContext(ctx context.Context, tid int, acl ACL) error {
+	return DefaultTgtd().UnbindACLContext(ctx, tid, acl)
+}
+
+// UnbindACLContext will remove the ACL from the target.
+func (t *Tgtd) UnbindACLContext(ctx context.Context, tid int, acl ACL) error {
+	opts, err := aclOpts("unbind", tid, acl)
+	if err != nil {
+		return err
+	}
+	_, err = t.tgtadm(ctx, opts)
+	return err
+}
+
+// ListACLs returns the ACLs of the target.
+func ListACLs(tid int) ([]ACL, error) {
+	return ListACLsContext(context.Background(), tid)
+}
+
+// ListACLsContext is like ListACLs but takes a context.
+func ListACLsContext(ctx context.Context, tid int) ([]ACL, error) {
+	return DefaultTgtd().ListACLsContext(ctx, tid)
+}
+
+// ListACLsContext returns the ACLs of the target.
+func (t *Tgtd) ListACLsContext(ctx context.Context, tid int) ([]ACL, error) {
+	targets, err := t.ListTargetsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		if target.TID != tid {
+			continue
+		}
+		return target.BoundACLs(), nil
+	}
+	return nil, errors.Wrapf(types.ErrNoTarget, "failed to list ACLs of target %v", tid)
+}
+
+// BindInitiatorName will add permission to allow the initiator with the iSCSI
+// name to connect to certain target.
+func BindInitiatorName(tid int, name string) error {
+	return BindInitiatorNameContext(context.Background(), tid, name)
+}
+
+// BindInitiatorNameContext is like BindInitiatorName but takes a context.
+func BindInitiatorNameContext(ctx context.Context, tid int, name string) error {
+	return DefaultTgtd().BindInitiatorNameContext(ctx, tid, name)
+}
+
+// BindInitiatorNameContext will add permission to allow the initiator with the
+// iSCSI name to connect to certain target.
+func (t *Tgtd) BindInitiatorNameContext(ctx context.Context, tid int, name string) error {
+	acl, err := NewNameACL(name)
+	if err != nil {
+		return err
+	}
+	return t.BindACLContext(ctx, tid, acl)
+}
+
+// UnbindInitiatorName will remove permission to allow the initiator with the
+// iSCSI name to connect to certain target.
+func UnbindInitiatorName(tid int, name string) error {
+	return UnbindInitiatorNameContext(context.Background(), tid, name)
+}
+
+// UnbindInitiatorNameContext is like UnbindInitiatorName but takes a context.
+func UnbindInitiatorNameContext(ctx context.Context, tid int, name string) error {
+	return DefaultTgtd().UnbindInitiatorNameContext(ctx, tid, name)
+}
+
+// UnbindInitiatorNameContext will remove permission to allow the initiator with
+// the iSCSI name to connect to certain target.
+func (t *Tgtd) UnbindInitiatorNameContext(ctx context.Context, tid int, name string) error {
+	acl, err := NewNameACL(name)
+	if err != nil {
+		return err
+	}
+	return t.UnbindACLContext(ctx, tid, acl)
+}
+
+func aclOpts(op string, tid int, acl ACL) ([]string, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", op,
+		"--mode", "target",
+		"--tid", strconv.Itoa(tid),
+	}
+	switch acl.Type {
+	case ACLTypeAddress:
+		opts = append(opts, "-I", acl.Value)
+	case ACLTypeName:
+		opts = append(opts, "-Q", acl.Value)
+	default:
+		return nil, fmt.Errorf("unknown ACL type %v", acl.Type)
+	}
+	return opts, nil
+}
+
+// GetInitiatorName returns the iSCSI name of the initiator, read from the
+// namespaces of iscsid.
+func GetInitiatorName(nsexec Executor) (string, error) {
+	return GetInitiatorNameContext(context.Background(), nsexec)
+}
+
+// GetInitiatorNameContext is like GetInitiatorName but takes a context.
+func GetInitiatorNameContext(ctx context.Context, nsexec Executor) (string, error) {
+	content, err := execute(ctx, nsexec, "cat", []string{InitiatorNameFile}, lhtypes.ExecuteDefaultTimeout)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %v", InitiatorNameFile)
+	}
+	return parseInitiatorName(content)
+}
+
+/*
+parseInitiatorName parses the initiator name file, which looks like:
+
+	## DO NOT EDIT OR REMOVE THIS FILE!
+	InitiatorName=iqn.1993-08.org.debian:01:e9a4e7b3c3d
+*/
+func parseInitiatorName(content string) (string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if name, found := strings.CutPrefix(line, "InitiatorName="); found {
+			return strings.TrimSpace(name), nil
+		}
+	}
+	return "", fmt.Errorf("cannot find initiator name in %v", InitiatorNameFile)
+}
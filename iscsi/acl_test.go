@@ -0,0 +1,47 @@
+package iscsi
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type ACLSuite struct{}
+
+var _ = Suite(&ACLSuite{})
+
+func (s *ACLSuite) TestParseACL(c *C) {
+	for value, expected := range map[string]ACL{
+		"ALL":                                   {Type: ACLTypeAddress, Value: "ALL"},
+		"10.0.0.1":                              {Type: ACLTypeAddress, Value: "10.0.0.1"},
+		"10.0.0.0/24":                           {Type: ACLTypeAddress, Value: "10.0.0.0/24"},
+		"fd00::1":                               {Type: ACLTypeAddress, Value: "fd00::1"},
+		"iqn.1993-08.org.debian:01:e9a4e7b3c3d": {Type: ACLTypeName, Value: "iqn.1993-08.org.debian:01:e9a4e7b3c3d"},
+	} {
+		acl, err := ParseACL(value)
+		c.Assert(err, IsNil)
+		c.Assert(acl, Equals, expected)
+	}
+
+	_, err := ParseACL("node-1")
+	c.Assert(err, NotNil)
+	_, err = NewNameACL("10.0.0.1")
+	c.Assert(err, NotNil)
+}
+
+func (s *ACLSuite) TestACLOpts(c *C) {
+	opts, err := aclOpts("bind", 1, ACL{Type: ACLTypeAddress, Value: "10.0.0.1"})
+	c.Assert(err, IsNil)
+	c.Assert(opts[len(opts)-2:], DeepEquals, []string{"-I", "10.0.0.1"})
+
+	opts, err = aclOpts("unbind", 1, ACL{Type: ACLTypeName, Value: "iqn.2019-10.io.longhorn:a"})
+	c.Assert(err, IsNil)
+	c.Assert(opts[len(opts)-2:], DeepEquals, []string{"-Q", "iqn.2019-10.io.longhorn:a"})
+}
+
+func (s *ACLSuite) TestParseInitiatorName(c *C) {
+	name, err := parseInitiatorName("## DO NOT EDIT OR REMOVE THIS FILE!\nInitiatorName=iqn.1993-08.org.debian:01:e9a4e7b3c3d\n")
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "iqn.1993-08.org.debian:01:e9a4e7b3c3d")
+
+	_, err = parseInitiatorName("")
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,71 @@
+package iscsi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lhexec "github.com/longhorn/go-common-libs/exec"
+)
+
+// TgtadmBackend sends tgtadm requests to tgtd. The options are the same as the
+// command line options of tgtadm, and the output is the same as the one
+// printed by tgtadm.
+type TgtadmBackend interface {
+	Execute(opts []string, timeout time.Duration) (string, error)
+}
+
+// ContextTgtadmBackend is a TgtadmBackend which aborts the request once the
+// context is done. For other backends, only the timeout of the request is
+// bounded by the deadline of the context.
+type ContextTgtadmBackend interface {
+	TgtadmBackend
+	ExecuteContext(ctx context.Context, opts []string, timeout time.Duration) (string, error)
+}
+
+var (
+	tgtadmBackendLock sync.RWMutex
+	tgtadmBackend     TgtadmBackend = &ExecBackend{}
+)
+
+// SetTgtadmBackend replaces the backend used by all target helpers, and
+// returns the previous one. The default backend is ExecBackend.
+func SetTgtadmBackend(backend TgtadmBackend) TgtadmBackend {
+	tgtadmBackendLock.Lock()
+	defer tgtadmBackendLock.Unlock()
+	previous := tgtadmBackend
+	tgtadmBackend = backend
+	return previous
+}
+
+func getTgtadmBackend() TgtadmBackend {
+	tgtadmBackendLock.RLock()
+	defer tgtadmBackendLock.RUnlock()
+	return tgtadmBackend
+}
+
+// ExecBackend forks the tgtadm binary for every request.
+type ExecBackend struct {
+	executor Executor
+}
+
+// NewExecBackend returns a backend executing tgtadm with the executor, or
+// lhexec.Executor if it's nil. The command is killed once the context is done
+// if the executor is a ContextExecutor.
+func NewExecBackend(executor Executor) *ExecBackend {
+	return &ExecBackend{
+		executor: executor,
+	}
+}
+
+func (b *ExecBackend) Execute(opts []string, timeout time.Duration) (string, error) {
+	return b.ExecuteContext(context.Background(), opts, timeout)
+}
+
+func (b *ExecBackend) ExecuteContext(ctx context.Context, opts []string, timeout time.Duration) (string, error) {
+	var executor Executor = lhexec.NewExecutor()
+	if b.executor != nil {
+		executor = b.executor
+	}
+	return execute(ctx, executor, tgtBinary, opts, timeout)
+}
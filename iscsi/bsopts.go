@@ -0,0 +1,173 @@
+package iscsi
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// BackingStoreFlag is an open flag of the backing file, i.e. `tgtadm
+// --bsoflags`.
+type BackingStoreFlag string
+
+const (
+	BackingStoreFlagSync   = BackingStoreFlag("sync")
+	BackingStoreFlagDirect = BackingStoreFlag("direct")
+)
+
+/*
+BackingStoreOptions are the options of the backing store of a LUN, which are
+passed to tgtd by `tgtadm --bstype <type> --bsopts <opts> --bsoflags <flags>`:
+
+  - longhorn of rancher/tgt takes the size of the volume and the request
+    timeout of the engine, e.g. --bsopts "size=1073741824;request_timeout=15".
+  - rdwr and aio take no bsopts, but they open the backing file with the
+    flags, e.g. --bsoflags "sync:direct".
+
+The other backing stores take neither of them.
+*/
+type BackingStoreOptions struct {
+	// Type is the backing store, or the default rdwr if empty.
+	Type string
+	// Size is the size of the longhorn volume in bytes, which tgtd reports
+	// as the LUN size. It's left out if 0.
+	Size int64
+	// RequestTimeout is the timeout of the requests from tgtd to the
+	// longhorn engine. It's left out if 0, so tgtd keeps its default.
+	RequestTimeout int64
+	// Flags are the open flags of rdwr and aio.
+	Flags []BackingStoreFlag
+}
+
+// ParseBackingStoreOptions parses the bsopts of the backing store, e.g.
+// size=1073741824;request_timeout=15 of longhorn. The options are validated.
+func ParseBackingStoreOptions(bstype, bsopts string) (*BackingStoreOptions, error) {
+	options := &BackingStoreOptions{Type: bstype}
+	for _, opt := range strings.Split(bsopts, ";") {
+		if opt == "" {
+			continue
+		}
+		key, value, found := strings.Cut(opt, "=")
+		if !found || options.backingStoreType() != "longhorn" {
+			return nil, fmt.Errorf("invalid option %v of backing-store %v", opt, options.backingStoreType())
+		}
+		var err error
+		switch key {
+		case "size":
+			options.Size, err = strconv.ParseInt(value, 10, 64)
+		case "request_timeout":
+			options.RequestTimeout, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return nil, fmt.Errorf("unknown option %v of backing-store longhorn", key)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid option %v of backing-store longhorn", opt)
+		}
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// SetBackingStoreOption returns the bsopts with the option set to the value,
+// which is replaced or appended. The other options are kept as they are, so
+// it also works for the bsopts unknown to ParseBackingStoreOptions.
+func SetBackingStoreOption(bsopts, key, value string) string {
+	opts := []string{}
+	replaced := false
+	for _, opt := range strings.Split(bsopts, ";") {
+		if opt == "" {
+			continue
+		}
+		if k, _, _ := strings.Cut(opt, "="); k == key {
+			opt, replaced = key+"="+value, true
+		}
+		opts = append(opts, opt)
+	}
+	if !replaced {
+		opts = append(opts, key+"="+value)
+	}
+	return strings.Join(opts, ";")
+}
+
+// ParseBackingStoreFlags parses the bsoflags, e.g. sync:direct, which tgtd
+// also shows as the backing store flags of the LUNs.
+func ParseBackingStoreFlags(bsoflags string) ([]BackingStoreFlag, error) {
+	var flags []BackingStoreFlag
+	for _, flag := range strings.FieldsFunc(bsoflags, func(r rune) bool { return r == ':' || r == ' ' }) {
+		flag := BackingStoreFlag(flag)
+		if flag != BackingStoreFlagSync && flag != BackingStoreFlagDirect {
+			return nil, fmt.Errorf("unknown backing store flag %v", flag)
+		}
+		if !slices.Contains(flags, flag) {
+			flags = append(flags, flag)
+		}
+	}
+	return flags, nil
+}
+
+// Validate checks the backing store takes the options.
+func (o *BackingStoreOptions) Validate() error {
+	bstype := o.backingStoreType()
+	if o.Size < 0 || o.RequestTimeout < 0 {
+		return fmt.Errorf("invalid size %v or request timeout %v of backing-store %v", o.Size, o.RequestTimeout, bstype)
+	}
+	if (o.Size != 0 || o.RequestTimeout != 0) && bstype != "longhorn" {
+		return fmt.Errorf("backing-store %v takes neither the size nor the request timeout", bstype)
+	}
+	if len(o.Flags) != 0 && bstype != "rdwr" && bstype != "aio" {
+		return fmt.Errorf("backing-store %v takes no flags", bstype)
+	}
+	for i, flag := range o.Flags {
+		if flag != BackingStoreFlagSync && flag != BackingStoreFlagDirect {
+			return fmt.Errorf("unknown backing store flag %v", flag)
+		}
+		if slices.Contains(o.Flags[:i], flag) {
+			return fmt.Errorf("duplicate backing store flag %v", flag)
+		}
+	}
+	return nil
+}
+
+// String returns the bsopts, or an empty string if there are none.
+func (o *BackingStoreOptions) String() string {
+	opts := []string{}
+	if o.Size != 0 {
+		opts = append(opts, "size="+strconv.FormatInt(o.Size, 10))
+	}
+	if o.RequestTimeout != 0 {
+		opts = append(opts, "request_timeout="+strconv.FormatInt(o.RequestTimeout, 10))
+	}
+	return strings.Join(opts, ";")
+}
+
+// FlagsString returns the bsoflags, or an empty string if there are none.
+func (o *BackingStoreOptions) FlagsString() string {
+	flags := []string{}
+	for _, flag := range o.Flags {
+		flags = append(flags, string(flag))
+	}
+	return strings.Join(flags, ":")
+}
+
+func (o *BackingStoreOptions) backingStoreType() string {
+	if o.Type == "" {
+		return "rdwr"
+	}
+	return o.Type
+}
+
+// BackingStoreOptions returns the backing store and the flags shown by tgtd.
+// tgtd doesn't show the bsopts, so the size and the request timeout are
+// unknown.
+func (lun *LUN) BackingStoreOptions() (*BackingStoreOptions, error) {
+	flags, err := ParseBackingStoreFlags(lun.BackingStoreFlags)
+	if err != nil {
+		return nil, err
+	}
+	return &BackingStoreOptions{Type: lun.BackingStoreType, Flags: flags}, nil
+}
@@ -0,0 +1,119 @@
+package iscsi_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+
+	. "gopkg.in/check.v1"
+)
+
+type BackingStoreOptionsSuite struct {
+	iscsitest.Fixture
+}
+
+var _ = Suite(&BackingStoreOptionsSuite{})
+
+func (s *BackingStoreOptionsSuite) TestParse(c *C) {
+	options, err := iscsi.ParseBackingStoreOptions("longhorn", "size=1073741824;request_timeout=15")
+	c.Assert(err, IsNil)
+	c.Assert(options, DeepEquals, &iscsi.BackingStoreOptions{Type: "longhorn", Size: 1073741824, RequestTimeout: 15})
+	c.Assert(options.String(), Equals, "size=1073741824;request_timeout=15")
+
+	// The options are serialized in the same order, and 0 is left out
+	options, err = iscsi.ParseBackingStoreOptions("longhorn", "request_timeout=15;size=1073741824;")
+	c.Assert(err, IsNil)
+	c.Assert(options.String(), Equals, "size=1073741824;request_timeout=15")
+	options.RequestTimeout = 0
+	c.Assert(options.String(), Equals, "size=1073741824")
+	options, err = iscsi.ParseBackingStoreOptions("longhorn", "")
+	c.Assert(err, IsNil)
+	c.Assert(options.String(), Equals, "")
+
+	for _, bstype := range []string{"", "rdwr", "aio"} {
+		options, err = iscsi.ParseBackingStoreOptions(bstype, "")
+		c.Assert(err, IsNil)
+		c.Assert(options.String(), Equals, "")
+	}
+
+	_, err = iscsi.ParseBackingStoreOptions("longhorn", "size=1G")
+	c.Assert(err, ErrorMatches, "invalid option size=1G of backing-store longhorn: .*")
+	_, err = iscsi.ParseBackingStoreOptions("longhorn", "size=-1")
+	c.Assert(err, ErrorMatches, "invalid size -1 or request timeout 0 of backing-store longhorn")
+	_, err = iscsi.ParseBackingStoreOptions("longhorn", "timeout=15")
+	c.Assert(err, ErrorMatches, "unknown option timeout of backing-store longhorn")
+	_, err = iscsi.ParseBackingStoreOptions("longhorn", "size")
+	c.Assert(err, ErrorMatches, "invalid option size of backing-store longhorn")
+	_, err = iscsi.ParseBackingStoreOptions("", "size=1073741824")
+	c.Assert(err, ErrorMatches, "invalid option size=1073741824 of backing-store rdwr")
+	_, err = iscsi.ParseBackingStoreOptions("aio", "size=1073741824")
+	c.Assert(err, ErrorMatches, "invalid option size=1073741824 of backing-store aio")
+}
+
+func (s *BackingStoreOptionsSuite) TestValidate(c *C) {
+	options := &iscsi.BackingStoreOptions{Type: "aio", Flags: []iscsi.BackingStoreFlag{iscsi.BackingStoreFlagSync, iscsi.BackingStoreFlagDirect}}
+	c.Assert(options.Validate(), IsNil)
+	c.Assert(options.String(), Equals, "")
+	c.Assert(options.FlagsString(), Equals, "sync:direct")
+
+	flags, err := iscsi.ParseBackingStoreFlags("direct:sync")
+	c.Assert(err, IsNil)
+	c.Assert(flags, DeepEquals, []iscsi.BackingStoreFlag{iscsi.BackingStoreFlagDirect, iscsi.BackingStoreFlagSync})
+	flags, err = iscsi.ParseBackingStoreFlags("")
+	c.Assert(err, IsNil)
+	c.Assert(flags, IsNil)
+	_, err = iscsi.ParseBackingStoreFlags("sync:excl")
+	c.Assert(err, ErrorMatches, "unknown backing store flag excl")
+
+	c.Assert((&iscsi.BackingStoreOptions{Type: "rdwr", Size: 1073741824}).Validate(), ErrorMatches, "backing-store rdwr takes neither the size nor the request timeout")
+	c.Assert((&iscsi.BackingStoreOptions{Type: "longhorn", Size: 1073741824}).Validate(), IsNil)
+	c.Assert((&iscsi.BackingStoreOptions{Type: "longhorn", Flags: []iscsi.BackingStoreFlag{iscsi.BackingStoreFlagSync}}).Validate(), ErrorMatches, "backing-store longhorn takes no flags")
+	c.Assert((&iscsi.BackingStoreOptions{Type: "sg", Flags: []iscsi.BackingStoreFlag{iscsi.BackingStoreFlagDirect}}).Validate(), ErrorMatches, "backing-store sg takes no flags")
+	c.Assert((&iscsi.BackingStoreOptions{Flags: []iscsi.BackingStoreFlag{"excl"}}).Validate(), ErrorMatches, "unknown backing store flag excl")
+	c.Assert((&iscsi.BackingStoreOptions{Flags: []iscsi.BackingStoreFlag{iscsi.BackingStoreFlagSync, iscsi.BackingStoreFlagSync}}).Validate(), ErrorMatches, "duplicate backing store flag sync")
+}
+
+func (s *BackingStoreOptionsSuite) TestAddLun(c *C) {
+	ctx := context.Background()
+	s.Fake.BackingStores = slices.DeleteFunc(s.Fake.BackingStores, func(bs string) bool { return bs == "longhorn" })
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, "iqn.2019-10.io.longhorn:vol1"), IsNil)
+	image := filepath.Join(c.MkDir(), "vol1.img")
+	c.Assert(os.WriteFile(image, nil, 0600), IsNil)
+	c.Assert(os.Truncate(image, 1073741824), IsNil)
+
+	// The typed options are validated before tgtd is asked, while the bsopts
+	// string is passed to tgtd as it is
+	invalid := &iscsi.BackingStoreOptions{Type: "rdwr", Size: 1073741824}
+	c.Assert(s.Tgtd.AddLunWithBackingStoreContext(ctx, 1, 1, image, invalid, iscsi.DeviceTypeDisk), ErrorMatches, "backing-store rdwr takes neither the size nor the request timeout")
+	c.Assert(s.Tgtd.AddLunContext(ctx, 1, 2, image, "rdwr", "conf=/etc/ceph/ceph.conf"), IsNil)
+	c.Assert(slices.Contains(s.Fake.Commands()[len(s.Fake.Commands())-1], "conf=/etc/ceph/ceph.conf"), Equals, true)
+	options := &iscsi.BackingStoreOptions{Type: "rdwr", Flags: []iscsi.BackingStoreFlag{iscsi.BackingStoreFlagDirect}}
+	c.Assert(s.Tgtd.AddLunWithBackingStoreContext(ctx, 1, 1, image, options, iscsi.DeviceTypeDisk), IsNil)
+
+	// The flags are parsed back from the show output, and kept once the LUN
+	// is re-created
+	c.Assert(os.Truncate(image, 2147483648), IsNil)
+	_, err := s.Tgtd.ExpandLunWithOptionsContext(ctx, 1, 1, 2147483648, nil)
+	c.Assert(err, IsNil)
+	target, err := s.Tgtd.GetTargetContext(ctx, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(1).BackingStoreFlags, Equals, "direct")
+	shown, err := target.LUN(1).BackingStoreOptions()
+	c.Assert(err, IsNil)
+	c.Assert(shown, DeepEquals, options)
+	c.Assert(target.LUN(1).SizeMB, Equals, int64(2147))
+
+	// The config is passed to tgtd as it is, like AddLun
+	_, err = s.Tgtd.ReconcileContext(ctx, &iscsi.TgtdConfig{Targets: []iscsi.TargetConfig{{
+		TID: 2,
+		IQN: "iqn.2019-10.io.longhorn:vol2",
+		LUNs: []iscsi.LUNConfig{
+			{ID: 1, BackingStore: image, BackingStoreType: "aio", BackingStoreOpts: "conf=/etc/ceph/ceph.conf"},
+		},
+	}}})
+	c.Assert(err, IsNil)
+}
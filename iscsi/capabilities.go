@@ -0,0 +1,305 @@
+package iscsi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/types"
+
+	lhtypes "github.com/longhorn/go-common-libs/types"
+)
+
+// upstreamLunParams are the params accepted by `tgtadm --op update --mode
+// logicalunit` of the upstream tgt
+var upstreamLunParams = []string{
+	"vendor_id", "product_id", "product_rev", "scsi_id", "scsi_sn",
+	"removable", "readonly", "swp", "thin_provisioning", "online", "sense_format",
+	"mode_page", "path", "lbppbe", "la_lba", "optimal_xfer_gran", "optimal_xfer_len",
+}
+
+var (
+	// systemInfoCache keeps the capabilities of each tgtd instance by control
+	// port, since they don't change until tgtd is relaunched
+	systemInfoCacheLock sync.Mutex
+	systemInfoCache     = map[int]cachedSystemInfo{}
+)
+
+type cachedSystemInfo struct {
+	backend TgtadmBackend
+	info    *SystemInfo
+}
+
+// LLD is a low level driver of tgtd, e.g. iscsi, and its state.
+type LLD struct {
+	Name string
+	// State is ready once the driver is initialized, or error if it failed,
+	// e.g. iser without RDMA devices.
+	State string
+}
+
+// SystemInfo is the system of the running tgtd, which is shown by
+// `tgtadm --op show --mode system`, and its capabilities.
+type SystemInfo struct {
+	// Version is the version of tgt shown by `tgtadm --version`, which is
+	// installed along with tgtd.
+	Version string
+	// State is the state of tgtd, e.g. ready or offline.
+	State string
+	Debug bool
+	LLDs  []LLD
+	// BackingStores and DeviceTypes are the names shown by tgtd, e.g. rdwr
+	// and cd/dvd.
+	BackingStores []string
+	DeviceTypes   []string
+	// BackingStoreFlags are the open flags each backing store accepts, e.g.
+	// sync and direct of rdwr. The backing stores without flags are left out.
+	BackingStoreFlags map[string][]BackingStoreFlag
+	// Rancher is set for the customized tgt of https://github.com/rancher/tgt,
+	// which is detected by its longhorn backing store. Besides the backing
+	// store, it accepts the bsopts param to update the backing store options
+	// of a LUN, e.g. the size, in place.
+	Rancher bool
+}
+
+// GetSystemInfo returns the system of the running tgtd.
+func GetSystemInfo() (*SystemInfo, error) {
+	return GetSystemInfoContext(context.Background())
+}
+
+// GetSystemInfoContext is like GetSystemInfo but takes a context.
+func GetSystemInfoContext(ctx context.Context) (*SystemInfo, error) {
+	return DefaultTgtd().GetSystemInfoContext(ctx)
+}
+
+// GetSystemInfoContext returns the system of the running tgtd.
+func (t *Tgtd) GetSystemInfoContext(ctx context.Context) (*SystemInfo, error) {
+	info, err := t.showSystem(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if info.Version, err = t.version(ctx); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// version returns the version of tgt. tgtadm prints it without asking tgtd, so
+// the request cannot be sent to the management socket, and tgtadm is executed
+// for it regardless of the backend.
+func (t *Tgtd) version(ctx context.Context) (string, error) {
+	backend, ok := t.backend().(*ExecBackend)
+	if !ok {
+		backend = &ExecBackend{}
+	}
+	output, err := backend.ExecuteContext(ctx, []string{"--version"}, lhtypes.ExecuteDefaultTimeout)
+	if err != nil {
+		return "", errors.Wrap(newTgtadmError([]string{"--version"}, err), "failed to get the version of tgt")
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// showSystem returns the system of tgtd without the version, which is enough
+// for the capabilities.
+func (t *Tgtd) showSystem(ctx context.Context) (*SystemInfo, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "system",
+	}
+	output, err := t.tgtadm(ctx, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to show tgtd system")
+	}
+	return parseSystemInfo(output), nil
+}
+
+// capabilities returns the system of tgtd like showSystem, but it's asked only
+// once until tgtd is relaunched by StartDaemon or TgtdSupervisor, so it must
+// only be used for the capabilities rather than the state.
+func (t *Tgtd) capabilities(ctx context.Context) (*SystemInfo, error) {
+	backend := t.backend()
+	// The backend is a part of the key, so another fake or socket doesn't
+	// get the capabilities of the previous one
+	cacheable := backend != nil && reflect.TypeOf(backend).Comparable()
+	if cacheable {
+		systemInfoCacheLock.Lock()
+		cached, ok := systemInfoCache[t.ControlPort]
+		systemInfoCacheLock.Unlock()
+		if ok && cached.backend == backend {
+			return cached.info, nil
+		}
+	}
+
+	info, err := t.showSystem(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// tgtd which isn't ready may not have registered all of them yet
+	if cacheable && info.Ready() == nil {
+		systemInfoCacheLock.Lock()
+		systemInfoCache[t.ControlPort] = cachedSystemInfo{backend: backend, info: info}
+		systemInfoCacheLock.Unlock()
+	}
+	return info, nil
+}
+
+// forgetCapabilities drops the cached capabilities once tgtd is relaunched on
+// the control port, e.g. by another binary.
+func forgetCapabilities(controlPort int) {
+	systemInfoCacheLock.Lock()
+	defer systemInfoCacheLock.Unlock()
+	delete(systemInfoCache, controlPort)
+}
+
+/*
+parseSystemInfo parses the output of `tgtadm --op show --mode system`,
+which looks like:
+
+	System:
+	    State: ready
+	    debug: off
+	LLDs:
+	    iscsi: ready
+	Backing stores:
+	    rdwr (bsoflags sync:direct)
+	    aio (bsoflags sync:direct)
+	    longhorn
+	Device types:
+	    disk
+	    cd/dvd
+	iSNS:
+	    iSNS=Off
+*/
+func parseSystemInfo(output string) *SystemInfo {
+	info := &SystemInfo{}
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, " ") {
+			section = strings.TrimSuffix(strings.TrimSpace(line), ":")
+			continue
+		}
+		value := strings.TrimSpace(line)
+		key, state, _ := strings.Cut(value, ":")
+		state = strings.TrimSpace(state)
+		switch section {
+		case "System":
+			switch key {
+			case "State":
+				info.State = state
+			case "debug":
+				info.Debug = state == "on"
+			}
+		case "LLDs":
+			info.LLDs = append(info.LLDs, LLD{Name: key, State: state})
+		case "Backing stores":
+			name, flags, found := strings.Cut(value, " ")
+			info.BackingStores = append(info.BackingStores, name)
+			if !found {
+				continue
+			}
+			flags = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(flags), "(bsoflags "), ")")
+			for _, flag := range strings.Split(flags, ":") {
+				if info.BackingStoreFlags == nil {
+					info.BackingStoreFlags = map[string][]BackingStoreFlag{}
+				}
+				info.BackingStoreFlags[name] = append(info.BackingStoreFlags[name], BackingStoreFlag(flag))
+			}
+		case "Device types":
+			info.DeviceTypes = append(info.DeviceTypes, value)
+		}
+	}
+	info.Rancher = info.HasBackingStore("longhorn")
+	return info
+}
+
+// LLDState returns the state of the low level driver, or an empty string if
+// tgtd doesn't have it.
+func (s *SystemInfo) LLDState(name string) string {
+	for _, lld := range s.LLDs {
+		if lld.Name == name {
+			return lld.State
+		}
+	}
+	return ""
+}
+
+// Ready returns nil if tgtd and its iSCSI driver are ready.
+func (s *SystemInfo) Ready() error {
+	if s.State != "ready" || s.LLDState("iscsi") != "ready" {
+		return errors.Errorf("tgtd is not ready, state %q, iscsi driver state %q", s.State, s.LLDState("iscsi"))
+	}
+	return nil
+}
+
+// HasBackingStore returns if tgtd supports the backing store.
+func (s *SystemInfo) HasBackingStore(name string) bool {
+	return slices.Contains(s.BackingStores, name)
+}
+
+// HasDeviceType returns if tgtd supports the device type.
+func (s *SystemInfo) HasDeviceType(deviceType DeviceType) bool {
+	return slices.Contains(s.DeviceTypes, deviceTypeNames[deviceType])
+}
+
+// CheckLun checks the backing store can back a LUN of the device type, see
+// DeviceType.ValidateBackingStore. The error matches
+// types.ErrUnsupportedOperation if it's tgtd which cannot. An empty backing
+// store is the default rdwr.
+func (s *SystemInfo) CheckLun(bstype string, deviceType DeviceType) error {
+	if bstype == "" {
+		bstype = "rdwr"
+	}
+	if err := deviceType.ValidateBackingStore(bstype); err != nil {
+		return err
+	}
+	if !s.HasBackingStore(bstype) {
+		if bstype == "longhorn" {
+			return errors.Wrapf(types.ErrUnsupportedOperation, "backing-store %v is only supported by rancher/tgt", bstype)
+		}
+		return errors.Wrapf(types.ErrUnsupportedOperation, "backing-store %v is not supported by tgtd, which supports %v", bstype, strings.Join(s.BackingStores, ", "))
+	}
+	if !s.HasDeviceType(deviceType) {
+		return errors.Wrapf(types.ErrUnsupportedOperation, "device type %v is not supported by tgtd", deviceType)
+	}
+	return nil
+}
+
+// SupportsLunParam returns if tgtd accepts the param when updating a LUN.
+func (s *SystemInfo) SupportsLunParam(name string) bool {
+	if name == "bsopts" {
+		return s.Rancher
+	}
+	return slices.Contains(upstreamLunParams, name)
+}
+
+// ExpandMethod returns the best method to expand the LUNs.
+func (s *SystemInfo) ExpandMethod() ExpandMethod {
+	if s.SupportsLunParam("bsopts") {
+		return ExpandMethodUpdate
+	}
+	return ExpandMethodRecreate
+}
+
+// CheckExpandMethod returns an error matching types.ErrUnsupportedOperation
+// if tgtd doesn't support the method.
+func (s *SystemInfo) CheckExpandMethod(method ExpandMethod) error {
+	switch method {
+	case ExpandMethodUpdate:
+		if !s.SupportsLunParam("bsopts") {
+			return errors.Wrapf(types.ErrUnsupportedOperation, "expand method %v is only supported by rancher/tgt", method)
+		}
+	case ExpandMethodRecreate:
+	default:
+		return fmt.Errorf("unknown expand method %v", method)
+	}
+	return nil
+}
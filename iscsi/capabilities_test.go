@@ -0,0 +1,89 @@
+package iscsi_test
+
+import (
+	"context"
+	"slices"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+	"github.com/longhorn/go-iscsi-helper/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type SystemInfoSuite struct {
+	iscsitest.Fixture
+}
+
+var _ = Suite(&SystemInfoSuite{})
+
+func (s *SystemInfoSuite) TestGetSystemInfo(c *C) {
+	ctx := context.Background()
+	info, err := s.Tgtd.GetSystemInfoContext(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(info.Version, Equals, "1.0.85")
+	c.Assert(info.State, Equals, "ready")
+	c.Assert(info.Debug, Equals, false)
+	c.Assert(info.LLDs, DeepEquals, []iscsi.LLD{{Name: "iscsi", State: "ready"}, {Name: "iser", State: "error"}})
+	c.Assert(info.LLDState("iser"), Equals, "error")
+	c.Assert(info.LLDState("fcoe"), Equals, "")
+	c.Assert(info.Ready(), IsNil)
+	// The flags shown along with rdwr and aio aren't part of the names
+	c.Assert(info.BackingStores, DeepEquals, s.Fake.BackingStores)
+	c.Assert(info.HasBackingStore("rdwr"), Equals, true)
+	c.Assert(info.BackingStoreFlags, DeepEquals, map[string][]iscsi.BackingStoreFlag{
+		"rdwr": {iscsi.BackingStoreFlagSync, iscsi.BackingStoreFlagDirect},
+		"aio":  {iscsi.BackingStoreFlagSync, iscsi.BackingStoreFlagDirect},
+	})
+	c.Assert(info.HasDeviceType(iscsi.DeviceTypeTape), Equals, true)
+	c.Assert(info.Rancher, Equals, true)
+
+	c.Assert(info.CheckLun("", iscsi.DeviceTypeDisk), IsNil)
+	c.Assert(info.CheckLun("longhorn", iscsi.DeviceTypeDisk), IsNil)
+	c.Assert(info.CheckLun("aio", iscsi.DeviceTypeDisk), IsNil)
+	c.Assert(info.CheckLun("rdwr", iscsi.DeviceTypeCD), IsNil)
+	err = info.CheckLun("rbd", iscsi.DeviceTypeDisk)
+	c.Assert(errors.Is(err, types.ErrUnsupportedOperation), Equals, true)
+	c.Assert(err, ErrorMatches, "backing-store rbd is not supported by tgtd, which supports sheepdog, .*")
+	c.Assert(info.CheckExpandMethod(iscsi.ExpandMethodUpdate), IsNil)
+	c.Assert(info.CheckExpandMethod("resize"), ErrorMatches, "unknown expand method resize")
+}
+
+func (s *SystemInfoSuite) TestUpstream(c *C) {
+	ctx := context.Background()
+	s.Fake.BackingStores = []string{"rdwr", "aio"}
+	info, err := s.Tgtd.GetSystemInfoContext(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(info.Rancher, Equals, false)
+	c.Assert(info.CheckLun("longhorn", iscsi.DeviceTypeDisk), ErrorMatches, "backing-store longhorn is only supported by rancher/tgt: .*")
+	c.Assert(errors.Is(info.CheckExpandMethod(iscsi.ExpandMethodUpdate), types.ErrUnsupportedOperation), Equals, true)
+	c.Assert(s.Tgtd.CheckTargetForBackingStoreContext(ctx, "rdwr"), Equals, true)
+	// The backing stores are matched by the whole name
+	c.Assert(s.Tgtd.CheckTargetForBackingStoreContext(ctx, "rd"), Equals, false)
+
+	// The LUN is rejected before tgtd is asked to add it
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, "iqn.2019-10.io.longhorn:vol1"), IsNil)
+	err = s.Tgtd.AddLunContext(ctx, 1, 1, "/var/run/longhorn-vol1.sock", "longhorn", "size=1073741824")
+	c.Assert(errors.Is(err, types.ErrUnsupportedOperation), Equals, true)
+	for _, command := range s.Fake.Commands() {
+		c.Assert(slices.Contains(command, "logicalunit"), Equals, false)
+	}
+}
+
+func (s *SystemInfoSuite) TestCachedForLuns(c *C) {
+	ctx := context.Background()
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, "iqn.2019-10.io.longhorn:vol1"), IsNil)
+	for lun := 1; lun <= 3; lun++ {
+		c.Assert(s.Tgtd.AddLunWithBackingStoreContext(ctx, 1, lun, c.MkDir(), &iscsi.BackingStoreOptions{Type: "null"}, iscsi.DeviceTypeDisk), IsNil)
+	}
+	shows := 0
+	for _, command := range s.Fake.Commands() {
+		if slices.Contains(command, "system") {
+			shows++
+		}
+	}
+	// The capabilities are asked once rather than for every LUN
+	c.Assert(shows, Equals, 1)
+}
@@ -0,0 +1,56 @@
+package iscsi
+
+import (
+	"fmt"
+)
+
+const (
+	nodeAuthPrefix      = "node.session.auth."
+	discoveryAuthPrefix = "discovery.sendtargets.auth."
+
+	authMethodNone = "None"
+	authMethodCHAP = "CHAP"
+)
+
+// ChapCredentials are the CHAP credentials of the initiator. Username and
+// Password are used by the initiator to authenticate itself to the target,
+// matching an incoming account of the target. UsernameIn and PasswordIn are
+// optional, and used to authenticate the target for mutual CHAP, matching the
+// outgoing account of the target.
+type ChapCredentials struct {
+	Username   string
+	Password   string
+	UsernameIn string
+	PasswordIn string
+}
+
+func (creds *ChapCredentials) validate() error {
+	if creds.Username == "" || creds.Password == "" {
+		return fmt.Errorf("empty CHAP username or password")
+	}
+	if (creds.UsernameIn == "") != (creds.PasswordIn == "") {
+		return fmt.Errorf("incomplete mutual CHAP username or password")
+	}
+	return nil
+}
+
+// settings returns the iscsiadm settings of the credentials, in the order to
+// be applied.
+func (creds *ChapCredentials) settings(prefix string) [][2]string {
+	settings := [][2]string{
+		{prefix + "authmethod", authMethodCHAP},
+		{prefix + "username", creds.Username},
+		{prefix + "password", creds.Password},
+	}
+	if creds.UsernameIn != "" {
+		settings = append(settings,
+			[2]string{prefix + "username_in", creds.UsernameIn},
+			[2]string{prefix + "password_in", creds.PasswordIn},
+		)
+	}
+	return settings
+}
+
+func (creds *ChapCredentials) secrets() []string {
+	return []string{creds.Password, creds.PasswordIn}
+}
@@ -0,0 +1,35 @@
+package iscsi
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type ChapSuite struct{}
+
+var _ = Suite(&ChapSuite{})
+
+func (s *ChapSuite) TestChapCredentialsSettings(c *C) {
+	creds := &ChapCredentials{Username: "user", Password: "pass"}
+	c.Assert(creds.validate(), IsNil)
+	c.Assert(creds.settings(nodeAuthPrefix), DeepEquals, [][2]string{
+		{"node.session.auth.authmethod", "CHAP"},
+		{"node.session.auth.username", "user"},
+		{"node.session.auth.password", "pass"},
+	})
+
+	creds.UsernameIn = "target"
+	creds.PasswordIn = "target-pass"
+	c.Assert(creds.validate(), IsNil)
+	c.Assert(creds.settings(discoveryAuthPrefix), DeepEquals, [][2]string{
+		{"discovery.sendtargets.auth.authmethod", "CHAP"},
+		{"discovery.sendtargets.auth.username", "user"},
+		{"discovery.sendtargets.auth.password", "pass"},
+		{"discovery.sendtargets.auth.username_in", "target"},
+		{"discovery.sendtargets.auth.password_in", "target-pass"},
+	})
+}
+
+func (s *ChapSuite) TestChapCredentialsValidate(c *C) {
+	c.Assert((&ChapCredentials{Username: "user"}).validate(), NotNil)
+	c.Assert((&ChapCredentials{Username: "user", Password: "pass", UsernameIn: "target"}).validate(), NotNil)
+}
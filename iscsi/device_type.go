@@ -0,0 +1,72 @@
+package iscsi
+
+import (
+	"fmt"
+	"slices"
+)
+
+// DeviceType is the SCSI device type of a LUN, i.e. `tgtadm --device-type`.
+type DeviceType string
+
+const (
+	DeviceTypeDisk DeviceType = "disk"
+	// DeviceTypeCD is a CD/DVD-ROM, e.g. backed by an ISO image. tgtd
+	// reports it as removable media.
+	DeviceTypeCD DeviceType = "cd"
+	// DeviceTypePassthrough passes the SCSI commands through to a SCSI
+	// generic device of the host, e.g. /dev/sg1.
+	DeviceTypePassthrough DeviceType = "pt"
+	// DeviceTypeTape is a virtual tape backed by a tape image created by
+	// tgtimg.
+	DeviceTypeTape DeviceType = "tape"
+)
+
+var (
+	// deviceTypeNames are the device types shown by `tgtadm --op show --mode target`
+	deviceTypeNames = map[DeviceType]string{
+		DeviceTypeDisk:        "disk",
+		DeviceTypeCD:          "cd/dvd",
+		DeviceTypePassthrough: "passthrough",
+		DeviceTypeTape:        "tape",
+	}
+
+	// backingStoreDeviceTypes are the backing stores which only work with
+	// some device types, e.g. smc only works with the media changers which
+	// aren't supported by the helpers
+	backingStoreDeviceTypes = map[string][]DeviceType{
+		"mmc": {DeviceTypeCD},
+		"sg":  {DeviceTypePassthrough},
+		"bsg": {DeviceTypePassthrough},
+		"ssc": {DeviceTypeTape},
+		"smc": {},
+	}
+)
+
+// ValidateBackingStore checks the backing store type can back a LUN of the
+// device type. The passthrough LUNs need sg or bsg, and the tape LUNs need ssc,
+// while the disk and CD LUNs can be backed by the generic backing stores,
+// e.g. rdwr and aio.
+func (t DeviceType) ValidateBackingStore(bstype string) error {
+	if _, exists := deviceTypeNames[t]; !exists {
+		return fmt.Errorf("unsupported device type %v", t)
+	}
+	deviceTypes, specific := backingStoreDeviceTypes[bstype]
+	if specific && !slices.Contains(deviceTypes, t) {
+		return fmt.Errorf("backing-store %v cannot be used for device type %v", bstype, t)
+	}
+	if !specific && (t == DeviceTypePassthrough || t == DeviceTypeTape) {
+		return fmt.Errorf("backing-store %v cannot be used for device type %v", bstype, t)
+	}
+	return nil
+}
+
+// DeviceType returns the device type of the LUN, or an empty string for the
+// controller LUN 0 and the device types unknown to the helpers.
+func (lun *LUN) DeviceType() DeviceType {
+	for deviceType, name := range deviceTypeNames {
+		if lun.Type == name {
+			return deviceType
+		}
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+package iscsi_test
+
+import (
+	"context"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+
+	. "gopkg.in/check.v1"
+)
+
+type DeviceTypeSuite struct {
+	iscsitest.Fixture
+}
+
+var _ = Suite(&DeviceTypeSuite{})
+
+func (s *DeviceTypeSuite) TestValidateBackingStore(c *C) {
+	for deviceType, valid := range map[iscsi.DeviceType][]string{
+		iscsi.DeviceTypeDisk:        {"rdwr", "aio", "longhorn"},
+		iscsi.DeviceTypeCD:          {"rdwr", "aio", "mmc"},
+		iscsi.DeviceTypePassthrough: {"sg", "bsg"},
+		iscsi.DeviceTypeTape:        {"ssc"},
+	} {
+		for _, bstype := range valid {
+			c.Assert(deviceType.ValidateBackingStore(bstype), IsNil, Commentf("%v %v", deviceType, bstype))
+		}
+	}
+	for deviceType, invalid := range map[iscsi.DeviceType][]string{
+		iscsi.DeviceTypeDisk:        {"sg", "bsg", "ssc", "smc", "mmc"},
+		iscsi.DeviceTypeCD:          {"sg", "ssc"},
+		iscsi.DeviceTypePassthrough: {"rdwr", "ssc"},
+		iscsi.DeviceTypeTape:        {"rdwr", "sg"},
+		iscsi.DeviceType("changer"): {"smc"},
+	} {
+		for _, bstype := range invalid {
+			c.Assert(deviceType.ValidateBackingStore(bstype), NotNil, Commentf("%v %v", deviceType, bstype))
+		}
+	}
+}
+
+func (s *DeviceTypeSuite) TestAddLunWithDeviceType(c *C) {
+	ctx := context.Background()
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, "iqn.2019-10.io.longhorn:vol1"), IsNil)
+	c.Assert(s.Tgtd.AddLunWithDeviceTypeContext(ctx, 1, 1, "/var/lib/images/install.iso", "rdwr", "", iscsi.DeviceTypeCD), IsNil)
+	c.Assert(s.Tgtd.AddLunWithDeviceTypeContext(ctx, 1, 2, "/dev/sg1", "sg", "", iscsi.DeviceTypePassthrough), IsNil)
+	c.Assert(s.Tgtd.AddLunWithDeviceTypeContext(ctx, 1, 3, "/var/lib/images/tape.img", "ssc", "", iscsi.DeviceTypeTape), IsNil)
+	c.Assert(s.Tgtd.AddLunContext(ctx, 1, 4, "/var/lib/images/disk.img", "rdwr", ""), IsNil)
+	c.Assert(s.Tgtd.AddLunWithDeviceTypeContext(ctx, 1, 5, "/dev/sg2", "sg", "", iscsi.DeviceTypeDisk), NotNil)
+
+	target, err := s.Tgtd.GetTargetContext(ctx, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(0).DeviceType(), Equals, iscsi.DeviceType(""))
+	c.Assert(target.LUN(1).DeviceType(), Equals, iscsi.DeviceTypeCD)
+	c.Assert(target.LUN(1).RemovableMedia, Equals, true)
+	c.Assert(target.LUN(2).DeviceType(), Equals, iscsi.DeviceTypePassthrough)
+	c.Assert(target.LUN(3).DeviceType(), Equals, iscsi.DeviceTypeTape)
+	c.Assert(target.LUN(4).DeviceType(), Equals, iscsi.DeviceTypeDisk)
+	c.Assert(target.LUN(5), IsNil)
+
+	// The device types survive the export to targets.conf
+	conf, err := s.Tgtd.ExportTargetsConfContext(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(conf, Matches, "(?s).*<backing-store /var/lib/images/install.iso>\n        lun 1\n        bs-type rdwr\n        device-type cd\n    </backing-store>.*")
+	c.Assert(s.Tgtd.ShutdownTgtdContext(ctx), IsNil)
+	_, err = s.Tgtd.ApplyTargetsConfContext(ctx, conf)
+	c.Assert(err, IsNil)
+	restored, err := s.Tgtd.ExportTargetsConfContext(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(restored, Equals, conf)
+
+	// A LUN is re-created once its device type drifts
+	config, err := iscsi.ParseTargetsConf(conf)
+	c.Assert(err, IsNil)
+	config.Targets[0].LUNs[0].DeviceType = ""
+	plan, err := s.Tgtd.PlanReconcileContext(ctx, config)
+	c.Assert(err, IsNil)
+	c.Assert(actions(plan), DeepEquals, []string{
+		"delete-lun target 1 lun 1 /var/lib/images/install.iso",
+		"add-lun target 1 lun 1 /var/lib/images/install.iso",
+	})
+	config.Targets[0].LUNs[1].DeviceType = ""
+	_, err = s.Tgtd.PlanReconcileContext(ctx, config)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,143 @@
+package iscsi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/cockroachdb/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/types"
+)
+
+// EvictInitiator closes the sessions of the initiator to the target, while the
+// other initiators stay connected. The initiator is matched by its iSCSI name
+// or IP address. If unbindACL is set, the ACL of the initiator is unbound
+// first so it cannot reconnect, and it fails without closing any session if
+// the remaining ACLs still allow the initiator, e.g. ACLAll. It returns the
+// evicted sessions.
+func EvictInitiator(tid int, initiator string, unbindACL bool) ([]Session, error) {
+	return EvictInitiatorContext(context.Background(), tid, initiator, unbindACL)
+}
+
+// EvictInitiatorContext is like EvictInitiator but takes a context.
+func EvictInitiatorContext(ctx context.Context, tid int, initiator string, unbindACL bool) ([]Session, error) {
+	return DefaultTgtd().EvictInitiatorContext(ctx, tid, initiator, unbindACL)
+}
+
+// EvictInitiatorContext closes the sessions of the initiator to the target,
+// while the other initiators stay connected. The initiator is matched by its
+// iSCSI name or IP address. If unbindACL is set, the ACL of the initiator is
+// unbound first so it cannot reconnect, and it fails without closing any
+// session if the remaining ACLs still allow the initiator, e.g. ACLAll. It
+// returns the evicted sessions.
+func (t *Tgtd) EvictInitiatorContext(ctx context.Context, tid int, initiator string, unbindACL bool) ([]Session, error) {
+	acl, err := ParseACL(initiator)
+	if err != nil {
+		return nil, err
+	}
+	if acl.Type == ACLTypeAddress && net.ParseIP(initiator) == nil {
+		return nil, fmt.Errorf("cannot evict initiator %v, which is not an IP address or an iSCSI name", initiator)
+	}
+
+	if unbindACL {
+		if err := t.unbindInitiatorACL(ctx, tid, acl); err != nil {
+			return nil, err
+		}
+	}
+
+	sessions, err := t.GetSessionsContext(ctx, tid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get sessions of target %v", tid)
+	}
+	evicted := []Session{}
+	for _, session := range sessions {
+		if !sessionMatches(session, acl) {
+			continue
+		}
+		for _, connection := range session.Connections {
+			err := t.CloseConnectionContext(ctx, tid, strconv.Itoa(session.ID), strconv.Itoa(connection.ID))
+			if err != nil && !errors.Is(err, types.ErrNoSession) && !errors.Is(err, types.ErrNoConnection) {
+				return evicted, errors.Wrapf(err, "failed to close connection %v:%v of initiator %v to target %v", session.ID, connection.ID, initiator, tid)
+			}
+		}
+		logrus.Infof("Evicted session %v of initiator %v from target %v", session.ID, initiator, tid)
+		evicted = append(evicted, session)
+	}
+	return evicted, nil
+}
+
+// unbindInitiatorACL unbinds the ACL of the initiator, after checking the
+// remaining ACLs won't allow it.
+func (t *Tgtd) unbindInitiatorACL(ctx context.Context, tid int, acl ACL) error {
+	acls, err := t.ListACLsContext(ctx, tid)
+	if err != nil {
+		return err
+	}
+	bound := false
+	remaining := []ACL{}
+	for _, a := range acls {
+		if a == acl {
+			bound = true
+			continue
+		}
+		remaining = append(remaining, a)
+	}
+	if allowed, reason := aclsAllow(remaining, acl); allowed {
+		return fmt.Errorf("cannot fence initiator %v of target %v: %v", acl, tid, reason)
+	}
+	if !bound {
+		return nil
+	}
+	if err := t.UnbindACLContext(ctx, tid, acl); err != nil && !errors.Is(err, types.ErrAclNoexist) {
+		return errors.Wrapf(err, "failed to unbind ACL %v of target %v", acl, tid)
+	}
+	return nil
+}
+
+// aclsAllow returns if the ACLs allow the initiator with the address or the
+// name of acl, and the reason. The target allows any name without name ACLs.
+func aclsAllow(acls []ACL, acl ACL) (bool, string) {
+	names := 0
+	for _, a := range acls {
+		if a.Type != acl.Type {
+			continue
+		}
+		switch acl.Type {
+		case ACLTypeName:
+			names++
+			if a.Value == acl.Value {
+				return true, "it's allowed by ACL " + a.Value
+			}
+		case ACLTypeAddress:
+			if a.Value == ACLAll || addressMatches(a.Value, acl.Value) {
+				return true, "it's allowed by ACL " + a.Value
+			}
+		}
+	}
+	if acl.Type == ACLTypeName && names == 0 {
+		return true, "all names are allowed without other name ACLs"
+	}
+	return false, ""
+}
+
+func addressMatches(pattern, address string) bool {
+	if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+		return ipNet.Contains(net.ParseIP(address))
+	}
+	return normalizeIP(pattern) == normalizeIP(address)
+}
+
+func sessionMatches(session Session, acl ACL) bool {
+	if acl.Type == ACLTypeName {
+		return session.Initiator == acl.Value
+	}
+	for _, connection := range session.Connections {
+		if addressMatches(acl.Value, connection.IPAddress) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package iscsi
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+
+	lhns "github.com/longhorn/go-common-libs/ns"
+	lhtypes "github.com/longhorn/go-common-libs/types"
+)
+
+// Executor executes commands, e.g. iscsiadm in the namespaces of iscsid. It's
+// implemented by *lhns.Executor, which the helpers took before, and emulated
+// by iscsitest.Fake for tests.
+type Executor interface {
+	Execute(envs []string, binary string, args []string, timeout time.Duration) (string, error)
+}
+
+// ContextExecutor is an Executor which kills the command once the context is
+// done. The helpers taking a context can only cancel the in-flight command if
+// the executor implements it, otherwise the timeout of the command is bounded
+// by the deadline of the context.
+type ContextExecutor interface {
+	Executor
+	ExecuteContext(ctx context.Context, envs []string, binary string, args []string, timeout time.Duration) (string, error)
+}
+
+// HostInterface accesses the block devices and sysfs of the host. If an
+// Executor implements it as well, the initiator helpers use it rather than the
+// host, so tests can emulate the devices created by the initiator.
+type HostInterface interface {
+	GetSystemBlockDevices() (map[string]lhtypes.BlockDeviceInfo, error)
+	WriteFile(filePath, data string) error
+	LockFile(filePath string) (*os.File, error)
+}
+
+// execute executes the command with nsexec. The command is killed once ctx is
+// done if nsexec is a ContextExecutor, otherwise only the timeout is bounded
+// by the deadline of ctx.
+func execute(ctx context.Context, nsexec Executor, binary string, args []string, timeout time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", errors.Wrapf(err, "cannot execute: %v %v", binary, args)
+	}
+	if cexec, ok := nsexec.(ContextExecutor); ok {
+		return cexec.ExecuteContext(ctx, nil, binary, args, timeout)
+	}
+	output, err := nsexec.Execute(nil, binary, args, contextTimeout(ctx, timeout))
+	if err == nil {
+		return output, nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return output, errors.Mark(err, ctxErr)
+	}
+	// The command may time out right before the context does
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return output, errors.Mark(err, context.DeadlineExceeded)
+	}
+	return output, err
+}
+
+// contextTimeout returns the timeout bounded by the deadline of ctx.
+func contextTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		remaining = time.Nanosecond
+	}
+	if timeout == lhtypes.ExecuteNoTimeout || remaining < timeout {
+		return remaining
+	}
+	return timeout
+}
+
+func getSystemBlockDevices(nsexec Executor) (map[string]lhtypes.BlockDeviceInfo, error) {
+	if host, ok := nsexec.(HostInterface); ok {
+		return host.GetSystemBlockDevices()
+	}
+	return lhns.GetSystemBlockDevices()
+}
+
+func writeHostFile(nsexec Executor, filePath, data string) error {
+	if host, ok := nsexec.(HostInterface); ok {
+		return host.WriteFile(filePath, data)
+	}
+	return lhns.WriteFile(filePath, data)
+}
+
+// LockHostFileContext acquires the lock file on the host within the timeout, or
+// until ctx is done. It's locked by nsexec if it's a HostInterface.
+func LockHostFileContext(ctx context.Context, filePath string, timeout time.Duration, nsexec Executor) (*util.FileLock, error) {
+	lockFile := lhns.LockFile
+	if host, ok := nsexec.(HostInterface); ok {
+		lockFile = host.LockFile
+	}
+	return util.LockFileContext(ctx, filePath, timeout, lockFile)
+}
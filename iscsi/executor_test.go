@@ -0,0 +1,47 @@
+package iscsi
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	lhexec "github.com/longhorn/go-common-libs/exec"
+	lhtypes "github.com/longhorn/go-common-libs/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type ExecutorSuite struct{}
+
+var _ = Suite(&ExecutorSuite{})
+
+func (s *ExecutorSuite) TestExecute(c *C) {
+	e := lhexec.NewExecutor()
+	output, err := execute(context.Background(), e, "sh", []string{"-c", "echo hello"}, lhtypes.ExecuteDefaultTimeout)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "hello\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = execute(ctx, e, "true", nil, lhtypes.ExecuteDefaultTimeout)
+	c.Assert(errors.Is(err, context.Canceled), Equals, true)
+
+	// The timeout of the command is bounded by the deadline of the context
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = execute(ctx, e, "sleep", []string{"10"}, lhtypes.ExecuteDefaultTimeout)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+}
+
+func (s *ExecutorSuite) TestContextTimeout(c *C) {
+	c.Assert(contextTimeout(context.Background(), time.Minute), Equals, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.Assert(contextTimeout(ctx, time.Minute) <= time.Second, Equals, true)
+	c.Assert(contextTimeout(ctx, time.Millisecond), Equals, time.Millisecond)
+	c.Assert(contextTimeout(ctx, lhtypes.ExecuteNoTimeout) <= time.Second, Equals, true)
+}
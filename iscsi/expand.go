@@ -0,0 +1,367 @@
+package iscsi
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/types"
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+// ExpandMethod is how a LUN is expanded.
+type ExpandMethod string
+
+const (
+	// ExpandMethodUpdate updates the size in the backing store options of the
+	// LUN in place. It's only supported by rancher/tgt.
+	ExpandMethodUpdate = ExpandMethod("update-bsopts")
+	// ExpandMethodRecreate deletes the LUN and adds it back with the new size,
+	// the same SCSI identity and params, while the target is offline. The
+	// sessions survive, but tgtd doesn't report the new capacity to the
+	// initiators, see ExpandOptions.Rescan.
+	ExpandMethodRecreate = ExpandMethod("recreate")
+)
+
+// ExpandOptions are the details of the LUN to re-create it, which tgtd doesn't
+// show.
+type ExpandOptions struct {
+	// Method overrides the best method supported by tgtd if it's set.
+	Method ExpandMethod
+	// BackingStore are the backing store options of the LUN, whose size is
+	// replaced by the new size if the backing store is longhorn. The backing
+	// stores without the size, e.g. rdwr, have to report the new size on
+	// their own. The type and the flags shown by tgtd are used if it's nil.
+	BackingStore *BackingStoreOptions
+	// BSOpts are the backing store options of the LUN if BackingStore is nil.
+	// They are passed to tgtd as they are, except that the size option is
+	// replaced by the new size, or appended if the backing store is longhorn.
+	BSOpts string
+	// Identity is the identity of the LUN. Otherwise only the SCSI ID and
+	// serial number shown by tgtd are kept.
+	Identity *LunIdentity
+	// Params are set after the LUN is re-created, besides the ones shown by
+	// tgtd, e.g. mode_page.
+	Params map[string]string
+	// Rescan makes the initiators rescan the LUN for the new capacity once
+	// the size is verified, e.g. by RescanScsiDevice.
+	Rescan func(ctx context.Context) error
+}
+
+// ExpandStep is a step of an expansion, with the error if it failed.
+type ExpandStep struct {
+	Description string
+	Err         error
+}
+
+// ExpandReport reports the steps of an expansion, so the failures are visible
+// even if the caller only logs it.
+type ExpandReport struct {
+	TID    int
+	LUN    int
+	Size   int64
+	Method ExpandMethod
+	Steps  []ExpandStep
+}
+
+func (r *ExpandReport) String() string {
+	lines := []string{fmt.Sprintf("expand LUN %v of target %v to %v with method %v:", r.LUN, r.TID, r.Size, r.Method)}
+	for _, step := range r.Steps {
+		if step.Err != nil {
+			lines = append(lines, fmt.Sprintf("  %v: failed: %v", step.Description, step.Err))
+		} else {
+			lines = append(lines, fmt.Sprintf("  %v: done", step.Description))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// step runs the step, and records and logs its result.
+func (r *ExpandReport) step(description string, run func() error) error {
+	err := run()
+	r.Steps = append(r.Steps, ExpandStep{Description: description, Err: err})
+	log := logrus.WithFields(logrus.Fields{"tid": r.TID, "lun": r.LUN, "size": r.Size, "method": r.Method})
+	if err != nil {
+		log.WithError(err).Warnf("Failed to %v for the expansion", description)
+		return errors.Wrapf(err, "failed to %v for expanding LUN %v of target %v", description, r.LUN, r.TID)
+	}
+	log.Infof("Expansion step done: %v", description)
+	return nil
+}
+
+// ExpandLun will update the size for the LUN with the best method supported
+// by tgtd, see ExpandLunWithOptions.
+func ExpandLun(tid, lun int, size int64) error {
+	return ExpandLunContext(context.Background(), tid, lun, size)
+}
+
+// ExpandLunContext is like ExpandLun but takes a context.
+func ExpandLunContext(ctx context.Context, tid, lun int, size int64) error {
+	return DefaultTgtd().ExpandLunContext(ctx, tid, lun, size)
+}
+
+// ExpandLunContext will update the size for the LUN with the best method
+// supported by tgtd, see ExpandLunWithOptions.
+func (t *Tgtd) ExpandLunContext(ctx context.Context, tid, lun int, size int64) error {
+	_, err := t.ExpandLunWithOptionsContext(ctx, tid, lun, size, nil)
+	return err
+}
+
+// ExpandLunWithOptions expands the LUN to the size. The size is updated in
+// place on rancher/tgt, while the LUN is re-created on the upstream tgt. The
+// size shown by tgtd is verified at the end. The report is returned along with
+// the error of the failed step, if any.
+func ExpandLunWithOptions(tid, lun int, size int64, options *ExpandOptions) (*ExpandReport, error) {
+	return ExpandLunWithOptionsContext(context.Background(), tid, lun, size, options)
+}
+
+// ExpandLunWithOptionsContext is like ExpandLunWithOptions but takes a context.
+func ExpandLunWithOptionsContext(ctx context.Context, tid, lun int, size int64, options *ExpandOptions) (*ExpandReport, error) {
+	return DefaultTgtd().ExpandLunWithOptionsContext(ctx, tid, lun, size, options)
+}
+
+// ExpandLunWithOptionsContext expands the LUN to the size. The size is updated
+// in place on rancher/tgt, while the LUN is re-created on the upstream tgt. The
+// size shown by tgtd is verified at the end. The report is returned along with
+// the error of the failed step, if any.
+func (t *Tgtd) ExpandLunWithOptionsContext(ctx context.Context, tid, lun int, size int64, options *ExpandOptions) (*ExpandReport, error) {
+	if options == nil {
+		options = &ExpandOptions{}
+	}
+	report := &ExpandReport{TID: tid, LUN: lun, Size: size, Method: options.Method}
+
+	// The method is checked first, so the LUN is kept as it is if tgtd
+	// doesn't support it
+	if err := report.step("detect tgtd capabilities", func() error {
+		info, err := t.capabilities(ctx)
+		if err != nil {
+			return err
+		}
+		if report.Method == "" {
+			report.Method = info.ExpandMethod()
+		}
+		return info.CheckExpandMethod(report.Method)
+	}); err != nil {
+		return report, err
+	}
+
+	var live *LUN
+	if err := report.step("get the LUN", func() (err error) {
+		live, err = t.getLun(ctx, tid, lun)
+		if err == nil && live.SizeMB > sizeMB(size) {
+			err = fmt.Errorf("cannot shrink the LUN of %v MB to %v bytes", live.SizeMB, size)
+		}
+		return err
+	}); err != nil {
+		return report, err
+	}
+
+	switch report.Method {
+	case ExpandMethodUpdate:
+		if err := report.step("update the size in the backing store options", func() error {
+			options := &BackingStoreOptions{Type: "longhorn", Size: size}
+			return t.updateLunBSOpts(ctx, tid, lun, options.String())
+		}); err != nil {
+			return report, err
+		}
+	case ExpandMethodRecreate:
+		if err := t.recreateLun(ctx, report, live, options); err != nil {
+			return report, err
+		}
+	default:
+		return report, fmt.Errorf("unknown expand method %v", report.Method)
+	}
+
+	if err := report.step("verify the size", func() error {
+		expanded, err := t.getLun(ctx, tid, lun)
+		if err != nil {
+			return err
+		}
+		// tgtd shows the size in MB and rounded, so it's compared the same
+		// way
+		if expanded.SizeMB < sizeMB(size) {
+			return fmt.Errorf("tgtd shows %v MB rather than %v MB", expanded.SizeMB, sizeMB(size))
+		}
+		return nil
+	}); err != nil {
+		return report, err
+	}
+	if options.Rescan == nil {
+		return report, nil
+	}
+	return report, report.step("rescan the LUN on the initiators", func() error {
+		return options.Rescan(ctx)
+	})
+}
+
+func (t *Tgtd) getLun(ctx context.Context, tid, lun int) (*LUN, error) {
+	targets, err := t.ListTargetsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		if target.TID != tid {
+			continue
+		}
+		if l := target.LUN(lun); l != nil {
+			return l, nil
+		}
+		return nil, errors.Wrapf(types.ErrNoLun, "cannot find LUN %v of target %v", lun, tid)
+	}
+	return nil, errors.Wrapf(types.ErrNoTarget, "cannot find target %v", tid)
+}
+
+func (t *Tgtd) updateLunBSOpts(ctx context.Context, tid, lun int, bsopts string) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "update",
+		"--mode", "logicalunit",
+		"--tid", strconv.Itoa(tid),
+		"--lun", strconv.Itoa(lun),
+		"--params", "bsopts=" + bsopts,
+	}
+	_, err := t.tgtadm(ctx, opts)
+	return err
+}
+
+// recreateLun deletes the LUN and adds it back with the new size while the
+// target is offline, so the initiators don't see the LUN missing or without
+// its identity. If it cannot be added back, it's added back with the original
+// options.
+func (t *Tgtd) recreateLun(ctx context.Context, report *ExpandReport, live *LUN, options *ExpandOptions) error {
+	tid, lun := report.TID, report.LUN
+	deviceType := live.DeviceType()
+	if deviceType == "" {
+		return report.step("check the device type", func() error {
+			return fmt.Errorf("unsupported device type %v", live.Type)
+		})
+	}
+	bstype, bsopts, bsoflags, err := options.backingStore(live)
+	if err != nil {
+		return report.step("get the backing store options", func() error {
+			return err
+		})
+	}
+	expanded := bsopts
+	if strings.Contains(";"+bsopts, ";size=") || bstype == "longhorn" {
+		expanded = SetBackingStoreOption(bsopts, "size", strconv.FormatInt(report.Size, 10))
+	}
+
+	return t.whileTargetOffline(ctx, report, func() error {
+		if err := report.step("delete the LUN", func() error {
+			return t.deleteLunRetry(ctx, tid, lun)
+		}); err != nil {
+			return err
+		}
+		if err := report.step("add the LUN back with the new size", func() error {
+			return t.addLun(ctx, tid, lun, live.BackingStorePath, bstype, expanded, bsoflags, deviceType)
+		}); err != nil {
+			_ = report.step("add the LUN back with the original size", func() error {
+				if err := t.addLun(ctx, tid, lun, live.BackingStorePath, bstype, bsopts, bsoflags, deviceType); err != nil {
+					return err
+				}
+				return t.restoreLun(ctx, tid, lun, live, options)
+			})
+			return err
+		}
+		return report.step("restore the identity and params", func() error {
+			return t.restoreLun(ctx, tid, lun, live, options)
+		})
+	})
+}
+
+// whileTargetOffline runs the steps while the target is offline. The target
+// is set back to ready even if the steps fail or the context is done.
+func (t *Tgtd) whileTargetOffline(ctx context.Context, report *ExpandReport, run func() error) error {
+	if err := report.step("take the target offline", func() error {
+		return t.SetTargetStateContext(ctx, report.TID, TargetStateOffline)
+	}); err != nil {
+		return err
+	}
+	err := run()
+	errReady := report.step("set the target back to ready", func() error {
+		return t.SetTargetStateContext(context.WithoutCancel(ctx), report.TID, TargetStateReady)
+	})
+	if err != nil {
+		return err
+	}
+	return errReady
+}
+
+func (t *Tgtd) deleteLunRetry(ctx context.Context, tid, lun int) (err error) {
+	for i := 0; i < TgtdRetryCounts; i++ {
+		// The LUN cannot be deleted with commands in flight
+		if err = t.DeleteLunContext(ctx, tid, lun); !errors.Is(err, types.ErrLunActive) {
+			return err
+		}
+		if errSleep := util.SleepContext(ctx, TgtdRetryInterval); errSleep != nil {
+			return errors.Wrapf(errSleep, "failed to wait for LUN %v of target %v: %v", lun, tid, err)
+		}
+	}
+	return err
+}
+
+// restoreLun sets the identity and the params of the live LUN to the
+// re-created one.
+func (t *Tgtd) restoreLun(ctx context.Context, tid, lun int, live *LUN, options *ExpandOptions) error {
+	identity := options.Identity
+	if identity == nil {
+		identity = &LunIdentity{}
+		if live.SCSIID != defaultSCSIID(tid, lun) {
+			identity.SCSIID = live.SCSIID
+		}
+		if live.SCSISN != defaultSCSISN(tid, lun) {
+			identity.SCSISN = live.SCSISN
+		}
+	}
+	params := identity.Params()
+	// Only the flags differing from the defaults of a new LUN are set, since
+	// tgtd may not accept the others, e.g. swp
+	defaults := map[string]bool{"online": true, "removable": live.DeviceType() == DeviceTypeCD}
+	flags := map[string]bool{
+		"online":            live.Online,
+		"readonly":          live.Readonly,
+		"removable":         live.RemovableMedia,
+		"swp":               live.SWP,
+		"thin_provisioning": live.ThinProvisioning,
+	}
+	for key, value := range flags {
+		if value == defaults[key] {
+			continue
+		}
+		params[key] = "0"
+		if value {
+			params[key] = "1"
+		}
+	}
+	for key, value := range options.Params {
+		params[key] = value
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	return t.UpdateLunContext(ctx, tid, lun, params)
+}
+
+// backingStore returns the backing store, the bsopts and the bsoflags of the
+// live LUN. The bsopts come from the options, since tgtd doesn't show them.
+// Only the typed BackingStore is validated, while BSOpts are kept as they are.
+func (options *ExpandOptions) backingStore(live *LUN) (bstype, bsopts, bsoflags string, err error) {
+	if options.BackingStore != nil {
+		backingStore := *options.BackingStore
+		backingStore.Type = live.BackingStoreType
+		if err := backingStore.Validate(); err != nil {
+			return "", "", "", err
+		}
+		return backingStore.Type, backingStore.String(), backingStore.FlagsString(), nil
+	}
+	shown, err := live.BackingStoreOptions()
+	if err != nil {
+		return "", "", "", err
+	}
+	return shown.Type, options.BSOpts, shown.FlagsString(), nil
+}
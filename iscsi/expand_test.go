@@ -0,0 +1,174 @@
+package iscsi_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+	"github.com/longhorn/go-iscsi-helper/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type ExpandSuite struct {
+	iscsitest.Fixture
+}
+
+var _ = Suite(&ExpandSuite{})
+
+// upstream makes the fake tgtd the upstream tgt without the longhorn backing
+// store and the bsopts param.
+func (s *ExpandSuite) upstream() {
+	s.Fake.BackingStores = slices.DeleteFunc(s.Fake.BackingStores, func(bs string) bool { return bs == "longhorn" })
+}
+
+func steps(report *iscsi.ExpandReport) []string {
+	result := []string{}
+	for _, step := range report.Steps {
+		result = append(result, step.Description)
+	}
+	return result
+}
+
+func (s *ExpandSuite) TestDetectCapabilities(c *C) {
+	ctx := context.Background()
+	capabilities, err := s.Tgtd.GetSystemInfoContext(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(capabilities.Rancher, Equals, true)
+	c.Assert(capabilities.HasBackingStore("rdwr"), Equals, true)
+	c.Assert(capabilities.HasDeviceType(iscsi.DeviceTypeCD), Equals, true)
+	c.Assert(capabilities.SupportsLunParam("bsopts"), Equals, true)
+	c.Assert(capabilities.SupportsLunParam("scsi_sn"), Equals, true)
+	c.Assert(capabilities.SupportsLunParam("write-cache"), Equals, false)
+	c.Assert(capabilities.ExpandMethod(), Equals, iscsi.ExpandMethodUpdate)
+
+	s.upstream()
+	capabilities, err = s.Tgtd.GetSystemInfoContext(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(capabilities.Rancher, Equals, false)
+	c.Assert(capabilities.HasBackingStore("longhorn"), Equals, false)
+	c.Assert(capabilities.SupportsLunParam("bsopts"), Equals, false)
+	c.Assert(capabilities.ExpandMethod(), Equals, iscsi.ExpandMethodRecreate)
+}
+
+func (s *ExpandSuite) TestExpandInPlace(c *C) {
+	ctx := context.Background()
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, "iqn.2019-10.io.longhorn:vol1"), IsNil)
+	c.Assert(s.Tgtd.AddLunContext(ctx, 1, 1, "/var/run/longhorn-vol1.sock", "longhorn", "size=1073741824;request_timeout=30"), IsNil)
+
+	report, err := s.Tgtd.ExpandLunWithOptionsContext(ctx, 1, 1, 2147483648, nil)
+	c.Assert(err, IsNil)
+	c.Assert(report.Method, Equals, iscsi.ExpandMethodUpdate)
+	c.Assert(steps(report), DeepEquals, []string{
+		"detect tgtd capabilities",
+		"get the LUN",
+		"update the size in the backing store options",
+		"verify the size",
+	})
+	target, err := s.Tgtd.GetTargetContext(ctx, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(1).SizeMB, Equals, int64(2147))
+
+	// tgtd shows the size in MB of 10^6 bytes, so growing by 1 MiB isn't
+	// taken for shrinking
+	_, err = s.Tgtd.ExpandLunWithOptionsContext(ctx, 1, 1, 2148532224, nil)
+	c.Assert(err, IsNil)
+	target, err = s.Tgtd.GetTargetContext(ctx, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(1).SizeMB, Equals, int64(2149))
+
+	// Shrinking is refused before anything is changed
+	report, err = s.Tgtd.ExpandLunWithOptionsContext(ctx, 1, 1, 1073741824, nil)
+	c.Assert(err, ErrorMatches, "failed to get the LUN for expanding LUN 1 of target 1: cannot shrink the LUN of 2149 MB to 1073741824 bytes")
+	c.Assert(report.Steps, HasLen, 2)
+	c.Assert(s.Tgtd.ExpandLunContext(ctx, 1, 2, 2147483648), NotNil)
+}
+
+func (s *ExpandSuite) TestExpandByRecreation(c *C) {
+	ctx := context.Background()
+	s.upstream()
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, "iqn.2019-10.io.longhorn:vol1"), IsNil)
+	c.Assert(s.Tgtd.BindInitiatorContext(ctx, 1, "ALL"), IsNil)
+	image := filepath.Join(c.MkDir(), "vol1.img")
+	c.Assert(os.WriteFile(image, nil, 0600), IsNil)
+	c.Assert(os.Truncate(image, 1073741824), IsNil)
+	c.Assert(s.Tgtd.AddLunContext(ctx, 1, 1, image, "rdwr", ""), IsNil)
+	identity := iscsi.NewLunIdentity("vol1")
+	c.Assert(s.Tgtd.SetLunIdentityContext(ctx, 1, 1, identity), IsNil)
+	c.Assert(s.Tgtd.SetLunThinProvisioningContext(ctx, 1, 1), IsNil)
+	c.Assert(s.Tgtd.SetLunReadOnlyContext(ctx, 1, 1), IsNil)
+	c.Assert(iscsi.DiscoverTarget("127.0.0.1", "iqn.2019-10.io.longhorn:vol1", s.Fake), IsNil)
+	c.Assert(iscsi.LoginTarget("127.0.0.1", "iqn.2019-10.io.longhorn:vol1", s.Fake), IsNil)
+
+	// The in-place update fails early on the upstream tgt
+	_, err := s.Tgtd.ExpandLunWithOptionsContext(ctx, 1, 1, 2147483648, &iscsi.ExpandOptions{Method: iscsi.ExpandMethodUpdate})
+	c.Assert(err, ErrorMatches, "failed to detect tgtd capabilities for expanding LUN 1 of target 1: expand method update-bsopts is only supported by rancher/tgt: .*")
+	c.Assert(errors.Is(err, types.ErrUnsupportedOperation), Equals, true)
+
+	// The backing file is expanded first
+	c.Assert(os.Truncate(image, 2147483648), IsNil)
+	rescans := 0
+	report, err := s.Tgtd.ExpandLunWithOptionsContext(ctx, 1, 1, 2147483648, &iscsi.ExpandOptions{
+		Rescan: func(ctx context.Context) error {
+			rescans++
+			return nil
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(report.Method, Equals, iscsi.ExpandMethodRecreate)
+	c.Assert(steps(report), DeepEquals, []string{
+		"detect tgtd capabilities",
+		"get the LUN",
+		"take the target offline",
+		"delete the LUN",
+		"add the LUN back with the new size",
+		"restore the identity and params",
+		"set the target back to ready",
+		"verify the size",
+		"rescan the LUN on the initiators",
+	})
+	c.Assert(rescans, Equals, 1)
+	c.Assert(report.String(), Matches, "(?s)expand LUN 1 of target 1 to 2147483648 with method recreate:\n  detect tgtd capabilities: done\n.*")
+
+	target, err := s.Tgtd.GetTargetContext(ctx, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(err, IsNil)
+	lun := target.LUN(1)
+	c.Assert(lun.SizeMB, Equals, int64(2147))
+	c.Assert(lun.SCSIID, Equals, identity.SCSIID)
+	c.Assert(lun.SCSISN, Equals, identity.SCSISN)
+	c.Assert(lun.Readonly, Equals, true)
+	c.Assert(lun.ThinProvisioning, Equals, true)
+	c.Assert(target.Nexuses, HasLen, 1)
+	c.Assert(s.Fake.Sessions(), DeepEquals, []string{"iqn.2019-10.io.longhorn:vol1"})
+	// Only the flags differing from the defaults are restored, e.g. not swp
+	var params []string
+	for _, command := range s.Fake.Commands() {
+		if i := slices.Index(command, "--params"); i != -1 {
+			params = strings.Split(command[i+1], ",")
+		}
+	}
+	slices.Sort(params)
+	c.Assert(params, DeepEquals, []string{"readonly=1", "scsi_id=" + identity.SCSIID, "scsi_sn=" + identity.SCSISN, "thin_provisioning=1"})
+
+	// The size is verified in the end, e.g. the backing file isn't expanded
+	_, err = s.Tgtd.ExpandLunWithOptionsContext(ctx, 1, 1, 4294967296, nil)
+	c.Assert(err, ErrorMatches, "failed to verify the size for expanding LUN 1 of target 1: tgtd shows 2147 MB rather than 4295 MB")
+	target, err = s.Tgtd.GetTargetContext(ctx, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(1).SCSIID, Equals, identity.SCSIID)
+
+	// The target is set back to ready even if the LUN cannot be restored
+	report, err = s.Tgtd.ExpandLunWithOptionsContext(ctx, 1, 1, 2147483648, &iscsi.ExpandOptions{Params: map[string]string{"write-cache": "off"}})
+	c.Assert(err, ErrorMatches, "(?s)failed to restore the identity and params for expanding LUN 1 of target 1: .*unknown parameter.*")
+	c.Assert(steps(report)[len(report.Steps)-1], Equals, "set the target back to ready")
+	target, err = s.Tgtd.GetTargetContext(ctx, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(err, IsNil)
+	c.Assert(target.State, Equals, iscsi.TargetStateReady)
+	c.Assert(s.Fake.Sessions(), DeepEquals, []string{"iqn.2019-10.io.longhorn:vol1"})
+}
@@ -0,0 +1,129 @@
+package iscsi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// DefaultVendorID is the vendor of the LUNs with the identity derived by
+	// NewLunIdentity.
+	DefaultVendorID = "LONGHORN"
+
+	// The max lengths of the identity fields in tgtd
+	maxVendorIDLength   = 8
+	maxProductIDLength  = 16
+	maxProductRevLength = 4
+	maxSCSIIDLength     = 24
+	maxSCSISNLength     = 36
+)
+
+// LunIdentity is the SCSI identity of a LUN reported to the initiators. tgtd
+// uses its defaults for the empty fields, which are vendor IET, product
+// VIRTUAL-DISK, and a SCSI ID and a serial number depending on the TID.
+type LunIdentity struct {
+	// VendorID, ProductID and ProductRev are in the standard inquiry data.
+	VendorID   string
+	ProductID  string
+	ProductRev string
+	// SCSIID is the vendor specific identifier in the device identification
+	// VPD page 0x83, i.e. the T10 vendor ID based designator along with
+	// VendorID. tgtd reports no NAA or EUI-64 designator, so there is no WWN,
+	// and udev builds the serial and the by-id links of the disk from it, e.g.
+	// scsi-1LONGHORN_<SCSIID>.
+	SCSIID string
+	// SCSISN is the unit serial number in the VPD page 0x80.
+	SCSISN string
+}
+
+// NewLunIdentity returns the identity derived from the name, e.g. a volume
+// name, so the initiators see the same disk no matter which TID or node the
+// target has. The SCSI ID and the serial number are the hex digests of the
+// name.
+func NewLunIdentity(name string) *LunIdentity {
+	sum := sha256.Sum256([]byte(name))
+	return &LunIdentity{
+		VendorID: DefaultVendorID,
+		SCSIID:   hex.EncodeToString(sum[16 : 16+maxSCSIIDLength/2]),
+		SCSISN:   hex.EncodeToString(sum[:16]),
+	}
+}
+
+// defaultSCSIID and defaultSCSISN return the defaults of tgtd, which depend on
+// the TID and the LUN.
+func defaultSCSIID(tid, lun int) string {
+	return fmt.Sprintf("IET     %04x%04x", tid, lun)
+}
+
+func defaultSCSISN(tid, lun int) string {
+	return fmt.Sprintf("beaf%d%d", tid, lun)
+}
+
+// Validate checks the fields fit in tgtd and can be passed as LUN params.
+func (id *LunIdentity) Validate() error {
+	for _, field := range []struct {
+		name      string
+		value     string
+		maxLength int
+	}{
+		{"vendor_id", id.VendorID, maxVendorIDLength},
+		{"product_id", id.ProductID, maxProductIDLength},
+		{"product_rev", id.ProductRev, maxProductRevLength},
+		{"scsi_id", id.SCSIID, maxSCSIIDLength},
+		{"scsi_sn", id.SCSISN, maxSCSISNLength},
+	} {
+		if len(field.value) > field.maxLength {
+			return fmt.Errorf("%v %q is longer than %v characters", field.name, field.value, field.maxLength)
+		}
+		for _, c := range field.value {
+			if c <= ' ' || c > '~' || strings.ContainsRune(",=", c) {
+				return fmt.Errorf("invalid character %q in %v %q", c, field.name, field.value)
+			}
+		}
+	}
+	return nil
+}
+
+// Params returns the LUN params of the non-empty fields.
+func (id *LunIdentity) Params() map[string]string {
+	params := map[string]string{}
+	for key, value := range map[string]string{
+		"vendor_id":   id.VendorID,
+		"product_id":  id.ProductID,
+		"product_rev": id.ProductRev,
+		"scsi_id":     id.SCSIID,
+		"scsi_sn":     id.SCSISN,
+	} {
+		if value != "" {
+			params[key] = value
+		}
+	}
+	return params
+}
+
+// SetLunIdentity sets the identity of the LUN. It should be set before any
+// initiator logs in, since the initiators don't notice the change.
+func SetLunIdentity(tid, lun int, identity *LunIdentity) error {
+	return SetLunIdentityContext(context.Background(), tid, lun, identity)
+}
+
+// SetLunIdentityContext is like SetLunIdentity but takes a context.
+func SetLunIdentityContext(ctx context.Context, tid, lun int, identity *LunIdentity) error {
+	return DefaultTgtd().SetLunIdentityContext(ctx, tid, lun, identity)
+}
+
+// SetLunIdentityContext sets the identity of the LUN. It should be set before
+// any initiator logs in, since the initiators don't notice the change.
+func (t *Tgtd) SetLunIdentityContext(ctx context.Context, tid, lun int, identity *LunIdentity) error {
+	if err := identity.Validate(); err != nil {
+		return err
+	}
+	params := identity.Params()
+	if len(params) == 0 {
+		return nil
+	}
+	return t.UpdateLunContext(ctx, tid, lun, params)
+}
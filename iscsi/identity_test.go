@@ -0,0 +1,59 @@
+package iscsi_test
+
+import (
+	"context"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+
+	. "gopkg.in/check.v1"
+)
+
+type IdentitySuite struct {
+	iscsitest.Fixture
+}
+
+var _ = Suite(&IdentitySuite{})
+
+func (s *IdentitySuite) TestNewLunIdentity(c *C) {
+	identity := iscsi.NewLunIdentity("vol1")
+	c.Assert(identity, DeepEquals, iscsi.NewLunIdentity("vol1"))
+	c.Assert(identity.VendorID, Equals, iscsi.DefaultVendorID)
+	c.Assert(identity.SCSIID, Matches, "[0-9a-f]{24}")
+	c.Assert(identity.SCSISN, Matches, "[0-9a-f]{32}")
+	c.Assert(identity.Validate(), IsNil)
+
+	other := iscsi.NewLunIdentity("vol2")
+	c.Assert(other.SCSIID, Not(Equals), identity.SCSIID)
+	c.Assert(other.SCSISN, Not(Equals), identity.SCSISN)
+}
+
+func (s *IdentitySuite) TestSetLunIdentity(c *C) {
+	ctx := context.Background()
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, "iqn.2019-10.io.longhorn:vol1"), IsNil)
+	c.Assert(s.Tgtd.AddLunBackedByFileContext(ctx, 1, 1, "/var/lib/images/vol1.img"), IsNil)
+	identity := iscsi.NewLunIdentity("vol1")
+	c.Assert(s.Tgtd.SetLunIdentityContext(ctx, 1, 1, identity), IsNil)
+
+	target, err := s.Tgtd.GetTargetContext(ctx, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(1).SCSIID, Equals, identity.SCSIID)
+	c.Assert(target.LUN(1).SCSISN, Equals, identity.SCSISN)
+
+	// The identity survives the export to targets.conf
+	config, err := s.Tgtd.GetTgtdConfigContext(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(config.Targets[0].LUNs[0].Params, DeepEquals, map[string]string{
+		"scsi_id": identity.SCSIID,
+		"scsi_sn": identity.SCSISN,
+	})
+
+	for _, invalid := range []*iscsi.LunIdentity{
+		{VendorID: "TOO-LONG-VENDOR"},
+		{ProductRev: "1.0.0"},
+		{SCSIID: "with space"},
+		{SCSISN: "a,b"},
+	} {
+		c.Assert(s.Tgtd.SetLunIdentityContext(ctx, 1, 1, invalid), NotNil, Commentf("%+v", invalid))
+	}
+}
@@ -2,8 +2,8 @@ package iscsi
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"net"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -12,6 +12,8 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/sirupsen/logrus"
 
+	"github.com/longhorn/go-iscsi-helper/util"
+
 	lhns "github.com/longhorn/go-common-libs/ns"
 	lhtypes "github.com/longhorn/go-common-libs/types"
 )
@@ -28,25 +30,82 @@ var (
 
 const (
 	iscsiBinary    = "iscsiadm"
+	blockdevBinary = "blockdev"
 	scanModeManual = "manual"
 	scanModeAuto   = "auto"
 	ScanTimeout    = 10 * time.Second
 )
 
-func CheckForInitiatorExistence(nsexec *lhns.Executor) error {
+func CheckForInitiatorExistence(nsexec Executor) error {
+	return CheckForInitiatorExistenceContext(context.Background(), nsexec)
+}
+
+// CheckForInitiatorExistenceContext is like CheckForInitiatorExistence but takes a context.
+func CheckForInitiatorExistenceContext(ctx context.Context, nsexec Executor) error {
 	opts := []string{
 		"--version",
 	}
-	_, err := nsexec.Execute(nil, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	_, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
 	return err
 }
 
-func UpdateScsiDeviceTimeout(devName string, timeout int64, nsexec *lhns.Executor) error {
+func UpdateScsiDeviceTimeout(devName string, timeout int64, nsexec Executor) error {
 	deviceTimeoutFile := filepath.Join("/sys/block", devName, "device", "timeout")
-	return lhns.WriteFile(deviceTimeoutFile, fmt.Sprint(timeout))
+	return writeHostFile(nsexec, deviceTimeoutFile, fmt.Sprint(timeout))
+}
+
+// DeleteScsiDevice removes the SCSI device from the initiator, e.g. before its
+// LUN is deleted from the target.
+func DeleteScsiDevice(devName string, nsexec Executor) error {
+	deleteFile := filepath.Join("/sys/block", devName, "device", "delete")
+	return writeHostFile(nsexec, deleteFile, "1")
+}
+
+// SetDeviceReadOnly makes the block device read-only on the initiator. The
+// kernel normally does it on its own once it finds the LUN write-protected.
+func SetDeviceReadOnly(devName string, nsexec Executor) error {
+	return SetDeviceReadOnlyContext(context.Background(), devName, nsexec)
+}
+
+// SetDeviceReadOnlyContext is like SetDeviceReadOnly but takes a context.
+func SetDeviceReadOnlyContext(ctx context.Context, devName string, nsexec Executor) error {
+	opts := []string{
+		"--setro", filepath.Join("/dev", devName),
+	}
+	_, err := execute(ctx, nsexec, blockdevBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	return err
+}
+
+// IsDeviceReadOnly returns if the block device is read-only on the initiator.
+func IsDeviceReadOnly(devName string, nsexec Executor) (bool, error) {
+	return IsDeviceReadOnlyContext(context.Background(), devName, nsexec)
 }
 
-func UpdateIscsiDeviceAbortTimeout(target string, timeout int64, nsexec *lhns.Executor) error {
+// IsDeviceReadOnlyContext is like IsDeviceReadOnly but takes a context.
+func IsDeviceReadOnlyContext(ctx context.Context, devName string, nsexec Executor) (bool, error) {
+	opts := []string{
+		"--getro", filepath.Join("/dev", devName),
+	}
+	output, err := execute(ctx, nsexec, blockdevBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(output) == "1", nil
+}
+
+// RescanScsiDevice makes the initiator rescan the SCSI device, e.g. for the new
+// capacity of an expanded LUN.
+func RescanScsiDevice(devName string, nsexec Executor) error {
+	rescanFile := filepath.Join("/sys/block", devName, "device", "rescan")
+	return writeHostFile(nsexec, rescanFile, "1")
+}
+
+func UpdateIscsiDeviceAbortTimeout(target string, timeout int64, nsexec Executor) error {
+	return UpdateIscsiDeviceAbortTimeoutContext(context.Background(), target, timeout, nsexec)
+}
+
+// UpdateIscsiDeviceAbortTimeoutContext is like UpdateIscsiDeviceAbortTimeout but takes a context.
+func UpdateIscsiDeviceAbortTimeoutContext(ctx context.Context, target string, timeout int64, nsexec Executor) error {
 	opts := []string{
 		"-m", "node",
 		"-T", target,
@@ -54,20 +113,85 @@ func UpdateIscsiDeviceAbortTimeout(target string, timeout int64, nsexec *lhns.Ex
 		"-n", "node.session.err_timeo.abort_timeout",
 		"-v", strconv.FormatInt(timeout, 10),
 	}
-	_, err := nsexec.Execute(nil, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	_, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
 	return err
 }
 
-func DiscoverTarget(ip, target string, nsexec *lhns.Executor) error {
+// DiscoverTarget discovers the target via the portal, which is an IP address
+// with an optional port, e.g. 10.0.0.1, 10.0.0.1:3261, fd00::1 or
+// [fd00::1]:3261. The same portal format is accepted by all initiator helpers.
+func DiscoverTarget(portal, target string, nsexec Executor) error {
+	return DiscoverTargetContext(context.Background(), portal, target, nsexec)
+}
+
+// DiscoverTargetContext is like DiscoverTarget but takes a context.
+func DiscoverTargetContext(ctx context.Context, portal, target string, nsexec Executor) error {
 	opts := []string{
 		"-m", "discovery",
 		"-t", "sendtargets",
-		"-p", ip,
+		"-p", iscsiadmPortal(portal),
 	}
-	output, err := nsexec.Execute(nil, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	output, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
 	if err != nil {
 		return err
 	}
+	return checkDiscoveredTarget(output, target)
+}
+
+// DiscoverTargetWithAuth discovers the target with the CHAP credentials for
+// the SendTargets discovery session. It is the same as DiscoverTarget if
+// creds is nil.
+func DiscoverTargetWithAuth(portal, target string, creds *ChapCredentials, nsexec Executor) error {
+	return DiscoverTargetWithAuthContext(context.Background(), portal, target, creds, nsexec)
+}
+
+// DiscoverTargetWithAuthContext is like DiscoverTargetWithAuth but takes a context.
+func DiscoverTargetWithAuthContext(ctx context.Context, portal, target string, creds *ChapCredentials, nsexec Executor) error {
+	if creds == nil {
+		return DiscoverTargetContext(ctx, portal, target, nsexec)
+	}
+	if err := creds.validate(); err != nil {
+		return err
+	}
+
+	opts := []string{
+		"-m", "discoverydb",
+		"-t", "sendtargets",
+		"-p", iscsiadmPortal(portal),
+		"-o", "new",
+	}
+	// Ignore the existing record error, i.e. exit status 15
+	if _, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout); err != nil && !strings.Contains(err.Error(), "exit status 15") {
+		return errors.Wrapf(err, "failed to create discovery record for %v", portal)
+	}
+	for _, setting := range creds.settings(discoveryAuthPrefix) {
+		opts := []string{
+			"-m", "discoverydb",
+			"-t", "sendtargets",
+			"-p", iscsiadmPortal(portal),
+			"-o", "update",
+			"-n", setting[0],
+			"-v", setting[1],
+		}
+		if _, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout); err != nil {
+			return util.RedactError(errors.Wrapf(err, "failed to update %v of discovery record for %v", setting[0], portal), creds.secrets()...)
+		}
+	}
+
+	opts = []string{
+		"-m", "discoverydb",
+		"-t", "sendtargets",
+		"-p", iscsiadmPortal(portal),
+		"--discover",
+	}
+	output, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	if err != nil {
+		return util.RedactError(err, creds.secrets()...)
+	}
+	return checkDiscoveredTarget(output, target)
+}
+
+func checkDiscoveredTarget(output, target string) error {
 	// Sometime iscsiadm won't return error but showing e.g.:
 	//  iscsiadm: Could not stat /etc/iscsi/nodes//,3260,-1/default to
 	//  delete node: No such file or directory\n\niscsiadm: Could not
@@ -83,52 +207,67 @@ func DiscoverTarget(ip, target string, nsexec *lhns.Executor) error {
 	return nil
 }
 
-func DeleteDiscoveredTarget(ip, target string, nsexec *lhns.Executor) error {
+func DeleteDiscoveredTarget(portal, target string, nsexec Executor) error {
+	return DeleteDiscoveredTargetContext(context.Background(), portal, target, nsexec)
+}
+
+// DeleteDiscoveredTargetContext is like DeleteDiscoveredTarget but takes a context.
+func DeleteDiscoveredTargetContext(ctx context.Context, portal, target string, nsexec Executor) error {
 	opts := []string{
 		"-m", "node",
 		"-o", "delete",
 		"-T", target,
 	}
-	if ip != "" {
-		opts = append(opts, "-p", ip)
+	if portal != "" {
+		opts = append(opts, "-p", iscsiadmPortal(portal))
 	}
-	_, err := nsexec.Execute(nil, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	_, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
 	return err
 }
 
-func IsTargetDiscovered(ip, target string, nsexec *lhns.Executor) bool {
+func IsTargetDiscovered(portal, target string, nsexec Executor) bool {
+	return IsTargetDiscoveredContext(context.Background(), portal, target, nsexec)
+}
+
+// IsTargetDiscoveredContext is like IsTargetDiscovered but takes a context.
+func IsTargetDiscoveredContext(ctx context.Context, portal, target string, nsexec Executor) bool {
 	opts := []string{
 		"-m", "node",
 		"-T", target,
 	}
-	if ip != "" {
-		opts = append(opts, "-p", ip)
+	if portal != "" {
+		opts = append(opts, "-p", iscsiadmPortal(portal))
 	}
-	_, err := nsexec.Execute(nil, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	_, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
 	return err == nil
 }
 
-func LoginTarget(ip, target string, nsexec *lhns.Executor) error {
+func LoginTarget(portal, target string, nsexec Executor) error {
+	return LoginTargetContext(context.Background(), portal, target, nsexec)
+}
+
+// LoginTargetContext is like LoginTarget but takes a context.
+func LoginTargetContext(ctx context.Context, portal, target string, nsexec Executor) error {
 	opts := []string{
 		"-m", "node",
 		"-T", target,
-		"-p", ip,
+		"-p", iscsiadmPortal(portal),
 		"--login",
 	}
-	_, err := nsexec.Execute(nil, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	_, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
 	if err != nil {
 		return err
 	}
 
-	scanMode, err := getIscsiNodeSessionScanMode(ip, target, nsexec)
+	scanMode, err := getIscsiNodeSessionScanMode(ctx, portal, target, nsexec)
 	if err != nil {
 		return errors.Wrap(err, "Failed to get node.session.scan mode")
 	}
 
 	if scanMode == scanModeManual {
-		logrus.Infof("Manually rescan LUNs of the target %v:%v", target, ip)
-		if err := manualScanSession(ip, target, nsexec); err != nil {
-			return errors.Wrapf(err, "failed to manually rescan iscsi session of target %v:%v", target, ip)
+		logrus.Infof("Manually rescan LUNs of the target %v:%v", target, portal)
+		if err := manualScanSession(ctx, portal, target, nsexec); err != nil {
+			return errors.Wrapf(err, "failed to manually rescan iscsi session of target %v:%v", target, portal)
 		}
 	} else {
 		logrus.Infof("default: automatically rescan all LUNs of all iscsi sessions")
@@ -137,30 +276,90 @@ func LoginTarget(ip, target string, nsexec *lhns.Executor) error {
 	return nil
 }
 
-// LogoutTarget will logout all sessions if ip == ""
-func LogoutTarget(ip, target string, nsexec *lhns.Executor) error {
+// LoginTargetWithAuth logs in the target with the CHAP credentials. It is the
+// same as LoginTarget if creds is nil.
+func LoginTargetWithAuth(portal, target string, creds *ChapCredentials, nsexec Executor) error {
+	return LoginTargetWithAuthContext(context.Background(), portal, target, creds, nsexec)
+}
+
+// LoginTargetWithAuthContext is like LoginTargetWithAuth but takes a context.
+func LoginTargetWithAuthContext(ctx context.Context, portal, target string, creds *ChapCredentials, nsexec Executor) error {
+	if err := UpdateIscsiNodeAuthContext(ctx, portal, target, creds, nsexec); err != nil {
+		return err
+	}
+	return LoginTargetContext(ctx, portal, target, nsexec)
+}
+
+// UpdateIscsiNodeAuth updates the node.session.auth settings of the node
+// record. The authentication is disabled if creds is nil.
+func UpdateIscsiNodeAuth(portal, target string, creds *ChapCredentials, nsexec Executor) error {
+	return UpdateIscsiNodeAuthContext(context.Background(), portal, target, creds, nsexec)
+}
+
+// UpdateIscsiNodeAuthContext is like UpdateIscsiNodeAuth but takes a context.
+func UpdateIscsiNodeAuthContext(ctx context.Context, portal, target string, creds *ChapCredentials, nsexec Executor) error {
+	settings := [][2]string{{nodeAuthPrefix + "authmethod", authMethodNone}}
+	secrets := []string{}
+	if creds != nil {
+		if err := creds.validate(); err != nil {
+			return err
+		}
+		settings = creds.settings(nodeAuthPrefix)
+		secrets = creds.secrets()
+	}
+
+	for _, setting := range settings {
+		opts := []string{
+			"-m", "node",
+			"-T", target,
+			"-p", iscsiadmPortal(portal),
+			"-o", "update",
+			"-n", setting[0],
+			"-v", setting[1],
+		}
+		if _, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout); err != nil {
+			return util.RedactError(errors.Wrapf(err, "failed to update %v of target %v", setting[0], target), secrets...)
+		}
+	}
+	return nil
+}
+
+// LogoutTarget will logout all sessions if portal == ""
+func LogoutTarget(portal, target string, nsexec Executor) error {
+	return LogoutTargetContext(context.Background(), portal, target, nsexec)
+}
+
+// LogoutTargetContext is like LogoutTarget but takes a context.
+func LogoutTargetContext(ctx context.Context, portal, target string, nsexec Executor) error {
 	opts := []string{
 		"-m", "node",
 		"-T", target,
 		"--logout",
 	}
-	if ip != "" {
-		opts = append(opts, "-p", ip)
+	if portal != "" {
+		opts = append(opts, "-p", iscsiadmPortal(portal))
 	}
-	_, err := nsexec.Execute(nil, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	_, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
 	return err
 }
 
-func GetDevice(ip, target string, lun int, nsexec *lhns.Executor) (*lhtypes.BlockDeviceInfo, error) {
+func GetDevice(portal, target string, lun int, nsexec Executor) (*lhtypes.BlockDeviceInfo, error) {
+	return GetDeviceContext(context.Background(), portal, target, lun, nsexec)
+}
+
+// GetDeviceContext is like GetDevice but takes a context.
+func GetDeviceContext(ctx context.Context, portal, target string, lun int, nsexec Executor) (*lhtypes.BlockDeviceInfo, error) {
 	var err error
 
 	var dev *lhtypes.BlockDeviceInfo
 	for i := 0; i < DeviceWaitRetryCounts; i++ {
-		dev, err = findScsiDevice(ip, target, lun, nsexec)
+		dev, err = findScsiDevice(ctx, portal, target, lun, nsexec)
 		if err == nil {
 			break
 		}
-		time.Sleep(DeviceWaitRetryInterval)
+		if errSleep := util.SleepContext(ctx, DeviceWaitRetryInterval); errSleep != nil {
+			return nil, errors.Wrapf(errSleep, "failed to wait for the device of target %v: %v", target, err)
+		}
 	}
 	if err != nil {
 		return nil, err
@@ -168,13 +367,18 @@ func GetDevice(ip, target string, lun int, nsexec *lhns.Executor) (*lhtypes.Bloc
 	return dev, nil
 }
 
-// IsTargetLoggedIn check all portals if ip == ""
-func IsTargetLoggedIn(ip, target string, nsexec *lhns.Executor) bool {
+// IsTargetLoggedIn check all portals if portal == ""
+func IsTargetLoggedIn(portal, target string, nsexec Executor) bool {
+	return IsTargetLoggedInContext(context.Background(), portal, target, nsexec)
+}
+
+// IsTargetLoggedInContext is like IsTargetLoggedIn but takes a context.
+func IsTargetLoggedInContext(ctx context.Context, portal, target string, nsexec Executor) bool {
 	opts := []string{
 		"-m", "session",
 	}
 
-	output, err := nsexec.Execute(nil, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	output, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
 	if err != nil {
 		return false
 	}
@@ -187,7 +391,7 @@ func IsTargetLoggedIn(ip, target string, nsexec *lhns.Executor) bool {
 	scanner := bufio.NewScanner(strings.NewReader(output))
 	for scanner.Scan() {
 		line := scanner.Text()
-		if strings.Contains(line, net.JoinHostPort(ip, "")) {
+		if strings.Contains(line, portalPattern(portal)) {
 			if strings.HasSuffix(line, " "+target) ||
 				strings.Contains(scanner.Text(), " "+target+" ") {
 				found = true
@@ -199,25 +403,85 @@ func IsTargetLoggedIn(ip, target string, nsexec *lhns.Executor) bool {
 	return found
 }
 
-func manualScanSession(ip, target string, nsexec *lhns.Executor) error {
+func manualScanSession(ctx context.Context, portal, target string, nsexec Executor) error {
 	opts := []string{
 		"-m", "node",
 		"-T", target,
-		"-p", ip,
+		"-p", iscsiadmPortal(portal),
 		"--rescan",
 	}
-	_, err := nsexec.Execute(nil, iscsiBinary, opts, ScanTimeout)
+	_, err := execute(ctx, nsexec, iscsiBinary, opts, ScanTimeout)
 	return err
 }
 
-func getIscsiNodeSessionScanMode(ip, target string, nsexec *lhns.Executor) (string, error) {
+// ScanLun scans only the LUN of the target on the session via the portal,
+// e.g. once the LUN is added to a target which is already logged in.
+func ScanLun(portal, target string, lun int, nsexec Executor) error {
+	return ScanLunContext(context.Background(), portal, target, lun, nsexec)
+}
+
+// ScanLunContext is like ScanLun but takes a context.
+func ScanLunContext(ctx context.Context, portal, target string, lun int, nsexec Executor) error {
+	host, err := findSessionHost(ctx, portal, target, nsexec)
+	if err != nil {
+		return err
+	}
+	// The channel and the target ID are always 0 for iSCSI
+	scanFile := fmt.Sprintf("/sys/class/scsi_host/host%d/scan", host)
+	return writeHostFile(nsexec, scanFile, fmt.Sprintf("0 0 %d", lun))
+}
+
+// findSessionHost returns the SCSI host number of the session, which is in
+// the output of `iscsiadm -m session -P 3` like:
+//
+//	Target: iqn.2019-10.io.longhorn:for.all (non-flash)
+//		Current Portal: 172.17.0.2:3260,1
+//		...
+//		Host Number: 12	State: running
+func findSessionHost(ctx context.Context, portal, target string, nsexec Executor) (int, error) {
+	opts := []string{
+		"-m", "session",
+		"-P", "3",
+	}
+	output, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	if err != nil {
+		return -1, err
+	}
+
+	targetLine := "Target: " + target
+	portalLine := " " + portalPattern(portal)
+	inTarget, inPortal := false, false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Target: ") {
+			inTarget = strings.Contains(line, targetLine+" ") || strings.HasSuffix(line, targetLine)
+			inPortal = false
+			continue
+		}
+		if inTarget && strings.Contains(line, portalLine) {
+			inPortal = true
+			continue
+		}
+		if inPortal && strings.Contains(line, "Host Number:") {
+			fields := strings.Fields(strings.TrimSpace(line))
+			if len(fields) < 3 {
+				return -1, fmt.Errorf("invalid output format, cannot find host number in: %s", line)
+			}
+			return strconv.Atoi(fields[2])
+		}
+	}
+	return -1, fmt.Errorf("cannot find iSCSI session of target %v", target)
+}
+
+func getIscsiNodeSessionScanMode(ctx context.Context, portal, target string, nsexec Executor) (string, error) {
 	opts := []string{
 		"-m", "node",
 		"-T", target,
-		"-p", ip,
+		"-p", iscsiadmPortal(portal),
 		"-o", "show",
 	}
-	output, err := nsexec.Execute(nil, iscsiBinary, opts, ScanTimeout)
+	output, err := execute(ctx, nsexec, iscsiBinary, opts, ScanTimeout)
 	if err != nil {
 		return "", err
 	}
@@ -227,14 +491,14 @@ func getIscsiNodeSessionScanMode(ip, target string, nsexec *lhns.Executor) (stri
 	return scanModeAuto, nil
 }
 
-func findScsiDevice(ip, target string, lun int, nsexec *lhns.Executor) (*lhtypes.BlockDeviceInfo, error) {
+func findScsiDevice(ctx context.Context, portal, target string, lun int, nsexec Executor) (*lhtypes.BlockDeviceInfo, error) {
 	name := ""
 
 	opts := []string{
 		"-m", "session",
 		"-P", "3",
 	}
-	output, err := nsexec.Execute(nil, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	output, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -254,14 +518,14 @@ func findScsiDevice(ip, target string, lun int, nsexec *lhns.Executor) (*lhtypes
 	*/
 	scanner := bufio.NewScanner(strings.NewReader(output))
 	targetLine := "Target: " + target
-	ipLine := " " + net.JoinHostPort(ip, "")
+	portalLine := " " + portalPattern(portal)
 
 	lunLine := "Lun: " + strconv.Itoa(lun)
 	diskPrefix := "Attached scsi disk"
 	stateLine := "State:"
 
 	inTarget := false
-	inIP := false
+	inPortal := false
 	inLun := false
 	for scanner.Scan() {
 		/* Target line can be:
@@ -275,11 +539,11 @@ func findScsiDevice(ip, target string, lun int, nsexec *lhns.Executor) (*lhtypes
 			inTarget = true
 			continue
 		}
-		if inTarget && strings.Contains(scanner.Text(), ipLine) {
-			inIP = true
+		if inTarget && strings.Contains(scanner.Text(), portalLine) {
+			inPortal = true
 			continue
 		}
-		if inIP && strings.Contains(scanner.Text(), lunLine) {
+		if inPortal && strings.Contains(scanner.Text(), lunLine) {
 			inLun = true
 			continue
 		}
@@ -302,7 +566,7 @@ func findScsiDevice(ip, target string, lun int, nsexec *lhns.Executor) (*lhtypes
 
 	// TODO: replace with namespace joiner
 	// now that we know the device is mapped, we can get it's (major:minor)
-	devices, err := lhns.GetSystemBlockDevices()
+	devices, err := getSystemBlockDevices(nsexec)
 	if err != nil {
 		return nil, err
 	}
@@ -355,15 +619,20 @@ func CleanupScsiNodes(target string) error {
 	return nil
 }
 
-func RescanTarget(ip, target string, nsexec *lhns.Executor) error {
+func RescanTarget(portal, target string, nsexec Executor) error {
+	return RescanTargetContext(context.Background(), portal, target, nsexec)
+}
+
+// RescanTargetContext is like RescanTarget but takes a context.
+func RescanTargetContext(ctx context.Context, portal, target string, nsexec Executor) error {
 	opts := []string{
 		"-m", "node",
 		"-T", target,
 		"-R",
 	}
-	if ip != "" {
-		opts = append(opts, "-p", ip)
+	if portal != "" {
+		opts = append(opts, "-p", iscsiadmPortal(portal))
 	}
-	_, err := nsexec.Execute(nil, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	_, err := execute(ctx, nsexec, iscsiBinary, opts, lhtypes.ExecuteDefaultTimeout)
 	return err
 }
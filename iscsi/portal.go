@@ -0,0 +1,180 @@
+package iscsi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+const (
+	DefaultPortalPort = 3260
+)
+
+// Portal is an IP address and TCP port the iSCSI target listens on.
+type Portal struct {
+	IP   string
+	Port int
+}
+
+// String returns the portal as host:port, with the IPv6 address in brackets.
+func (p Portal) String() string {
+	return net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+}
+
+// ParsePortal parses a portal in the format of IP, IP:port or [IPv6]:port.
+// The default port is used if it's not specified.
+func ParsePortal(portal string) (Portal, error) {
+	host, port := splitPortal(portal)
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if net.ParseIP(host) == nil {
+		return Portal{}, fmt.Errorf("invalid IP address in portal %v", portal)
+	}
+	p := Portal{IP: host, Port: DefaultPortalPort}
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n <= 0 || n > 65535 {
+			return Portal{}, fmt.Errorf("invalid port in portal %v", portal)
+		}
+		p.Port = n
+	}
+	return p, nil
+}
+
+// splitPortal splits a portal into the host and the port. The port is empty
+// if the portal is a bare IPv4 or IPv6 address.
+func splitPortal(portal string) (string, string) {
+	host, port, err := net.SplitHostPort(portal)
+	if err != nil {
+		return portal, ""
+	}
+	return host, port
+}
+
+// iscsiadmPortal returns the portal argument for `iscsiadm -p`, which
+// requires the IPv6 address in brackets.
+func iscsiadmPortal(portal string) string {
+	ip := net.ParseIP(portal)
+	if ip == nil || ip.To4() != nil {
+		return portal
+	}
+	return "[" + portal + "]"
+}
+
+// portalPattern returns the pattern to match the portal in the output of
+// `iscsiadm -m session`, e.g. `172.17.0.2:3260,1`. Any port matches if the
+// portal doesn't contain one.
+func portalPattern(portal string) string {
+	host, port := splitPortal(portal)
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if port == "" {
+		return net.JoinHostPort(host, "")
+	}
+	return net.JoinHostPort(host, port) + ","
+}
+
+// CreatePortal will make tgtd listen on the portal.
+func CreatePortal(portal Portal) error {
+	return CreatePortalContext(context.Background(), portal)
+}
+
+// CreatePortalContext is like CreatePortal but takes a context.
+func CreatePortalContext(ctx context.Context, portal Portal) error {
+	return DefaultTgtd().CreatePortalContext(ctx, portal)
+}
+
+// CreatePortalContext will make tgtd listen on the portal.
+func (t *Tgtd) CreatePortalContext(ctx context.Context, portal Portal) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "new",
+		"--mode", "portal",
+		"--param", "portal=" + portal.String(),
+	}
+	_, err := t.tgtadm(ctx, opts)
+	return err
+}
+
+// DeletePortal will make tgtd stop listening on the portal.
+func DeletePortal(portal Portal) error {
+	return DeletePortalContext(context.Background(), portal)
+}
+
+// DeletePortalContext is like DeletePortal but takes a context.
+func DeletePortalContext(ctx context.Context, portal Portal) error {
+	return DefaultTgtd().DeletePortalContext(ctx, portal)
+}
+
+// DeletePortalContext will make tgtd stop listening on the portal.
+func (t *Tgtd) DeletePortalContext(ctx context.Context, portal Portal) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "delete",
+		"--mode", "portal",
+		"--param", "portal=" + portal.String(),
+	}
+	_, err := t.tgtadm(ctx, opts)
+	return err
+}
+
+// ListPortals returns the portals tgtd listens on.
+func ListPortals() ([]Portal, error) {
+	return ListPortalsContext(context.Background())
+}
+
+// ListPortalsContext is like ListPortals but takes a context.
+func ListPortalsContext(ctx context.Context) ([]Portal, error) {
+	return DefaultTgtd().ListPortalsContext(ctx)
+}
+
+// ListPortalsContext returns the portals tgtd listens on.
+func (t *Tgtd) ListPortalsContext(ctx context.Context) ([]Portal, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "portal",
+	}
+	output, err := t.tgtadm(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return parsePortals(output)
+}
+
+/*
+parsePortals parses the output of `tgtadm --op show --mode portal`, which looks like:
+
+	Portal: 0.0.0.0:3260,1
+	Portal: [::]:3260,1
+*/
+func parsePortals(output string) ([]Portal, error) {
+	portals := []Portal{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		value, found := strings.CutPrefix(line, "Portal: ")
+		if !found {
+			return nil, fmt.Errorf("invalid output format, cannot find portal in: %s", line)
+		}
+		// Remove the portal group tag
+		if i := strings.LastIndex(value, ","); i >= 0 {
+			value = value[:i]
+		}
+		portal, err := ParsePortal(value)
+		if err != nil {
+			return nil, err
+		}
+		portals = append(portals, portal)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to parse portals")
+	}
+	return portals, nil
+}
@@ -0,0 +1,55 @@
+package iscsi
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type PortalSuite struct{}
+
+var _ = Suite(&PortalSuite{})
+
+func (s *PortalSuite) TestParsePortal(c *C) {
+	for value, expected := range map[string]Portal{
+		"10.0.0.1":        {IP: "10.0.0.1", Port: 3260},
+		"10.0.0.1:3261":   {IP: "10.0.0.1", Port: 3261},
+		"fd00::1":         {IP: "fd00::1", Port: 3260},
+		"[fd00::1]":       {IP: "fd00::1", Port: 3260},
+		"[fd00::1]:3261":  {IP: "fd00::1", Port: 3261},
+		"0.0.0.0:3260":    {IP: "0.0.0.0", Port: 3260},
+		"[::]:3260":       {IP: "::", Port: 3260},
+		"192.168.1.10:80": {IP: "192.168.1.10", Port: 80},
+	} {
+		portal, err := ParsePortal(value)
+		c.Assert(err, IsNil)
+		c.Assert(portal, Equals, expected)
+	}
+
+	for _, value := range []string{"", "node-1", "10.0.0.1:0", "10.0.0.1:port"} {
+		_, err := ParsePortal(value)
+		c.Assert(err, NotNil)
+	}
+
+	c.Assert(Portal{IP: "fd00::1", Port: 3261}.String(), Equals, "[fd00::1]:3261")
+}
+
+func (s *PortalSuite) TestPortalArguments(c *C) {
+	c.Assert(iscsiadmPortal("10.0.0.1"), Equals, "10.0.0.1")
+	c.Assert(iscsiadmPortal("10.0.0.1:3261"), Equals, "10.0.0.1:3261")
+	c.Assert(iscsiadmPortal("fd00::1"), Equals, "[fd00::1]")
+	c.Assert(iscsiadmPortal("[fd00::1]:3261"), Equals, "[fd00::1]:3261")
+
+	c.Assert(portalPattern(""), Equals, ":")
+	c.Assert(portalPattern("10.0.0.1"), Equals, "10.0.0.1:")
+	c.Assert(portalPattern("10.0.0.1:3261"), Equals, "10.0.0.1:3261,")
+	c.Assert(portalPattern("fd00::1"), Equals, "[fd00::1]:")
+	c.Assert(portalPattern("[fd00::1]:3261"), Equals, "[fd00::1]:3261,")
+}
+
+func (s *PortalSuite) TestParsePortals(c *C) {
+	portals, err := parsePortals("Portal: 0.0.0.0:3260,1\nPortal: [::]:3260,1\n")
+	c.Assert(err, IsNil)
+	c.Assert(portals, DeepEquals, []Portal{{IP: "0.0.0.0", Port: 3260}, {IP: "::", Port: 3260}})
+
+	_, err = parsePortals("0.0.0.0:3260,1\n")
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,523 @@
+package iscsi
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// TgtdConfig is the desired state of tgtd, which is enforced by Reconcile.
+type TgtdConfig struct {
+	Targets []TargetConfig
+	// Accounts are the CHAP accounts to create. The passwords are only used to
+	// create the missing accounts, since tgtd doesn't show them.
+	Accounts []AccountConfig
+	// Portals are the portals tgtd listens on. They are left untouched if nil.
+	Portals []Portal
+	// Prune deletes the targets and the accounts which are not in the config.
+	// Otherwise they are left untouched.
+	Prune bool
+}
+
+// TargetConfig is the desired state of a target.
+type TargetConfig struct {
+	TID  int
+	IQN  string
+	LUNs []LUNConfig
+	ACLs []ACL
+	// Accounts are bound to the target. Each of them must be either in the
+	// config or already in tgtd.
+	Accounts []TargetAccount
+}
+
+// LUNConfig is the desired state of a LUN. LUN 0 is the controller created by
+// tgtd, so it cannot be configured.
+type LUNConfig struct {
+	ID           int
+	BackingStore string
+	// BackingStoreType is the default of tgtd, i.e. rdwr, if empty.
+	BackingStoreType string
+	BackingStoreOpts string
+	// DeviceType is DeviceTypeDisk if empty.
+	DeviceType DeviceType
+	// Params are set by `tgtadm --op update`. The ones shown by tgtd, e.g.
+	// online and readonly, are updated once they drift, while the others are
+	// only set when the LUN is created.
+	Params map[string]string
+}
+
+// AccountConfig is a CHAP account of tgtd.
+type AccountConfig struct {
+	User     string
+	Password string
+}
+
+type ReconcileAction string
+
+const (
+	ReconcileCreatePortal  = ReconcileAction("create-portal")
+	ReconcileDeletePortal  = ReconcileAction("delete-portal")
+	ReconcileCreateAccount = ReconcileAction("create-account")
+	ReconcileDeleteAccount = ReconcileAction("delete-account")
+	ReconcileCreateTarget  = ReconcileAction("create-target")
+	ReconcileDeleteTarget  = ReconcileAction("delete-target")
+	ReconcileAddLun        = ReconcileAction("add-lun")
+	ReconcileDeleteLun     = ReconcileAction("delete-lun")
+	ReconcileUpdateLun     = ReconcileAction("update-lun")
+	ReconcileBindACL       = ReconcileAction("bind-acl")
+	ReconcileUnbindACL     = ReconcileAction("unbind-acl")
+	ReconcileBindAccount   = ReconcileAction("bind-account")
+	ReconcileUnbindAccount = ReconcileAction("unbind-account")
+)
+
+// ReconcileOperation is an operation of a reconcile plan.
+type ReconcileOperation struct {
+	Action ReconcileAction
+	// TID and LUN are the target and the LUN of the operation, or 0 if not
+	// applicable.
+	TID int
+	LUN int
+	// Object is what the operation applies to, e.g. the IQN of the target,
+	// the backing store of the LUN, the params, the ACL, the user or the
+	// portal. It never contains a password.
+	Object string
+
+	apply func(ctx context.Context) error
+}
+
+func (op ReconcileOperation) String() string {
+	s := string(op.Action)
+	if op.TID != 0 {
+		s += fmt.Sprintf(" target %v", op.TID)
+	}
+	if op.LUN != 0 {
+		s += fmt.Sprintf(" lun %v", op.LUN)
+	}
+	return s + " " + op.Object
+}
+
+// ReconcilePlan is the list of operations to make tgtd match the config. It's
+// empty if tgtd already matches it.
+type ReconcilePlan struct {
+	Operations []ReconcileOperation
+
+	// tgtd is the instance the plan is made for and applied to
+	tgtd *Tgtd
+}
+
+func (p *ReconcilePlan) String() string {
+	lines := []string{}
+	for _, op := range p.Operations {
+		lines = append(lines, op.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *ReconcilePlan) add(action ReconcileAction, tid, lun int, object string, apply func(ctx context.Context) error) {
+	p.Operations = append(p.Operations, ReconcileOperation{
+		Action: action,
+		TID:    tid,
+		LUN:    lun,
+		Object: object,
+		apply:  apply,
+	})
+}
+
+// Apply applies the operations in order to the instance the plan is made
+// for, and stops at the first failure.
+func (p *ReconcilePlan) Apply() error {
+	return p.ApplyContext(context.Background())
+}
+
+// ApplyContext is like Apply but takes a context.
+func (p *ReconcilePlan) ApplyContext(ctx context.Context) error {
+	for _, op := range p.Operations {
+		if err := op.apply(ctx); err != nil {
+			return errors.Wrapf(err, "failed to %v", op)
+		}
+	}
+	return nil
+}
+
+// Reconcile compares the config with tgtd, and applies the minimal operations
+// to make tgtd match it. The plan is returned even if applying it fails.
+func Reconcile(config *TgtdConfig) (*ReconcilePlan, error) {
+	return ReconcileContext(context.Background(), config)
+}
+
+// ReconcileContext is like Reconcile but takes a context.
+func ReconcileContext(ctx context.Context, config *TgtdConfig) (*ReconcilePlan, error) {
+	return DefaultTgtd().ReconcileContext(ctx, config)
+}
+
+// ReconcileContext compares the config with tgtd, and applies the minimal
+// operations to make tgtd match it. The plan is returned even if applying it
+// fails.
+func (t *Tgtd) ReconcileContext(ctx context.Context, config *TgtdConfig) (*ReconcilePlan, error) {
+	plan, err := t.PlanReconcileContext(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return plan, plan.ApplyContext(ctx)
+}
+
+// PlanReconcile returns the operations Reconcile would apply, without
+// changing tgtd.
+func PlanReconcile(config *TgtdConfig) (*ReconcilePlan, error) {
+	return PlanReconcileContext(context.Background(), config)
+}
+
+// PlanReconcileContext is like PlanReconcile but takes a context.
+func PlanReconcileContext(ctx context.Context, config *TgtdConfig) (*ReconcilePlan, error) {
+	return DefaultTgtd().PlanReconcileContext(ctx, config)
+}
+
+// PlanReconcileContext returns the operations Reconcile would apply, without
+// changing tgtd.
+func (t *Tgtd) PlanReconcileContext(ctx context.Context, config *TgtdConfig) (*ReconcilePlan, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	targets, err := t.ListTargetsContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to show targets")
+	}
+	users, err := t.ListAccountsContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to show accounts")
+	}
+	var portals []Portal
+	if config.Portals != nil {
+		if portals, err = t.ListPortalsContext(ctx); err != nil {
+			return nil, errors.Wrap(err, "failed to show portals")
+		}
+	}
+
+	plan := &ReconcilePlan{tgtd: t}
+
+	// Add the portals before removing any, so tgtd keeps listening
+	for _, portal := range config.Portals {
+		if !containsPortal(portals, portal) {
+			plan.add(ReconcileCreatePortal, 0, 0, portal.String(), func(ctx context.Context) error {
+				return t.CreatePortalContext(ctx, portal)
+			})
+		}
+	}
+
+	existingUsers := map[string]bool{}
+	for _, user := range users {
+		existingUsers[user] = true
+	}
+	desiredUsers := map[string]bool{}
+	for _, account := range config.Accounts {
+		desiredUsers[account.User] = true
+		if !existingUsers[account.User] {
+			plan.add(ReconcileCreateAccount, 0, 0, account.User, func(ctx context.Context) error {
+				return t.CreateAccountContext(ctx, account.User, account.Password)
+			})
+		}
+	}
+	for _, target := range config.Targets {
+		for _, account := range target.Accounts {
+			if !desiredUsers[account.User] && !existingUsers[account.User] {
+				return nil, fmt.Errorf("account %v of target %v is neither in the config nor in tgtd", account.User, target.TID)
+			}
+		}
+	}
+
+	liveTargets := map[int]*Target{}
+	for _, live := range targets {
+		liveTargets[live.TID] = live
+	}
+	desiredTIDs := map[int]bool{}
+	desiredIQNs := map[string]bool{}
+	for _, target := range config.Targets {
+		desiredTIDs[target.TID] = true
+		desiredIQNs[target.IQN] = true
+	}
+	// Delete the targets conflicting with the config before creating any,
+	// i.e. the ones with the TID or the IQN of another target in the config
+	for _, live := range targets {
+		if sameTarget(config.Targets, live) {
+			continue
+		}
+		if desiredTIDs[live.TID] || desiredIQNs[live.IQN] || config.Prune {
+			plan.addDeleteTarget(live.TID, live.IQN)
+			delete(liveTargets, live.TID)
+		}
+	}
+
+	for _, target := range config.Targets {
+		planTarget(plan, &target, liveTargets[target.TID])
+	}
+
+	if config.Portals != nil {
+		for _, portal := range portals {
+			if !containsPortal(config.Portals, portal) {
+				plan.add(ReconcileDeletePortal, 0, 0, portal.String(), func(ctx context.Context) error {
+					return t.DeletePortalContext(ctx, portal)
+				})
+			}
+		}
+	}
+	if config.Prune {
+		for _, user := range users {
+			if !desiredUsers[user] {
+				plan.add(ReconcileDeleteAccount, 0, 0, user, func(ctx context.Context) error {
+					return t.DeleteAccountContext(ctx, user)
+				})
+			}
+		}
+	}
+	return plan, nil
+}
+
+func (p *ReconcilePlan) addDeleteTarget(tid int, iqn string) {
+	p.add(ReconcileDeleteTarget, tid, 0, iqn, func(ctx context.Context) error {
+		return p.tgtd.DeleteTargetContext(ctx, tid)
+	})
+}
+
+// planTarget adds the operations to make the live target match the config.
+// live is nil if the target doesn't exist.
+func planTarget(plan *ReconcilePlan, target *TargetConfig, live *Target) {
+	tid := target.TID
+	if live == nil {
+		plan.add(ReconcileCreateTarget, tid, 0, target.IQN, func(ctx context.Context) error {
+			return plan.tgtd.CreateTargetContext(ctx, tid, target.IQN)
+		})
+		live = &Target{TID: tid, IQN: target.IQN}
+	}
+
+	desiredLUNs := map[int]bool{}
+	for _, lun := range target.LUNs {
+		desiredLUNs[lun.ID] = true
+	}
+	for _, liveLUN := range live.LUNs {
+		if liveLUN.ID != 0 && !desiredLUNs[liveLUN.ID] {
+			plan.addDeleteLun(tid, liveLUN.ID, liveLUN.BackingStorePath)
+		}
+	}
+	for _, lun := range target.LUNs {
+		liveLUN := live.LUN(lun.ID)
+		if liveLUN != nil && !sameBackingStore(&lun, liveLUN) {
+			plan.addDeleteLun(tid, lun.ID, liveLUN.BackingStorePath)
+			liveLUN = nil
+		}
+		if liveLUN == nil {
+			plan.add(ReconcileAddLun, tid, lun.ID, lun.BackingStore, func(ctx context.Context) error {
+				if lun.BackingStoreType == "" && lun.deviceType() == DeviceTypeDisk {
+					return plan.tgtd.AddLunBackedByFileContext(ctx, tid, lun.ID, lun.BackingStore)
+				}
+				return plan.tgtd.AddLunWithDeviceTypeContext(ctx, tid, lun.ID, lun.BackingStore, lun.backingStoreType(), lun.BackingStoreOpts, lun.deviceType())
+			})
+		}
+		if params := lunParamsToUpdate(lun.Params, liveLUN); len(params) != 0 {
+			plan.add(ReconcileUpdateLun, tid, lun.ID, formatParams(params), func(ctx context.Context) error {
+				return plan.tgtd.UpdateLunContext(ctx, tid, lun.ID, params)
+			})
+		}
+	}
+
+	liveACLs := live.BoundACLs()
+	for _, acl := range target.ACLs {
+		if !containsACL(liveACLs, acl) {
+			plan.add(ReconcileBindACL, tid, 0, acl.String(), func(ctx context.Context) error {
+				return plan.tgtd.BindACLContext(ctx, tid, acl)
+			})
+		}
+	}
+	for _, acl := range liveACLs {
+		if !containsACL(target.ACLs, acl) {
+			plan.add(ReconcileUnbindACL, tid, 0, acl.String(), func(ctx context.Context) error {
+				return plan.tgtd.UnbindACLContext(ctx, tid, acl)
+			})
+		}
+	}
+
+	// Unbind first, since a target can have only one outgoing account
+	for _, account := range live.Accounts {
+		if !containsAccount(target.Accounts, account) {
+			plan.add(ReconcileUnbindAccount, tid, 0, accountObject(account), func(ctx context.Context) error {
+				return plan.tgtd.UnbindAccountContext(ctx, tid, account.User, account.Outgoing)
+			})
+		}
+	}
+	for _, account := range target.Accounts {
+		if !containsAccount(live.Accounts, account) {
+			plan.add(ReconcileBindAccount, tid, 0, accountObject(account), func(ctx context.Context) error {
+				return plan.tgtd.BindAccountContext(ctx, tid, account.User, account.Outgoing)
+			})
+		}
+	}
+}
+
+func (p *ReconcilePlan) addDeleteLun(tid, lun int, backingStore string) {
+	p.add(ReconcileDeleteLun, tid, lun, backingStore, func(ctx context.Context) error {
+		return p.tgtd.DeleteLunContext(ctx, tid, lun)
+	})
+}
+
+func (c *TgtdConfig) validate() error {
+	tids := map[int]bool{}
+	iqns := map[string]bool{}
+	for _, target := range c.Targets {
+		if target.TID <= 0 || target.TID >= maxTargetID {
+			return fmt.Errorf("invalid target ID %v of target %v", target.TID, target.IQN)
+		}
+		if target.IQN == "" {
+			return fmt.Errorf("empty IQN of target %v", target.TID)
+		}
+		if tids[target.TID] || iqns[target.IQN] {
+			return fmt.Errorf("duplicate target %v %v", target.TID, target.IQN)
+		}
+		tids[target.TID], iqns[target.IQN] = true, true
+
+		luns := map[int]bool{}
+		for _, lun := range target.LUNs {
+			if lun.ID <= 0 {
+				return fmt.Errorf("invalid LUN %v of target %v", lun.ID, target.TID)
+			}
+			if luns[lun.ID] {
+				return fmt.Errorf("duplicate LUN %v of target %v", lun.ID, target.TID)
+			}
+			luns[lun.ID] = true
+			if err := lun.deviceType().ValidateBackingStore(lun.backingStoreType()); err != nil {
+				return errors.Wrapf(err, "invalid LUN %v of target %v", lun.ID, target.TID)
+			}
+		}
+		outgoing := 0
+		for _, account := range target.Accounts {
+			if account.Outgoing {
+				outgoing++
+			}
+		}
+		if outgoing > 1 {
+			return fmt.Errorf("target %v has more than one outgoing account", target.TID)
+		}
+	}
+	for _, account := range c.Accounts {
+		if account.User == "" || account.Password == "" {
+			return fmt.Errorf("empty user or password for the account")
+		}
+	}
+	return nil
+}
+
+// sameTarget returns true if the config has the live target with the same TID.
+func sameTarget(targets []TargetConfig, live *Target) bool {
+	for _, target := range targets {
+		if target.TID == live.TID {
+			return target.IQN == live.IQN
+		}
+	}
+	return false
+}
+
+func sameBackingStore(lun *LUNConfig, live *LUN) bool {
+	if lun.BackingStore != live.BackingStorePath || lun.deviceType() != live.DeviceType() {
+		return false
+	}
+	return lun.BackingStoreType == "" || lun.BackingStoreType == live.BackingStoreType
+}
+
+// backingStoreType returns the backing store type, or rdwr which is the
+// default of tgtd.
+func (lun *LUNConfig) backingStoreType() string {
+	if lun.BackingStoreType == "" {
+		return "rdwr"
+	}
+	return lun.BackingStoreType
+}
+
+func (lun *LUNConfig) deviceType() DeviceType {
+	if lun.DeviceType == "" {
+		return DeviceTypeDisk
+	}
+	return lun.DeviceType
+}
+
+// lunParamsToUpdate returns all params for a new LUN, i.e. live is nil, or the
+// ones drifted from the live LUN.
+func lunParamsToUpdate(params map[string]string, live *LUN) map[string]string {
+	if live == nil {
+		return params
+	}
+	shown := map[string]bool{
+		"online":            live.Online,
+		"readonly":          live.Readonly,
+		"removable":         live.RemovableMedia,
+		"swp":               live.SWP,
+		"thin_provisioning": live.ThinProvisioning,
+	}
+	shownStrings := map[string]string{
+		"scsi_id": live.SCSIID,
+		"scsi_sn": live.SCSISN,
+	}
+	drifted := map[string]string{}
+	for key, value := range params {
+		if current, isShown := shownStrings[key]; isShown {
+			if value != current {
+				drifted[key] = value
+			}
+			continue
+		}
+		current, isShown := shown[key]
+		if !isShown {
+			continue
+		}
+		desired, err := strconv.ParseBool(value)
+		if err != nil || desired != current {
+			drifted[key] = value
+		}
+	}
+	return drifted
+}
+
+func formatParams(params map[string]string) string {
+	pairs := []string{}
+	for key, value := range params {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func accountObject(account TargetAccount) string {
+	if account.Outgoing {
+		return account.User + " (outgoing)"
+	}
+	return account.User
+}
+
+func containsPortal(portals []Portal, portal Portal) bool {
+	for _, p := range portals {
+		if p.String() == portal.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func containsACL(acls []ACL, acl ACL) bool {
+	for _, a := range acls {
+		if a == acl {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAccount(accounts []TargetAccount, account TargetAccount) bool {
+	for _, a := range accounts {
+		if a == account {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package iscsi_test
+
+import (
+	"context"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+	"github.com/longhorn/go-iscsi-helper/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type ReconcileSuite struct {
+	iscsitest.Fixture
+}
+
+var _ = Suite(&ReconcileSuite{})
+
+func (s *ReconcileSuite) config(c *C) *iscsi.TgtdConfig {
+	acl, err := iscsi.NewAddressACL("10.0.0.0/24")
+	c.Assert(err, IsNil)
+	return &iscsi.TgtdConfig{
+		Targets: []iscsi.TargetConfig{
+			{
+				TID: 1,
+				IQN: "iqn.2019-10.io.longhorn:vol1",
+				LUNs: []iscsi.LUNConfig{
+					{
+						ID:               1,
+						BackingStore:     "/var/run/longhorn-vol1.sock",
+						BackingStoreType: "longhorn",
+						BackingStoreOpts: "size=1073741824",
+						Params:           map[string]string{"thin_provisioning": "1", "vendor_id": "LONGHORN"},
+					},
+					{ID: 2, BackingStore: "/var/lib/images/vol1.img"},
+				},
+				ACLs:     []iscsi.ACL{acl},
+				Accounts: []iscsi.TargetAccount{{User: "user"}, {User: "target", Outgoing: true}},
+			},
+		},
+		Accounts: []iscsi.AccountConfig{
+			{User: "user", Password: "secret-password"},
+			{User: "target", Password: "mutual-password"},
+		},
+		Portals: []iscsi.Portal{{IP: "0.0.0.0", Port: 3260}},
+	}
+}
+
+func actions(plan *iscsi.ReconcilePlan) []string {
+	result := []string{}
+	for _, op := range plan.Operations {
+		result = append(result, op.String())
+	}
+	return result
+}
+
+func (s *ReconcileSuite) TestReconcile(c *C) {
+	ctx := context.Background()
+	config := s.config(c)
+	plan, err := s.Tgtd.ReconcileContext(ctx, config)
+	c.Assert(err, IsNil)
+	c.Assert(actions(plan), DeepEquals, []string{
+		"create-account user",
+		"create-account target",
+		"create-target target 1 iqn.2019-10.io.longhorn:vol1",
+		"add-lun target 1 lun 1 /var/run/longhorn-vol1.sock",
+		"update-lun target 1 lun 1 thin_provisioning=1,vendor_id=LONGHORN",
+		"add-lun target 1 lun 2 /var/lib/images/vol1.img",
+		"bind-acl target 1 10.0.0.0/24",
+		"bind-account target 1 user",
+		"bind-account target 1 target (outgoing)",
+		"delete-portal [::]:3260",
+	})
+	c.Assert(plan.String(), Not(Matches), "(?s).*password.*")
+
+	target, err := s.Tgtd.GetTargetContext(ctx, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(1).ThinProvisioning, Equals, true)
+	c.Assert(target.LUN(2).BackingStoreType, Equals, "rdwr")
+	c.Assert(target.ACLs, DeepEquals, []string{"10.0.0.0/24"})
+	c.Assert(target.Accounts, HasLen, 2)
+
+	// Nothing to do once tgtd matches the config
+	plan, err = s.Tgtd.PlanReconcileContext(ctx, config)
+	c.Assert(err, IsNil)
+	c.Assert(plan.Operations, HasLen, 0)
+}
+
+func (s *ReconcileSuite) TestDrift(c *C) {
+	ctx := context.Background()
+	config := s.config(c)
+	_, err := s.Tgtd.ReconcileContext(ctx, config)
+	c.Assert(err, IsNil)
+
+	c.Assert(s.Tgtd.DeleteLunContext(ctx, 1, 2), IsNil)
+	c.Assert(s.Tgtd.UpdateLunContext(ctx, 1, 1, map[string]string{"thin_provisioning": "0"}), IsNil)
+	c.Assert(s.Tgtd.BindInitiatorContext(ctx, 1, "ALL"), IsNil)
+	c.Assert(s.Tgtd.UnbindAccountContext(ctx, 1, "target", true), IsNil)
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 2, "iqn.2019-10.io.longhorn:other"), IsNil)
+	config.Targets[0].LUNs[0].BackingStore = "/var/run/longhorn-vol1-new.sock"
+
+	plan, err := s.Tgtd.PlanReconcileContext(ctx, config)
+	c.Assert(err, IsNil)
+	c.Assert(actions(plan), DeepEquals, []string{
+		"delete-lun target 1 lun 1 /var/run/longhorn-vol1.sock",
+		"add-lun target 1 lun 1 /var/run/longhorn-vol1-new.sock",
+		"update-lun target 1 lun 1 thin_provisioning=1,vendor_id=LONGHORN",
+		"add-lun target 1 lun 2 /var/lib/images/vol1.img",
+		"unbind-acl target 1 ALL",
+		"bind-account target 1 target (outgoing)",
+	})
+	c.Assert(plan.Apply(), IsNil)
+
+	// Only the drifted param is updated
+	c.Assert(s.Tgtd.UpdateLunContext(ctx, 1, 1, map[string]string{"thin_provisioning": "0"}), IsNil)
+	plan, err = s.Tgtd.PlanReconcileContext(ctx, config)
+	c.Assert(err, IsNil)
+	c.Assert(actions(plan), DeepEquals, []string{"update-lun target 1 lun 1 thin_provisioning=1"})
+
+	// The target created elsewhere is only deleted with prune
+	config.Prune = true
+	plan, err = s.Tgtd.ReconcileContext(ctx, config)
+	c.Assert(err, IsNil)
+	c.Assert(actions(plan), DeepEquals, []string{
+		"delete-target target 2 iqn.2019-10.io.longhorn:other",
+		"update-lun target 1 lun 1 thin_provisioning=1",
+	})
+	c.Assert(s.Fake.TargetIDs(), DeepEquals, []int{1})
+}
+
+func (s *ReconcileSuite) TestConflict(c *C) {
+	ctx := context.Background()
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, "iqn.2019-10.io.longhorn:other"), IsNil)
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 3, "iqn.2019-10.io.longhorn:vol1"), IsNil)
+
+	config := s.config(c)
+	config.Portals = nil
+	config.Targets[0].LUNs, config.Targets[0].ACLs, config.Targets[0].Accounts = nil, nil, nil
+	plan, err := s.Tgtd.ReconcileContext(ctx, config)
+	c.Assert(err, IsNil)
+	c.Assert(actions(plan), DeepEquals, []string{
+		"create-account user",
+		"create-account target",
+		"delete-target target 1 iqn.2019-10.io.longhorn:other",
+		"delete-target target 3 iqn.2019-10.io.longhorn:vol1",
+		"create-target target 1 iqn.2019-10.io.longhorn:vol1",
+	})
+	c.Assert(s.Fake.TargetIDs(), DeepEquals, []int{1})
+
+	// An active target cannot be deleted
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 2, "iqn.2019-10.io.longhorn:vol2"), IsNil)
+	c.Assert(s.Tgtd.BindInitiatorContext(ctx, 2, "ALL"), IsNil)
+	c.Assert(s.Tgtd.AddLunBackedByFileContext(ctx, 2, 1, "/var/lib/images/vol2.img"), IsNil)
+	c.Assert(iscsi.DiscoverTarget("127.0.0.1", "iqn.2019-10.io.longhorn:vol2", s.Fake), IsNil)
+	c.Assert(iscsi.LoginTarget("127.0.0.1", "iqn.2019-10.io.longhorn:vol2", s.Fake), IsNil)
+	config.Prune = true
+	plan, err = s.Tgtd.ReconcileContext(ctx, config)
+	c.Assert(err, ErrorMatches, "(?s)failed to delete-target target 2 iqn.2019-10.io.longhorn:vol2: .*")
+	c.Assert(errors.Is(err, types.ErrTargetActive), Equals, true)
+	c.Assert(plan.Operations, HasLen, 1)
+}
+
+func (s *ReconcileSuite) TestInvalidConfig(c *C) {
+	ctx := context.Background()
+	for _, update := range []func(config *iscsi.TgtdConfig){
+		func(config *iscsi.TgtdConfig) { config.Targets[0].TID = 0 },
+		func(config *iscsi.TgtdConfig) { config.Targets[0].LUNs[1].ID = 0 },
+		func(config *iscsi.TgtdConfig) { config.Targets[0].LUNs[1].ID = 1 },
+		func(config *iscsi.TgtdConfig) { config.Targets = append(config.Targets, config.Targets[0]) },
+		func(config *iscsi.TgtdConfig) { config.Accounts = config.Accounts[:1] },
+		func(config *iscsi.TgtdConfig) {
+			config.Targets[0].Accounts = append(config.Targets[0].Accounts, iscsi.TargetAccount{User: "user", Outgoing: true})
+		},
+	} {
+		config := s.config(c)
+		update(config)
+		_, err := s.Tgtd.ReconcileContext(ctx, config)
+		c.Assert(err, NotNil)
+	}
+	c.Assert(s.Fake.TargetIDs(), HasLen, 0)
+}
@@ -0,0 +1,139 @@
+package iscsi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RedirectReason is the reason of a login redirection, which tells the
+// initiators whether to keep the new portal.
+type RedirectReason string
+
+const (
+	// RedirectTemporary makes the initiators log in to the original portal
+	// again on the next login, e.g. while the target is moved back and forth.
+	RedirectTemporary = RedirectReason("Temporary")
+	// RedirectPermanent makes the initiators replace the original portal
+	// with the new one.
+	RedirectPermanent = RedirectReason("Permanent")
+)
+
+// Redirect is a login redirection of a target to another portal.
+type Redirect struct {
+	Portal Portal
+	Reason RedirectReason
+}
+
+// SetTargetRedirect makes tgtd answer the logins to the target with a
+// redirection to the portal, so the initiators log in to the target there.
+// The existing sessions are kept, and they're redirected once they log in
+// again, e.g. after their connections are closed.
+func SetTargetRedirect(tid int, portal Portal, reason RedirectReason) error {
+	return SetTargetRedirectContext(context.Background(), tid, portal, reason)
+}
+
+// SetTargetRedirectContext is like SetTargetRedirect but takes a context.
+func SetTargetRedirectContext(ctx context.Context, tid int, portal Portal, reason RedirectReason) error {
+	return DefaultTgtd().SetTargetRedirectContext(ctx, tid, portal, reason)
+}
+
+// SetTargetRedirectContext makes tgtd answer the logins to the target with a
+// redirection to the portal, so the initiators log in to the target there.
+// The existing sessions are kept, and they're redirected once they log in
+// again, e.g. after their connections are closed.
+func (t *Tgtd) SetTargetRedirectContext(ctx context.Context, tid int, portal Portal, reason RedirectReason) error {
+	if reason != RedirectTemporary && reason != RedirectPermanent {
+		return fmt.Errorf("invalid redirect reason %v", reason)
+	}
+	if _, err := ParsePortal(portal.String()); err != nil {
+		return err
+	}
+	// The redirection is enabled by the address, so it's set at last
+	if err := t.updateTargetParam(ctx, tid, "RedirectPort", strconv.Itoa(portal.Port)); err != nil {
+		return err
+	}
+	if err := t.updateTargetParam(ctx, tid, "RedirectReason", string(reason)); err != nil {
+		return err
+	}
+	return t.updateTargetParam(ctx, tid, "RedirectAddress", portal.IP)
+}
+
+// ClearTargetRedirect stops redirecting the logins to the target.
+func ClearTargetRedirect(tid int) error {
+	return ClearTargetRedirectContext(context.Background(), tid)
+}
+
+// ClearTargetRedirectContext is like ClearTargetRedirect but takes a context.
+func ClearTargetRedirectContext(ctx context.Context, tid int) error {
+	return DefaultTgtd().ClearTargetRedirectContext(ctx, tid)
+}
+
+// ClearTargetRedirectContext stops redirecting the logins to the target.
+func (t *Tgtd) ClearTargetRedirectContext(ctx context.Context, tid int) error {
+	return t.updateTargetParam(ctx, tid, "RedirectAddress", "")
+}
+
+// GetTargetRedirect returns the login redirection of the target, or nil if
+// the logins aren't redirected.
+func GetTargetRedirect(tid int) (*Redirect, error) {
+	return GetTargetRedirectContext(context.Background(), tid)
+}
+
+// GetTargetRedirectContext is like GetTargetRedirect but takes a context.
+func GetTargetRedirectContext(ctx context.Context, tid int) (*Redirect, error) {
+	return DefaultTgtd().GetTargetRedirectContext(ctx, tid)
+}
+
+// GetTargetRedirectContext returns the login redirection of the target, or nil
+// if the logins aren't redirected.
+func (t *Tgtd) GetTargetRedirectContext(ctx context.Context, tid int) (*Redirect, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "target",
+		"--tid", strconv.Itoa(tid),
+	}
+	output, err := t.tgtadm(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseTargetRedirect(output)
+}
+
+/*
+parseTargetRedirect parses the output of `tgtadm --op show --mode target
+--tid <tid>`, which shows the redirection along with the iSCSI params of the
+target, like:
+
+	RedirectAddress=10.0.0.2
+	RedirectPort=3260
+	RedirectReason=Temporary
+	MaxRecvDataSegmentLength=8192
+	...
+*/
+func parseTargetRedirect(output string) (*Redirect, error) {
+	params := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		if key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "="); found {
+			params[key] = value
+		}
+	}
+	address := params["RedirectAddress"]
+	if address == "" {
+		return nil, nil
+	}
+	portal, err := ParsePortal(address)
+	if err != nil {
+		return nil, err
+	}
+	if port := params["RedirectPort"]; port != "" {
+		if portal.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid redirect port %v", port)
+		}
+	}
+	return &Redirect{Portal: portal, Reason: RedirectReason(params["RedirectReason"])}, nil
+}
@@ -0,0 +1,54 @@
+package iscsi_test
+
+import (
+	"context"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+
+	. "gopkg.in/check.v1"
+)
+
+type RedirectSuite struct {
+	iscsitest.Fixture
+}
+
+var _ = Suite(&RedirectSuite{})
+
+func (s *RedirectSuite) TestRedirect(c *C) {
+	ctx := context.Background()
+	name := "iqn.2019-10.io.longhorn:vol1"
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, name), IsNil)
+	c.Assert(s.Tgtd.BindInitiatorContext(ctx, 1, iscsi.ACLAll), IsNil)
+	redirect, err := s.Tgtd.GetTargetRedirectContext(ctx, 1)
+	c.Assert(err, IsNil)
+	c.Assert(redirect, IsNil)
+
+	portal, err := iscsi.ParsePortal("10.0.0.2:3261")
+	c.Assert(err, IsNil)
+	c.Assert(s.Tgtd.SetTargetRedirectContext(ctx, 1, portal, "Later"), ErrorMatches, "invalid redirect reason Later")
+	c.Assert(s.Tgtd.SetTargetRedirectContext(ctx, 1, portal, iscsi.RedirectTemporary), IsNil)
+	redirect, err = s.Tgtd.GetTargetRedirectContext(ctx, 1)
+	c.Assert(err, IsNil)
+	c.Assert(*redirect, Equals, iscsi.Redirect{Portal: portal, Reason: iscsi.RedirectTemporary})
+
+	// The logins are redirected
+	c.Assert(iscsi.DiscoverTarget("127.0.0.1", name, s.Fake), IsNil)
+	c.Assert(iscsi.LoginTarget("127.0.0.1", name, s.Fake), ErrorMatches, "(?s).*target moved to 10.0.0.2:3261.*")
+
+	portal, err = iscsi.ParsePortal("[fd00::2]")
+	c.Assert(err, IsNil)
+	c.Assert(s.Tgtd.SetTargetRedirectContext(ctx, 1, portal, iscsi.RedirectPermanent), IsNil)
+	redirect, err = s.Tgtd.GetTargetRedirectContext(ctx, 1)
+	c.Assert(err, IsNil)
+	c.Assert(*redirect, Equals, iscsi.Redirect{Portal: iscsi.Portal{IP: "fd00::2", Port: 3260}, Reason: iscsi.RedirectPermanent})
+
+	c.Assert(s.Tgtd.ClearTargetRedirectContext(ctx, 1), IsNil)
+	redirect, err = s.Tgtd.GetTargetRedirectContext(ctx, 1)
+	c.Assert(err, IsNil)
+	c.Assert(redirect, IsNil)
+	c.Assert(iscsi.LoginTarget("127.0.0.1", name, s.Fake), IsNil)
+
+	_, err = s.Tgtd.GetTargetRedirectContext(ctx, 2)
+	c.Assert(err, NotNil)
+}
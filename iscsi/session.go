@@ -0,0 +1,198 @@
+package iscsi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/types"
+)
+
+// Session is a session of an initiator logged in to a target.
+type Session struct {
+	ID int
+	// ITNexusID is the ID of the I_T nexus of the session, which is shown by
+	// `tgtadm --op show --mode target`.
+	ITNexusID      int
+	Initiator      string
+	InitiatorAlias string
+	Connections    []Connection
+}
+
+// Connection is a connection of a session.
+type Connection struct {
+	ID int
+	// IPAddress is the address of the initiator shown by tgtd, which doesn't
+	// show its port.
+	IPAddress string
+	// Params are the negotiated params of the connection, e.g.
+	// MaxRecvDataSegmentLength.
+	Params map[string]string
+}
+
+// GetSessions returns the sessions of the target. tgtd only shows the params of
+// one connection at a time, so it takes a tgtadm request per connection besides
+// the ones for the sessions and the targets.
+func GetSessions(tid int) ([]Session, error) {
+	return GetSessionsContext(context.Background(), tid)
+}
+
+// GetSessionsContext is like GetSessions but takes a context.
+func GetSessionsContext(ctx context.Context, tid int) ([]Session, error) {
+	return DefaultTgtd().GetSessionsContext(ctx, tid)
+}
+
+// GetSessionsContext returns the sessions of the target. tgtd only shows the
+// params of one connection at a time, so it takes a tgtadm request per
+// connection besides the ones for the sessions and the targets.
+func (t *Tgtd) GetSessionsContext(ctx context.Context, tid int) ([]Session, error) {
+	sessions, err := t.listSessions(ctx, tid)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return sessions, nil
+	}
+
+	targets, err := t.ListTargetsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nexuses := map[int]ITNexus{}
+	for _, target := range targets {
+		if target.TID == tid {
+			for _, nexus := range target.Nexuses {
+				nexuses[nexus.ID] = nexus
+			}
+		}
+	}
+
+	for i := range sessions {
+		session := &sessions[i]
+		// tgtd uses the session ID as the I_T nexus ID
+		if nexus, exists := nexuses[session.ID]; exists {
+			session.ITNexusID = nexus.ID
+			session.InitiatorAlias = nexus.InitiatorAlias
+		}
+		for j := range session.Connections {
+			connection := &session.Connections[j]
+			if connection.Params, err = t.getConnectionParams(ctx, tid, session.ID, connection.ID); err != nil {
+				// The session can be gone since it's listed
+				if errors.Is(err, types.ErrNoSession) || errors.Is(err, types.ErrNoConnection) {
+					continue
+				}
+				return nil, errors.Wrapf(err, "failed to get params of connection %v:%v of target %v", session.ID, connection.ID, tid)
+			}
+		}
+	}
+	return sessions, nil
+}
+
+// listSessions returns the sessions of the target with only what `tgtadm --op
+// show --mode conn` shows, e.g. to close their connections.
+func (t *Tgtd) listSessions(ctx context.Context, tid int) ([]Session, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "conn",
+		"--tid", strconv.Itoa(tid),
+	}
+	output, err := t.tgtadm(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseSessions(output)
+}
+
+/*
+parseSessions parses the output of `tgtadm --op show --mode conn`, which looks
+like:
+
+	Session: 11
+	    Connection: 0
+	        Initiator: iqn.2016-08.com.example:a
+	        IP Address: 192.168.0.1
+*/
+func parseSessions(output string) ([]Session, error) {
+	sessions := []Session{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		key, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Session":
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse session from line %v", line)
+			}
+			sessions = append(sessions, Session{ID: id})
+		case "Connection":
+			if len(sessions) == 0 {
+				return nil, fmt.Errorf("invalid output format, found connection without session: %v", line)
+			}
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse connection from line %v", line)
+			}
+			session := &sessions[len(sessions)-1]
+			session.Connections = append(session.Connections, Connection{ID: id})
+		case "Initiator", "IP Address":
+			if len(sessions) == 0 || len(sessions[len(sessions)-1].Connections) == 0 {
+				return nil, fmt.Errorf("invalid output format, found %v without connection: %v", key, line)
+			}
+			session := &sessions[len(sessions)-1]
+			if key == "Initiator" {
+				session.Initiator = value
+			} else {
+				session.Connections[len(session.Connections)-1].IPAddress = value
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to parse sessions")
+	}
+	return sessions, nil
+}
+
+// getConnectionParams returns the negotiated params of the connection, which
+// are shown as key=value lines.
+func (t *Tgtd) getConnectionParams(ctx context.Context, tid, sid, cid int) (map[string]string, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "conn",
+		"--tid", strconv.Itoa(tid),
+		"--sid", strconv.Itoa(sid),
+		"--cid", strconv.Itoa(cid),
+	}
+	output, err := t.tgtadm(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	params := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		if key, value, found := strings.Cut(strings.TrimSpace(line), "="); found {
+			params[key] = value
+		}
+	}
+	return params, nil
+}
+
+// normalizeIP returns the IPv4 addresses mapped to IPv6 as IPv4, since tgtd
+// shows the addresses of the IPv4 initiators on the IPv6 portals that way.
+func normalizeIP(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,114 @@
+package iscsi_test
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+
+	. "gopkg.in/check.v1"
+)
+
+type SessionSuite struct {
+	iscsitest.Fixture
+}
+
+var _ = Suite(&SessionSuite{})
+
+func (s *SessionSuite) login(c *C, portal, name string) {
+	c.Assert(iscsi.DiscoverTarget(portal, name, s.Fake), IsNil)
+	c.Assert(iscsi.LoginTarget(portal, name, s.Fake), IsNil)
+}
+
+func (s *SessionSuite) TestGetSessions(c *C) {
+	ctx := context.Background()
+	name := "iqn.2019-10.io.longhorn:vol1"
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, name), IsNil)
+	c.Assert(s.Tgtd.BindInitiatorContext(ctx, 1, "ALL"), IsNil)
+
+	sessions, err := s.Tgtd.GetSessionsContext(ctx, 1)
+	c.Assert(err, IsNil)
+	c.Assert(sessions, HasLen, 0)
+
+	s.login(c, "127.0.0.1", name)
+	s.login(c, "127.0.0.2", name)
+	sessions, err = s.Tgtd.GetSessionsContext(ctx, 1)
+	c.Assert(err, IsNil)
+	c.Assert(sessions, HasLen, 2)
+	target, err := s.Tgtd.GetTargetContext(ctx, name)
+	c.Assert(err, IsNil)
+	c.Assert(target.Nexuses, HasLen, 2)
+	for i, session := range sessions {
+		c.Assert(session.ITNexusID, Equals, target.Nexuses[i].ID)
+		c.Assert(session.Initiator, Equals, iscsitest.DefaultInitiatorName)
+		c.Assert(session.InitiatorAlias, Equals, "iscsitest")
+		c.Assert(session.Connections, HasLen, 1)
+		c.Assert(session.Connections[0].Params["HeaderDigest"], Equals, "None")
+		c.Assert(session.Connections[0].Params["MaxRecvDataSegmentLength"], Equals, "262144")
+	}
+	c.Assert(sessions[0].Connections[0].IPAddress, Equals, "127.0.0.1")
+	c.Assert(sessions[1].Connections[0].IPAddress, Equals, "127.0.0.2")
+
+	// The connections are parsed from the same output
+	connections, err := s.Tgtd.GetTargetConnectionsContext(ctx, 1)
+	c.Assert(err, IsNil)
+	c.Assert(connections, DeepEquals, map[string][]string{
+		strconv.Itoa(sessions[0].ID): {strconv.Itoa(sessions[0].Connections[0].ID)},
+		strconv.Itoa(sessions[1].ID): {strconv.Itoa(sessions[1].Connections[0].ID)},
+	})
+
+	_, err = s.Tgtd.GetSessionsContext(ctx, 2)
+	c.Assert(err, NotNil)
+}
+
+func (s *SessionSuite) TestEvictInitiator(c *C) {
+	ctx := context.Background()
+	name := "iqn.2019-10.io.longhorn:vol1"
+	hostA, hostB := "iqn.1993-08.org.debian:01:host-a", "iqn.1993-08.org.debian:01:host-b"
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, name), IsNil)
+	c.Assert(s.Tgtd.BindInitiatorContext(ctx, 1, iscsi.ACLAll), IsNil)
+	c.Assert(s.Tgtd.BindInitiatorNameContext(ctx, 1, hostA), IsNil)
+	c.Assert(s.Tgtd.BindInitiatorNameContext(ctx, 1, hostB), IsNil)
+	s.Fake.InitiatorName = hostA
+	s.login(c, "127.0.0.1", name)
+	s.Fake.InitiatorName = hostB
+	s.login(c, "127.0.0.2", name)
+
+	// The address cannot be fenced with ACLAll, and nothing is changed
+	_, err := s.Tgtd.EvictInitiatorContext(ctx, 1, "127.0.0.2", true)
+	c.Assert(err, ErrorMatches, "cannot fence initiator 127.0.0.2 of target 1: it's allowed by ACL ALL")
+	sessions, err := s.Tgtd.GetSessionsContext(ctx, 1)
+	c.Assert(err, IsNil)
+	c.Assert(sessions, HasLen, 2)
+
+	evicted, err := s.Tgtd.EvictInitiatorContext(ctx, 1, hostB, true)
+	c.Assert(err, IsNil)
+	c.Assert(evicted, HasLen, 1)
+	c.Assert(evicted[0].Initiator, Equals, hostB)
+	sessions, err = s.Tgtd.GetSessionsContext(ctx, 1)
+	c.Assert(err, IsNil)
+	c.Assert(sessions, HasLen, 1)
+	c.Assert(sessions[0].Initiator, Equals, hostA)
+	acls, err := s.Tgtd.ListACLsContext(ctx, 1)
+	c.Assert(err, IsNil)
+	c.Assert(acls, DeepEquals, []iscsi.ACL{{Type: iscsi.ACLTypeAddress, Value: iscsi.ACLAll}, {Type: iscsi.ACLTypeName, Value: hostA}})
+	c.Assert(iscsi.LoginTarget("127.0.0.2", name, s.Fake), NotNil)
+
+	// Unbinding the last name ACL would allow all names
+	_, err = s.Tgtd.EvictInitiatorContext(ctx, 1, hostA, true)
+	c.Assert(err, ErrorMatches, ".*all names are allowed without other name ACLs")
+
+	// Evicting without unbinding the ACL, and evicting again is a no-op
+	evicted, err = s.Tgtd.EvictInitiatorContext(ctx, 1, "127.0.0.1", false)
+	c.Assert(err, IsNil)
+	c.Assert(evicted, HasLen, 1)
+	c.Assert(evicted[0].Initiator, Equals, hostA)
+	evicted, err = s.Tgtd.EvictInitiatorContext(ctx, 1, "127.0.0.1", false)
+	c.Assert(err, IsNil)
+	c.Assert(evicted, HasLen, 0)
+	c.Assert(s.Fake.Sessions(), HasLen, 0)
+
+	_, err = s.Tgtd.EvictInitiatorContext(ctx, 1, "10.0.0.0/8", false)
+	c.Assert(err, NotNil)
+}
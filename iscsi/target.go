@@ -1,7 +1,7 @@
 package iscsi
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -13,27 +13,49 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/sirupsen/logrus"
 
-	lhexec "github.com/longhorn/go-common-libs/exec"
-	lhtypes "github.com/longhorn/go-common-libs/types"
+	"github.com/longhorn/go-iscsi-helper/util"
 )
 
+// ModePageWriteCacheDisabled is the mode_page param of the caching mode page
+// with the write cache disabled.
+const ModePageWriteCacheDisabled = "8:0:18:0x10:0:0xff:0xff:0:0:0xff:0xff:0xff:0xff:0x80:0x14:0:0:0:0:0:0"
+
 var (
 	TgtdRetryCounts   = 5
 	TgtdRetryInterval = 1 * time.Second
 )
 
+const (
+	// TargetStateReady is the state of a target serving the initiators
+	TargetStateReady = "ready"
+	// TargetStateOffline is the state of a target whose commands are held
+	// off by tgtd. The connected initiators retry the commands until their
+	// SCSI timeout, and the new logins are rejected.
+	TargetStateOffline = "offline"
+)
+
 const (
 	tgtBinary = "tgtadm"
 
 	maxTargetID = 4095
-
-	logFile = "/var/log/tgtd.log"
 )
 
 // CreateTarget will create a iSCSI target using the name specified. If name is
 // unspecified, a name will be generated. Notice the name must comply with iSCSI
 // name format.
 func CreateTarget(tid int, name string) error {
+	return CreateTargetContext(context.Background(), tid, name)
+}
+
+// CreateTargetContext is like CreateTarget but takes a context.
+func CreateTargetContext(ctx context.Context, tid int, name string) error {
+	return DefaultTgtd().CreateTargetContext(ctx, tid, name)
+}
+
+// CreateTargetContext will create a iSCSI target using the name specified. If
+// name is unspecified, a name will be generated. Notice the name must comply
+// with iSCSI name format.
+func (t *Tgtd) CreateTargetContext(ctx context.Context, tid int, name string) error {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "new",
@@ -41,25 +63,81 @@ func CreateTarget(tid int, name string) error {
 		"--tid", strconv.Itoa(tid),
 		"-T", name,
 	}
-	_, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	_, err := t.tgtadm(ctx, opts)
 	return err
 }
 
 // DeleteTarget will remove a iSCSI target specified by tid
 func DeleteTarget(tid int) error {
+	return DeleteTargetContext(context.Background(), tid)
+}
+
+// DeleteTargetContext is like DeleteTarget but takes a context.
+func DeleteTargetContext(ctx context.Context, tid int) error {
+	return DefaultTgtd().DeleteTargetContext(ctx, tid)
+}
+
+// DeleteTargetContext will remove a iSCSI target specified by tid
+func (t *Tgtd) DeleteTargetContext(ctx context.Context, tid int) error {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "delete",
 		"--mode", "target",
 		"--tid", strconv.Itoa(tid),
 	}
-	_, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	_, err := t.tgtadm(ctx, opts)
+	return err
+}
+
+// SetTargetState will set the state of the target to TargetStateReady or
+// TargetStateOffline.
+func SetTargetState(tid int, state string) error {
+	return SetTargetStateContext(context.Background(), tid, state)
+}
+
+// SetTargetStateContext is like SetTargetState but takes a context.
+func SetTargetStateContext(ctx context.Context, tid int, state string) error {
+	return DefaultTgtd().SetTargetStateContext(ctx, tid, state)
+}
+
+// SetTargetStateContext will set the state of the target to TargetStateReady or
+// TargetStateOffline.
+func (t *Tgtd) SetTargetStateContext(ctx context.Context, tid int, state string) error {
+	if state != TargetStateReady && state != TargetStateOffline {
+		return fmt.Errorf("invalid target state %v", state)
+	}
+	return t.updateTargetParam(ctx, tid, "state", state)
+}
+
+// updateTargetParam updates the param of the target, e.g. the state or the
+// iSCSI params.
+func (t *Tgtd) updateTargetParam(ctx context.Context, tid int, name, value string) error {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "update",
+		"--mode", "target",
+		"--tid", strconv.Itoa(tid),
+		"--name", name,
+		"--value", value,
+	}
+	_, err := t.tgtadm(ctx, opts)
 	return err
 }
 
 // AddLunBackedByFile will add a LUN in an existing target, which backing by
 // specified file.
 func AddLunBackedByFile(tid int, lun int, backingFile string) error {
+	return AddLunBackedByFileContext(context.Background(), tid, lun, backingFile)
+}
+
+// AddLunBackedByFileContext is like AddLunBackedByFile but takes a context.
+func AddLunBackedByFileContext(ctx context.Context, tid int, lun int, backingFile string) error {
+	return DefaultTgtd().AddLunBackedByFileContext(ctx, tid, lun, backingFile)
+}
+
+// AddLunBackedByFileContext will add a LUN in an existing target, which backing
+// by specified file.
+func (t *Tgtd) AddLunBackedByFileContext(ctx context.Context, tid int, lun int, backingFile string) error {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "new",
@@ -68,15 +146,76 @@ func AddLunBackedByFile(tid int, lun int, backingFile string) error {
 		"--lun", strconv.Itoa(lun),
 		"-b", backingFile,
 	}
-	_, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	_, err := t.tgtadm(ctx, opts)
 	return err
 }
 
 // AddLun will add a LUN in an existing target, which backing by
 // specified file, using AIO backing-store
 func AddLun(tid int, lun int, backingFile string, bstype string, bsopts string) error {
-	if !CheckTargetForBackingStore(bstype) {
-		return fmt.Errorf("backing-store %s is not supported", bstype)
+	return AddLunContext(context.Background(), tid, lun, backingFile, bstype, bsopts)
+}
+
+// AddLunContext is like AddLun but takes a context.
+func AddLunContext(ctx context.Context, tid int, lun int, backingFile string, bstype string, bsopts string) error {
+	return DefaultTgtd().AddLunContext(ctx, tid, lun, backingFile, bstype, bsopts)
+}
+
+// AddLunContext will add a LUN in an existing target, which backing by
+// specified file, using AIO backing-store
+func (t *Tgtd) AddLunContext(ctx context.Context, tid int, lun int, backingFile string, bstype string, bsopts string) error {
+	return t.AddLunWithDeviceTypeContext(ctx, tid, lun, backingFile, bstype, bsopts, DeviceTypeDisk)
+}
+
+// AddLunWithDeviceType is like AddLun but creates a LUN of the device type,
+// e.g. a CD-ROM backed by an ISO image with backing-store rdwr.
+func AddLunWithDeviceType(tid int, lun int, backingFile string, bstype string, bsopts string, deviceType DeviceType) error {
+	return AddLunWithDeviceTypeContext(context.Background(), tid, lun, backingFile, bstype, bsopts, deviceType)
+}
+
+// AddLunWithDeviceTypeContext is like AddLunWithDeviceType but takes a context.
+// The bsopts are passed to tgtd as they are, e.g. the conf of rbd, see
+// AddLunWithBackingStore for the validated options.
+func AddLunWithDeviceTypeContext(ctx context.Context, tid int, lun int, backingFile string, bstype string, bsopts string, deviceType DeviceType) error {
+	return DefaultTgtd().AddLunWithDeviceTypeContext(ctx, tid, lun, backingFile, bstype, bsopts, deviceType)
+}
+
+// AddLunWithDeviceTypeContext is like AddLun but creates a LUN of the device
+// type, e.g. a CD-ROM backed by an ISO image with backing-store rdwr.
+func (t *Tgtd) AddLunWithDeviceTypeContext(ctx context.Context, tid int, lun int, backingFile string, bstype string, bsopts string, deviceType DeviceType) error {
+	return t.addLun(ctx, tid, lun, backingFile, bstype, bsopts, "", deviceType)
+}
+
+// AddLunWithBackingStore is like AddLunWithDeviceType but takes the backing
+// store options, including the flags to open the backing file with. The
+// options are validated before tgtd is asked.
+func AddLunWithBackingStore(tid int, lun int, backingFile string, options *BackingStoreOptions, deviceType DeviceType) error {
+	return AddLunWithBackingStoreContext(context.Background(), tid, lun, backingFile, options, deviceType)
+}
+
+// AddLunWithBackingStoreContext is like AddLunWithBackingStore but takes a
+// context.
+func AddLunWithBackingStoreContext(ctx context.Context, tid int, lun int, backingFile string, options *BackingStoreOptions, deviceType DeviceType) error {
+	return DefaultTgtd().AddLunWithBackingStoreContext(ctx, tid, lun, backingFile, options, deviceType)
+}
+
+// AddLunWithBackingStoreContext is like AddLunWithDeviceType but takes the
+// backing store options, including the flags to open the backing file with. The
+// options are validated before tgtd is asked.
+func (t *Tgtd) AddLunWithBackingStoreContext(ctx context.Context, tid int, lun int, backingFile string, options *BackingStoreOptions, deviceType DeviceType) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	return t.addLun(ctx, tid, lun, backingFile, options.Type, options.String(), options.FlagsString(), deviceType)
+}
+
+func (t *Tgtd) addLun(ctx context.Context, tid int, lun int, backingFile, bstype, bsopts, bsoflags string, deviceType DeviceType) error {
+	info, err := t.capabilities(ctx)
+	if err != nil {
+		return err
+	}
+	if err := info.CheckLun(bstype, deviceType); err != nil {
+		return err
 	}
 	opts := []string{
 		"--lld", "iscsi",
@@ -90,12 +229,29 @@ func AddLun(tid int, lun int, backingFile string, bstype string, bsopts string)
 	if bsopts != "" {
 		opts = append(opts, "--bsopts", bsopts)
 	}
-	_, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	if bsoflags != "" {
+		opts = append(opts, "--bsoflags", bsoflags)
+	}
+	// disk is the default of tgtd
+	if deviceType != DeviceTypeDisk {
+		opts = append(opts, "--device-type", string(deviceType))
+	}
+	_, err = t.tgtadm(ctx, opts)
 	return err
 }
 
 // UpdateLun will update parameters for the LUN
 func UpdateLun(tid int, lun int, params map[string]string) error {
+	return UpdateLunContext(context.Background(), tid, lun, params)
+}
+
+// UpdateLunContext is like UpdateLun but takes a context.
+func UpdateLunContext(ctx context.Context, tid int, lun int, params map[string]string) error {
+	return DefaultTgtd().UpdateLunContext(ctx, tid, lun, params)
+}
+
+// UpdateLunContext will update parameters for the LUN
+func (t *Tgtd) UpdateLunContext(ctx context.Context, tid int, lun int, params map[string]string) error {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "update",
@@ -110,216 +266,327 @@ func UpdateLun(tid int, lun int, params map[string]string) error {
 		}
 		opts = append(opts, "--params", strings.TrimSuffix(paramStr, ","))
 	}
-	_, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	_, err := t.tgtadm(ctx, opts)
 	return err
 }
 
 // SetLunThinProvisioning will set param thin_provisioning to true for the LUN
 func SetLunThinProvisioning(tid int, lun int) error {
-	return UpdateLun(tid, lun, map[string]string{"thin_provisioning": "1"})
+	return SetLunThinProvisioningContext(context.Background(), tid, lun)
+}
+
+// SetLunThinProvisioningContext is like SetLunThinProvisioning but takes a context.
+func SetLunThinProvisioningContext(ctx context.Context, tid int, lun int) error {
+	return DefaultTgtd().SetLunThinProvisioningContext(ctx, tid, lun)
+}
+
+// SetLunThinProvisioningContext will set param thin_provisioning to true for
+// the LUN
+func (t *Tgtd) SetLunThinProvisioningContext(ctx context.Context, tid int, lun int) error {
+	return t.UpdateLunContext(ctx, tid, lun, map[string]string{"thin_provisioning": "1"})
+}
+
+// SetLunOnline will set param online of the LUN. tgtd fails the commands to
+// an offline LUN as not ready, so use the target state to hold off the I/O
+// without failing it.
+func SetLunOnline(tid int, lun int, online bool) error {
+	return SetLunOnlineContext(context.Background(), tid, lun, online)
+}
+
+// SetLunOnlineContext is like SetLunOnline but takes a context.
+func SetLunOnlineContext(ctx context.Context, tid int, lun int, online bool) error {
+	return DefaultTgtd().SetLunOnlineContext(ctx, tid, lun, online)
+}
+
+// SetLunOnlineContext will set param online of the LUN. tgtd fails the commands
+// to an offline LUN as not ready, so use the target state to hold off the I/O
+// without failing it.
+func (t *Tgtd) SetLunOnlineContext(ctx context.Context, tid int, lun int, online bool) error {
+	value := "0"
+	if online {
+		value = "1"
+	}
+	return t.UpdateLunContext(ctx, tid, lun, map[string]string{"online": value})
+}
+
+// SetLunReadOnly will set param readonly to true for the LUN, so the LUN is
+// write-protected and the writes from the initiators are rejected
+func SetLunReadOnly(tid int, lun int) error {
+	return SetLunReadOnlyContext(context.Background(), tid, lun)
+}
+
+// SetLunReadOnlyContext is like SetLunReadOnly but takes a context.
+func SetLunReadOnlyContext(ctx context.Context, tid int, lun int) error {
+	return DefaultTgtd().SetLunReadOnlyContext(ctx, tid, lun)
+}
+
+// SetLunReadOnlyContext will set param readonly to true for the LUN, so the LUN
+// is write-protected and the writes from the initiators are rejected
+func (t *Tgtd) SetLunReadOnlyContext(ctx context.Context, tid int, lun int) error {
+	return t.UpdateLunContext(ctx, tid, lun, map[string]string{"readonly": "1"})
 }
 
 // DisableWriteCache will set param write-cache to false for the LUN
 func DisableWriteCache(tid int, lun int) error {
+	return DisableWriteCacheContext(context.Background(), tid, lun)
+}
+
+// DisableWriteCacheContext is like DisableWriteCache but takes a context.
+func DisableWriteCacheContext(ctx context.Context, tid int, lun int) error {
+	return DefaultTgtd().DisableWriteCacheContext(ctx, tid, lun)
+}
+
+// DisableWriteCacheContext will set param write-cache to false for the LUN
+func (t *Tgtd) DisableWriteCacheContext(ctx context.Context, tid int, lun int) error {
 	// Mode page 8 is the caching mode page
 	// Refer to "Caching Mode page (08h)" in SCSI Commands Reference Manual for more information.
 	// https://www.seagate.com/files/staticfiles/support/docs/manual/Interface%20manuals/100293068j.pdf
 	// https://github.com/fujita/tgt/blob/master/scripts/tgt-admin#L418
-	return UpdateLun(tid, lun, map[string]string{"mode_page": "8:0:18:0x10:0:0xff:0xff:0:0:0xff:0xff:0xff:0xff:0x80:0x14:0:0:0:0:0:0"})
+	return t.UpdateLunContext(ctx, tid, lun, map[string]string{"mode_page": ModePageWriteCacheDisabled})
 }
 
 // DeleteLun will remove a LUN from an target
 func DeleteLun(tid int, lun int) error {
-	opts := []string{
-		"--lld", "iscsi",
-		"--op", "delete",
-		"--mode", "logicalunit",
-		"--tid", strconv.Itoa(tid),
-		"--lun", strconv.Itoa(lun),
-	}
-	_, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
-	return err
+	return DeleteLunContext(context.Background(), tid, lun)
+}
+
+// DeleteLunContext is like DeleteLun but takes a context.
+func DeleteLunContext(ctx context.Context, tid int, lun int) error {
+	return DefaultTgtd().DeleteLunContext(ctx, tid, lun)
 }
 
-// ExpandLun will update the size for the LUN.
-// This is valid only for the customized tgt https://github.com/rancher/tgt/
-func ExpandLun(tid, lun int, size int64) error {
+// DeleteLunContext will remove a LUN from an target
+func (t *Tgtd) DeleteLunContext(ctx context.Context, tid int, lun int) error {
 	opts := []string{
 		"--lld", "iscsi",
-		"--op", "update",
+		"--op", "delete",
 		"--mode", "logicalunit",
 		"--tid", strconv.Itoa(tid),
 		"--lun", strconv.Itoa(lun),
-		"--params", fmt.Sprintf("bsopts=size=%d", size),
 	}
-	_, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	_, err := t.tgtadm(ctx, opts)
 	return err
 }
 
 // BindInitiator will add permission to allow certain initiator(s) to connect to
 // certain target. "ALL" is a special initiator which is the wildcard
 func BindInitiator(tid int, initiator string) error {
-	opts := []string{
-		"--lld", "iscsi",
-		"--op", "bind",
-		"--mode", "target",
-		"--tid", strconv.Itoa(tid),
-		"-I", initiator,
+	return BindInitiatorContext(context.Background(), tid, initiator)
+}
+
+// BindInitiatorContext is like BindInitiator but takes a context.
+func BindInitiatorContext(ctx context.Context, tid int, initiator string) error {
+	return DefaultTgtd().BindInitiatorContext(ctx, tid, initiator)
+}
+
+// BindInitiatorContext will add permission to allow certain initiator(s) to
+// connect to certain target. "ALL" is a special initiator which is the wildcard
+func (t *Tgtd) BindInitiatorContext(ctx context.Context, tid int, initiator string) error {
+	acl, err := NewAddressACL(initiator)
+	if err != nil {
+		return err
 	}
-	_, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
-	return err
+	return t.BindACLContext(ctx, tid, acl)
 }
 
 // UnbindInitiator will remove permission to allow certain initiator(s) to connect to
 // certain target.
 func UnbindInitiator(tid int, initiator string) error {
-	opts := []string{
-		"--lld", "iscsi",
-		"--op", "unbind",
-		"--mode", "target",
-		"--tid", strconv.Itoa(tid),
-		"-I", initiator,
+	return UnbindInitiatorContext(context.Background(), tid, initiator)
+}
+
+// UnbindInitiatorContext is like UnbindInitiator but takes a context.
+func UnbindInitiatorContext(ctx context.Context, tid int, initiator string) error {
+	return DefaultTgtd().UnbindInitiatorContext(ctx, tid, initiator)
+}
+
+// UnbindInitiatorContext will remove permission to allow certain initiator(s)
+// to connect to certain target.
+func (t *Tgtd) UnbindInitiatorContext(ctx context.Context, tid int, initiator string) error {
+	acl, err := NewAddressACL(initiator)
+	if err != nil {
+		return err
 	}
-	_, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
-	return err
+	return t.UnbindACLContext(ctx, tid, acl)
+}
+
+// StartDaemon will start tgtd daemon, prepare for further commands. tgtd
+// listens on the portals if specified, otherwise on all addresses with the
+// default port. It returns an error if tgtd exits before it's ready, while the
+// later exits are only logged, use TgtdSupervisor to restart tgtd and be
+// notified of the exits instead. If a TgtdSupervisor supervises the instance,
+// it only waits for tgtd to be ready.
+func StartDaemon(debug bool, portals ...Portal) error {
+	return StartDaemonContext(context.Background(), debug, portals...)
+}
+
+// StartDaemonContext is like StartDaemon but takes a context.
+func StartDaemonContext(ctx context.Context, debug bool, portals ...Portal) error {
+	instance := DefaultTgtd()
+	if len(portals) != 0 {
+		instance.Portals = portals
+	}
+	return instance.StartDaemonContext(ctx, debug)
 }
 
-// StartDaemon will start tgtd daemon, prepare for further commands
-func StartDaemon(debug bool) error {
-	if CheckTargetForBackingStore("rdwr") {
+// StartDaemonContext starts the instance like the package level StartDaemon.
+// Cancelling the context stops waiting for tgtd, but doesn't stop tgtd
+// itself.
+func (t *Tgtd) StartDaemonContext(ctx context.Context, debug bool) error {
+	if supervised(t.ControlPort) {
+		// The supervisor launches and restarts tgtd, so a second one would
+		// only fight over the control port
+		return t.waitTgtdReady(ctx, nil)
+	}
+	if ProbeTgtdLiveness(ctx, t) == nil {
 		fmt.Fprintf(os.Stderr, "go-iscsi-helper: tgtd is already running\n")
 		return nil
 	}
 
-	logf, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	exited, err := t.startDaemon(debug)
 	if err != nil {
 		return err
 	}
-	go startDaemon(logf, debug)
+	return t.waitTgtdReady(ctx, exited)
+}
 
-	// Wait until daemon is up
-	daemonIsRunning := false
+// waitTgtdReady waits until tgtd is ready. exited receives the exit of the
+// launched tgtd if any, which is fine if another tgtd serves the instance.
+func (t *Tgtd) waitTgtdReady(ctx context.Context, exited <-chan error) error {
 	for i := 0; i < TgtdRetryCounts; i++ {
-		if CheckTargetForBackingStore("rdwr") {
-			daemonIsRunning = true
-			break
+		if ProbeTgtdReadiness(ctx, t) == nil {
+			return nil
+		}
+		select {
+		case err := <-exited:
+			if ProbeTgtdLiveness(ctx, t) == nil {
+				fmt.Fprintf(os.Stderr, "go-iscsi-helper: tgtd is already running\n")
+				return nil
+			}
+			if err == nil {
+				err = errors.New("tgtd exited")
+			}
+			return errors.Wrap(err, "failed to start tgtd daemon")
+		default:
+		}
+		if err := util.SleepContext(ctx, TgtdRetryInterval); err != nil {
+			return errors.Wrap(err, "failed to wait for tgtd daemon")
 		}
-		time.Sleep(TgtdRetryInterval)
-	}
-	if !daemonIsRunning {
-		return fmt.Errorf("failed to start tgtd daemon")
 	}
-	return nil
+	return fmt.Errorf("failed to start tgtd daemon")
 }
 
-func startDaemon(logf *os.File, debug bool) {
-	defer func() {
+// startDaemon launches tgtd, and returns the channel receiving its exit.
+func (t *Tgtd) startDaemon(debug bool) (<-chan error, error) {
+	var (
+		mw   io.Writer = os.Stderr
+		logf *os.File
+		err  error
+	)
+	if t.LogFile != "" {
+		logf, err = os.OpenFile(t.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		mw = io.MultiWriter(os.Stderr, logf)
+	}
+	closeLog := func() {
+		if logf == nil {
+			return
+		}
 		if errClose := logf.Close(); errClose != nil {
 			logrus.WithError(errClose).Error("Failed to close log file")
 		}
-	}()
-
-	opts := []string{
-		"-f",
 	}
-	if debug {
-		opts = append(opts, "-d", "1")
-	}
-	cmd := exec.Command("tgtd", opts...)
-	mw := io.MultiWriter(os.Stderr, logf)
+
+	options := t.Options()
+	options.Debug = debug
+	cmd := exec.Command(tgtdBinary, options.args()...)
 	cmd.Stdout = mw
 	cmd.Stderr = mw
-	if err := cmd.Run(); err != nil {
-		if CheckTargetForBackingStore("rdwr") {
-			_, _ = fmt.Fprintf(mw, "go-iscsi-helper: tgtd is already running\n")
-			return
-		}
-		_, _ = fmt.Fprintf(mw, "go-iscsi-helper: command failed: %v\n", err)
-		panic(err)
+	if err := cmd.Start(); err != nil {
+		closeLog()
+		return nil, errors.Wrapf(err, "failed to launch %v", tgtdBinary)
 	}
-	_, _ = fmt.Fprintln(mw, "go-iscsi-helper: done")
+	forgetCapabilities(t.ControlPort)
+
+	exited := make(chan error, 1)
+	go func() {
+		defer closeLog()
+		err := cmd.Wait()
+		if err != nil {
+			_, _ = fmt.Fprintf(mw, "go-iscsi-helper: command failed: %v\n", err)
+		} else {
+			_, _ = fmt.Fprintln(mw, "go-iscsi-helper: done")
+		}
+		exited <- err
+	}()
+	return exited, nil
 }
 
+// CheckTargetForBackingStore returns if tgtd is running and supports the
+// backing store.
 func CheckTargetForBackingStore(name string) bool {
-	opts := []string{
-		"--lld", "iscsi",
-		"--op", "show",
-		"--mode", "system",
-	}
-	output, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	return CheckTargetForBackingStoreContext(context.Background(), name)
+}
+
+// CheckTargetForBackingStoreContext is like CheckTargetForBackingStore but takes a context.
+func CheckTargetForBackingStoreContext(ctx context.Context, name string) bool {
+	return DefaultTgtd().CheckTargetForBackingStoreContext(ctx, name)
+}
+
+// CheckTargetForBackingStoreContext returns if tgtd is running and supports the
+// backing store.
+func (t *Tgtd) CheckTargetForBackingStoreContext(ctx context.Context, name string) bool {
+	info, err := t.showSystem(ctx)
 	if err != nil {
 		return false
 	}
-	return strings.Contains(output, " "+name)
+	return info.HasBackingStore(name)
 }
 
 // GetTargetTid If returned TID is -1, then target doesn't exist, but we won't
 // return error
 func GetTargetTid(name string) (int, error) {
-	opts := []string{
-		"--lld", "iscsi",
-		"--op", "show",
-		"--mode", "target",
-	}
-	output, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	return GetTargetTidContext(context.Background(), name)
+}
+
+// GetTargetTidContext is like GetTargetTid but takes a context.
+func GetTargetTidContext(ctx context.Context, name string) (int, error) {
+	return DefaultTgtd().GetTargetTidContext(ctx, name)
+}
+
+// GetTargetTidContext If returned TID is -1, then target doesn't exist, but we
+// won't return error
+func (t *Tgtd) GetTargetTidContext(ctx context.Context, name string) (int, error) {
+	target, err := t.GetTargetContext(ctx, name)
 	if err != nil {
 		return -1, err
 	}
-	/* Output will looks like:
-	Target 1: iqn.2016-08.com.example:a
-		System information:
-		...
-	Target 2: iqn.2016-08.com.example:b
-		System information:
-		...
-	*/
-	tid := -1
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	for scanner.Scan() {
-		if strings.HasSuffix(scanner.Text(), " "+name) {
-			tidString := strings.Fields(strings.Split(scanner.Text(), ":")[0])[1]
-			tid, err = strconv.Atoi(tidString)
-			if err != nil {
-				return -1, errors.Wrapf(err, "BUG: Failed to parse %s", tidString)
-			}
-			break
-		}
+	if target == nil {
+		return -1, nil
 	}
-	return tid, nil
+	return target.TID, nil
 }
 
 func ShutdownTgtd() error {
-	// Step 1: Show all targets
-	showOpts := []string{"--op", "show", "--mode", "target"}
-	output, err := lhexec.NewExecutor().Execute(nil, tgtBinary, showOpts, lhtypes.ExecuteDefaultTimeout)
-	if err != nil {
-
-		return fmt.Errorf("failed to show targets: %v", err)
-	}
+	return ShutdownTgtdContext(context.Background())
+}
 
-	// Step 2: Parse target IDs
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	var targetIDs []string
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "Target") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				targetIDs = append(targetIDs, fields[1])
-			}
-		}
-	}
+// ShutdownTgtdContext is like ShutdownTgtd but takes a context.
+func ShutdownTgtdContext(ctx context.Context) error {
+	return DefaultTgtd().ShutdownTgtdContext(ctx)
+}
 
-	if err := scanner.Err(); err != nil {
-		return errors.Wrapf(err, "failed to parse targets")
+func (t *Tgtd) ShutdownTgtdContext(ctx context.Context) error {
+	targets, err := t.ListTargetsContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to show targets")
 	}
 
-	// Step 3: Delete each target
-	for _, tid := range targetIDs {
-		deleteOpts := []string{"--op", "delete", "--mode", "target", "--tid", tid}
-		_, err := lhexec.NewExecutor().Execute(nil, tgtBinary, deleteOpts, lhtypes.ExecuteDefaultTimeout)
-		if err != nil {
-			return errors.Wrapf(err, "failed to delete target %s", tid)
+	for _, target := range targets {
+		if err := t.DeleteTargetContext(ctx, target.TID); err != nil {
+			return errors.Wrapf(err, "failed to delete target %v", target.TID)
 		}
 	}
 
@@ -327,67 +594,42 @@ func ShutdownTgtd() error {
 }
 
 func GetTargetConnections(tid int) (map[string][]string, error) {
-	opts := []string{
-		"--lld", "iscsi",
-		"--op", "show",
-		"--mode", "conn",
-		"--tid", strconv.Itoa(tid),
-	}
-	output, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	return GetTargetConnectionsContext(context.Background(), tid)
+}
+
+// GetTargetConnectionsContext is like GetTargetConnections but takes a context.
+func GetTargetConnectionsContext(ctx context.Context, tid int) (map[string][]string, error) {
+	return DefaultTgtd().GetTargetConnectionsContext(ctx, tid)
+}
+
+// GetTargetConnectionsContext returns the IDs of the connections of the
+// target by the IDs of their sessions, see GetSessionsContext for the details.
+func (t *Tgtd) GetTargetConnectionsContext(ctx context.Context, tid int) (map[string][]string, error) {
+	sessions, err := t.listSessions(ctx, tid)
 	if err != nil {
 		return nil, err
 	}
-	/* Output will looks like:
-	Session: 11
-	    Connection: 0
-	        Initiator: iqn.2016-08.com.example:a
-	        IP Address: 192.168.0.1
-	Session: 12
-	    Connection: 1
-	        Initiator: iqn.2016-08.com.example:a
-	        IP Address: 192.168.0.2
-		...
-	*/
 	res := map[string][]string{}
-	currentSIDString := ""
-	currentCIDStringList := []string{}
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(line, "Session: ") {
-			if currentSIDString != "" {
-				res[currentSIDString] = currentCIDStringList
-			}
-			sidFields := strings.Split(line, ": ")
-			if len(sidFields) != 2 {
-				return nil, fmt.Errorf("failed to parse and get session id from line %v", line)
-			}
-			sidString := sidFields[1]
-			if _, err := strconv.Atoi(sidString); err != nil {
-				return nil, err
-			}
-			currentSIDString = sidString
-			currentCIDStringList = []string{}
+	for _, session := range sessions {
+		cids := []string{}
+		for _, connection := range session.Connections {
+			cids = append(cids, strconv.Itoa(connection.ID))
 		}
-		if strings.HasPrefix(line, "Connection: ") {
-			cidFields := strings.Split(line, ": ")
-			if len(cidFields) != 2 {
-				return nil, fmt.Errorf("failed to parse and get connection id from line %v", line)
-			}
-			cidString := cidFields[1]
-			if _, err := strconv.Atoi(cidString); err != nil {
-				return nil, err
-			}
-			currentCIDStringList = append(currentCIDStringList, cidString)
-		}
-	}
-	if len(currentCIDStringList) != 0 {
-		res[currentSIDString] = currentCIDStringList
+		res[strconv.Itoa(session.ID)] = cids
 	}
 	return res, nil
 }
 
 func CloseConnection(tid int, sid, cid string) error {
+	return CloseConnectionContext(context.Background(), tid, sid, cid)
+}
+
+// CloseConnectionContext is like CloseConnection but takes a context.
+func CloseConnectionContext(ctx context.Context, tid int, sid, cid string) error {
+	return DefaultTgtd().CloseConnectionContext(ctx, tid, sid, cid)
+}
+
+func (t *Tgtd) CloseConnectionContext(ctx context.Context, tid int, sid, cid string) error {
 	opts := []string{
 		"--lld", "iscsi",
 		"--op", "delete",
@@ -396,39 +638,27 @@ func CloseConnection(tid int, sid, cid string) error {
 		"--sid", sid,
 		"--cid", cid,
 	}
-	_, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	_, err := t.tgtadm(ctx, opts)
 	return err
 }
 
 func FindNextAvailableTargetID() (int, error) {
-	existingTids := map[int]struct{}{}
-	opts := []string{
-		"--lld", "iscsi",
-		"--op", "show",
-		"--mode", "target",
-	}
-	output, err := lhexec.NewExecutor().Execute(nil, tgtBinary, opts, lhtypes.ExecuteDefaultTimeout)
+	return FindNextAvailableTargetIDContext(context.Background())
+}
+
+// FindNextAvailableTargetIDContext is like FindNextAvailableTargetID but takes a context.
+func FindNextAvailableTargetIDContext(ctx context.Context) (int, error) {
+	return DefaultTgtd().FindNextAvailableTargetIDContext(ctx)
+}
+
+func (t *Tgtd) FindNextAvailableTargetIDContext(ctx context.Context) (int, error) {
+	targets, err := t.ListTargetsContext(ctx)
 	if err != nil {
 		return -1, err
 	}
-	/* Output will looks like:
-	Target 1: iqn.2016-08.com.example:a
-		System information:
-		...
-	Target 2: iqn.2016-08.com.example:b
-		System information:
-		...
-	*/
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	for scanner.Scan() {
-		if strings.HasPrefix(scanner.Text(), "Target ") {
-			tidString := strings.Fields(strings.Split(scanner.Text(), ":")[0])[1]
-			tid, err := strconv.Atoi(tidString)
-			if err != nil {
-				return -1, errors.Wrapf(err, "BUG: Failed to parse %s", tidString)
-			}
-			existingTids[tid] = struct{}{}
-		}
+	existingTids := map[int]struct{}{}
+	for _, target := range targets {
+		existingTids[target.TID] = struct{}{}
 	}
 	for i := 1; i < maxTargetID; i++ {
 		if _, exists := existingTids[i]; !exists {
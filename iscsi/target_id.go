@@ -0,0 +1,108 @@
+package iscsi
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/types"
+	"github.com/longhorn/go-iscsi-helper/util"
+
+	csync "github.com/longhorn/go-common-libs/sync"
+)
+
+var (
+	// TargetIDLockFile serializes the target ID allocation of the processes
+	// sharing tgtd. It's next to the tgtd socket.
+	TargetIDLockFile    = filepath.Join(filepath.Dir(TgtdSocketPrefix), "tid.lock")
+	TargetIDLockTimeout = 60 * time.Second
+)
+
+// PreferredTargetID returns the target ID derived from the target name, so a
+// target gets the same ID across restarts unless the ID is taken.
+func PreferredTargetID(name string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return int(h.Sum32()%uint32(maxTargetID-1)) + 1
+}
+
+// AllocateTarget creates the target with an allocated target ID and returns
+// the ID. The preferred ID of the name is used if it's free, otherwise the
+// next free one. The allocation is serialized by TargetIDLockFile, and the
+// IDs taken by the processes not holding it are skipped.
+func AllocateTarget(name string) (int, error) {
+	return AllocateTargetContext(context.Background(), name)
+}
+
+// AllocateTargetContext is like AllocateTarget but takes a context.
+func AllocateTargetContext(ctx context.Context, name string) (int, error) {
+	return DefaultTgtd().AllocateTargetContext(ctx, name)
+}
+
+// AllocateTargetContext creates the target with an allocated target ID and
+// returns the ID. The preferred ID of the name is used if it's free, otherwise
+// the next free one. The allocation is serialized by TargetIDLockFile, and the
+// IDs taken by the processes not holding it are skipped.
+func (t *Tgtd) AllocateTargetContext(ctx context.Context, name string) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(TargetIDLockFile), 0755); err != nil {
+		return -1, errors.Wrapf(err, "failed to create the directory of %v", TargetIDLockFile)
+	}
+	// The processes sharing tgtd share the namespaces as well, so the lock
+	// file is locked in the current ones like its directory is created
+	lock, err := util.LockFileContext(ctx, TargetIDLockFile, TargetIDLockTimeout, csync.LockFile)
+	if err != nil {
+		return -1, errors.Wrapf(err, "failed to allocate target ID for %v", name)
+	}
+	defer lock.Unlock()
+
+	preferred := PreferredTargetID(name)
+	taken, err := t.takenTargetIDs(ctx, name)
+	if err != nil {
+		return -1, err
+	}
+	for i := 0; i < maxTargetID-1; i++ {
+		tid := (preferred-1+i)%(maxTargetID-1) + 1
+		if _, exists := taken[tid]; exists {
+			continue
+		}
+		err := t.CreateTargetContext(ctx, tid, name)
+		if err == nil {
+			if tid != preferred {
+				logrus.Infof("go-iscsi-helper: target ID %v of %v is taken, allocated %v", preferred, name, tid)
+			}
+			return tid, nil
+		}
+		if !errors.Is(err, types.ErrTargetExist) {
+			return -1, errors.Wrapf(err, "failed to create target %v with ID %v", name, tid)
+		}
+		// The ID or the name is taken without the lock
+		if taken, err = t.takenTargetIDs(ctx, name); err != nil {
+			return -1, err
+		}
+		taken[tid] = struct{}{}
+	}
+	return -1, fmt.Errorf("cannot find an available target ID for %v", name)
+}
+
+// takenTargetIDs returns the IDs of the existing targets, or ErrTargetExist if
+// the name is taken.
+func (t *Tgtd) takenTargetIDs(ctx context.Context, name string) (map[int]struct{}, error) {
+	targets, err := t.ListTargetsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	taken := map[int]struct{}{}
+	for _, target := range targets {
+		if target.IQN == name {
+			return nil, errors.Wrapf(types.ErrTargetExist, "target %v exists with ID %v", name, target.TID)
+		}
+		taken[target.TID] = struct{}{}
+	}
+	return taken, nil
+}
@@ -0,0 +1,96 @@
+package iscsi_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+	"github.com/longhorn/go-iscsi-helper/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type TargetIDSuite struct {
+	iscsitest.Fixture
+
+	lockFile string
+}
+
+var _ = Suite(&TargetIDSuite{})
+
+func (s *TargetIDSuite) SetUpTest(c *C) {
+	s.Fixture.SetUpTest(c)
+
+	s.lockFile = iscsi.TargetIDLockFile
+	iscsi.TargetIDLockFile = filepath.Join(c.MkDir(), "tgtd", "tid.lock")
+}
+
+func (s *TargetIDSuite) TearDownTest(c *C) {
+	iscsi.TargetIDLockFile = s.lockFile
+}
+
+func (s *TargetIDSuite) TestPreferredTargetID(c *C) {
+	ctx := context.Background()
+	name := "iqn.2019-10.io.longhorn:vol1"
+	tid := iscsi.PreferredTargetID(name)
+	c.Assert(tid > 0 && tid < 4095, Equals, true)
+	c.Assert(iscsi.PreferredTargetID(name), Equals, tid)
+	c.Assert(iscsi.PreferredTargetID("iqn.2019-10.io.longhorn:vol2"), Not(Equals), tid)
+
+	// The target gets the same ID after it's re-created
+	allocated, err := s.Tgtd.AllocateTargetContext(ctx, name)
+	c.Assert(err, IsNil)
+	c.Assert(allocated, Equals, tid)
+	c.Assert(s.Tgtd.DeleteTargetContext(ctx, tid), IsNil)
+	allocated, err = s.Tgtd.AllocateTargetContext(ctx, name)
+	c.Assert(err, IsNil)
+	c.Assert(allocated, Equals, tid)
+
+	// The name cannot be taken twice
+	_, err = s.Tgtd.AllocateTargetContext(ctx, name)
+	c.Assert(errors.Is(err, types.ErrTargetExist), Equals, true)
+}
+
+func (s *TargetIDSuite) TestCollision(c *C) {
+	ctx := context.Background()
+	name := "iqn.2019-10.io.longhorn:vol1"
+	tid := iscsi.PreferredTargetID(name)
+	next := tid%4094 + 1
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, tid, "iqn.2019-10.io.longhorn:other"), IsNil)
+
+	allocated, err := s.Tgtd.AllocateTargetContext(ctx, name)
+	c.Assert(err, IsNil)
+	c.Assert(allocated, Equals, next)
+	target, err := s.Tgtd.GetTargetContext(ctx, name)
+	c.Assert(err, IsNil)
+	c.Assert(target.TID, Equals, next)
+}
+
+func (s *TargetIDSuite) TestConcurrentAllocation(c *C) {
+	ctx := context.Background()
+	const count = 16
+	tids := make([]int, count)
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tids[i], errs[i] = s.Tgtd.AllocateTargetContext(ctx, fmt.Sprintf("iqn.2019-10.io.longhorn:vol%d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[int]bool{}
+	for i := 0; i < count; i++ {
+		c.Assert(errs[i], IsNil)
+		c.Assert(seen[tids[i]], Equals, false)
+		seen[tids[i]] = true
+	}
+	c.Assert(s.Fake.TargetIDs(), HasLen, count)
+}
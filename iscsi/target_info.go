@@ -0,0 +1,393 @@
+package iscsi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Target is a target reported by `tgtadm --op show --mode target`.
+type Target struct {
+	TID    int
+	IQN    string
+	Driver string
+	State  string
+
+	Nexuses  []ITNexus
+	LUNs     []LUN
+	Accounts []TargetAccount
+	// ACLs are the initiator addresses allowed to log in, i.e. `tgtadm -I`.
+	ACLs []string
+	// InitiatorNameACLs are the initiator names allowed to log in, i.e.
+	// `tgtadm -Q`, which tgtd shows in a section of their own.
+	InitiatorNameACLs []string
+}
+
+// ITNexus is an I_T nexus, i.e. a session from an initiator to the target.
+type ITNexus struct {
+	ID             int
+	Initiator      string
+	InitiatorAlias string
+	Connections    []ITNexusConnection
+}
+
+// ITNexusConnection is a connection of an I_T nexus.
+type ITNexusConnection struct {
+	ID        int
+	IPAddress string
+}
+
+// LUN is a logical unit of a target.
+type LUN struct {
+	ID   int
+	Type string
+
+	SCSIID string
+	SCSISN string
+
+	// SizeMB is the size reported by tgtd, which is in MB of 10^6 bytes and
+	// rounded to the nearest, e.g. 1074 for 1 GiB.
+	SizeMB    int64
+	BlockSize int64
+
+	Online           bool
+	RemovableMedia   bool
+	PreventRemoval   bool
+	Readonly         bool
+	SWP              bool
+	ThinProvisioning bool
+
+	BackingStoreType  string
+	BackingStorePath  string
+	BackingStoreFlags string
+}
+
+// TargetAccount is a CHAP account bound to a target.
+type TargetAccount struct {
+	User     string
+	Outgoing bool
+}
+
+// LUN returns the LUN with the given ID, or nil if it doesn't exist.
+func (t *Target) LUN(id int) *LUN {
+	for i := range t.LUNs {
+		if t.LUNs[i].ID == id {
+			return &t.LUNs[i]
+		}
+	}
+	return nil
+}
+
+// BoundACLs returns the address and the name ACLs of the target.
+func (t *Target) BoundACLs() []ACL {
+	acls := []ACL{}
+	for _, address := range t.ACLs {
+		acls = append(acls, ACL{Type: ACLTypeAddress, Value: address})
+	}
+	for _, name := range t.InitiatorNameACLs {
+		acls = append(acls, ACL{Type: ACLTypeName, Value: name})
+	}
+	return acls
+}
+
+// ListTargets returns all targets of tgtd.
+func ListTargets() ([]*Target, error) {
+	return ListTargetsContext(context.Background())
+}
+
+// ListTargetsContext is like ListTargets but takes a context.
+func ListTargetsContext(ctx context.Context) ([]*Target, error) {
+	return DefaultTgtd().ListTargetsContext(ctx)
+}
+
+// ListTargetsContext returns all targets of tgtd.
+func (t *Tgtd) ListTargetsContext(ctx context.Context) ([]*Target, error) {
+	opts := []string{
+		"--lld", "iscsi",
+		"--op", "show",
+		"--mode", "target",
+	}
+	output, err := t.tgtadm(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseTargets(output)
+}
+
+// GetTarget returns the target with the IQN name. If the target doesn't
+// exist, it returns nil without error.
+func GetTarget(name string) (*Target, error) {
+	return GetTargetContext(context.Background(), name)
+}
+
+// GetTargetContext is like GetTarget but takes a context.
+func GetTargetContext(ctx context.Context, name string) (*Target, error) {
+	return DefaultTgtd().GetTargetContext(ctx, name)
+}
+
+// GetTargetContext returns the target with the IQN name. If the target doesn't
+// exist, it returns nil without error.
+func (t *Tgtd) GetTargetContext(ctx context.Context, name string) (*Target, error) {
+	targets, err := t.ListTargetsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		if t.IQN == name {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+const (
+	targetSectionNone = iota
+	targetSectionSystem
+	targetSectionNexus
+	targetSectionLUN
+	targetSectionAccount
+	targetSectionACL
+	targetSectionACLName
+)
+
+/*
+parseTargets parses the output of `tgtadm --op show --mode target`, which looks like:
+
+	Target 1: iqn.2019-10.io.longhorn:vol
+	    System information:
+	        Driver: iscsi
+	        State: ready
+	    I_T nexus information:
+	        I_T nexus: 2
+	            Initiator: iqn.1993-08.org.debian:01:e9a4e7b3c3d alias: node-1
+	            Connection: 0
+	                IP Address: 10.0.0.1
+	    LUN information:
+	        LUN: 1
+	            Type: disk
+	            SCSI ID: IET     00010001
+	            SCSI SN: beaf11
+	            Size: 1074 MB, Block size: 512
+	            Online: Yes
+	            Removable media: No
+	            Prevent removal: No
+	            Readonly: No
+	            SWP: No
+	            Thin-provisioning: Yes
+	            Backing store type: longhorn
+	            Backing store path: /var/run/longhorn-vol.sock
+	            Backing store flags:
+	    Account information:
+	        user1
+	        user2 (outgoing)
+	    ACL information:
+	        ALL
+	    ACL initiator-name information:
+	        iqn.1993-08.org.debian:01:e9a4e7b3c3d
+*/
+func parseTargets(output string) ([]*Target, error) {
+	targets := []*Target{}
+
+	var (
+		target  *Target
+		nexus   *ITNexus
+		lun     *LUN
+		section = targetSectionNone
+	)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(raw, "Target ") {
+			t, err := parseTargetLine(line)
+			if err != nil {
+				return nil, err
+			}
+			target = t
+			targets = append(targets, target)
+			nexus, lun = nil, nil
+			section = targetSectionNone
+			continue
+		}
+		if target == nil {
+			return nil, fmt.Errorf("invalid output format, found %q before any target", line)
+		}
+
+		switch line {
+		case "System information:":
+			section = targetSectionSystem
+			continue
+		case "I_T nexus information:":
+			section = targetSectionNexus
+			continue
+		case "LUN information:":
+			section = targetSectionLUN
+			continue
+		case "Account information:":
+			section = targetSectionAccount
+			continue
+		case "ACL information:":
+			section = targetSectionACL
+			continue
+		case "ACL initiator-name information:":
+			section = targetSectionACLName
+			continue
+		}
+
+		switch section {
+		case targetSectionAccount:
+			account := TargetAccount{User: line}
+			if user, found := strings.CutSuffix(line, " (outgoing)"); found {
+				account = TargetAccount{User: user, Outgoing: true}
+			}
+			target.Accounts = append(target.Accounts, account)
+			continue
+		case targetSectionACL:
+			target.ACLs = append(target.ACLs, line)
+			continue
+		case targetSectionACLName:
+			target.InitiatorNameACLs = append(target.InitiatorNameACLs, line)
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch section {
+		case targetSectionSystem:
+			switch key {
+			case "Driver":
+				target.Driver = value
+			case "State":
+				target.State = value
+			}
+		case targetSectionNexus:
+			switch key {
+			case "I_T nexus":
+				id, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to parse I_T nexus from line %v", line)
+				}
+				target.Nexuses = append(target.Nexuses, ITNexus{ID: id})
+				nexus = &target.Nexuses[len(target.Nexuses)-1]
+			case "Initiator":
+				if nexus == nil {
+					return nil, fmt.Errorf("invalid output format, found initiator without I_T nexus: %v", line)
+				}
+				nexus.Initiator, nexus.InitiatorAlias, _ = strings.Cut(value, " alias: ")
+			case "Connection":
+				if nexus == nil {
+					return nil, fmt.Errorf("invalid output format, found connection without I_T nexus: %v", line)
+				}
+				id, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to parse connection from line %v", line)
+				}
+				nexus.Connections = append(nexus.Connections, ITNexusConnection{ID: id})
+			case "IP Address":
+				if nexus == nil || len(nexus.Connections) == 0 {
+					return nil, fmt.Errorf("invalid output format, found IP address without connection: %v", line)
+				}
+				nexus.Connections[len(nexus.Connections)-1].IPAddress = value
+			}
+		case targetSectionLUN:
+			if key == "LUN" {
+				id, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to parse LUN from line %v", line)
+				}
+				target.LUNs = append(target.LUNs, LUN{ID: id})
+				lun = &target.LUNs[len(target.LUNs)-1]
+				continue
+			}
+			if lun == nil {
+				return nil, fmt.Errorf("invalid output format, found LUN attribute without LUN: %v", line)
+			}
+			err = parseLUNAttribute(lun, key, value)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse line %v", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to parse targets")
+	}
+	return targets, nil
+}
+
+// parseTargetLine parses a line like `Target 1: iqn.2019-10.io.longhorn:vol`.
+// Notice the IQN itself contains colons.
+func parseTargetLine(line string) (*Target, error) {
+	header, iqn, found := strings.Cut(line, ": ")
+	if !found {
+		return nil, fmt.Errorf("failed to parse target from line %v", line)
+	}
+	tidString := strings.TrimPrefix(header, "Target ")
+	tid, err := strconv.Atoi(tidString)
+	if err != nil {
+		return nil, errors.Wrapf(err, "BUG: Failed to parse %s", tidString)
+	}
+	return &Target{TID: tid, IQN: strings.TrimSpace(iqn)}, nil
+}
+
+// tgtdMB is the unit of the LUN size shown by tgtd.
+const tgtdMB = 1000 * 1000
+
+// sizeMB returns the size in bytes as tgtd shows it, see LUN.SizeMB.
+func sizeMB(size int64) int64 {
+	return (size + tgtdMB/2) / tgtdMB
+}
+
+func parseLUNAttribute(lun *LUN, key, value string) (err error) {
+	switch key {
+	case "Type":
+		lun.Type = value
+	case "SCSI ID":
+		lun.SCSIID = value
+	case "SCSI SN":
+		lun.SCSISN = value
+	case "Size":
+		// Size: 1074 MB, Block size: 512
+		size, blockSize, _ := strings.Cut(value, ", Block size:")
+		if lun.SizeMB, err = strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(size, "MB")), 10, 64); err != nil {
+			return err
+		}
+		if blockSize = strings.TrimSpace(blockSize); blockSize != "" {
+			if lun.BlockSize, err = strconv.ParseInt(blockSize, 10, 64); err != nil {
+				return err
+			}
+		}
+	case "Online":
+		lun.Online = parseYesNo(value)
+	case "Removable media":
+		lun.RemovableMedia = parseYesNo(value)
+	case "Prevent removal":
+		lun.PreventRemoval = parseYesNo(value)
+	case "Readonly":
+		lun.Readonly = parseYesNo(value)
+	case "SWP":
+		lun.SWP = parseYesNo(value)
+	case "Thin-provisioning":
+		lun.ThinProvisioning = parseYesNo(value)
+	case "Backing store type":
+		lun.BackingStoreType = value
+	case "Backing store path":
+		lun.BackingStorePath = value
+	case "Backing store flags":
+		lun.BackingStoreFlags = value
+	}
+	return nil
+}
+
+func parseYesNo(value string) bool {
+	return strings.EqualFold(value, "yes")
+}
@@ -0,0 +1,142 @@
+package iscsi
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type TargetInfoSuite struct{}
+
+var _ = Suite(&TargetInfoSuite{})
+
+const showTargetOutput = `Target 1: iqn.2019-10.io.longhorn:vol1
+    System information:
+        Driver: iscsi
+        State: ready
+    I_T nexus information:
+        I_T nexus: 2
+            Initiator: iqn.1993-08.org.debian:01:e9a4e7b3c3d alias: node-1
+            Connection: 0
+                IP Address: 10.0.0.1
+    LUN information:
+        LUN: 0
+            Type: controller
+            SCSI ID: IET     00010000
+            SCSI SN: beaf10
+            Size: 0 MB, Block size: 1
+            Online: Yes
+            Removable media: No
+            Prevent removal: No
+            Readonly: No
+            SWP: No
+            Thin-provisioning: No
+            Backing store type: null
+            Backing store path: None
+            Backing store flags: 
+        LUN: 1
+            Type: disk
+            SCSI ID: IET     00010001
+            SCSI SN: beaf11
+            Size: 1074 MB, Block size: 512
+            Online: Yes
+            Removable media: No
+            Prevent removal: No
+            Readonly: No
+            SWP: No
+            Thin-provisioning: Yes
+            Backing store type: longhorn
+            Backing store path: /var/run/longhorn-vol1.sock
+            Backing store flags: 
+    Account information:
+        user1
+        user2 (outgoing)
+    ACL information:
+        ALL
+    ACL initiator-name information:
+        iqn.1993-08.org.debian:01:e9a4e7b3c3d
+Target 2: iqn.2019-10.io.longhorn:xvol1
+    System information:
+        Driver: iscsi
+        State: ready
+    I_T nexus information:
+    LUN information:
+        LUN: 0
+            Type: controller
+            SCSI ID: IET     00020000
+            SCSI SN: beaf20
+            Size: 0 MB, Block size: 1
+            Online: Yes
+            Removable media: No
+            Prevent removal: No
+            Readonly: No
+            SWP: No
+            Thin-provisioning: No
+            Backing store type: null
+            Backing store path: None
+            Backing store flags: 
+    Account information:
+    ACL information:
+`
+
+func (s *TargetInfoSuite) TestParseTargets(c *C) {
+	targets, err := parseTargets(showTargetOutput)
+	c.Assert(err, IsNil)
+	c.Assert(targets, HasLen, 2)
+
+	t := targets[0]
+	c.Assert(t.TID, Equals, 1)
+	c.Assert(t.IQN, Equals, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(t.Driver, Equals, "iscsi")
+	c.Assert(t.State, Equals, "ready")
+	c.Assert(t.Nexuses, DeepEquals, []ITNexus{
+		{
+			ID:             2,
+			Initiator:      "iqn.1993-08.org.debian:01:e9a4e7b3c3d",
+			InitiatorAlias: "node-1",
+			Connections:    []ITNexusConnection{{ID: 0, IPAddress: "10.0.0.1"}},
+		},
+	})
+	c.Assert(t.LUNs, HasLen, 2)
+	c.Assert(t.LUN(1), DeepEquals, &LUN{
+		ID:               1,
+		Type:             "disk",
+		SCSIID:           "IET     00010001",
+		SCSISN:           "beaf11",
+		SizeMB:           1074,
+		BlockSize:        512,
+		Online:           true,
+		ThinProvisioning: true,
+		BackingStoreType: "longhorn",
+		BackingStorePath: "/var/run/longhorn-vol1.sock",
+	})
+	c.Assert(t.LUN(2), IsNil)
+	c.Assert(t.Accounts, DeepEquals, []TargetAccount{{User: "user1"}, {User: "user2", Outgoing: true}})
+	c.Assert(t.ACLs, DeepEquals, []string{"ALL"})
+	c.Assert(t.InitiatorNameACLs, DeepEquals, []string{"iqn.1993-08.org.debian:01:e9a4e7b3c3d"})
+	c.Assert(t.BoundACLs(), DeepEquals, []ACL{
+		{Type: ACLTypeAddress, Value: "ALL"},
+		{Type: ACLTypeName, Value: "iqn.1993-08.org.debian:01:e9a4e7b3c3d"},
+	})
+
+	t = targets[1]
+	c.Assert(t.TID, Equals, 2)
+	c.Assert(t.IQN, Equals, "iqn.2019-10.io.longhorn:xvol1")
+	c.Assert(t.Nexuses, HasLen, 0)
+	c.Assert(t.LUNs, HasLen, 1)
+	c.Assert(t.Accounts, HasLen, 0)
+	c.Assert(t.ACLs, HasLen, 0)
+	c.Assert(t.InitiatorNameACLs, HasLen, 0)
+}
+
+func (s *TargetInfoSuite) TestParseTargetsEmpty(c *C) {
+	targets, err := parseTargets("")
+	c.Assert(err, IsNil)
+	c.Assert(targets, HasLen, 0)
+}
+
+func (s *TargetInfoSuite) TestParseTargetsInvalid(c *C) {
+	_, err := parseTargets("Target x: iqn.2019-10.io.longhorn:vol1\n")
+	c.Assert(err, NotNil)
+
+	_, err = parseTargets("    System information:\n")
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,521 @@
+package iscsi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+const (
+	// TargetsConfPasswordPlaceholder replaces the passwords tgtd doesn't
+	// show, the same as `tgt-admin --dump`. The accounts with it are expected
+	// to exist in tgtd when the targets.conf is applied.
+	TargetsConfPasswordPlaceholder = "PLACEHOLDER"
+)
+
+// targetsConfParams are the LUN params with their own directives in
+// targets.conf. The others are in the params directive.
+var targetsConfParams = map[string]bool{
+	"vendor_id":    true,
+	"product_id":   true,
+	"product_rev":  true,
+	"scsi_id":      true,
+	"scsi_sn":      true,
+	"removable":    true,
+	"sense_format": true,
+	"online":       true,
+	"readonly":     true,
+	"mode_page":    true,
+}
+
+// GetTgtdConfig returns the live targets of tgtd as a config, which reconciles
+// to nothing. tgtd doesn't show the passwords and the bsopts, so the config
+// has no account to create and no bsopts, and only the LUN params shown by
+// tgtd which differ from the defaults are included.
+func GetTgtdConfig() (*TgtdConfig, error) {
+	return GetTgtdConfigContext(context.Background())
+}
+
+// GetTgtdConfigContext is like GetTgtdConfig but takes a context.
+func GetTgtdConfigContext(ctx context.Context) (*TgtdConfig, error) {
+	return DefaultTgtd().GetTgtdConfigContext(ctx)
+}
+
+// GetTgtdConfigContext returns the live targets of tgtd as a config, which
+// reconciles to nothing. tgtd doesn't show the passwords and the bsopts, so the
+// config has no account to create and no bsopts, and only the LUN params shown
+// by tgtd which differ from the defaults are included.
+func (t *Tgtd) GetTgtdConfigContext(ctx context.Context) (*TgtdConfig, error) {
+	targets, err := t.ListTargetsContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to show targets")
+	}
+
+	config := &TgtdConfig{}
+	for _, target := range targets {
+		tc := TargetConfig{
+			TID:      target.TID,
+			IQN:      target.IQN,
+			Accounts: target.Accounts,
+		}
+		for _, lun := range target.LUNs {
+			if lun.ID == 0 {
+				continue
+			}
+			tc.LUNs = append(tc.LUNs, LUNConfig{
+				ID:               lun.ID,
+				BackingStore:     lun.BackingStorePath,
+				BackingStoreType: lun.BackingStoreType,
+				DeviceType:       exportedDeviceType(&lun),
+				Params:           shownLUNParams(target.TID, &lun),
+			})
+		}
+		tc.ACLs = append(tc.ACLs, target.BoundACLs()...)
+		config.Targets = append(config.Targets, tc)
+	}
+	return config, nil
+}
+
+// exportedDeviceType returns the device type of the LUN, or an empty string
+// for the disk which is the default.
+func exportedDeviceType(lun *LUN) DeviceType {
+	if deviceType := lun.DeviceType(); deviceType != DeviceTypeDisk {
+		return deviceType
+	}
+	return ""
+}
+
+// shownLUNParams returns the params shown by tgtd which differ from the
+// defaults.
+func shownLUNParams(tid int, lun *LUN) map[string]string {
+	params := map[string]string{}
+	flag := func(key string, value, defaultValue bool) {
+		if value == defaultValue {
+			return
+		}
+		params[key] = "0"
+		if value {
+			params[key] = "1"
+		}
+	}
+	flag("online", lun.Online, true)
+	flag("readonly", lun.Readonly, false)
+	// The CD-ROMs are removable by default
+	flag("removable", lun.RemovableMedia, lun.DeviceType() == DeviceTypeCD)
+	flag("swp", lun.SWP, false)
+	flag("thin_provisioning", lun.ThinProvisioning, false)
+	// tgtd derives the default SCSI ID and serial number from the TID and LUN
+	if lun.SCSIID != defaultSCSIID(tid, lun.ID) {
+		params["scsi_id"] = lun.SCSIID
+	}
+	if lun.SCSISN != defaultSCSISN(tid, lun.ID) {
+		params["scsi_sn"] = lun.SCSISN
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	return params
+}
+
+// ExportTargetsConf returns the live state of tgtd in the targets.conf format
+// of tgt-admin. The passwords are replaced by TargetsConfPasswordPlaceholder.
+func ExportTargetsConf() (string, error) {
+	return ExportTargetsConfContext(context.Background())
+}
+
+// ExportTargetsConfContext is like ExportTargetsConf but takes a context.
+func ExportTargetsConfContext(ctx context.Context) (string, error) {
+	return DefaultTgtd().ExportTargetsConfContext(ctx)
+}
+
+// ExportTargetsConfContext returns the live state of tgtd in the targets.conf
+// format of tgt-admin. The passwords are replaced by
+// TargetsConfPasswordPlaceholder.
+func (t *Tgtd) ExportTargetsConfContext(ctx context.Context) (string, error) {
+	config, err := t.GetTgtdConfigContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return FormatTargetsConf(config), nil
+}
+
+// ApplyTargetsConf parses the targets.conf and reconciles tgtd with it.
+func ApplyTargetsConf(content string) (*ReconcilePlan, error) {
+	return ApplyTargetsConfContext(context.Background(), content)
+}
+
+// ApplyTargetsConfContext is like ApplyTargetsConf but takes a context.
+func ApplyTargetsConfContext(ctx context.Context, content string) (*ReconcilePlan, error) {
+	return DefaultTgtd().ApplyTargetsConfContext(ctx, content)
+}
+
+// ApplyTargetsConfContext parses the targets.conf and reconciles tgtd with it.
+func (t *Tgtd) ApplyTargetsConfContext(ctx context.Context, content string) (*ReconcilePlan, error) {
+	config, err := ParseTargetsConf(content)
+	if err != nil {
+		return nil, err
+	}
+	return t.ReconcileContext(ctx, config)
+}
+
+/*
+FormatTargetsConf formats the config in the targets.conf format of tgt-admin,
+which looks like:
+
+	default-driver iscsi
+
+	<target iqn.2019-10.io.longhorn:vol>
+	    controller_tid 1
+	    <backing-store /var/run/longhorn-vol.sock>
+	        lun 1
+	        bs-type longhorn
+	        bsopts size=1073741824
+	        vendor_id LONGHORN
+	        params thin_provisioning=1
+	    </backing-store>
+	    initiator-address ALL
+	    initiator-name iqn.1993-08.org.debian:01:client
+	    incominguser user PLACEHOLDER
+	    outgoinguser target PLACEHOLDER
+	</target>
+
+The passwords of the accounts which are not in the config or have no password
+are replaced by TargetsConfPasswordPlaceholder. The portals are not included.
+*/
+func FormatTargetsConf(config *TgtdConfig) string {
+	passwords := map[string]string{}
+	for _, account := range config.Accounts {
+		passwords[account.User] = account.Password
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "default-driver iscsi\n")
+	for _, target := range config.Targets {
+		fmt.Fprintf(b, "\n<target %s>\n", target.IQN)
+		fmt.Fprintf(b, "    controller_tid %d\n", target.TID)
+		for _, lun := range target.LUNs {
+			fmt.Fprintf(b, "    <backing-store %s>\n", lun.BackingStore)
+			fmt.Fprintf(b, "        lun %d\n", lun.ID)
+			if lun.BackingStoreType != "" {
+				fmt.Fprintf(b, "        bs-type %s\n", lun.BackingStoreType)
+			}
+			if lun.BackingStoreOpts != "" {
+				fmt.Fprintf(b, "        bsopts %s\n", lun.BackingStoreOpts)
+			}
+			if lun.DeviceType != "" {
+				fmt.Fprintf(b, "        device-type %s\n", lun.DeviceType)
+			}
+			keys := []string{}
+			for key := range lun.Params {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			others := map[string]string{}
+			for _, key := range keys {
+				if targetsConfParams[key] {
+					fmt.Fprintf(b, "        %s %s\n", key, lun.Params[key])
+				} else {
+					others[key] = lun.Params[key]
+				}
+			}
+			if len(others) != 0 {
+				fmt.Fprintf(b, "        params %s\n", formatParams(others))
+			}
+			fmt.Fprintf(b, "    </backing-store>\n")
+		}
+		for _, acl := range target.ACLs {
+			switch acl.Type {
+			case ACLTypeName:
+				fmt.Fprintf(b, "    initiator-name %s\n", acl.Value)
+			default:
+				fmt.Fprintf(b, "    initiator-address %s\n", acl.Value)
+			}
+		}
+		for _, account := range target.Accounts {
+			password := passwords[account.User]
+			if password == "" {
+				password = TargetsConfPasswordPlaceholder
+			}
+			directive := "incominguser"
+			if account.Outgoing {
+				directive = "outgoinguser"
+			}
+			fmt.Fprintf(b, "    %s %s %s\n", directive, account.User, password)
+		}
+		fmt.Fprintf(b, "</target>\n")
+	}
+	return b.String()
+}
+
+// ParseTargetsConf parses a targets.conf of tgt-admin. Besides the
+// directives written by FormatTargetsConf, it accepts the simple
+// backing-store and direct-store directives, and the bs-type, bsopts,
+// device-type and LUN params at the target level, which apply to all LUNs of
+// the target. The targets without controller_tid and the LUNs without lun are
+// numbered in order, the same as tgt-admin. The accounts with
+// TargetsConfPasswordPlaceholder are not in the returned config, so they must
+// exist in tgtd.
+func ParseTargetsConf(content string) (*TgtdConfig, error) {
+	p := &targetsConfParser{
+		config:    &TgtdConfig{},
+		passwords: map[string]string{},
+	}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		p.lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := p.parseLine(line); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse line %v of targets.conf", p.lineNumber)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to parse targets.conf")
+	}
+	if p.target != nil {
+		return nil, fmt.Errorf("target %v is not closed in targets.conf", p.target.config.IQN)
+	}
+	p.numberTargets()
+
+	users := []string{}
+	for user := range p.passwords {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		if password := p.passwords[user]; password != TargetsConfPasswordPlaceholder {
+			p.config.Accounts = append(p.config.Accounts, AccountConfig{User: user, Password: password})
+		}
+	}
+	return p.config, nil
+}
+
+type targetsConfParser struct {
+	config     *TgtdConfig
+	passwords  map[string]string
+	lineNumber int
+
+	target *targetsConfTarget
+	lun    *targetsConfLUN
+}
+
+type targetsConfTarget struct {
+	config TargetConfig
+	// LUNs is parsed separately, since the target level directives apply to
+	// all LUNs regardless of the order
+	luns []*targetsConfLUN
+	// defaults are the target level directives of the LUNs
+	defaults targetsConfLUN
+}
+
+type targetsConfLUN struct {
+	id               int
+	backingStore     string
+	backingStoreType string
+	backingStoreOpts string
+	deviceType       DeviceType
+	params           map[string]string
+}
+
+func (p *targetsConfParser) parseLine(line string) error {
+	if strings.HasPrefix(line, "</") {
+		return p.closeSection(strings.TrimSuffix(strings.TrimPrefix(line, "</"), ">"))
+	}
+	if strings.HasPrefix(line, "<") {
+		name, value, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(line, "<"), ">"), " ")
+		return p.openSection(name, strings.TrimSpace(value))
+	}
+
+	directive, value, _ := strings.Cut(line, " ")
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return fmt.Errorf("missing value of %v", directive)
+	}
+	switch {
+	case p.lun != nil:
+		return p.parseLUNDirective(p.lun, directive, value)
+	case p.target != nil:
+		return p.parseTargetDirective(directive, value)
+	case directive == "default-driver":
+		if value != "iscsi" {
+			return fmt.Errorf("unsupported driver %v", value)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported directive %v outside of target", directive)
+}
+
+func (p *targetsConfParser) openSection(name, value string) error {
+	if value == "" {
+		return fmt.Errorf("missing value of section %v", name)
+	}
+	switch {
+	case name == "target" && p.target == nil:
+		p.target = &targetsConfTarget{
+			config: TargetConfig{IQN: value},
+		}
+		return nil
+	case (name == "backing-store" || name == "direct-store") && p.target != nil && p.lun == nil:
+		p.lun = &targetsConfLUN{backingStore: value}
+		p.target.luns = append(p.target.luns, p.lun)
+		return nil
+	}
+	return fmt.Errorf("unexpected section %v", name)
+}
+
+func (p *targetsConfParser) closeSection(name string) error {
+	switch {
+	case p.lun != nil && (name == "backing-store" || name == "direct-store"):
+		p.lun = nil
+		return nil
+	case p.lun == nil && p.target != nil && name == "target":
+		p.config.Targets = append(p.config.Targets, p.target.build())
+		p.target = nil
+		return nil
+	}
+	return fmt.Errorf("unexpected end of section %v", name)
+}
+
+func (p *targetsConfParser) parseTargetDirective(directive, value string) (err error) {
+	target := p.target
+	switch directive {
+	case "controller_tid":
+		if target.config.TID, err = strconv.Atoi(value); err != nil {
+			return errors.Wrapf(err, "invalid controller_tid %v", value)
+		}
+	case "backing-store", "direct-store":
+		target.luns = append(target.luns, &targetsConfLUN{backingStore: value})
+	case "initiator-address", "initiator-name":
+		for _, field := range strings.Fields(value) {
+			acl, err := NewAddressACL(field)
+			if directive == "initiator-name" {
+				acl, err = NewNameACL(field)
+			}
+			if err != nil {
+				return err
+			}
+			target.config.ACLs = append(target.config.ACLs, acl)
+		}
+	case "incominguser", "outgoinguser":
+		fields := strings.Fields(value)
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid %v, expecting user and password", directive)
+		}
+		if password, exists := p.passwords[fields[0]]; exists && password != fields[1] {
+			return fmt.Errorf("conflicting passwords of account %v", fields[0])
+		}
+		p.passwords[fields[0]] = fields[1]
+		target.config.Accounts = append(target.config.Accounts, TargetAccount{
+			User:     fields[0],
+			Outgoing: directive == "outgoinguser",
+		})
+	default:
+		return p.parseLUNDirective(&target.defaults, directive, value)
+	}
+	return nil
+}
+
+func (p *targetsConfParser) parseLUNDirective(lun *targetsConfLUN, directive, value string) (err error) {
+	switch {
+	case directive == "lun" && lun != &p.target.defaults:
+		if lun.id, err = strconv.Atoi(value); err != nil {
+			return errors.Wrapf(err, "invalid lun %v", value)
+		}
+	case directive == "bs-type":
+		lun.backingStoreType = value
+	case directive == "bsopts":
+		lun.backingStoreOpts = value
+	case directive == "device-type":
+		lun.deviceType = DeviceType(value)
+	case directive == "params":
+		for _, param := range strings.Split(value, ",") {
+			key, v, found := strings.Cut(param, "=")
+			if !found {
+				return fmt.Errorf("invalid param %v", param)
+			}
+			lun.setParam(strings.TrimSpace(key), strings.TrimSpace(v))
+		}
+	case targetsConfParams[directive]:
+		lun.setParam(directive, value)
+	default:
+		return fmt.Errorf("unsupported directive %v", directive)
+	}
+	return nil
+}
+
+func (l *targetsConfLUN) setParam(key, value string) {
+	if l.params == nil {
+		l.params = map[string]string{}
+	}
+	l.params[key] = value
+}
+
+// build applies the target level directives to the LUNs, and numbers the LUNs
+// without lun.
+func (t *targetsConfTarget) build() TargetConfig {
+	used := map[int]bool{}
+	for _, lun := range t.luns {
+		used[lun.id] = true
+	}
+	next := 1
+	for _, lun := range t.luns {
+		if lun.id == 0 {
+			for used[next] {
+				next++
+			}
+			lun.id = next
+			used[next] = true
+		}
+
+		lc := LUNConfig{
+			ID:               lun.id,
+			BackingStore:     lun.backingStore,
+			BackingStoreType: lun.backingStoreType,
+			BackingStoreOpts: lun.backingStoreOpts,
+			DeviceType:       lun.deviceType,
+		}
+		if lc.DeviceType == "" {
+			lc.DeviceType = t.defaults.deviceType
+		}
+		if lc.BackingStoreType == "" {
+			lc.BackingStoreType = t.defaults.backingStoreType
+		}
+		if lc.BackingStoreOpts == "" {
+			lc.BackingStoreOpts = t.defaults.backingStoreOpts
+		}
+		for key, value := range t.defaults.params {
+			if _, exists := lun.params[key]; !exists {
+				lun.setParam(key, value)
+			}
+		}
+		lc.Params = lun.params
+		t.config.LUNs = append(t.config.LUNs, lc)
+	}
+	return t.config
+}
+
+// numberTargets numbers the targets without controller_tid.
+func (p *targetsConfParser) numberTargets() {
+	used := map[int]bool{}
+	for _, target := range p.config.Targets {
+		used[target.TID] = true
+	}
+	next := 1
+	for i := range p.config.Targets {
+		if p.config.Targets[i].TID != 0 {
+			continue
+		}
+		for used[next] {
+			next++
+		}
+		p.config.Targets[i].TID = next
+		used[next] = true
+	}
+}
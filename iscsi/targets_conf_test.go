@@ -0,0 +1,176 @@
+package iscsi_test
+
+import (
+	"context"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+
+	. "gopkg.in/check.v1"
+)
+
+type TargetsConfSuite struct {
+	iscsitest.Fixture
+}
+
+var _ = Suite(&TargetsConfSuite{})
+
+const exportedTargetsConf = `default-driver iscsi
+
+<target iqn.2019-10.io.longhorn:vol1>
+    controller_tid 1
+    <backing-store /var/run/longhorn-vol1.sock>
+        lun 1
+        bs-type longhorn
+        params thin_provisioning=1
+    </backing-store>
+    <backing-store /var/lib/images/vol1.img>
+        lun 2
+        bs-type rdwr
+        readonly 1
+    </backing-store>
+    initiator-address 10.0.0.0/24
+    initiator-name iqn.1993-08.org.debian:01:client
+    incominguser user PLACEHOLDER
+</target>
+
+<target iqn.2019-10.io.longhorn:vol2>
+    controller_tid 3
+</target>
+`
+
+func (s *TargetsConfSuite) TestExport(c *C) {
+	ctx := context.Background()
+	c.Assert(s.Tgtd.CreateAccountContext(ctx, "user", "secret-password"), IsNil)
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, "iqn.2019-10.io.longhorn:vol1"), IsNil)
+	c.Assert(s.Tgtd.AddLunContext(ctx, 1, 1, "/var/run/longhorn-vol1.sock", "longhorn", "size=1073741824"), IsNil)
+	c.Assert(s.Tgtd.SetLunThinProvisioningContext(ctx, 1, 1), IsNil)
+	c.Assert(s.Tgtd.AddLunBackedByFileContext(ctx, 1, 2, "/var/lib/images/vol1.img"), IsNil)
+	c.Assert(s.Tgtd.UpdateLunContext(ctx, 1, 2, map[string]string{"readonly": "1"}), IsNil)
+	c.Assert(s.Tgtd.BindInitiatorContext(ctx, 1, "10.0.0.0/24"), IsNil)
+	c.Assert(s.Tgtd.BindInitiatorNameContext(ctx, 1, "iqn.1993-08.org.debian:01:client"), IsNil)
+	c.Assert(s.Tgtd.BindAccountContext(ctx, 1, "user", false), IsNil)
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 3, "iqn.2019-10.io.longhorn:vol2"), IsNil)
+
+	conf, err := s.Tgtd.ExportTargetsConfContext(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(conf, Equals, exportedTargetsConf)
+
+	// The export reconciles to nothing
+	config, err := iscsi.ParseTargetsConf(conf)
+	c.Assert(err, IsNil)
+	c.Assert(config.Accounts, HasLen, 0)
+	plan, err := s.Tgtd.PlanReconcileContext(ctx, config)
+	c.Assert(err, IsNil)
+	c.Assert(plan.Operations, HasLen, 0)
+
+	// Restore it after the targets are lost, the account still exists
+	c.Assert(s.Tgtd.ShutdownTgtdContext(ctx), IsNil)
+	plan, err = s.Tgtd.ApplyTargetsConfContext(ctx, conf)
+	c.Assert(err, IsNil)
+	c.Assert(plan.Operations, Not(HasLen), 0)
+	restored, err := s.Tgtd.ExportTargetsConfContext(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(restored, Equals, exportedTargetsConf)
+
+	// The password is required once the account is lost as well
+	c.Assert(s.Tgtd.ShutdownTgtdContext(ctx), IsNil)
+	c.Assert(s.Tgtd.DeleteAccountContext(ctx, "user"), IsNil)
+	_, err = s.Tgtd.ApplyTargetsConfContext(ctx, conf)
+	c.Assert(err, ErrorMatches, "account user of target 1 is neither in the config nor in tgtd")
+}
+
+func (s *TargetsConfSuite) TestParse(c *C) {
+	ctx := context.Background()
+	config, err := iscsi.ParseTargetsConf(`
+# Written by hand
+default-driver iscsi
+
+<target iqn.2019-10.io.longhorn:vol1>
+    bs-type aio
+    vendor_id LONGHORN
+    backing-store /var/lib/images/vol1-a.img
+    <backing-store /var/lib/images/vol1-b.img>
+        vendor_id OTHER
+        params thin_provisioning=1, swp=0
+    </backing-store>
+    <direct-store /dev/sdb>
+        lun 1
+        bs-type rdwr
+    </direct-store>
+    initiator-address 10.0.0.1 10.0.0.2
+    incominguser user secret-password
+    outgoinguser target mutual-password
+</target>
+
+<target iqn.2019-10.io.longhorn:vol2>
+    incominguser user secret-password
+</target>
+
+<target iqn.2019-10.io.longhorn:vol3>
+    controller_tid 2
+</target>
+`)
+	c.Assert(err, IsNil)
+	c.Assert(config.Accounts, DeepEquals, []iscsi.AccountConfig{
+		{User: "target", Password: "mutual-password"},
+		{User: "user", Password: "secret-password"},
+	})
+	c.Assert(config.Targets, HasLen, 3)
+
+	target := config.Targets[0]
+	c.Assert(target.TID, Equals, 1)
+	c.Assert(target.LUNs, DeepEquals, []iscsi.LUNConfig{
+		{
+			ID:               2,
+			BackingStore:     "/var/lib/images/vol1-a.img",
+			BackingStoreType: "aio",
+			Params:           map[string]string{"vendor_id": "LONGHORN"},
+		},
+		{
+			ID:               3,
+			BackingStore:     "/var/lib/images/vol1-b.img",
+			BackingStoreType: "aio",
+			Params:           map[string]string{"vendor_id": "OTHER", "thin_provisioning": "1", "swp": "0"},
+		},
+		{
+			ID:               1,
+			BackingStore:     "/dev/sdb",
+			BackingStoreType: "rdwr",
+			Params:           map[string]string{"vendor_id": "LONGHORN"},
+		},
+	})
+	c.Assert(target.ACLs, DeepEquals, []iscsi.ACL{
+		{Type: iscsi.ACLTypeAddress, Value: "10.0.0.1"},
+		{Type: iscsi.ACLTypeAddress, Value: "10.0.0.2"},
+	})
+	c.Assert(target.Accounts, DeepEquals, []iscsi.TargetAccount{{User: "user"}, {User: "target", Outgoing: true}})
+
+	// The targets without controller_tid skip the used ones
+	c.Assert(config.Targets[1].TID, Equals, 3)
+	c.Assert(config.Targets[2].TID, Equals, 2)
+
+	plan, err := s.Tgtd.ReconcileContext(ctx, config)
+	c.Assert(err, IsNil)
+	c.Assert(plan.Operations, Not(HasLen), 0)
+	c.Assert(s.Fake.TargetIDs(), DeepEquals, []int{1, 2, 3})
+}
+
+func (s *TargetsConfSuite) TestParseErrors(c *C) {
+	for _, conf := range []string{
+		"default-driver iser\n",
+		"backing-store /dev/sdb\n",
+		"<target iqn.2019-10.io.longhorn:vol1>\n",
+		"<target iqn.2019-10.io.longhorn:vol1>\n<target iqn.2019-10.io.longhorn:vol2>\n",
+		"<target iqn.2019-10.io.longhorn:vol1>\n</backing-store>\n",
+		"<target iqn.2019-10.io.longhorn:vol1>\nwrite-cache off\n</target>\n",
+		"<target iqn.2019-10.io.longhorn:vol1>\ncontroller_tid one\n</target>\n",
+		"<target iqn.2019-10.io.longhorn:vol1>\ninitiator-address 10.0.0.300\n</target>\n",
+		"<target iqn.2019-10.io.longhorn:vol1>\nincominguser user\n</target>\n",
+		"<target iqn.2019-10.io.longhorn:vol1>\nincominguser user a\noutgoinguser user b\n</target>\n",
+		"<target iqn.2019-10.io.longhorn:vol1>\nlun 1\n</target>\n",
+	} {
+		_, err := iscsi.ParseTargetsConf(conf)
+		c.Assert(err, NotNil, Commentf("%s", conf))
+	}
+}
@@ -0,0 +1,69 @@
+package iscsi
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/types"
+	"github.com/longhorn/go-iscsi-helper/util"
+
+	lhtypes "github.com/longhorn/go-common-libs/types"
+)
+
+// tgtadm executes tgtadm with opts against the instance. If the command
+// fails, the returned error is a *types.TgtadmError. The secrets in opts, e.g.
+// CHAP passwords, are redacted from the returned error.
+func (t *Tgtd) tgtadm(ctx context.Context, opts []string, secrets ...string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var (
+		output string
+		err    error
+	)
+	opts = t.tgtadmOpts(opts)
+	backend := t.backend()
+	if contextBackend, ok := backend.(ContextTgtadmBackend); ok {
+		output, err = contextBackend.ExecuteContext(ctx, opts, lhtypes.ExecuteDefaultTimeout)
+	} else {
+		output, err = backend.Execute(opts, contextTimeout(ctx, lhtypes.ExecuteDefaultTimeout))
+	}
+	if err != nil {
+		return output, newTgtadmError(opts, err, secrets...)
+	}
+	return output, nil
+}
+
+func newTgtadmError(opts []string, err error, secrets ...string) *types.TgtadmError {
+	// Both *exec.ExitError and *tgtdResponseError carry the exit code
+	exitCode := -1
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+	if len(secrets) != 0 {
+		opts = util.RedactArgs(opts, secrets...)
+		err = util.RedactError(err, secrets...)
+	}
+	return types.NewTgtadmError(opts, parseStderr(err.Error()), exitCode, err)
+}
+
+// parseStderr extracts the stderr of the command from the error message
+// generated by lhexec, which looks like:
+//
+//	failed to execute: /usr/sbin/tgtadm [tgtadm --op ...], output , stderr tgtadm: can't find the target
+//	: exit status 4
+func parseStderr(msg string) string {
+	const stderrPrefix = ", stderr "
+	i := strings.LastIndex(msg, stderrPrefix)
+	if i < 0 {
+		return msg
+	}
+	stderr := msg[i+len(stderrPrefix):]
+	if j := strings.LastIndex(stderr, ": exit status "); j >= 0 {
+		stderr = stderr[:j]
+	}
+	return strings.TrimSpace(stderr)
+}
@@ -0,0 +1,50 @@
+package iscsi
+
+import (
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type TgtadmSuite struct{}
+
+var _ = Suite(&TgtadmSuite{})
+
+func (s *TgtadmSuite) TestNewTgtadmError(c *C) {
+	opts := []string{"--op", "delete", "--mode", "target", "--tid", "1"}
+	cause := errors.New("failed to execute: /usr/sbin/tgtadm [tgtadm --op delete --mode target --tid 1], output , stderr tgtadm: can't find the target\n")
+
+	err := error(newTgtadmError(opts, cause))
+	c.Assert(errors.Is(err, types.ErrNoTarget), Equals, true)
+	c.Assert(errors.Is(err, types.ErrTargetExist), Equals, false)
+	c.Assert(errors.Is(err, cause), Equals, true)
+
+	var tgtadmErr *types.TgtadmError
+	c.Assert(errors.As(err, &tgtadmErr), Equals, true)
+	c.Assert(tgtadmErr.Args, DeepEquals, opts)
+	c.Assert(tgtadmErr.Output, Equals, "tgtadm: can't find the target")
+	c.Assert(tgtadmErr.ExitCode, Equals, -1)
+	// The command line is only shown once
+	c.Assert(err.Error(), Equals, "tgtadm failed: "+cause.Error())
+	c.Assert(types.NewTgtadmError(opts, "", 4, errors.New("tgtadm: can't find the target")).Error(), Equals, "tgtadm --op delete --mode target --tid 1 failed: tgtadm: can't find the target")
+
+	wrapped := errors.Wrap(err, "failed to delete target")
+	c.Assert(errors.Is(wrapped, types.ErrNoTarget), Equals, true)
+}
+
+func (s *TgtadmSuite) TestNewTgtadmErrorUnclassified(c *C) {
+	cause := errors.New("timeout executing: /usr/sbin/tgtadm [tgtadm --op show --mode target]")
+	err := newTgtadmError([]string{"--op", "show", "--mode", "target"}, cause)
+	c.Assert(err.Err, IsNil)
+	c.Assert(errors.Is(err, cause), Equals, true)
+}
+
+func (s *TgtadmSuite) TestTgtadmErrorFromCode(c *C) {
+	c.Assert(types.TgtadmErrorFromCode(0), IsNil)
+	c.Assert(types.TgtadmErrorFromCode(4), Equals, types.ErrNoTarget)
+	c.Assert(types.TgtadmErrorFromCode(20), Equals, types.ErrLunActive)
+	c.Assert(types.TgtadmErrorFromCode(24), Equals, types.ErrPreventRemoval)
+	c.Assert(types.TgtadmErrorFromCode(25), IsNil)
+}
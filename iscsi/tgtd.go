@@ -0,0 +1,71 @@
+package iscsi
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// DefaultTgtdLogFile is the log file of the default tgtd instance.
+const DefaultTgtdLogFile = "/var/log/tgtd.log"
+
+// Tgtd is a tgtd instance. Several instances can run on a host, e.g. for the
+// old and the new instance manager during an upgrade, as long as each of them
+// has its own control port and portals.
+//
+// The methods manage the instance, e.g. CreateTargetContext, while the package
+// level functions of the same names manage DefaultTgtd.
+type Tgtd struct {
+	// ControlPort selects the management socket of the instance, i.e.
+	// `tgtd -C <port>` and `tgtadm -C <port>`.
+	ControlPort int
+	// Portals are the iSCSI portals the instance listens on, or all
+	// addresses with the default port if empty.
+	Portals []Portal
+	// LogFile receives the output of the instance launched by
+	// StartDaemonContext besides stderr if not empty.
+	LogFile string
+	// Backend sends the requests to the instance, or the backend set by
+	// SetTgtadmBackend is used if nil. The requests carry the control port
+	// either way.
+	Backend TgtadmBackend
+}
+
+// DefaultTgtd returns the instance on DefaultControlPort listening on all
+// addresses, which the package level functions manage.
+func DefaultTgtd() *Tgtd {
+	return &Tgtd{
+		ControlPort: DefaultControlPort,
+		LogFile:     DefaultTgtdLogFile,
+	}
+}
+
+// SocketPath returns the management socket of the instance.
+func (t *Tgtd) SocketPath() string {
+	return fmt.Sprintf("%s.%d", TgtdSocketPrefix, t.ControlPort)
+}
+
+// Options returns the options to launch the instance, e.g. with
+// TgtdSupervisor.
+func (t *Tgtd) Options() TgtdOptions {
+	return TgtdOptions{
+		ControlPort: t.ControlPort,
+		Portals:     t.Portals,
+		LogFile:     t.LogFile,
+	}
+}
+
+func (t *Tgtd) backend() TgtadmBackend {
+	if t.Backend != nil {
+		return t.Backend
+	}
+	return getTgtadmBackend()
+}
+
+// tgtadmOpts returns opts with the control port of the instance. It's left
+// out for the default port, so the requests stay the same as before.
+func (t *Tgtd) tgtadmOpts(opts []string) []string {
+	if t.ControlPort == DefaultControlPort {
+		return opts
+	}
+	return append([]string{"--control-port", strconv.Itoa(t.ControlPort)}, opts...)
+}
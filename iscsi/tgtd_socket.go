@@ -0,0 +1,390 @@
+package iscsi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/types"
+)
+
+// The protocol of the tgtd management socket is from tgt/usr/tgtadm.h and
+// tgt/usr/tgtadm.c. A request is a tgtadm_req header followed by the
+// NUL-terminated parameters, and a response is a tgtadm_rsp header followed
+// by the output of the show operations.
+const (
+	TgtdSocketPrefix   = "/var/run/tgtd/socket"
+	DefaultControlPort = 0
+
+	tgtLLDNameLen  = 64
+	tgtadmReqSize  = 120
+	tgtadmRspSize  = 8
+	tgtadmMaxParam = 8192
+)
+
+const (
+	tgtadmOpNew = iota
+	tgtadmOpDelete
+	tgtadmOpShow
+	tgtadmOpBind
+	tgtadmOpUnbind
+	tgtadmOpUpdate
+	tgtadmOpStats
+	tgtadmOpStart
+	tgtadmOpStop
+)
+
+const (
+	tgtadmModeSystem = iota
+	tgtadmModeTarget
+	tgtadmModeDevice
+	tgtadmModePortal
+	tgtadmModeLLD
+	tgtadmModeSession
+	tgtadmModeConnection
+	tgtadmModeAccount
+)
+
+const (
+	tgtadmAccountIncoming = iota
+	tgtadmAccountOutgoing
+)
+
+var (
+	tgtadmOps = map[string]uint32{
+		"new":    tgtadmOpNew,
+		"delete": tgtadmOpDelete,
+		"show":   tgtadmOpShow,
+		"bind":   tgtadmOpBind,
+		"unbind": tgtadmOpUnbind,
+		"update": tgtadmOpUpdate,
+		"stat":   tgtadmOpStats,
+		"start":  tgtadmOpStart,
+		"stop":   tgtadmOpStop,
+	}
+
+	tgtadmModes = map[string]uint32{
+		"system":      tgtadmModeSystem,
+		"sys":         tgtadmModeSystem,
+		"target":      tgtadmModeTarget,
+		"tgt":         tgtadmModeTarget,
+		"logicalunit": tgtadmModeDevice,
+		"lu":          tgtadmModeDevice,
+		"portal":      tgtadmModePortal,
+		"lld":         tgtadmModeLLD,
+		"session":     tgtadmModeSession,
+		"sess":        tgtadmModeSession,
+		"connection":  tgtadmModeConnection,
+		"conn":        tgtadmModeConnection,
+		"account":     tgtadmModeAccount,
+	}
+
+	// tgtadmDeviceTypes are the SCSI peripheral device types from tgt/usr/scsi.h
+	tgtadmDeviceTypes = map[string]uint32{
+		"disk":    0x00,
+		"tape":    0x01,
+		"cd":      0x05,
+		"changer": 0x08,
+		"osd":     0x11,
+		"pt":      0xff,
+	}
+)
+
+// tgtadmReq is the Go representation of struct tgtadm_req.
+type tgtadmReq struct {
+	mode       uint32
+	op         uint32
+	lld        string
+	tid        int32
+	sid        uint64
+	lun        uint64
+	cid        uint32
+	hostNo     uint32
+	deviceType uint32
+	acDir      uint32
+	pack       uint32
+	force      uint32
+
+	params string
+
+	// controlPort selects the socket rather than being sent, or it's -1 if
+	// not specified.
+	controlPort int
+}
+
+// marshal encodes the request in the native byte order, since tgtd only
+// listens on a local unix socket.
+func (req *tgtadmReq) marshal() []byte {
+	params := append([]byte(req.params), 0)
+	buf := make([]byte, tgtadmReqSize, tgtadmReqSize+len(params))
+	order := binary.NativeEndian
+	order.PutUint32(buf[0:], req.mode)
+	order.PutUint32(buf[4:], req.op)
+	copy(buf[8:8+tgtLLDNameLen-1], req.lld)
+	order.PutUint32(buf[72:], uint32(tgtadmReqSize+len(params)))
+	order.PutUint32(buf[76:], uint32(req.tid))
+	order.PutUint64(buf[80:], req.sid)
+	order.PutUint64(buf[88:], req.lun)
+	order.PutUint32(buf[96:], req.cid)
+	order.PutUint32(buf[100:], req.hostNo)
+	order.PutUint32(buf[104:], req.deviceType)
+	order.PutUint32(buf[108:], req.acDir)
+	order.PutUint32(buf[112:], req.pack)
+	order.PutUint32(buf[116:], req.force)
+	return append(buf, params...)
+}
+
+// tgtdResponseError is the error code returned by tgtd. Like tgtadm, the
+// error code is used as the exit code.
+type tgtdResponseError struct {
+	code int
+}
+
+func (e *tgtdResponseError) Error() string {
+	msg := types.TgtadmUnknown
+	if sentinel := types.TgtadmErrorFromCode(e.code); sentinel != nil {
+		msg = sentinel.Error()
+	}
+	return "tgtadm: " + msg
+}
+
+func (e *tgtdResponseError) ExitCode() int {
+	return e.code
+}
+
+// SocketBackend talks to the management socket of tgtd directly rather than
+// forking tgtadm.
+type SocketBackend struct {
+	// Path is the management socket of tgtd, e.g. /var/run/tgtd/socket.0
+	Path string
+}
+
+// NewSocketBackend returns a backend for the tgtd instance listening on the
+// control port, i.e. `tgtd -C <controlPort>`.
+func NewSocketBackend(controlPort int) *SocketBackend {
+	return &SocketBackend{
+		Path: (&Tgtd{ControlPort: controlPort}).SocketPath(),
+	}
+}
+
+func (b *SocketBackend) Execute(opts []string, timeout time.Duration) (string, error) {
+	return b.ExecuteContext(context.Background(), opts, timeout)
+}
+
+// ExecuteContext sends the request to tgtd. The connection is closed once ctx
+// is done, which aborts the request. Like tgtadm, the control port option
+// overrides Path.
+func (b *SocketBackend) ExecuteContext(ctx context.Context, opts []string, timeout time.Duration) (output string, err error) {
+	req, err := parseTgtadmOpts(opts)
+	if err != nil {
+		return "", err
+	}
+
+	path := b.Path
+	if req.controlPort >= 0 {
+		path = (&Tgtd{ControlPort: req.controlPort}).SocketPath()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to connect to tgtd socket %v", path)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer func() {
+		if !stop() && ctx.Err() != nil && err != nil {
+			err = errors.Mark(err, ctx.Err())
+		}
+		_ = conn.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := conn.Write(req.marshal()); err != nil {
+		return "", errors.Wrapf(err, "failed to send request to tgtd socket %v", path)
+	}
+
+	rsp := make([]byte, tgtadmRspSize)
+	if _, err := io.ReadFull(conn, rsp); err != nil {
+		return "", errors.Wrapf(err, "failed to receive response from tgtd socket %v", path)
+	}
+	code := binary.NativeEndian.Uint32(rsp[0:])
+	length := binary.NativeEndian.Uint32(rsp[4:])
+	if code != 0 {
+		return "", &tgtdResponseError{code: int(code)}
+	}
+	if length <= tgtadmRspSize {
+		return "", nil
+	}
+
+	buf := make([]byte, length-tgtadmRspSize)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", errors.Wrapf(err, "failed to receive output from tgtd socket %v", path)
+	}
+	return string(bytes.TrimRight(buf, "\x00")), nil
+}
+
+// parseTgtadmOpts converts the tgtadm command line options used by this
+// package to a request, the same way tgtadm does.
+func parseTgtadmOpts(opts []string) (*tgtadmReq, error) {
+	req := &tgtadmReq{
+		lld:         "iscsi",
+		tid:         -1,
+		lun:         ^uint64(0),
+		controlPort: -1,
+	}
+
+	var (
+		targetName, path, bsType, bsOpts, bsOFlags, blockSize string
+		address, initiatorName, user, password, name, value   string
+		params                                                []string
+		hasOp, hasMode                                        bool
+	)
+	for i := 0; i < len(opts); i++ {
+		opt := opts[i]
+		if opt == "--outgoing" || opt == "-O" {
+			req.acDir = tgtadmAccountOutgoing
+			continue
+		}
+		if opt == "--force" || opt == "-F" {
+			req.force = 1
+			continue
+		}
+
+		if i+1 >= len(opts) {
+			return nil, fmt.Errorf("missing value for tgtadm option %v", opt)
+		}
+		i++
+		arg := opts[i]
+
+		var err error
+		switch opt {
+		case "--control-port", "-C":
+			req.controlPort, err = strconv.Atoi(arg)
+		case "--lld", "-L":
+			req.lld = arg
+		case "--op", "-o":
+			if req.op, hasOp = tgtadmOps[arg]; !hasOp {
+				return nil, fmt.Errorf("unknown tgtadm operation %v", arg)
+			}
+		case "--mode", "-m":
+			if req.mode, hasMode = tgtadmModes[arg]; !hasMode {
+				return nil, fmt.Errorf("unknown tgtadm mode %v", arg)
+			}
+		case "--tid", "-t":
+			var tid int64
+			tid, err = strconv.ParseInt(arg, 10, 32)
+			req.tid = int32(tid)
+		case "--sid", "-s":
+			req.sid, err = strconv.ParseUint(arg, 10, 64)
+		case "--cid", "-c":
+			var cid uint64
+			cid, err = strconv.ParseUint(arg, 10, 32)
+			req.cid = uint32(cid)
+		case "--lun", "-l":
+			req.lun, err = strconv.ParseUint(arg, 10, 64)
+		case "--targetname", "-T":
+			targetName = arg
+		case "--backing-store", "-b":
+			path = arg
+		case "--bstype", "-E":
+			bsType = arg
+		case "--bsopts", "-S":
+			bsOpts = arg
+		case "--bsoflags", "-f":
+			bsOFlags = arg
+		case "--blocksize", "-y":
+			blockSize = arg
+		case "--device-type", "-Y":
+			deviceType, exists := tgtadmDeviceTypes[arg]
+			if !exists {
+				return nil, fmt.Errorf("unknown device type %v", arg)
+			}
+			req.deviceType = deviceType
+		case "--initiator-address", "-I":
+			address = arg
+		case "--initiator-name", "-Q":
+			initiatorName = arg
+		case "--user", "-u":
+			user = arg
+		case "--password", "-p":
+			password = arg
+		case "--name", "-n":
+			name = arg
+		case "--value", "-v":
+			value = arg
+		case "--params", "--param", "-P":
+			params = append(params, arg)
+		default:
+			return nil, fmt.Errorf("unsupported tgtadm option %v", opt)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value %v for tgtadm option %v", arg, opt)
+		}
+	}
+	if !hasOp || !hasMode {
+		return nil, fmt.Errorf("tgtadm operation and mode are required")
+	}
+
+	b := []string{}
+	switch req.mode {
+	case tgtadmModeTarget:
+		if targetName != "" {
+			b = append(b, "targetname="+targetName)
+		}
+		if address != "" {
+			b = append(b, "initiator-address="+address)
+		}
+		if initiatorName != "" {
+			b = append(b, "initiator-name="+initiatorName)
+		}
+	case tgtadmModeDevice:
+		if path != "" {
+			b = append(b, "path="+path)
+		}
+		if bsType != "" {
+			b = append(b, "bstype="+bsType)
+		}
+		if bsOpts != "" {
+			b = append(b, "bsopts="+bsOpts)
+		}
+		if bsOFlags != "" {
+			b = append(b, "bsoflags="+bsOFlags)
+		}
+		if blockSize != "" {
+			b = append(b, "blocksize="+blockSize)
+		}
+	case tgtadmModeAccount:
+		if user != "" {
+			b = append(b, "user="+user)
+		}
+		if password != "" {
+			b = append(b, "password="+password)
+		}
+	}
+	if name != "" {
+		b = append(b, name+"="+value)
+	}
+	b = append(b, params...)
+
+	req.params = strings.Join(b, ",")
+	if len(req.params) >= tgtadmMaxParam {
+		return nil, fmt.Errorf("tgtadm parameters are too long")
+	}
+	return req, nil
+}
@@ -0,0 +1,175 @@
+package iscsi
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type TgtdSocketSuite struct{}
+
+var _ = Suite(&TgtdSocketSuite{})
+
+func (s *TgtdSocketSuite) TestParseTgtadmOpts(c *C) {
+	req, err := parseTgtadmOpts([]string{
+		"--lld", "iscsi",
+		"--op", "new",
+		"--mode", "logicalunit",
+		"--tid", "3",
+		"--lun", "1",
+		"-b", "/var/run/longhorn-vol.sock",
+		"--bstype", "longhorn",
+		"--bsopts", "size=1024;request_timeout=15",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(req.op, Equals, uint32(tgtadmOpNew))
+	c.Assert(req.mode, Equals, uint32(tgtadmModeDevice))
+	c.Assert(req.tid, Equals, int32(3))
+	c.Assert(req.lun, Equals, uint64(1))
+	c.Assert(req.params, Equals, "path=/var/run/longhorn-vol.sock,bstype=longhorn,bsopts=size=1024;request_timeout=15")
+
+	req, err = parseTgtadmOpts([]string{"--op", "bind", "--mode", "account", "--tid", "1", "--user", "u", "--outgoing"})
+	c.Assert(err, IsNil)
+	c.Assert(req.acDir, Equals, uint32(tgtadmAccountOutgoing))
+	c.Assert(req.params, Equals, "user=u")
+	c.Assert(req.lun, Equals, ^uint64(0))
+
+	req, err = parseTgtadmOpts([]string{"--op", "show", "--mode", "target"})
+	c.Assert(err, IsNil)
+	c.Assert(req.tid, Equals, int32(-1))
+	c.Assert(req.params, Equals, "")
+	c.Assert(req.controlPort, Equals, -1)
+
+	// The control port selects the socket rather than being sent
+	req, err = parseTgtadmOpts([]string{"--control-port", "1", "--op", "show", "--mode", "target"})
+	c.Assert(err, IsNil)
+	c.Assert(req.controlPort, Equals, 1)
+	c.Assert(req.params, Equals, "")
+
+	_, err = parseTgtadmOpts([]string{"--op", "show"})
+	c.Assert(err, NotNil)
+	_, err = parseTgtadmOpts([]string{"--op", "show", "--mode", "target", "--unknown", "x"})
+	c.Assert(err, NotNil)
+	_, err = parseTgtadmOpts([]string{"--op", "show", "--mode"})
+	c.Assert(err, NotNil)
+}
+
+// serveTgtd accepts one request on the socket, and replies with the error
+// code and the output.
+func serveTgtd(c *C, l net.Listener, code uint32, output string, reqCh chan<- []byte) {
+	conn, err := l.Accept()
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	header := make([]byte, tgtadmReqSize)
+	_, err = io.ReadFull(conn, header)
+	c.Assert(err, IsNil)
+	length := binary.NativeEndian.Uint32(header[72:])
+	params := make([]byte, length-tgtadmReqSize)
+	_, err = io.ReadFull(conn, params)
+	c.Assert(err, IsNil)
+	reqCh <- append(header, params...)
+
+	rsp := make([]byte, tgtadmRspSize)
+	binary.NativeEndian.PutUint32(rsp[0:], code)
+	binary.NativeEndian.PutUint32(rsp[4:], uint32(tgtadmRspSize+len(output)))
+	_, err = conn.Write(append(rsp, output...))
+	c.Assert(err, IsNil)
+}
+
+func (s *TgtdSocketSuite) TestSocketBackend(c *C) {
+	path := filepath.Join(c.MkDir(), "socket.0")
+	l, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	defer l.Close()
+	backend := &SocketBackend{Path: path}
+
+	reqCh := make(chan []byte, 1)
+	go serveTgtd(c, l, 0, "Target 1: iqn.2019-10.io.longhorn:vol\n", reqCh)
+	output, err := backend.Execute([]string{"--lld", "iscsi", "--op", "new", "--mode", "target", "--tid", "1", "-T", "iqn.2019-10.io.longhorn:vol"}, time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "Target 1: iqn.2019-10.io.longhorn:vol\n")
+
+	req := <-reqCh
+	c.Assert(binary.NativeEndian.Uint32(req[0:]), Equals, uint32(tgtadmModeTarget))
+	c.Assert(binary.NativeEndian.Uint32(req[4:]), Equals, uint32(tgtadmOpNew))
+	c.Assert(string(req[8:13]), Equals, "iscsi")
+	c.Assert(int32(binary.NativeEndian.Uint32(req[76:])), Equals, int32(1))
+	c.Assert(string(req[tgtadmReqSize:]), Equals, "targetname=iqn.2019-10.io.longhorn:vol\x00")
+
+	go serveTgtd(c, l, 4, "", reqCh)
+	opts := []string{"--lld", "iscsi", "--op", "delete", "--mode", "target", "--tid", "2"}
+	_, err = backend.Execute(opts, time.Second)
+	c.Assert(err, NotNil)
+	<-reqCh
+
+	tgtadmErr := newTgtadmError(opts, err)
+	c.Assert(errors.Is(tgtadmErr, types.ErrNoTarget), Equals, true)
+	c.Assert(tgtadmErr.ExitCode, Equals, 4)
+	c.Assert(tgtadmErr.Output, Equals, "tgtadm: "+types.TgtadmNoTarget)
+}
+
+func (s *TgtdSocketSuite) TestSocketBackendCancel(c *C) {
+	path := filepath.Join(c.MkDir(), "socket.0")
+	l, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	defer l.Close()
+	backend := &SocketBackend{Path: path}
+
+	// tgtd accepts the request but never replies
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = backend.ExecuteContext(ctx, []string{"--lld", "iscsi", "--op", "show", "--mode", "target"}, time.Minute)
+	c.Assert(errors.Is(err, context.Canceled), Equals, true)
+	c.Assert(time.Since(start) < time.Minute, Equals, true)
+}
+
+func (s *TgtdSocketSuite) TestSystemInfoVersion(c *C) {
+	path := filepath.Join(c.MkDir(), "socket.0")
+	l, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	defer l.Close()
+	tgtd := &Tgtd{Backend: &SocketBackend{Path: path}}
+
+	// The socket cannot answer --version, so tgtadm is executed for it
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "tgtadm"), []byte("#!/bin/sh\necho 1.0.85\n"), 0755), IsNil)
+	env := os.Getenv("PATH")
+	c.Assert(os.Setenv("PATH", dir+string(os.PathListSeparator)+env), IsNil)
+	defer func() {
+		c.Assert(os.Setenv("PATH", env), IsNil)
+	}()
+	reqCh := make(chan []byte, 1)
+	go serveTgtd(c, l, 0, "System:\n    State: ready\n", reqCh)
+	info, err := tgtd.GetSystemInfoContext(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(info.State, Equals, "ready")
+	c.Assert(info.Version, Equals, "1.0.85")
+	<-reqCh
+
+	c.Assert(os.WriteFile(filepath.Join(dir, "tgtadm"), []byte("#!/bin/sh\nexit 1\n"), 0755), IsNil)
+	go serveTgtd(c, l, 0, "System:\n    State: ready\n", reqCh)
+	_, err = tgtd.GetSystemInfoContext(context.Background())
+	c.Assert(err, ErrorMatches, "failed to get the version of tgt: .*")
+	<-reqCh
+}
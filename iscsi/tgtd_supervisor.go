@@ -0,0 +1,562 @@
+package iscsi
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/util"
+)
+
+const (
+	DefaultTgtdReadinessTimeout  = 10 * time.Second
+	DefaultTgtdProbeInterval     = 10 * time.Second
+	DefaultTgtdProbeTimeout      = 5 * time.Second
+	DefaultTgtdFailureThreshold  = 3
+	DefaultTgtdRestartBackoff    = 1 * time.Second
+	DefaultTgtdMaxRestartBackoff = 1 * time.Minute
+	DefaultTgtdStopTimeout       = 30 * time.Second
+
+	tgtdBinary = "tgtd"
+
+	tgtdReadinessInterval = 200 * time.Millisecond
+	tgtdExitsBuffer       = 16
+)
+
+var (
+	// supervisedPorts are the control ports of the started supervisors, so
+	// StartDaemon doesn't launch another tgtd while one is restarting
+	supervisedPortsLock sync.Mutex
+	supervisedPorts     = map[int]bool{}
+)
+
+// TgtdOptions are the options to launch tgtd.
+type TgtdOptions struct {
+	// Binary is the path of tgtd, or tgtd in PATH if empty.
+	Binary string
+	// Debug enables the debug logs of tgtd.
+	Debug bool
+	// ControlPort is the control port of tgtd, which must be unique among
+	// the tgtd instances on the host.
+	ControlPort int
+	// Portals are the portals tgtd listens on. tgtd listens on all addresses
+	// with the default port if empty.
+	Portals []Portal
+	// LogFile receives the output of tgtd besides stderr if not empty.
+	LogFile string
+	// ExtraArgs are appended to the arguments of tgtd.
+	ExtraArgs []string
+}
+
+func (o *TgtdOptions) args() []string {
+	// Keep tgtd in the foreground, so it can be supervised
+	args := []string{"-f"}
+	if o.Debug {
+		args = append(args, "-d", "1")
+	}
+	if o.ControlPort != DefaultControlPort {
+		args = append(args, "-C", strconv.Itoa(o.ControlPort))
+	}
+	if len(o.Portals) != 0 {
+		params := []string{}
+		for _, portal := range o.Portals {
+			params = append(params, "portal="+portal.String())
+		}
+		args = append(args, "--iscsi", strings.Join(params, ","))
+	}
+	return append(args, o.ExtraArgs...)
+}
+
+// TgtdSupervisorOptions are the options of TgtdSupervisor. The zero values of
+// the durations and the threshold are replaced by the defaults.
+type TgtdSupervisorOptions struct {
+	TgtdOptions
+
+	// Backend sends the requests of the probes and Stop to tgtd, or the
+	// backend set by SetTgtadmBackend is used if nil.
+	Backend TgtadmBackend
+
+	// ReadinessProbe checks if tgtd is ready after it's launched. By default,
+	// tgtd and its iSCSI driver must be in the ready state.
+	ReadinessProbe func(ctx context.Context, tgtd *Tgtd) error
+	// ReadinessTimeout is how long to wait for tgtd to be ready.
+	ReadinessTimeout time.Duration
+
+	// LivenessProbe checks if tgtd is still serving. By default, tgtd must
+	// answer a management request.
+	LivenessProbe func(ctx context.Context, tgtd *Tgtd) error
+	// ProbeInterval is the interval of the liveness probes.
+	ProbeInterval time.Duration
+	// ProbeTimeout is the timeout of each liveness probe.
+	ProbeTimeout time.Duration
+	// FailureThreshold is the number of consecutive liveness probe failures
+	// after which tgtd is killed and restarted.
+	FailureThreshold int
+
+	// DisableRestart disables the restart of tgtd once it exits.
+	DisableRestart bool
+	// MaxRestarts is the max number of consecutive restarts, i.e. restarts of
+	// a tgtd which doesn't stay up for MaxRestartBackoff. No limit if 0.
+	MaxRestarts int
+	// RestartBackoff is the delay before the first restart. It's doubled for
+	// each consecutive restart, up to MaxRestartBackoff.
+	RestartBackoff    time.Duration
+	MaxRestartBackoff time.Duration
+
+	// StopTimeout is how long Stop waits for tgtd to exit before it's
+	// terminated, and then killed.
+	StopTimeout time.Duration
+}
+
+func (o TgtdSupervisorOptions) withDefaults() TgtdSupervisorOptions {
+	if o.Binary == "" {
+		o.Binary = tgtdBinary
+	}
+	if o.ReadinessProbe == nil {
+		o.ReadinessProbe = ProbeTgtdReadiness
+	}
+	if o.ReadinessTimeout == 0 {
+		o.ReadinessTimeout = DefaultTgtdReadinessTimeout
+	}
+	if o.LivenessProbe == nil {
+		o.LivenessProbe = ProbeTgtdLiveness
+	}
+	if o.ProbeInterval == 0 {
+		o.ProbeInterval = DefaultTgtdProbeInterval
+	}
+	if o.ProbeTimeout == 0 {
+		o.ProbeTimeout = DefaultTgtdProbeTimeout
+	}
+	if o.FailureThreshold == 0 {
+		o.FailureThreshold = DefaultTgtdFailureThreshold
+	}
+	if o.RestartBackoff == 0 {
+		o.RestartBackoff = DefaultTgtdRestartBackoff
+	}
+	if o.MaxRestartBackoff == 0 {
+		o.MaxRestartBackoff = DefaultTgtdMaxRestartBackoff
+	}
+	if o.StopTimeout == 0 {
+		o.StopTimeout = DefaultTgtdStopTimeout
+	}
+	return o
+}
+
+// TgtdExit notifies an exit of tgtd.
+type TgtdExit struct {
+	// PID is the process ID of the exited tgtd, or 0 if it failed to launch.
+	PID int
+	// Err is why tgtd exited, or nil if it exited with status 0.
+	Err error
+	// Restarting is true if tgtd will be restarted after the backoff.
+	Restarting bool
+	// Stopped is true if tgtd exited because of Stop.
+	Stopped bool
+}
+
+// TgtdSupervisor launches tgtd and keeps it running. tgtd is restarted with
+// backoff once it exits or fails the liveness probes, and every exit is
+// notified through Exits. A supervisor can only be started once.
+type TgtdSupervisor struct {
+	options TgtdSupervisorOptions
+
+	lock     sync.Mutex
+	started  bool
+	stopping bool
+	process  *tgtdProcess
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	exits  chan TgtdExit
+	done   chan struct{}
+}
+
+type tgtdProcess struct {
+	cmd     *exec.Cmd
+	started time.Time
+	exited  chan struct{}
+	// err is set before exited is closed
+	err error
+}
+
+func NewTgtdSupervisor(options TgtdSupervisorOptions) *TgtdSupervisor {
+	s := &TgtdSupervisor{
+		options: options.withDefaults(),
+		exits:   make(chan TgtdExit, tgtdExitsBuffer),
+		done:    make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// Tgtd returns the supervised instance.
+func (s *TgtdSupervisor) Tgtd() *Tgtd {
+	return &Tgtd{
+		ControlPort: s.options.ControlPort,
+		Portals:     s.options.Portals,
+		LogFile:     s.options.LogFile,
+		Backend:     s.options.Backend,
+	}
+}
+
+// Exits returns the channel of the exit notifications. It's closed once
+// tgtd won't be restarted anymore, i.e. it's stopped or out of restarts.
+// Notifications are dropped if the channel is full.
+func (s *TgtdSupervisor) Exits() <-chan TgtdExit {
+	return s.exits
+}
+
+// PID returns the process ID of the current tgtd, or 0 if it's not running.
+func (s *TgtdSupervisor) PID() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.process == nil || s.process.hasExited() {
+		return 0
+	}
+	return s.process.cmd.Process.Pid
+}
+
+// Start launches tgtd and waits until it's ready. Once started, tgtd is
+// supervised until Stop, regardless of ctx.
+func (s *TgtdSupervisor) Start(ctx context.Context) error {
+	s.lock.Lock()
+	if s.started {
+		s.lock.Unlock()
+		return errors.New("tgtd supervisor is already started")
+	}
+	s.started = true
+	s.lock.Unlock()
+
+	if err := superviseControlPort(s.options.ControlPort); err != nil {
+		s.cancel()
+		close(s.exits)
+		close(s.done)
+		return err
+	}
+	p, err := s.launch()
+	if err == nil {
+		err = s.waitReady(ctx, p)
+	}
+	if err != nil {
+		unsuperviseControlPort(s.options.ControlPort)
+		s.cancel()
+		close(s.exits)
+		close(s.done)
+		return err
+	}
+	go s.supervise(p)
+	return nil
+}
+
+// Stop drains tgtd and stops it. All connections are closed and all targets
+// are deleted first, and tgtd is kept running if it fails. Then tgtd is asked
+// to shut down, and it's terminated if it doesn't exit within the stop
+// timeout, or killed once ctx is done.
+func (s *TgtdSupervisor) Stop(ctx context.Context) error {
+	s.lock.Lock()
+	started, p := s.started, s.process
+	s.lock.Unlock()
+	if !started {
+		return nil
+	}
+	tgtd := s.Tgtd()
+
+	if p != nil && !p.hasExited() {
+		if err := tgtd.drainTgtd(ctx); err != nil {
+			return errors.Wrap(err, "failed to drain tgtd")
+		}
+	}
+
+	// No more restart from now on
+	s.lock.Lock()
+	s.stopping = true
+	p = s.process
+	s.lock.Unlock()
+	s.cancel()
+
+	if p != nil && !p.hasExited() {
+		if _, err := tgtd.tgtadm(ctx, []string{"--op", "delete", "--mode", "system"}); err != nil {
+			logrus.WithError(err).Warn("Failed to shut down tgtd, will terminate it")
+		}
+		if !p.wait(ctx, s.options.StopTimeout) {
+			logrus.Warnf("Terminating tgtd %v", p.cmd.Process.Pid)
+			_ = p.cmd.Process.Signal(syscall.SIGTERM)
+			if !p.wait(ctx, s.options.StopTimeout) {
+				logrus.Warnf("Killing tgtd %v", p.cmd.Process.Pid)
+				_ = p.cmd.Process.Kill()
+			}
+		}
+	}
+	<-s.done
+	return nil
+}
+
+func (s *TgtdSupervisor) launch() (*tgtdProcess, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopping {
+		return nil, errors.New("tgtd supervisor is stopping")
+	}
+
+	var (
+		output io.Writer = os.Stderr
+		logf   *os.File
+		err    error
+	)
+	if s.options.LogFile != "" {
+		logf, err = os.OpenFile(s.options.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		output = io.MultiWriter(os.Stderr, logf)
+	}
+	closeLog := func() {
+		if logf == nil {
+			return
+		}
+		if errClose := logf.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close log file")
+		}
+	}
+
+	cmd := exec.Command(s.options.Binary, s.options.args()...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		closeLog()
+		return nil, errors.Wrapf(err, "failed to launch %v", s.options.Binary)
+	}
+
+	forgetCapabilities(s.options.ControlPort)
+
+	p := &tgtdProcess{
+		cmd:     cmd,
+		started: time.Now(),
+		exited:  make(chan struct{}),
+	}
+	go func() {
+		p.err = cmd.Wait()
+		closeLog()
+		close(p.exited)
+	}()
+	s.process = p
+	return p, nil
+}
+
+func (s *TgtdSupervisor) waitReady(ctx context.Context, p *tgtdProcess) error {
+	ctx, cancel := context.WithTimeout(ctx, s.options.ReadinessTimeout)
+	defer cancel()
+
+	for {
+		err := s.options.ReadinessProbe(ctx, s.Tgtd())
+		if p.hasExited() {
+			if p.err != nil {
+				return errors.Wrap(p.err, "tgtd exited before it was ready")
+			}
+			return errors.New("tgtd exited before it was ready")
+		}
+		if err == nil {
+			return nil
+		}
+		if errSleep := util.SleepContext(ctx, tgtdReadinessInterval); errSleep != nil {
+			// tgtd is of no use if it's not ready
+			_ = p.cmd.Process.Kill()
+			<-p.exited
+			return errors.WithSecondaryError(errors.Wrap(errSleep, "failed to wait for tgtd to be ready"), err)
+		}
+	}
+}
+
+func (s *TgtdSupervisor) supervise(p *tgtdProcess) {
+	defer close(s.done)
+	defer close(s.exits)
+	defer unsuperviseControlPort(s.options.ControlPort)
+
+	backoff := s.options.RestartBackoff
+	restarts := 0
+	for {
+		exit := TgtdExit{
+			PID: p.cmd.Process.Pid,
+			Err: s.monitor(p),
+		}
+		// A tgtd which was up long enough resets the backoff
+		if time.Since(p.started) >= s.options.MaxRestartBackoff {
+			backoff, restarts = s.options.RestartBackoff, 0
+		}
+
+		for p = nil; p == nil; {
+			s.lock.Lock()
+			exit.Stopped = s.stopping
+			s.lock.Unlock()
+			if exit.Stopped || s.options.DisableRestart ||
+				(s.options.MaxRestarts > 0 && restarts >= s.options.MaxRestarts) {
+				s.notify(exit)
+				return
+			}
+			exit.Restarting = true
+			s.notify(exit)
+
+			if err := util.SleepContext(s.ctx, backoff); err != nil {
+				return
+			}
+			backoff = min(backoff*2, s.options.MaxRestartBackoff)
+			restarts++
+
+			restarted, err := s.launch()
+			if err == nil {
+				err = s.waitReady(s.ctx, restarted)
+			}
+			if err != nil {
+				exit = TgtdExit{Err: err}
+				if restarted != nil {
+					exit.PID = restarted.cmd.Process.Pid
+				}
+				continue
+			}
+			p = restarted
+		}
+	}
+}
+
+// monitor probes the liveness of tgtd until it exits, and kills it once the
+// probe fails consecutively for the failure threshold.
+func (s *TgtdSupervisor) monitor(p *tgtdProcess) error {
+	ticker := time.NewTicker(s.options.ProbeInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-p.exited:
+			return p.err
+		case <-s.ctx.Done():
+			// Stop takes care of tgtd
+			<-p.exited
+			return p.err
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(s.ctx, s.options.ProbeTimeout)
+		err := s.options.LivenessProbe(ctx, s.Tgtd())
+		cancel()
+		if err == nil || s.ctx.Err() != nil {
+			failures = 0
+			continue
+		}
+		failures++
+		logrus.WithError(err).Warnf("tgtd %v failed liveness probe %v/%v", p.cmd.Process.Pid, failures, s.options.FailureThreshold)
+		if failures >= s.options.FailureThreshold {
+			_ = p.cmd.Process.Kill()
+			<-p.exited
+			return errors.Wrapf(err, "tgtd was killed after %v failed liveness probes", failures)
+		}
+	}
+}
+
+func (s *TgtdSupervisor) notify(exit TgtdExit) {
+	if exit.Err != nil {
+		logrus.WithError(exit.Err).Warnf("tgtd %v exited, restarting: %v", exit.PID, exit.Restarting)
+	}
+	select {
+	case s.exits <- exit:
+	default:
+		logrus.Warnf("Dropped the exit notification of tgtd %v", exit.PID)
+	}
+}
+
+func (p *tgtdProcess) hasExited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait returns true if the process exits before the timeout or ctx is done.
+func (p *tgtdProcess) wait(ctx context.Context, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.exited:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func superviseControlPort(port int) error {
+	supervisedPortsLock.Lock()
+	defer supervisedPortsLock.Unlock()
+	if supervisedPorts[port] {
+		return errors.Errorf("tgtd on control port %v is already supervised", port)
+	}
+	supervisedPorts[port] = true
+	return nil
+}
+
+func unsuperviseControlPort(port int) {
+	supervisedPortsLock.Lock()
+	defer supervisedPortsLock.Unlock()
+	delete(supervisedPorts, port)
+}
+
+// supervised returns true if a started supervisor keeps tgtd running on the
+// control port.
+func supervised(port int) bool {
+	supervisedPortsLock.Lock()
+	defer supervisedPortsLock.Unlock()
+	return supervisedPorts[port]
+}
+
+// ProbeTgtdReadiness returns nil if tgtd and its iSCSI driver are ready.
+func ProbeTgtdReadiness(ctx context.Context, t *Tgtd) error {
+	info, err := t.showSystem(ctx)
+	if err != nil {
+		return err
+	}
+	return info.Ready()
+}
+
+// ProbeTgtdLiveness returns nil if tgtd answers a management request.
+func ProbeTgtdLiveness(ctx context.Context, t *Tgtd) error {
+	_, err := t.tgtadm(ctx, []string{"--op", "show", "--mode", "system"})
+	return err
+}
+
+// drainTgtd closes all connections and deletes all targets.
+func (t *Tgtd) drainTgtd(ctx context.Context) error {
+	targets, err := t.ListTargetsContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to show targets")
+	}
+
+	for _, target := range targets {
+		sessions, err := t.listSessions(ctx, target.TID)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get sessions of target %v", target.TID)
+		}
+		for _, session := range sessions {
+			for _, connection := range session.Connections {
+				if err := t.CloseConnectionContext(ctx, target.TID, strconv.Itoa(session.ID), strconv.Itoa(connection.ID)); err != nil {
+					return errors.Wrapf(err, "failed to close connection %v:%v of target %v", session.ID, connection.ID, target.TID)
+				}
+			}
+		}
+		if err := t.DeleteTargetContext(ctx, target.TID); err != nil {
+			return errors.Wrapf(err, "failed to delete target %v", target.TID)
+		}
+	}
+	return nil
+}
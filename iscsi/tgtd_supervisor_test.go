@@ -0,0 +1,240 @@
+package iscsi_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+
+	. "gopkg.in/check.v1"
+)
+
+type SupervisorSuite struct {
+	iscsitest.Fixture
+}
+
+var _ = Suite(&SupervisorSuite{})
+
+// tgtd writes a script standing in for tgtd, which ignores the arguments.
+func (s *SupervisorSuite) tgtd(c *C, script string) string {
+	binary := filepath.Join(c.MkDir(), "tgtd")
+	c.Assert(os.WriteFile(binary, []byte("#!/bin/sh\n"+script+"\n"), 0755), IsNil)
+	return binary
+}
+
+func (s *SupervisorSuite) receive(c *C, exits <-chan iscsi.TgtdExit) iscsi.TgtdExit {
+	select {
+	case exit, ok := <-exits:
+		c.Assert(ok, Equals, true)
+		return exit
+	case <-time.After(10 * time.Second):
+		c.Fatal("no exit notification")
+	}
+	return iscsi.TgtdExit{}
+}
+
+func (s *SupervisorSuite) assertClosed(c *C, exits <-chan iscsi.TgtdExit) {
+	select {
+	case _, ok := <-exits:
+		c.Assert(ok, Equals, false)
+	case <-time.After(10 * time.Second):
+		c.Fatal("exit notifications are not closed")
+	}
+}
+
+func (s *SupervisorSuite) TestStartAndStop(c *C) {
+	ctx := context.Background()
+	supervisor := iscsi.NewTgtdSupervisor(iscsi.TgtdSupervisorOptions{
+		TgtdOptions: iscsi.TgtdOptions{
+			Binary:  s.tgtd(c, "exec sleep 60"),
+			LogFile: filepath.Join(c.MkDir(), "tgtd.log"),
+		},
+		Backend:     s.Tgtd.Backend,
+		StopTimeout: 100 * time.Millisecond,
+	})
+	c.Assert(supervisor.Start(context.Background()), IsNil)
+	c.Assert(supervisor.PID(), Not(Equals), 0)
+	c.Assert(supervisor.Start(context.Background()), NotNil)
+
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, "iqn.2019-10.io.longhorn:vol1"), IsNil)
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 2, "iqn.2019-10.io.longhorn:vol2"), IsNil)
+
+	// The fake tgtd doesn't exit by itself, so the script is terminated
+	c.Assert(supervisor.Stop(context.Background()), IsNil)
+	c.Assert(s.Fake.TargetIDs(), HasLen, 0)
+	c.Assert(supervisor.PID(), Equals, 0)
+
+	exit := s.receive(c, supervisor.Exits())
+	c.Assert(exit.Stopped, Equals, true)
+	c.Assert(exit.Restarting, Equals, false)
+	c.Assert(exit.Err, ErrorMatches, "signal: terminated")
+	s.assertClosed(c, supervisor.Exits())
+
+	shutdown := false
+	for _, command := range s.Fake.Commands() {
+		if command[0] == "tgtadm" && command[2] == "delete" && command[4] == "system" {
+			shutdown = true
+		}
+	}
+	c.Assert(shutdown, Equals, true)
+	c.Assert(supervisor.Stop(context.Background()), IsNil)
+}
+
+func (s *SupervisorSuite) TestRestart(c *C) {
+	supervisor := iscsi.NewTgtdSupervisor(iscsi.TgtdSupervisorOptions{
+		TgtdOptions: iscsi.TgtdOptions{
+			Binary: s.tgtd(c, "sleep 0.2; exit 3"),
+		},
+		Backend:        s.Tgtd.Backend,
+		RestartBackoff: 10 * time.Millisecond,
+		MaxRestarts:    2,
+	})
+	c.Assert(supervisor.Start(context.Background()), IsNil)
+
+	pids := map[int]bool{}
+	for _, restarting := range []bool{true, true, false} {
+		exit := s.receive(c, supervisor.Exits())
+		c.Assert(exit.Restarting, Equals, restarting)
+		c.Assert(exit.Stopped, Equals, false)
+		exitErr := &exec.ExitError{}
+		c.Assert(errors.As(exit.Err, &exitErr), Equals, true)
+		c.Assert(exitErr.ExitCode(), Equals, 3)
+		pids[exit.PID] = true
+	}
+	c.Assert(pids, HasLen, 3)
+	s.assertClosed(c, supervisor.Exits())
+	c.Assert(supervisor.Stop(context.Background()), IsNil)
+}
+
+func (s *SupervisorSuite) TestLivenessProbe(c *C) {
+	probes := 0
+	supervisor := iscsi.NewTgtdSupervisor(iscsi.TgtdSupervisorOptions{
+		TgtdOptions: iscsi.TgtdOptions{
+			Binary: s.tgtd(c, "exec sleep 60"),
+		},
+		Backend: s.Tgtd.Backend,
+		LivenessProbe: func(ctx context.Context, tgtd *iscsi.Tgtd) error {
+			probes++
+			return errors.New("no response")
+		},
+		ProbeInterval:    10 * time.Millisecond,
+		FailureThreshold: 2,
+		DisableRestart:   true,
+	})
+	c.Assert(supervisor.Start(context.Background()), IsNil)
+
+	exit := s.receive(c, supervisor.Exits())
+	c.Assert(exit.Restarting, Equals, false)
+	c.Assert(exit.Err, ErrorMatches, "tgtd was killed after 2 failed liveness probes: no response")
+	c.Assert(probes, Equals, 2)
+	s.assertClosed(c, supervisor.Exits())
+}
+
+func (s *SupervisorSuite) TestReadiness(c *C) {
+	c.Assert(iscsi.ProbeTgtdReadiness(context.Background(), s.Tgtd), IsNil)
+
+	supervisor := iscsi.NewTgtdSupervisor(iscsi.TgtdSupervisorOptions{
+		TgtdOptions: iscsi.TgtdOptions{
+			Binary: s.tgtd(c, "exec sleep 60"),
+		},
+		Backend: s.Tgtd.Backend,
+		ReadinessProbe: func(ctx context.Context, tgtd *iscsi.Tgtd) error {
+			return errors.New("not ready")
+		},
+		ReadinessTimeout: 100 * time.Millisecond,
+	})
+	err := supervisor.Start(context.Background())
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Assert(err, ErrorMatches, "failed to wait for tgtd to be ready.*")
+	c.Assert(supervisor.PID(), Equals, 0)
+	s.assertClosed(c, supervisor.Exits())
+
+	// tgtd fails to start, e.g. the portal is in use
+	supervisor = iscsi.NewTgtdSupervisor(iscsi.TgtdSupervisorOptions{
+		TgtdOptions: iscsi.TgtdOptions{
+			Binary: s.tgtd(c, "exit 1"),
+		},
+		Backend: s.Tgtd.Backend,
+		ReadinessProbe: func(ctx context.Context, tgtd *iscsi.Tgtd) error {
+			return errors.New("not ready")
+		},
+	})
+	c.Assert(supervisor.Start(context.Background()), ErrorMatches, "tgtd exited before it was ready: exit status 1")
+}
+
+func (s *SupervisorSuite) TestControlPort(c *C) {
+	ctx := context.Background()
+	s.Fake.ControlPort = 1
+	args := filepath.Join(c.MkDir(), "args")
+	supervisor := iscsi.NewTgtdSupervisor(iscsi.TgtdSupervisorOptions{
+		TgtdOptions: iscsi.TgtdOptions{
+			Binary:      s.tgtd(c, `echo "$@" > `+args+`; exec sleep 60`),
+			ControlPort: 1,
+		},
+		Backend:     s.Tgtd.Backend,
+		StopTimeout: 100 * time.Millisecond,
+	})
+	// The probes reach the fake tgtd on the control port
+	c.Assert(supervisor.Start(context.Background()), IsNil)
+	// The fake tgtd can be ready before the script writes the arguments
+	var content []byte
+	for i := 0; i < 100 && len(content) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		content, _ = os.ReadFile(args)
+	}
+	c.Assert(string(content), Equals, "-f -C 1\n")
+
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, "iqn.2019-10.io.longhorn:vol1"), NotNil)
+	c.Assert(supervisor.Tgtd().CreateTargetContext(context.Background(), 1, "iqn.2019-10.io.longhorn:vol1"), IsNil)
+
+	c.Assert(supervisor.Stop(context.Background()), IsNil)
+	c.Assert(s.Fake.TargetIDs(), HasLen, 0)
+}
+
+func (s *SupervisorSuite) TestStartDaemon(c *C) {
+	dir := c.MkDir()
+	launched := filepath.Join(dir, "launched")
+	c.Assert(os.WriteFile(filepath.Join(dir, "tgtd"), []byte("#!/bin/sh\ntouch "+launched+"\nexit 1\n"), 0755), IsNil)
+	path := os.Getenv("PATH")
+	c.Assert(os.Setenv("PATH", dir+string(os.PathListSeparator)+path), IsNil)
+	defer func() {
+		c.Assert(os.Setenv("PATH", path), IsNil)
+	}()
+
+	// tgtd exits before it's ready, which is an error rather than a panic
+	s.Fake.ControlPort = 1
+	c.Assert(s.Tgtd.StartDaemonContext(context.Background(), false), ErrorMatches, "failed to start tgtd daemon: exit status 1")
+	c.Assert(os.Remove(launched), IsNil)
+
+	// The supervised tgtd isn't ready, e.g. it's being restarted, so
+	// StartDaemon waits for it rather than launching another one
+	supervisor := iscsi.NewTgtdSupervisor(iscsi.TgtdSupervisorOptions{
+		TgtdOptions: iscsi.TgtdOptions{
+			Binary: s.tgtd(c, "exec sleep 60"),
+		},
+		Backend: s.Tgtd.Backend,
+		ReadinessProbe: func(ctx context.Context, tgtd *iscsi.Tgtd) error {
+			return nil
+		},
+		StopTimeout: 100 * time.Millisecond,
+	})
+	c.Assert(supervisor.Start(context.Background()), IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := s.Tgtd.StartDaemonContext(ctx, false)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	_, err = os.Stat(launched)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	s.Fake.ControlPort = iscsi.DefaultControlPort
+	c.Assert(s.Tgtd.StartDaemonContext(context.Background(), false), IsNil)
+	c.Assert(supervisor.Stop(context.Background()), IsNil)
+	_, err = os.Stat(launched)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
@@ -0,0 +1,78 @@
+package iscsi_test
+
+import (
+	"context"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+
+	. "gopkg.in/check.v1"
+)
+
+type TgtdSuite struct {
+	iscsitest.Fixture
+}
+
+var _ = Suite(&TgtdSuite{})
+
+func (s *TgtdSuite) TestInstances(c *C) {
+	ctx := context.Background()
+	other := iscsitest.NewFake()
+	other.ControlPort = 1
+	tgtd := other.Tgtd()
+	c.Assert(iscsi.DefaultTgtd().LogFile, Equals, iscsi.DefaultTgtdLogFile)
+
+	// The instances have their own targets, even with the same TID
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, 1, "iqn.2019-10.io.longhorn:vol1"), IsNil)
+	c.Assert(tgtd.CreateTargetContext(ctx, 1, "iqn.2019-10.io.longhorn:vol2"), IsNil)
+	c.Assert(tgtd.AddLunContext(ctx, 1, 1, "/dev/null", "rdwr", ""), IsNil)
+	c.Assert(s.Fake.TargetIDs(), DeepEquals, []int{1})
+	c.Assert(other.TargetIDs(), DeepEquals, []int{1})
+
+	target, err := tgtd.GetTargetContext(ctx, "iqn.2019-10.io.longhorn:vol2")
+	c.Assert(err, IsNil)
+	c.Assert(target.TID, Equals, 1)
+	c.Assert(target.LUN(1), NotNil)
+	target, err = s.Tgtd.GetTargetContext(ctx, "iqn.2019-10.io.longhorn:vol2")
+	c.Assert(err, IsNil)
+	c.Assert(target, IsNil)
+
+	// The requests carry the control port
+	for _, command := range other.Commands() {
+		c.Assert(command[1:3], DeepEquals, []string{"--control-port", "1"})
+	}
+	for _, command := range s.Fake.Commands() {
+		c.Assert(command[1], Equals, "--lld")
+	}
+
+	// The plan is applied to the instance it's made for
+	plan, err := tgtd.PlanReconcileContext(ctx, &iscsi.TgtdConfig{Targets: []iscsi.TargetConfig{{
+		TID:  3,
+		IQN:  "iqn.2019-10.io.longhorn:vol3",
+		LUNs: []iscsi.LUNConfig{{ID: 1, BackingStore: "/dev/null"}},
+	}}})
+	c.Assert(err, IsNil)
+	c.Assert(plan.Apply(), IsNil)
+	c.Assert(other.TargetIDs(), DeepEquals, []int{1, 3})
+	c.Assert(s.Fake.TargetIDs(), DeepEquals, []int{1})
+
+	// tgtd on another control port isn't running
+	missing := &iscsi.Tgtd{ControlPort: 2, Backend: s.Tgtd.Backend}
+	c.Assert(missing.CheckTargetForBackingStoreContext(ctx, "rdwr"), Equals, false)
+	_, err = missing.ListTargetsContext(ctx)
+	c.Assert(err, ErrorMatches, "(?s).*can't send the request to the tgt daemon.*")
+	c.Assert(tgtd.CheckTargetForBackingStoreContext(ctx, "rdwr"), Equals, true)
+}
+
+func (s *TgtdSuite) TestOptions(c *C) {
+	tgtd := &iscsi.Tgtd{
+		ControlPort: 1,
+		Portals:     []iscsi.Portal{{IP: "0.0.0.0", Port: 3261}},
+		LogFile:     "/var/log/tgtd.1.log",
+	}
+	c.Assert(tgtd.SocketPath(), Equals, "/var/run/tgtd/socket.1")
+	options := tgtd.Options()
+	c.Assert(options.ControlPort, Equals, 1)
+	c.Assert(options.Portals, DeepEquals, tgtd.Portals)
+	c.Assert(options.LogFile, Equals, "/var/log/tgtd.1.log")
+}
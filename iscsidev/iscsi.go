@@ -1,7 +1,10 @@
 package iscsidev
 
 import (
+	"context"
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,8 +25,10 @@ var (
 
 	TargetLunID = 1
 
-	RetryCounts           = 5
-	RetryIntervalSCSI     = 3 * time.Second
+	RetryCounts       = 5
+	RetryIntervalSCSI = 3 * time.Second
+	// Deprecated: the target IDs are allocated by iscsi.AllocateTarget
+	// without retrying.
 	RetryIntervalTargetID = 500 * time.Millisecond
 )
 
@@ -35,20 +40,109 @@ type IscsiDeviceParameters struct {
 	IscsiAbortTimeout int64
 }
 
+// ChapParameters are the optional CHAP credentials of the target. If
+// ChapUsername is set, initiators have to authenticate with it. If
+// MutualChapUsername is set as well, the target authenticates itself to the
+// initiators with it. Notice the accounts are global to tgtd, so the user
+// names should be unique to the device.
+type ChapParameters struct {
+	ChapUsername       string
+	ChapPassword       string
+	MutualChapUsername string
+	MutualChapPassword string
+}
+
+// LUN is a LUN of the device besides the one at TargetLunID, e.g. a read-only
+// snapshot exposed next to the volume.
+type LUN struct {
+	ID           int
+	KernelDevice *lhtypes.BlockDeviceInfo
+
+	BackingFile string
+	BSType      string
+	BSOpts      string
+
+	// Identity is the SCSI identity of the LUN. It's derived from the target
+	// name and the LUN ID if it's nil.
+	Identity *iscsi.LunIdentity
+
+	// ReadOnly makes the LUN write-protected, and its kernel device read-only.
+	ReadOnly bool
+
+	// DeviceType is iscsi.DeviceTypeDisk if empty. Only disks and CD-ROMs
+	// are supported, since the other types have no block device.
+	DeviceType iscsi.DeviceType
+}
+
+func (lun *LUN) deviceType() (iscsi.DeviceType, error) {
+	switch lun.DeviceType {
+	case "", iscsi.DeviceTypeDisk:
+		return iscsi.DeviceTypeDisk, nil
+	case iscsi.DeviceTypeCD:
+		return iscsi.DeviceTypeCD, nil
+	}
+	// The initiator only creates block devices for disks and CD-ROMs
+	return "", fmt.Errorf("unsupported device type %v of LUN %v", lun.DeviceType, lun.ID)
+}
+
+// BackingStoreOptions parses BSType and BSOpts of the LUN.
+func (lun *LUN) BackingStoreOptions() (*iscsi.BackingStoreOptions, error) {
+	options, err := iscsi.ParseBackingStoreOptions(lun.BSType, lun.BSOpts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid backing store options of LUN %v", lun.ID)
+	}
+	return options, nil
+}
+
+// NewISOLun returns a read-only virtual CD-ROM LUN backed by the ISO image.
+func NewISOLun(id int, isoFile string) *LUN {
+	return &LUN{
+		ID:          id,
+		BackingFile: isoFile,
+		BSType:      "rdwr",
+		ReadOnly:    true,
+		DeviceType:  iscsi.DeviceTypeCD,
+	}
+}
+
 type Device struct {
 	Target       string
 	KernelDevice *lhtypes.BlockDeviceInfo
 
 	ScsiDeviceParameters
 	IscsiDeviceParameters
+	ChapParameters
 
 	BackingFile string
 	BSType      string
 	BSOpts      string
 
+	// Identity is the SCSI identity of the LUN at TargetLunID. NewDevice
+	// derives it from the volume name, so the initiators see the same disk
+	// after the target is re-created with another TID or on another node.
+	// tgtd uses its defaults if it's nil.
+	Identity *iscsi.LunIdentity
+
+	// ReadOnly makes the LUN at TargetLunID write-protected, and its kernel
+	// device read-only. It must be set before CreateTarget.
+	ReadOnly bool
+
+	// ACLs are the initiators allowed to connect to the target. All
+	// initiators are allowed if it's empty.
+	ACLs []iscsi.ACL
+
+	// LUNs are the LUNs of the target besides the one at TargetLunID, which
+	// is backed by BackingFile. Use AddLun and RemoveLun to change them once
+	// the target is created.
+	LUNs []*LUN
+
+	// Tgtd is the tgtd instance serving the target, or iscsi.DefaultTgtd if
+	// nil. The initiator logs in via the port of its first portal.
+	Tgtd *iscsi.Tgtd
+
 	targetID int
 
-	nsexec *lhns.Executor
+	nsexec iscsi.Executor
 }
 
 func NewDevice(name, backingFile, bsType, bsOpts string, scsiTimeout, iscsiAbortTimeout int64) (*Device, error) {
@@ -57,7 +151,12 @@ func NewDevice(name, backingFile, bsType, bsOpts string, scsiTimeout, iscsiAbort
 	if err != nil {
 		return nil, err
 	}
+	return NewDeviceWithExecutor(name, backingFile, bsType, bsOpts, scsiTimeout, iscsiAbortTimeout, nsexec)
+}
 
+// NewDeviceWithExecutor is the same as NewDevice, but runs the initiator
+// commands with nsexec.
+func NewDeviceWithExecutor(name, backingFile, bsType, bsOpts string, scsiTimeout, iscsiAbortTimeout int64, nsexec iscsi.Executor) (*Device, error) {
 	dev := &Device{
 		Target: GetTargetName(name),
 		ScsiDeviceParameters: ScsiDeviceParameters{
@@ -69,6 +168,7 @@ func NewDevice(name, backingFile, bsType, bsOpts string, scsiTimeout, iscsiAbort
 		BackingFile: backingFile,
 		BSType:      bsType,
 		BSOpts:      bsOpts,
+		Identity:    iscsi.NewLunIdentity(name),
 		nsexec:      nsexec,
 	}
 	return dev, nil
@@ -83,7 +183,12 @@ func GetTargetName(volumeName string) string {
 }
 
 func (dev *Device) ReloadTargetID() error {
-	tid, err := iscsi.GetTargetTid(dev.Target)
+	return dev.ReloadTargetIDContext(context.Background())
+}
+
+// ReloadTargetIDContext is like ReloadTargetID but takes a context.
+func (dev *Device) ReloadTargetIDContext(ctx context.Context) error {
+	tid, err := dev.tgtd().GetTargetTidContext(ctx, dev.Target)
 	if err != nil {
 		return err
 	}
@@ -92,69 +197,422 @@ func (dev *Device) ReloadTargetID() error {
 }
 
 func (dev *Device) CreateTarget() (err error) {
-	// Start tgtd daemon if it's not already running
-	if err := iscsi.StartDaemon(false); err != nil {
+	return dev.CreateTargetContext(context.Background())
+}
+
+// CreateTargetContext is like CreateTarget but takes a context.
+func (dev *Device) CreateTargetContext(ctx context.Context) (err error) {
+	// Start tgtd daemon if it's not already running, or wait for the supervised one
+	if err := dev.tgtd().StartDaemonContext(ctx, false); err != nil {
+		return err
+	}
+	// Check the LUNs first, so no target is left behind if tgtd cannot back
+	// them
+	if err := dev.checkLuns(ctx); err != nil {
 		return err
 	}
 
-	tid := 0
-	for i := 0; i < RetryCounts; i++ {
-		if tid, err = iscsi.FindNextAvailableTargetID(); err != nil {
+	tid, err := dev.tgtd().AllocateTargetContext(ctx, dev.Target)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("go-iscsi-helper: created target %v with target id %v", dev.Target, tid)
+	dev.targetID = tid
+
+	primary := &LUN{
+		ID:          TargetLunID,
+		BackingFile: dev.BackingFile,
+		BSType:      dev.BSType,
+		BSOpts:      dev.BSOpts,
+		ReadOnly:    dev.ReadOnly,
+	}
+	if err := dev.addLun(ctx, primary, dev.Identity); err != nil {
+		return err
+	}
+	for _, lun := range dev.LUNs {
+		if err := dev.addLun(ctx, lun, dev.lunIdentity(lun)); err != nil {
 			return err
 		}
-		logrus.Infof("go-iscsi-helper: found available target id %v", tid)
-		err = iscsi.CreateTarget(tid, dev.Target)
-		if err == nil {
-			dev.targetID = tid
-			break
-		}
-		logrus.Infof("go-iscsi-helper: failed to use target id %v, retrying with a new target ID: err %v", tid, err)
-		time.Sleep(RetryIntervalTargetID)
-		continue
 	}
+	if err := dev.bindChapAccounts(ctx); err != nil {
+		return err
+	}
+	return dev.bindACLs(ctx)
+}
+
+// checkLuns checks tgtd supports the backing stores and the device types of
+// all LUNs.
+func (dev *Device) checkLuns(ctx context.Context) error {
+	info, err := dev.tgtd().GetSystemInfoContext(ctx)
 	if err != nil {
 		return err
 	}
+	primary := &LUN{ID: TargetLunID, BSType: dev.BSType, BSOpts: dev.BSOpts}
+	for _, lun := range append([]*LUN{primary}, dev.LUNs...) {
+		deviceType, err := lun.deviceType()
+		if err != nil {
+			return err
+		}
+		if err := info.CheckLun(lun.BSType, deviceType); err != nil {
+			return errors.Wrapf(err, "cannot add LUN %v to target %v", lun.ID, dev.Target)
+		}
+	}
+	return nil
+}
 
-	if err := iscsi.AddLun(dev.targetID, TargetLunID, dev.BackingFile, dev.BSType, dev.BSOpts); err != nil {
+func (dev *Device) addLun(ctx context.Context, lun *LUN, identity *iscsi.LunIdentity) error {
+	deviceType, err := lun.deviceType()
+	if err != nil {
 		return err
 	}
+	if err := dev.tgtd().AddLunWithDeviceTypeContext(ctx, dev.targetID, lun.ID, lun.BackingFile, lun.BSType, lun.BSOpts, deviceType); err != nil {
+		return err
+	}
+	if lun.ReadOnly {
+		if err := dev.tgtd().SetLunReadOnlyContext(ctx, dev.targetID, lun.ID); err != nil {
+			return err
+		}
+	}
+	if identity != nil {
+		if err := dev.tgtd().SetLunIdentityContext(ctx, dev.targetID, lun.ID, identity); err != nil {
+			return err
+		}
+	}
+	if deviceType != iscsi.DeviceTypeDisk {
+		return nil
+	}
 	// Cannot modify the parameters for the LUNs during the adding stage
-	if err := iscsi.SetLunThinProvisioning(dev.targetID, TargetLunID); err != nil {
+	if err := dev.tgtd().SetLunThinProvisioningContext(ctx, dev.targetID, lun.ID); err != nil {
 		return err
 	}
 	// Longhorn reads and writes data with direct io rather than buffer io, so
 	// the write cache is actually disabled in the implementation.
 	// Explicitly disable the write cache for meeting the SCSI specification.
-	if err := iscsi.DisableWriteCache(dev.targetID, TargetLunID); err != nil {
+	return dev.tgtd().DisableWriteCacheContext(ctx, dev.targetID, lun.ID)
+}
+
+func (dev *Device) lunIdentity(lun *LUN) *iscsi.LunIdentity {
+	if lun.Identity != nil {
+		return lun.Identity
+	}
+	return iscsi.NewLunIdentity(fmt.Sprintf("%v/%v", dev.Target, lun.ID))
+}
+
+// GetLun returns the LUN with the ID besides the one at TargetLunID, or nil if
+// it doesn't exist.
+func (dev *Device) GetLun(id int) *LUN {
+	for _, lun := range dev.LUNs {
+		if lun.ID == id {
+			return lun
+		}
+	}
+	return nil
+}
+
+// AddLun adds the LUN to the device. If the target is already created, the
+// LUN is added to it, and if the initiator is already started, only the new
+// LUN is scanned and its kernel device is resolved.
+func (dev *Device) AddLun(lun *LUN) error {
+	return dev.AddLunContext(context.Background(), lun)
+}
+
+// AddLunContext is like AddLun but takes a context.
+func (dev *Device) AddLunContext(ctx context.Context, lun *LUN) error {
+	if lun.ID <= 0 || lun.ID == TargetLunID || dev.GetLun(lun.ID) != nil {
+		return fmt.Errorf("invalid or duplicate LUN %v for target %v", lun.ID, dev.Target)
+	}
+	if _, err := lun.deviceType(); err != nil {
+		return err
+	}
+	if dev.targetID != 0 {
+		if err := dev.addLun(ctx, lun, dev.lunIdentity(lun)); err != nil {
+			return errors.Wrapf(err, "failed to add LUN %v to target %v", lun.ID, dev.Target)
+		}
+	}
+	if dev.KernelDevice != nil {
+		if err := dev.attachLun(ctx, lun); err != nil {
+			return err
+		}
+	}
+	dev.LUNs = append(dev.LUNs, lun)
+	return nil
+}
+
+func (dev *Device) attachLun(ctx context.Context, lun *LUN) error {
+	lock, err := dev.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	portal, err := dev.localPortal()
+	if err != nil {
+		return err
+	}
+	if err := iscsi.ScanLunContext(ctx, portal, dev.Target, lun.ID, dev.nsexec); err != nil {
+		return errors.Wrapf(err, "failed to scan LUN %v of target %v", lun.ID, dev.Target)
+	}
+	if lun.KernelDevice, err = iscsi.GetDeviceContext(ctx, portal, dev.Target, lun.ID, dev.nsexec); err != nil {
+		return err
+	}
+	return dev.setupKernelDevice(ctx, lun.KernelDevice, lun.ReadOnly)
+}
+
+// RemoveLun removes the LUN from the device. Its kernel device is removed from
+// the initiator first, then the LUN is deleted from the target.
+func (dev *Device) RemoveLun(id int) error {
+	return dev.RemoveLunContext(context.Background(), id)
+}
+
+// RemoveLunContext is like RemoveLun but takes a context.
+func (dev *Device) RemoveLunContext(ctx context.Context, id int) error {
+	lun := dev.GetLun(id)
+	if lun == nil {
+		return fmt.Errorf("cannot find LUN %v of target %v", id, dev.Target)
+	}
+	if lun.KernelDevice != nil {
+		lock, err := dev.lockContext(ctx)
+		if err != nil {
+			return err
+		}
+		err = iscsi.DeleteScsiDevice(lun.KernelDevice.Name, dev.nsexec)
+		lock.Unlock()
+		if err != nil {
+			return errors.Wrapf(err, "failed to delete device %v of LUN %v", lun.KernelDevice.Name, id)
+		}
+		lun.KernelDevice = nil
+	}
+	if dev.targetID != 0 {
+		if err := dev.tgtd().DeleteLunContext(ctx, dev.targetID, id); err != nil && !errors.Is(err, types.ErrNoLun) {
+			return errors.Wrapf(err, "failed to delete LUN %v of target %v", id, dev.Target)
+		}
+	}
+	for i := range dev.LUNs {
+		if dev.LUNs[i] == lun {
+			dev.LUNs = append(dev.LUNs[:i], dev.LUNs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// getLunDevices resolves the kernel devices of all LUNs, and updates their
+// timeouts.
+func (dev *Device) getLunDevices(ctx context.Context, portal string) (err error) {
+	if dev.KernelDevice, err = iscsi.GetDeviceContext(ctx, portal, dev.Target, TargetLunID, dev.nsexec); err != nil {
+		return err
+	}
+	if err := dev.setupKernelDevice(ctx, dev.KernelDevice, dev.ReadOnly); err != nil {
+		return err
+	}
+	for _, lun := range dev.LUNs {
+		if lun.KernelDevice, err = iscsi.GetDeviceContext(ctx, portal, dev.Target, lun.ID, dev.nsexec); err != nil {
+			return errors.Wrapf(err, "failed to get device of LUN %v", lun.ID)
+		}
+		if err := dev.setupKernelDevice(ctx, lun.KernelDevice, lun.ReadOnly); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupKernelDevice updates the SCSI timeout of the kernel device, and makes
+// sure it's read-only for a read-only LUN.
+func (dev *Device) setupKernelDevice(ctx context.Context, kernelDevice *lhtypes.BlockDeviceInfo, readOnly bool) error {
+	if err := iscsi.UpdateScsiDeviceTimeout(kernelDevice.Name, dev.ScsiTimeout, dev.nsexec); err != nil {
 		return err
 	}
-	if err := iscsi.BindInitiator(dev.targetID, "ALL"); err != nil {
+	if !readOnly {
+		return nil
+	}
+	ro, err := iscsi.IsDeviceReadOnlyContext(ctx, kernelDevice.Name, dev.nsexec)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check if device %v is read-only", kernelDevice.Name)
+	}
+	if ro {
+		return nil
+	}
+	logrus.Warnf("Device %v of the read-only target %v is writable, setting it read-only", kernelDevice.Name, dev.Target)
+	return iscsi.SetDeviceReadOnlyContext(ctx, kernelDevice.Name, dev.nsexec)
+}
+
+func (dev *Device) bindACLs(ctx context.Context) error {
+	if len(dev.ACLs) == 0 {
+		return dev.tgtd().BindInitiatorContext(ctx, dev.targetID, iscsi.ACLAll)
+	}
+	for _, acl := range dev.ACLs {
+		if err := dev.tgtd().BindACLContext(ctx, dev.targetID, acl); err != nil && !errors.Is(err, types.ErrAclExist) {
+			return errors.Wrapf(err, "failed to bind ACL %v to target %v", acl, dev.Target)
+		}
+	}
+	return nil
+}
+
+// SetLocalInitiatorACLs restricts the target to the local initiator, by both
+// the IP address and the iSCSI name.
+func (dev *Device) SetLocalInitiatorACLs() error {
+	return dev.SetLocalInitiatorACLsContext(context.Background())
+}
+
+// SetLocalInitiatorACLsContext is like SetLocalInitiatorACLs but takes a context.
+func (dev *Device) SetLocalInitiatorACLsContext(ctx context.Context) error {
+	localIP, err := util.GetIPToHost()
+	if err != nil {
+		return err
+	}
+	addressACL, err := iscsi.NewAddressACL(localIP)
+	if err != nil {
+		return err
+	}
+	initiatorName, err := iscsi.GetInitiatorNameContext(ctx, dev.nsexec)
+	if err != nil {
+		return errors.Wrap(err, "failed to get local initiator name")
+	}
+	nameACL, err := iscsi.NewNameACL(initiatorName)
+	if err != nil {
 		return err
 	}
+	dev.ACLs = []iscsi.ACL{addressACL, nameACL}
 	return nil
 }
 
+// chapCredentials returns the initiator credentials matching the CHAP
+// accounts of the target, or nil if CHAP is disabled.
+func (dev *Device) chapCredentials() *iscsi.ChapCredentials {
+	if dev.ChapUsername == "" {
+		return nil
+	}
+	return &iscsi.ChapCredentials{
+		Username:   dev.ChapUsername,
+		Password:   dev.ChapPassword,
+		UsernameIn: dev.MutualChapUsername,
+		PasswordIn: dev.MutualChapPassword,
+	}
+}
+
+func (dev *Device) bindChapAccounts(ctx context.Context) error {
+	if dev.ChapUsername == "" {
+		if dev.MutualChapUsername != "" {
+			return fmt.Errorf("mutual CHAP for target %v requires CHAP", dev.Target)
+		}
+		return nil
+	}
+	if err := dev.createAccount(ctx, dev.ChapUsername, dev.ChapPassword); err != nil {
+		return err
+	}
+	if err := dev.tgtd().BindAccountContext(ctx, dev.targetID, dev.ChapUsername, false); err != nil && !errors.Is(err, types.ErrBindingExist) {
+		return errors.Wrapf(err, "failed to bind CHAP account %v to target %v", dev.ChapUsername, dev.Target)
+	}
+	if dev.MutualChapUsername == "" {
+		return nil
+	}
+	if err := dev.createAccount(ctx, dev.MutualChapUsername, dev.MutualChapPassword); err != nil {
+		return err
+	}
+	if err := dev.tgtd().BindAccountContext(ctx, dev.targetID, dev.MutualChapUsername, true); err != nil && !errors.Is(err, types.ErrBindingExist) {
+		return errors.Wrapf(err, "failed to bind mutual CHAP account %v to target %v", dev.MutualChapUsername, dev.Target)
+	}
+	return nil
+}
+
+func (dev *Device) createAccount(ctx context.Context, user, password string) error {
+	if err := dev.tgtd().CreateAccountContext(ctx, user, password); err != nil {
+		if !errors.Is(err, types.ErrUserExist) {
+			return errors.Wrapf(err, "failed to create CHAP account %v", user)
+		}
+		logrus.Infof("go-iscsi-helper: CHAP account %v already exists", user)
+	}
+	return nil
+}
+
+// deleteChapAccounts removes the CHAP accounts of the device unless they are
+// still bound to other targets.
+func (dev *Device) deleteChapAccounts(ctx context.Context) error {
+	users := []string{}
+	for _, user := range []string{dev.ChapUsername, dev.MutualChapUsername} {
+		if user != "" {
+			users = append(users, user)
+		}
+	}
+	if len(users) == 0 {
+		return nil
+	}
+
+	targets, err := dev.tgtd().ListTargetsContext(ctx)
+	if err != nil {
+		return err
+	}
+	inUse := map[string]bool{}
+	for _, target := range targets {
+		for _, account := range target.Accounts {
+			inUse[account.User] = true
+		}
+	}
+	for _, user := range users {
+		if inUse[user] {
+			logrus.Infof("go-iscsi-helper: CHAP account %v is still in use, skip deleting it", user)
+			continue
+		}
+		if err := dev.tgtd().DeleteAccountContext(ctx, user); err != nil && !errors.Is(err, types.ErrNoUser) {
+			return errors.Wrapf(err, "failed to delete CHAP account %v", user)
+		}
+	}
+	return nil
+}
+
+// tgtd returns the tgtd instance serving the target.
+func (dev *Device) tgtd() *iscsi.Tgtd {
+	if dev.Tgtd == nil {
+		return iscsi.DefaultTgtd()
+	}
+	return dev.Tgtd
+}
+
+// localPortal returns the portal for the local initiator, which is the local
+// IP address with the port of the tgtd instance.
+func (dev *Device) localPortal() (string, error) {
+	localIP, err := util.GetIPToHost()
+	if err != nil {
+		return "", err
+	}
+	if dev.Tgtd == nil || len(dev.Tgtd.Portals) == 0 {
+		return localIP, nil
+	}
+	return iscsi.Portal{IP: localIP, Port: dev.Tgtd.Portals[0].Port}.String(), nil
+}
+
+// lockContext acquires the lock file serializing the initiator operations. It
+// gives up once ctx is done, so the lock is never held by an operation the
+// caller has given up.
+func (dev *Device) lockContext(ctx context.Context) (*util.FileLock, error) {
+	return iscsi.LockHostFileContext(ctx, LockFile, LockTimeout, dev.nsexec)
+}
+
 func (dev *Device) StartInitator() error {
-	lock := lhns.NewLock(LockFile, LockTimeout)
-	if err := lock.Lock(); err != nil {
-		return errors.Wrap(err, "failed to lock")
+	return dev.StartInitatorContext(context.Background())
+}
+
+// StartInitatorContext is like StartInitator but takes a context.
+func (dev *Device) StartInitatorContext(ctx context.Context) error {
+	lock, err := dev.lockContext(ctx)
+	if err != nil {
+		return err
 	}
 	defer lock.Unlock()
 
-	if err := iscsi.CheckForInitiatorExistence(dev.nsexec); err != nil {
+	if err := iscsi.CheckForInitiatorExistenceContext(ctx, dev.nsexec); err != nil {
 		return err
 	}
 
-	localIP, err := util.GetIPToHost()
+	portal, err := dev.localPortal()
 	if err != nil {
 		return err
 	}
 
 	// Setup initiator
 	for i := 0; i < RetryCounts; i++ {
-		err := iscsi.DiscoverTarget(localIP, dev.Target, dev.nsexec)
-		if iscsi.IsTargetDiscovered(localIP, dev.Target, dev.nsexec) {
+		err := iscsi.DiscoverTargetWithAuthContext(ctx, portal, dev.Target, dev.chapCredentials(), dev.nsexec)
+		if iscsi.IsTargetDiscoveredContext(ctx, portal, dev.Target, dev.nsexec) {
 			break
 		}
 
@@ -168,98 +626,113 @@ func (dev *Device) StartInitator() error {
 			logrus.Warnf("Nodes cleaned up for %v", dev.Target)
 		}
 
-		time.Sleep(RetryIntervalSCSI)
-	}
-	if err := iscsi.UpdateIscsiDeviceAbortTimeout(dev.Target, dev.IscsiAbortTimeout, dev.nsexec); err != nil {
-		return err
-	}
-	if err := iscsi.LoginTarget(localIP, dev.Target, dev.nsexec); err != nil {
-		return err
+		if err := util.SleepContext(ctx, RetryIntervalSCSI); err != nil {
+			return errors.Wrapf(err, "failed to discover target %v", dev.Target)
+		}
 	}
-	if dev.KernelDevice, err = iscsi.GetDevice(localIP, dev.Target, TargetLunID, dev.nsexec); err != nil {
+	if err := iscsi.UpdateIscsiDeviceAbortTimeoutContext(ctx, dev.Target, dev.IscsiAbortTimeout, dev.nsexec); err != nil {
 		return err
 	}
-	if err := iscsi.UpdateScsiDeviceTimeout(dev.KernelDevice.Name, dev.ScsiTimeout, dev.nsexec); err != nil {
+	if err := iscsi.LoginTargetWithAuthContext(ctx, portal, dev.Target, dev.chapCredentials(), dev.nsexec); err != nil {
 		return err
 	}
-
-	return nil
+	return dev.getLunDevices(ctx, portal)
 }
 
 // ReloadInitiator does nothing for the iSCSI initiator/target except for
 // updating the timeout. It is mainly responsible for initializing the struct
 // field `dev.KernelDevice`.
 func (dev *Device) ReloadInitiator() error {
-	lock := lhns.NewLock(LockFile, LockTimeout)
-	if err := lock.Lock(); err != nil {
-		return errors.Wrap(err, "failed to lock")
+	return dev.ReloadInitiatorContext(context.Background())
+}
+
+// ReloadInitiatorContext is like ReloadInitiator but takes a context.
+func (dev *Device) ReloadInitiatorContext(ctx context.Context) error {
+	lock, err := dev.lockContext(ctx)
+	if err != nil {
+		return err
 	}
 	defer lock.Unlock()
 
-	if err := iscsi.CheckForInitiatorExistence(dev.nsexec); err != nil {
+	if err := iscsi.CheckForInitiatorExistenceContext(ctx, dev.nsexec); err != nil {
 		return err
 	}
 
-	localIP, err := util.GetIPToHost()
+	portal, err := dev.localPortal()
 	if err != nil {
 		return err
 	}
 
-	if err := iscsi.DiscoverTarget(localIP, dev.Target, dev.nsexec); err != nil {
+	if err := iscsi.DiscoverTargetWithAuthContext(ctx, portal, dev.Target, dev.chapCredentials(), dev.nsexec); err != nil {
 		return err
 	}
 
-	if !iscsi.IsTargetDiscovered(localIP, dev.Target, dev.nsexec) {
+	if !iscsi.IsTargetDiscoveredContext(ctx, portal, dev.Target, dev.nsexec) {
 		return fmt.Errorf("failed to discover target %v for the initiator", dev.Target)
 	}
 
-	if err := iscsi.UpdateIscsiDeviceAbortTimeout(dev.Target, dev.IscsiAbortTimeout, dev.nsexec); err != nil {
+	if err := iscsi.UpdateIscsiDeviceAbortTimeoutContext(ctx, dev.Target, dev.IscsiAbortTimeout, dev.nsexec); err != nil {
 		return err
 	}
-	if dev.KernelDevice, err = iscsi.GetDevice(localIP, dev.Target, TargetLunID, dev.nsexec); err != nil {
-		return err
-	}
-
-	return iscsi.UpdateScsiDeviceTimeout(dev.KernelDevice.Name, dev.ScsiTimeout, dev.nsexec)
+	return dev.getLunDevices(ctx, portal)
 }
 
 func (dev *Device) StopInitiator() error {
-	lock := lhns.NewLock(LockFile, LockTimeout)
-	if err := lock.Lock(); err != nil {
-		return errors.Wrap(err, "failed to lock")
+	return dev.StopInitiatorContext(context.Background())
+}
+
+// StopInitiatorContext is like StopInitiator but takes a context.
+func (dev *Device) StopInitiatorContext(ctx context.Context) error {
+	lock, err := dev.lockContext(ctx)
+	if err != nil {
+		return err
 	}
 	defer lock.Unlock()
 
-	if err := LogoutTarget(dev.Target, dev.nsexec); err != nil {
+	if err := LogoutTargetContext(ctx, dev.Target, dev.nsexec); err != nil {
 		return errors.Wrapf(err, "failed to logout target")
 	}
 	return nil
 }
 
 func (dev *Device) RefreshInitiator() error {
-	lock := lhns.NewLock(LockFile, LockTimeout)
-	if err := lock.Lock(); err != nil {
-		return errors.Wrap(err, "failed to lock")
+	return dev.RefreshInitiatorContext(context.Background())
+}
+
+// RefreshInitiatorContext is like RefreshInitiator but takes a context.
+func (dev *Device) RefreshInitiatorContext(ctx context.Context) error {
+	lock, err := dev.lockContext(ctx)
+	if err != nil {
+		return err
 	}
 	defer lock.Unlock()
 
-	if err := iscsi.CheckForInitiatorExistence(dev.nsexec); err != nil {
+	if err := iscsi.CheckForInitiatorExistenceContext(ctx, dev.nsexec); err != nil {
 		return err
 	}
 
-	ip, err := util.GetIPToHost()
+	portal, err := dev.localPortal()
 	if err != nil {
 		return err
 	}
 
-	return iscsi.RescanTarget(ip, dev.Target, dev.nsexec)
+	return iscsi.RescanTargetContext(ctx, portal, dev.Target, dev.nsexec)
+}
+
+func LogoutTarget(target string, nsexec iscsi.Executor) error {
+	return LogoutTargetContext(context.Background(), target, nsexec)
 }
 
-func LogoutTarget(target string, nsexec *lhns.Executor) error {
-	if err := iscsi.CheckForInitiatorExistence(nsexec); err != nil {
+// LogoutTargetContext is like LogoutTarget but takes a context.
+func LogoutTargetContext(ctx context.Context, target string, nsexec iscsi.Executor) error {
+	if err := iscsi.CheckForInitiatorExistenceContext(ctx, nsexec); err != nil {
 		return err
 	}
-	if iscsi.IsTargetLoggedIn("", target, nsexec) {
+	loggedIn := iscsi.IsTargetLoggedInContext(ctx, "", target, nsexec)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if loggedIn {
 		var err error
 		loggingOut := false
 
@@ -267,29 +740,37 @@ func LogoutTarget(target string, nsexec *lhns.Executor) error {
 		for i := 0; i < RetryCounts; i++ {
 			// New IP may be different from the IP in the previous record.
 			// https://github.com/longhorn/longhorn/issues/1920
-			err = iscsi.LogoutTarget("", target, nsexec)
+			err = iscsi.LogoutTargetContext(ctx, "", target, nsexec)
 			// Ignore Not Found error
 			if err == nil || strings.Contains(err.Error(), "exit status 21") {
 				err = nil
 				break
 			}
+			if ctx.Err() != nil {
+				break
+			}
 			// The timeout for response may return in the future,
 			// check session to know if it's logged out or not
-			if strings.Contains(err.Error(), "Timeout executing: ") {
+			if strings.Contains(strings.ToLower(err.Error()), "timeout executing: ") {
 				loggingOut = true
 				break
 			}
-			time.Sleep(RetryIntervalSCSI)
+			if errSleep := util.SleepContext(ctx, RetryIntervalSCSI); errSleep != nil {
+				err = errors.WithSecondaryError(errSleep, err)
+				break
+			}
 		}
 		// Wait for device to logout
 		if loggingOut {
 			logrus.Infof("Logging out iSCSI device timeout, waiting for logout complete")
 			for i := 0; i < RetryCounts; i++ {
-				if !iscsi.IsTargetLoggedIn("", target, nsexec) {
-					err = nil
+				if !iscsi.IsTargetLoggedInContext(ctx, "", target, nsexec) {
+					err = ctx.Err()
 					break
 				}
-				time.Sleep(RetryIntervalSCSI)
+				if err := util.SleepContext(ctx, RetryIntervalSCSI); err != nil {
+					return errors.Wrapf(err, "failed to wait for logout of target %v", target)
+				}
 			}
 		}
 		if err != nil {
@@ -307,18 +788,21 @@ func LogoutTarget(target string, nsexec *lhns.Executor) error {
 		 * 21"(no record found) as valid result
 		 */
 		for i := 0; i < RetryCounts; i++ {
-			if !iscsi.IsTargetDiscovered("", target, nsexec) {
-				err = nil
+			if !iscsi.IsTargetDiscoveredContext(ctx, "", target, nsexec) {
+				err = ctx.Err()
 				break
 			}
 
-			err = iscsi.DeleteDiscoveredTarget("", target, nsexec)
+			err = iscsi.DeleteDiscoveredTargetContext(ctx, "", target, nsexec)
 			// Ignore Not Found error
 			if err == nil || strings.Contains(err.Error(), "exit status 21") {
 				err = nil
 				break
 			}
-			time.Sleep(RetryIntervalSCSI)
+			if errSleep := util.SleepContext(ctx, RetryIntervalSCSI); errSleep != nil {
+				err = errors.WithSecondaryError(errSleep, err)
+				break
+			}
 		}
 		if err != nil {
 			return err
@@ -328,52 +812,194 @@ func LogoutTarget(target string, nsexec *lhns.Executor) error {
 }
 
 func (dev *Device) DeleteTarget() error {
-	if tid, err := iscsi.GetTargetTid(dev.Target); err == nil && tid != -1 {
+	return dev.DeleteTargetContext(context.Background())
+}
+
+// DeleteTargetContext is like DeleteTarget but takes a context.
+func (dev *Device) DeleteTargetContext(ctx context.Context) error {
+	// The target is considered deleted if it cannot be found, so check the
+	// context first
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if tid, err := dev.tgtd().GetTargetTidContext(ctx, dev.Target); err == nil && tid != -1 {
 		if tid != dev.targetID && dev.targetID != 0 {
 			logrus.Errorf("BUG: Invalid TID %v found for %v, was %v", tid, dev.Target, dev.targetID)
 		}
 
 		logrus.Infof("Shutting down iSCSI target %v", dev.Target)
 
-		// UnbindInitiator can return tgtadmSuccess, tgtadmAclNoexist or tgtadmNoTarget
-		// Target is deleted in the last step, so tgtadmNoTarget error should not occur here.
-		// Just ignore tgtadmAclNoexist and continue working on the remaining tasks.
-		if err := iscsi.UnbindInitiator(tid, "ALL"); err != nil {
-			if !strings.Contains(err.Error(), types.TgtadmAclNoexist) {
-				return err
-			}
-			logrus.WithError(err).Warnf("failed to unbind initiator target id %v", tid)
-		}
-
-		sessionConnectionsMap, err := iscsi.GetTargetConnections(tid)
+		acls, err := dev.tgtd().ListACLsContext(ctx, tid)
 		if err != nil {
 			return err
 		}
-		for sid, cidList := range sessionConnectionsMap {
-			for _, cid := range cidList {
-				if err := iscsi.CloseConnection(tid, sid, cid); err != nil {
+		// UnbindACL can return success, types.ErrAclNoexist or types.ErrNoTarget
+		// Target is deleted in the last step, so types.ErrNoTarget should not occur here.
+		// Just ignore types.ErrAclNoexist and continue working on the remaining tasks.
+		for _, acl := range acls {
+			if err := dev.tgtd().UnbindACLContext(ctx, tid, acl); err != nil {
+				if !errors.Is(err, types.ErrAclNoexist) {
 					return err
 				}
+				logrus.WithError(err).Warnf("failed to unbind ACL %v of target id %v", acl, tid)
 			}
 		}
 
+		if err := dev.closeConnections(ctx, tid); err != nil {
+			return err
+		}
+
 		// All connections closed, and it is possible for tgtd to have stale LUNs if tgtd crashed before.
 		// Try to delete LUN here and continue on target deletion if tgtd thinks the LUN still active.
-		if err := iscsi.DeleteLun(tid, TargetLunID); err != nil {
-			if strings.Contains(err.Error(), types.TgtadmLunActive) {
-				logrus.WithError(err).Warnf("LUN %d still active, continuing with target deletion", TargetLunID)
-			} else {
-				return err
+		lunIDs := []int{TargetLunID}
+		for _, lun := range dev.LUNs {
+			lunIDs = append(lunIDs, lun.ID)
+		}
+		for _, lunID := range lunIDs {
+			if err := dev.tgtd().DeleteLunContext(ctx, tid, lunID); err != nil {
+				if errors.Is(err, types.ErrLunActive) {
+					logrus.WithError(err).Warnf("LUN %d still active, continuing with target deletion", lunID)
+				} else if lunID == TargetLunID || !errors.Is(err, types.ErrNoLun) {
+					return err
+				}
 			}
 		}
 
-		if err := iscsi.DeleteTarget(tid); err != nil {
+		if err := dev.tgtd().DeleteTargetContext(ctx, tid); err != nil {
+			return err
+		}
+
+		if err := dev.deleteChapAccounts(ctx); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// Quiesce holds off the I/O to the target without disconnecting the
+// initiators, e.g. while the engine behind the backing store is swapped. The
+// initiators retry the commands until ScsiTimeout, so Resume has to be called
+// before that. New logins are rejected meanwhile.
+func (dev *Device) Quiesce() error {
+	return dev.QuiesceContext(context.Background())
+}
+
+// QuiesceContext is like Quiesce but takes a context.
+func (dev *Device) QuiesceContext(ctx context.Context) error {
+	return dev.setTargetState(ctx, iscsi.TargetStateOffline)
+}
+
+// Resume resumes the I/O to the target held off by Quiesce.
+func (dev *Device) Resume() error {
+	return dev.ResumeContext(context.Background())
+}
+
+// ResumeContext is like Resume but takes a context.
+func (dev *Device) ResumeContext(ctx context.Context) error {
+	return dev.setTargetState(ctx, iscsi.TargetStateReady)
+}
+
+func (dev *Device) setTargetState(ctx context.Context, state string) error {
+	if dev.targetID == 0 {
+		return errors.Wrapf(types.ErrNoTarget, "target %v is not created", dev.Target)
+	}
+	if err := dev.tgtd().SetTargetStateContext(ctx, dev.targetID, state); err != nil {
+		return errors.Wrapf(err, "failed to set target %v %v", dev.Target, state)
+	}
+	logrus.Infof("Set target %v %v", dev.Target, state)
+	return nil
+}
+
+// Redirect makes the initiators log in to the target at the portal, e.g. on
+// the node the engine is moved to. The connections are closed, so the
+// initiators log in again and follow the redirection. It's meant for the
+// external initiators, i.e. the local initiator has to be stopped first.
+func (dev *Device) Redirect(portal string, reason iscsi.RedirectReason) error {
+	return dev.RedirectContext(context.Background(), portal, reason)
+}
+
+// RedirectContext is like Redirect but takes a context.
+func (dev *Device) RedirectContext(ctx context.Context, portal string, reason iscsi.RedirectReason) error {
+	if dev.targetID == 0 {
+		return errors.Wrapf(types.ErrNoTarget, "target %v is not created", dev.Target)
+	}
+	p, err := iscsi.ParsePortal(portal)
+	if err != nil {
+		return err
+	}
+	if err := dev.tgtd().SetTargetRedirectContext(ctx, dev.targetID, p, reason); err != nil {
+		return errors.Wrapf(err, "failed to redirect target %v to %v", dev.Target, p)
+	}
+	logrus.Infof("Redirected target %v to %v (%v)", dev.Target, p, reason)
+	return dev.closeConnections(ctx, dev.targetID)
+}
+
+// GetSessions returns the sessions of the initiators logged in to the target,
+// i.e. the hosts the device is attached to.
+func (dev *Device) GetSessions() ([]iscsi.Session, error) {
+	return dev.GetSessionsContext(context.Background())
+}
+
+// GetSessionsContext is like GetSessions but takes a context.
+func (dev *Device) GetSessionsContext(ctx context.Context) ([]iscsi.Session, error) {
+	tid, err := dev.tgtd().GetTargetTidContext(ctx, dev.Target)
+	if err != nil {
+		return nil, err
+	}
+	if tid == -1 {
+		return nil, errors.Wrapf(types.ErrNoTarget, "cannot find target %v", dev.Target)
+	}
+	return dev.tgtd().GetSessionsContext(ctx, tid)
+}
+
+// EvictInitiator disconnects the initiator with the iSCSI name or IP address
+// from the target, e.g. to fence a node, while the other initiators stay
+// connected. If unbindACL is set, its ACL is unbound and removed from ACLs so
+// it cannot reconnect. See iscsi.EvictInitiator.
+func (dev *Device) EvictInitiator(initiator string, unbindACL bool) ([]iscsi.Session, error) {
+	return dev.EvictInitiatorContext(context.Background(), initiator, unbindACL)
+}
+
+// EvictInitiatorContext is like EvictInitiator but takes a context.
+func (dev *Device) EvictInitiatorContext(ctx context.Context, initiator string, unbindACL bool) ([]iscsi.Session, error) {
+	tid, err := dev.tgtd().GetTargetTidContext(ctx, dev.Target)
+	if err != nil {
+		return nil, err
+	}
+	if tid == -1 {
+		return nil, errors.Wrapf(types.ErrNoTarget, "cannot find target %v", dev.Target)
+	}
+	acls := slices.DeleteFunc(slices.Clone(dev.ACLs), func(acl iscsi.ACL) bool {
+		return acl.Value == initiator
+	})
+	sessions, err := dev.tgtd().EvictInitiatorContext(ctx, tid, initiator, unbindACL)
+	if err != nil {
+		return sessions, errors.Wrapf(err, "failed to evict initiator %v from target %v", initiator, dev.Target)
+	}
+	if unbindACL {
+		dev.ACLs = acls
+	}
+	return sessions, nil
+}
+
+func (dev *Device) closeConnections(ctx context.Context, tid int) error {
+	sessions, err := dev.tgtd().GetSessionsContext(ctx, tid)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		for _, connection := range session.Connections {
+			if err := dev.tgtd().CloseConnectionContext(ctx, tid, strconv.Itoa(session.ID), strconv.Itoa(connection.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// UpdateScsiBackingStore sets the backing store options of the LUN at
+// TargetLunID, which are used once the target is created or the LUN is
+// re-created for the expansion.
 func (dev *Device) UpdateScsiBackingStore(bsType, bsOpts string) error {
 	dev.BSType = bsType
 	dev.BSOpts = bsOpts
@@ -381,5 +1007,56 @@ func (dev *Device) UpdateScsiBackingStore(bsType, bsOpts string) error {
 }
 
 func (dev *Device) ExpandTarget(size int64) error {
-	return iscsi.ExpandLun(dev.targetID, TargetLunID, size)
+	return dev.ExpandTargetContext(context.Background(), size)
+}
+
+// ExpandTargetContext is like ExpandTarget but takes a context.
+func (dev *Device) ExpandTargetContext(ctx context.Context, size int64) error {
+	return dev.expandLun(ctx, TargetLunID, size, dev.BSType, &dev.BSOpts, dev.Identity, dev.KernelDevice)
+}
+
+// ExpandLun expands the LUN of the target, which can be TargetLunID or any
+// other LUN of the device.
+func (dev *Device) ExpandLun(id int, size int64) error {
+	return dev.ExpandLunContext(context.Background(), id, size)
+}
+
+// ExpandLunContext is like ExpandLun but takes a context.
+func (dev *Device) ExpandLunContext(ctx context.Context, id int, size int64) error {
+	if id == TargetLunID {
+		return dev.ExpandTargetContext(ctx, size)
+	}
+	lun := dev.GetLun(id)
+	if lun == nil {
+		return fmt.Errorf("cannot find LUN %v of target %v", id, dev.Target)
+	}
+	if deviceType, _ := lun.deviceType(); deviceType != iscsi.DeviceTypeDisk {
+		return fmt.Errorf("cannot expand LUN %v of device type %v", id, deviceType)
+	}
+	return dev.expandLun(ctx, id, size, lun.BSType, &lun.BSOpts, dev.lunIdentity(lun), lun.KernelDevice)
+}
+
+// expandLun expands the LUN with the best method supported by tgtd. If the
+// LUN is re-created, its identity and params are restored. The kernel device
+// is rescanned for the new capacity as a step of the expansion if the
+// initiator is started. The size in bsOpts is updated for longhorn, so the LUN
+// keeps it once re-created.
+func (dev *Device) expandLun(ctx context.Context, id int, size int64, bsType string, bsOpts *string, identity *iscsi.LunIdentity, kernelDevice *lhtypes.BlockDeviceInfo) error {
+	options := &iscsi.ExpandOptions{
+		BSOpts:   *bsOpts,
+		Identity: identity,
+		Params:   map[string]string{"mode_page": iscsi.ModePageWriteCacheDisabled},
+	}
+	if kernelDevice != nil {
+		options.Rescan = func(ctx context.Context) error {
+			return iscsi.RescanScsiDevice(kernelDevice.Name, dev.nsexec)
+		}
+	}
+	if _, err := dev.tgtd().ExpandLunWithOptionsContext(ctx, dev.targetID, id, size, options); err != nil {
+		return errors.Wrapf(err, "failed to expand LUN %v of target %v", id, dev.Target)
+	}
+	if bsType == "longhorn" {
+		*bsOpts = iscsi.SetBackingStoreOption(*bsOpts, "size", strconv.FormatInt(size, 10))
+	}
+	return nil
 }
@@ -0,0 +1,499 @@
+package iscsidev
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+	"github.com/longhorn/go-iscsi-helper/types"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type DeviceSuite struct {
+	iscsitest.Fixture
+
+	tidLockFile   string
+	retryInterval time.Duration
+}
+
+var _ = Suite(&DeviceSuite{})
+
+func (s *DeviceSuite) SetUpTest(c *C) {
+	s.Fixture.SetUpTest(c)
+
+	s.tidLockFile, s.retryInterval = iscsi.TargetIDLockFile, RetryIntervalSCSI
+	iscsi.TargetIDLockFile = filepath.Join(c.MkDir(), "tid.lock")
+	RetryIntervalSCSI = time.Millisecond
+}
+
+func (s *DeviceSuite) TearDownTest(c *C) {
+	iscsi.TargetIDLockFile, RetryIntervalSCSI = s.tidLockFile, s.retryInterval
+}
+
+func (s *DeviceSuite) newDevice(c *C, name string) *Device {
+	dev, err := NewDeviceWithExecutor(name, "/var/run/longhorn-"+name+".sock", "longhorn", "size=1073741824", 180, 15, s.Fake)
+	c.Assert(err, IsNil)
+	dev.Tgtd = s.Tgtd
+	return dev
+}
+
+func (s *DeviceSuite) TestStartAndStop(c *C) {
+	ctx := context.Background()
+	dev := s.newDevice(c, "vol1")
+	c.Assert(dev.SetLocalInitiatorACLs(), IsNil)
+	c.Assert(dev.CreateTarget(), IsNil)
+	c.Assert(dev.StartInitator(), IsNil)
+	c.Assert(dev.KernelDevice, NotNil)
+	c.Assert(s.Fake.Sessions(), DeepEquals, []string{dev.Target})
+
+	timeout, exists := s.Fake.File("/sys/block/" + dev.KernelDevice.Name + "/device/timeout")
+	c.Assert(exists, Equals, true)
+	c.Assert(timeout, Equals, "180")
+
+	target, err := s.Tgtd.GetTargetContext(ctx, dev.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.Nexuses, HasLen, 1)
+	c.Assert(target.LUN(TargetLunID), NotNil)
+
+	sessions, err := dev.GetSessions()
+	c.Assert(err, IsNil)
+	c.Assert(sessions, HasLen, 1)
+	c.Assert(sessions[0].ITNexusID, Equals, target.Nexuses[0].ID)
+	c.Assert(sessions[0].Initiator, Equals, iscsitest.DefaultInitiatorName)
+	c.Assert(target.LUN(TargetLunID).ThinProvisioning, Equals, true)
+
+	// A second target must not reuse the target ID
+	other := s.newDevice(c, "vol2")
+	c.Assert(other.CreateTarget(), IsNil)
+	tid, otherTID := iscsi.PreferredTargetID(dev.Target), iscsi.PreferredTargetID(other.Target)
+	c.Assert(tid, Not(Equals), otherTID)
+	c.Assert(s.Fake.TargetIDs(), DeepEquals, []int{min(tid, otherTID), max(tid, otherTID)})
+
+	c.Assert(dev.StopInitiator(), IsNil)
+	c.Assert(s.Fake.Sessions(), HasLen, 0)
+	c.Assert(s.Fake.NodeRecords(), Equals, 0)
+	c.Assert(dev.DeleteTarget(), IsNil)
+	c.Assert(s.Fake.TargetIDs(), DeepEquals, []int{otherTID})
+
+	// Stopping the initiator again is a no-op
+	c.Assert(dev.StopInitiator(), IsNil)
+	c.Assert(dev.DeleteTarget(), IsNil)
+}
+
+func (s *DeviceSuite) TestTgtdInstance(c *C) {
+	instance := iscsitest.NewFake()
+	instance.ControlPort = 1
+	instance.LockDirectory = c.MkDir()
+	dev, err := NewDeviceWithExecutor("vol1", "/var/run/longhorn-vol1.sock", "longhorn", "size=1073741824", 180, 15, instance)
+	c.Assert(err, IsNil)
+	dev.Tgtd = instance.Tgtd()
+	dev.Tgtd.Portals = []iscsi.Portal{{IP: "0.0.0.0", Port: 3261}}
+
+	// The target is created on the instance only
+	c.Assert(dev.CreateTarget(), IsNil)
+	c.Assert(instance.TargetIDs(), DeepEquals, []int{iscsi.PreferredTargetID(dev.Target)})
+	c.Assert(s.Fake.TargetIDs(), HasLen, 0)
+
+	// The initiator logs in via the port of the instance
+	c.Assert(dev.StartInitator(), IsNil)
+	c.Assert(instance.Sessions(), DeepEquals, []string{dev.Target})
+	portals := []string{}
+	for _, command := range instance.Commands() {
+		if command[0] == "iscsiadm" && slices.Contains(command, "--login") {
+			portals = append(portals, command[slices.Index(command, "-p")+1])
+		}
+	}
+	c.Assert(portals, HasLen, 1)
+	c.Assert(strings.HasSuffix(portals[0], ":3261"), Equals, true)
+
+	sessions, err := dev.GetSessions()
+	c.Assert(err, IsNil)
+	c.Assert(sessions, HasLen, 1)
+
+	c.Assert(dev.StopInitiator(), IsNil)
+	c.Assert(dev.DeleteTarget(), IsNil)
+	c.Assert(instance.TargetIDs(), HasLen, 0)
+}
+
+func (s *DeviceSuite) TestUnsupportedLun(c *C) {
+	dev := s.newDevice(c, "vol1")
+	dev.LUNs = []*LUN{{ID: 2, BackingFile: "/dev/sg1", BSType: "sg", DeviceType: iscsi.DeviceTypeCD}}
+	c.Assert(dev.CreateTarget(), NotNil)
+	dev.LUNs = []*LUN{NewISOLun(2, "/var/lib/longhorn/images/tools.iso")}
+
+	// No target is left behind if tgtd cannot back a LUN
+	s.Fake.BackingStores = []string{"longhorn"}
+	err := dev.CreateTarget()
+	c.Assert(err, ErrorMatches, "cannot add LUN 2 to target iqn.2019-10.io.longhorn:vol1: backing-store rdwr is not supported by tgtd, which supports longhorn: .*")
+	c.Assert(errors.Is(err, types.ErrUnsupportedOperation), Equals, true)
+	c.Assert(s.Fake.TargetIDs(), HasLen, 0)
+}
+
+func (s *DeviceSuite) TestChap(c *C) {
+	ctx := context.Background()
+	dev := s.newDevice(c, "vol1")
+	dev.ChapUsername, dev.ChapPassword = "user", "secret-password"
+	dev.MutualChapUsername, dev.MutualChapPassword = "target", "mutual-password"
+	c.Assert(dev.CreateTarget(), IsNil)
+	c.Assert(dev.StartInitator(), IsNil)
+
+	c.Assert(dev.StopInitiator(), IsNil)
+	c.Assert(dev.DeleteTarget(), IsNil)
+	accounts, err := s.Tgtd.ListAccountsContext(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(accounts, HasLen, 0)
+
+	// The initiator cannot log in with a wrong password
+	dev = s.newDevice(c, "vol2")
+	dev.ChapUsername, dev.ChapPassword = "user", "secret-password"
+	c.Assert(dev.CreateTarget(), IsNil)
+	dev.ChapPassword = "wrong-password"
+	err = dev.StartInitator()
+	c.Assert(err, NotNil)
+	c.Assert(err, ErrorMatches, "(?s).*exit status 24.*")
+	c.Assert(err, Not(ErrorMatches), "(?s).*wrong-password.*")
+	c.Assert(s.Fake.Sessions(), HasLen, 0)
+}
+
+func (s *DeviceSuite) TestACLs(c *C) {
+	dev := s.newDevice(c, "vol1")
+	acl, err := iscsi.NewNameACL("iqn.1993-08.org.debian:01:other")
+	c.Assert(err, IsNil)
+	dev.ACLs = []iscsi.ACL{{Type: iscsi.ACLTypeAddress, Value: iscsi.ACLAll}, acl}
+	c.Assert(dev.CreateTarget(), IsNil)
+	c.Assert(dev.StartInitator(), NotNil)
+	c.Assert(dev.DeleteTarget(), IsNil)
+	c.Assert(s.Fake.TargetIDs(), HasLen, 0)
+}
+
+func (s *DeviceSuite) TestEvictInitiator(c *C) {
+	dev := s.newDevice(c, "vol1")
+	c.Assert(dev.SetLocalInitiatorACLs(), IsNil)
+	other, err := iscsi.NewNameACL("iqn.1993-08.org.debian:01:other")
+	c.Assert(err, IsNil)
+	dev.ACLs = append(dev.ACLs, other)
+	c.Assert(dev.CreateTarget(), IsNil)
+	c.Assert(dev.StartInitator(), IsNil)
+
+	evicted, err := dev.EvictInitiator(iscsitest.DefaultInitiatorName, true)
+	c.Assert(err, IsNil)
+	c.Assert(evicted, HasLen, 1)
+	c.Assert(s.Fake.Sessions(), HasLen, 0)
+	c.Assert(dev.ACLs, HasLen, 2)
+	c.Assert(dev.ACLs[1], Equals, other)
+
+	// tgtd rejects all addresses without address ACLs, so the only one can be
+	// unbound, while all names are allowed without name ACLs
+	address := dev.ACLs[0]
+	c.Assert(address.Type, Equals, iscsi.ACLTypeAddress)
+	_, err = dev.EvictInitiator(address.Value, true)
+	c.Assert(err, IsNil)
+	c.Assert(dev.ACLs, DeepEquals, []iscsi.ACL{other})
+	_, err = dev.EvictInitiator(other.Value, true)
+	c.Assert(err, ErrorMatches, ".*all names are allowed without other name ACLs")
+	c.Assert(dev.ACLs, DeepEquals, []iscsi.ACL{other})
+	c.Assert(dev.DeleteTarget(), IsNil)
+	_, err = dev.EvictInitiator(other.Value, false)
+	c.Assert(errors.Is(err, types.ErrNoTarget), Equals, true)
+}
+
+func (s *DeviceSuite) TestQuiesce(c *C) {
+	ctx := context.Background()
+	dev := s.newDevice(c, "vol1")
+	c.Assert(errors.Is(dev.Quiesce(), types.ErrNoTarget), Equals, true)
+	c.Assert(dev.CreateTarget(), IsNil)
+	c.Assert(dev.StartInitator(), IsNil)
+
+	c.Assert(dev.Quiesce(), IsNil)
+	target, err := s.Tgtd.GetTargetContext(ctx, dev.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.State, Equals, iscsi.TargetStateOffline)
+	c.Assert(target.Nexuses, HasLen, 1)
+	// New logins are rejected
+	other := s.newDevice(c, "vol1")
+	c.Assert(other.ReloadTargetID(), IsNil)
+	c.Assert(dev.StopInitiator(), IsNil)
+	c.Assert(other.StartInitator(), NotNil)
+
+	c.Assert(dev.Resume(), IsNil)
+	c.Assert(dev.Resume(), IsNil)
+	c.Assert(dev.StartInitator(), IsNil)
+	c.Assert(s.Tgtd.SetTargetStateContext(ctx, dev.targetID, "paused"), ErrorMatches, "invalid target state paused")
+
+	// The LUN online flag
+	c.Assert(s.Tgtd.SetLunOnlineContext(ctx, dev.targetID, TargetLunID, false), IsNil)
+	target, err = s.Tgtd.GetTargetContext(ctx, dev.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.State, Equals, iscsi.TargetStateReady)
+	c.Assert(target.LUN(TargetLunID).Online, Equals, false)
+	c.Assert(s.Tgtd.SetLunOnlineContext(ctx, dev.targetID, TargetLunID, true), IsNil)
+	target, err = s.Tgtd.GetTargetContext(ctx, dev.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(TargetLunID).Online, Equals, true)
+	c.Assert(dev.DeleteTarget(), IsNil)
+}
+
+func (s *DeviceSuite) TestRedirect(c *C) {
+	ctx := context.Background()
+	dev := s.newDevice(c, "vol1")
+	c.Assert(errors.Is(dev.Redirect("10.0.0.2", iscsi.RedirectTemporary), types.ErrNoTarget), Equals, true)
+	c.Assert(dev.CreateTarget(), IsNil)
+	c.Assert(iscsi.DiscoverTarget("127.0.0.1", dev.Target, s.Fake), IsNil)
+	c.Assert(iscsi.LoginTarget("127.0.0.1", dev.Target, s.Fake), IsNil)
+	c.Assert(s.Fake.Sessions(), HasLen, 1)
+
+	c.Assert(dev.Redirect("10.0.0.2", iscsi.RedirectPermanent), IsNil)
+	c.Assert(s.Fake.Sessions(), HasLen, 0)
+	redirect, err := s.Tgtd.GetTargetRedirectContext(ctx, dev.targetID)
+	c.Assert(err, IsNil)
+	c.Assert(redirect.Portal.String(), Equals, "10.0.0.2:3260")
+	c.Assert(iscsi.LoginTarget("127.0.0.1", dev.Target, s.Fake), NotNil)
+
+	c.Assert(dev.Redirect("node-2", iscsi.RedirectPermanent), NotNil)
+	c.Assert(dev.DeleteTarget(), IsNil)
+}
+
+func (s *DeviceSuite) TestExpandAndRefresh(c *C) {
+	ctx := context.Background()
+	dev := s.newDevice(c, "vol1")
+	// The bsopts are passed to tgtd as they are, and only the size is
+	// replaced on expansion
+	c.Assert(dev.UpdateScsiBackingStore("longhorn", "size=1073741824;request_timeout=15;engine=v2"), IsNil)
+	c.Assert(dev.CreateTarget(), IsNil)
+	c.Assert(dev.StartInitator(), IsNil)
+
+	c.Assert(dev.ExpandTarget(2147483648), IsNil)
+	c.Assert(dev.BSOpts, Equals, "size=2147483648;request_timeout=15;engine=v2")
+	c.Assert(dev.RefreshInitiator(), IsNil)
+	target, err := s.Tgtd.GetTargetContext(ctx, dev.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(TargetLunID).SizeMB, Equals, int64(2147))
+
+	// Reloading keeps the session and finds the same device
+	reloaded := s.newDevice(c, "vol1")
+	c.Assert(reloaded.ReloadTargetID(), IsNil)
+	c.Assert(reloaded.ReloadInitiator(), IsNil)
+	c.Assert(reloaded.KernelDevice.Name, Equals, dev.KernelDevice.Name)
+	c.Assert(s.Fake.Sessions(), HasLen, 1)
+}
+
+func (s *DeviceSuite) TestStopInitiatorDeadline(c *C) {
+	dev := s.newDevice(c, "vol1")
+	c.Assert(dev.CreateTarget(), IsNil)
+	c.Assert(dev.StartInitator(), IsNil)
+
+	// A stuck logout is killed at the deadline, and the lock is released
+	s.Fake.Hang("iscsiadm", "--logout")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := dev.StopInitiatorContext(ctx)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Assert(time.Since(start) < LockTimeout, Equals, true)
+
+	lock, err := dev.lockContext(context.Background())
+	c.Assert(err, IsNil)
+	lock.Unlock()
+
+	// No retry is started with a cancelled context
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	commands := len(s.Fake.Commands())
+	c.Assert(errors.Is(dev.DeleteTargetContext(ctx), context.Canceled), Equals, true)
+	c.Assert(s.Fake.Commands(), HasLen, commands)
+	c.Assert(s.Fake.TargetIDs(), DeepEquals, []int{iscsi.PreferredTargetID(dev.Target)})
+}
+
+func (s *DeviceSuite) TestMultipleLuns(c *C) {
+	ctx := context.Background()
+	dev := s.newDevice(c, "vol1")
+	dev.LUNs = []*LUN{{ID: 2, BackingFile: "/var/run/longhorn-vol1-snap1.sock", BSType: "longhorn", BSOpts: "size=1073741824"}}
+	c.Assert(dev.CreateTarget(), IsNil)
+	c.Assert(dev.StartInitator(), IsNil)
+	c.Assert(dev.GetLun(2).KernelDevice, NotNil)
+	c.Assert(dev.GetLun(2).KernelDevice.Name, Not(Equals), dev.KernelDevice.Name)
+
+	// Only the new LUN is scanned on the initiator
+	commands := len(s.Fake.Commands())
+	c.Assert(dev.AddLun(&LUN{ID: 3, BackingFile: "/var/run/longhorn-vol1-snap2.sock", BSType: "longhorn"}), IsNil)
+	for _, command := range s.Fake.Commands()[commands:] {
+		c.Assert(command, Not(DeepEquals), []string{"iscsiadm", "-m", "node", "-T", dev.Target, "-R"})
+	}
+	scan, _ := s.Fake.File("/sys/class/scsi_host/host1/scan")
+	c.Assert(scan, Equals, "0 0 3")
+	c.Assert(dev.GetLun(3).KernelDevice, NotNil)
+	c.Assert(dev.AddLun(&LUN{ID: 3}), NotNil)
+	c.Assert(dev.AddLun(&LUN{ID: TargetLunID}), NotNil)
+
+	target, err := s.Tgtd.GetTargetContext(ctx, dev.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.LUNs, HasLen, 4)
+	c.Assert(target.LUN(3).ThinProvisioning, Equals, true)
+
+	c.Assert(dev.ExpandLun(3, 2147483648), IsNil)
+	rescan, _ := s.Fake.File(filepath.Join("/sys/block", dev.GetLun(3).KernelDevice.Name, "device", "rescan"))
+	c.Assert(rescan, Equals, "1")
+	c.Assert(dev.ExpandLun(4, 2147483648), NotNil)
+
+	// The device is removed from the initiator along with the LUN
+	name := dev.GetLun(2).KernelDevice.Name
+	c.Assert(dev.RemoveLun(2), IsNil)
+	c.Assert(dev.GetLun(2), IsNil)
+	devices, err := s.Fake.GetSystemBlockDevices()
+	c.Assert(err, IsNil)
+	c.Assert(devices, HasLen, 2)
+	_, exists := devices[name]
+	c.Assert(exists, Equals, false)
+	target, err = s.Tgtd.GetTargetContext(ctx, dev.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(2), IsNil)
+
+	reloaded := s.newDevice(c, "vol1")
+	reloaded.LUNs = []*LUN{{ID: 3}}
+	c.Assert(reloaded.ReloadTargetID(), IsNil)
+	c.Assert(reloaded.ReloadInitiator(), IsNil)
+	c.Assert(reloaded.GetLun(3).KernelDevice.Name, Equals, dev.GetLun(3).KernelDevice.Name)
+
+	c.Assert(dev.StopInitiator(), IsNil)
+	c.Assert(dev.DeleteTarget(), IsNil)
+	c.Assert(s.Fake.TargetIDs(), HasLen, 0)
+}
+
+func (s *DeviceSuite) TestStableIdentity(c *C) {
+	ctx := context.Background()
+	dev := s.newDevice(c, "vol1")
+	dev.LUNs = []*LUN{{ID: 2, BackingFile: "/var/run/longhorn-vol1-snap1.sock", BSType: "longhorn"}}
+	c.Assert(dev.CreateTarget(), IsNil)
+	target, err := s.Tgtd.GetTargetContext(ctx, dev.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(TargetLunID).SCSIID, Equals, iscsi.NewLunIdentity("vol1").SCSIID)
+	c.Assert(target.LUN(2).SCSIID, Not(Equals), target.LUN(TargetLunID).SCSIID)
+	c.Assert(target.LUN(2).SCSISN, Not(Equals), target.LUN(TargetLunID).SCSISN)
+	c.Assert(dev.DeleteTarget(), IsNil)
+
+	// The identity doesn't depend on the TID
+	other := s.newDevice(c, "vol2")
+	c.Assert(other.CreateTarget(), IsNil)
+	c.Assert(s.Tgtd.CreateTargetContext(ctx, target.TID, GetTargetName("vol3")), IsNil)
+	recreated := s.newDevice(c, "vol1")
+	recreated.LUNs = []*LUN{{ID: 2, BackingFile: "/var/run/longhorn-vol1-snap1.sock", BSType: "longhorn"}}
+	c.Assert(recreated.CreateTarget(), IsNil)
+	retarget, err := s.Tgtd.GetTargetContext(ctx, recreated.Target)
+	c.Assert(err, IsNil)
+	c.Assert(retarget.TID, Not(Equals), target.TID)
+	c.Assert(retarget.LUN(TargetLunID).SCSIID, Equals, target.LUN(TargetLunID).SCSIID)
+	c.Assert(retarget.LUN(TargetLunID).SCSISN, Equals, target.LUN(TargetLunID).SCSISN)
+	c.Assert(retarget.LUN(2).SCSIID, Equals, target.LUN(2).SCSIID)
+
+	// tgtd defaults are kept without an identity
+	c.Assert(other.DeleteTarget(), IsNil)
+	other.Identity = nil
+	c.Assert(other.CreateTarget(), IsNil)
+	othertarget, err := s.Tgtd.GetTargetContext(ctx, other.Target)
+	c.Assert(err, IsNil)
+	c.Assert(othertarget.LUN(TargetLunID).SCSIID, Matches, "IET .*")
+}
+
+func (s *DeviceSuite) TestReadOnly(c *C) {
+	ctx := context.Background()
+	dev := s.newDevice(c, "vol1")
+	dev.ReadOnly = true
+	dev.LUNs = []*LUN{
+		{ID: 2, BackingFile: "/var/run/longhorn-vol1-snap1.sock", BSType: "longhorn", ReadOnly: true},
+		{ID: 3, BackingFile: "/var/run/longhorn-vol1-snap2.sock", BSType: "longhorn"},
+	}
+	c.Assert(dev.CreateTarget(), IsNil)
+	target, err := s.Tgtd.GetTargetContext(ctx, dev.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(TargetLunID).Readonly, Equals, true)
+	c.Assert(target.LUN(2).Readonly, Equals, true)
+	c.Assert(target.LUN(3).Readonly, Equals, false)
+
+	c.Assert(dev.StartInitator(), IsNil)
+	for name, readOnly := range map[string]bool{
+		dev.KernelDevice.Name:           true,
+		dev.GetLun(2).KernelDevice.Name: true,
+		dev.GetLun(3).KernelDevice.Name: false,
+	} {
+		ro, err := iscsi.IsDeviceReadOnly(name, s.Fake)
+		c.Assert(err, IsNil)
+		c.Assert(ro, Equals, readOnly, Commentf("%v", name))
+	}
+
+	// The device is set read-only if the kernel didn't do it
+	c.Assert(s.Fake.WriteFile("/sys/block/"+dev.KernelDevice.Name+"/ro", "0"), IsNil)
+	c.Assert(dev.ReloadInitiator(), IsNil)
+	ro, err := iscsi.IsDeviceReadOnly(dev.KernelDevice.Name, s.Fake)
+	c.Assert(err, IsNil)
+	c.Assert(ro, Equals, true)
+
+	c.Assert(dev.StopInitiator(), IsNil)
+	c.Assert(dev.DeleteTarget(), IsNil)
+}
+
+func (s *DeviceSuite) TestISOLun(c *C) {
+	ctx := context.Background()
+	dev := s.newDevice(c, "vol1")
+	c.Assert(dev.CreateTarget(), IsNil)
+	c.Assert(dev.StartInitator(), IsNil)
+
+	c.Assert(dev.AddLun(NewISOLun(2, "/var/lib/images/install.iso")), IsNil)
+	target, err := s.Tgtd.GetTargetContext(ctx, dev.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(2).DeviceType(), Equals, iscsi.DeviceTypeCD)
+	c.Assert(target.LUN(2).BackingStoreType, Equals, "rdwr")
+	c.Assert(target.LUN(2).Readonly, Equals, true)
+	c.Assert(target.LUN(2).ThinProvisioning, Equals, false)
+	c.Assert(dev.GetLun(2).KernelDevice.Name, Equals, "sr0")
+	ro, err := iscsi.IsDeviceReadOnly("sr0", s.Fake)
+	c.Assert(err, IsNil)
+	c.Assert(ro, Equals, true)
+
+	// The LUNs without block devices cannot be added
+	c.Assert(dev.AddLun(&LUN{ID: 3, BackingFile: "/dev/sg1", BSType: "sg", DeviceType: iscsi.DeviceTypePassthrough}), NotNil)
+	c.Assert(dev.GetLun(3), IsNil)
+
+	c.Assert(dev.RemoveLun(2), IsNil)
+	c.Assert(dev.StopInitiator(), IsNil)
+	c.Assert(dev.DeleteTarget(), IsNil)
+}
+
+func (s *DeviceSuite) TestExpandOnUpstreamTgt(c *C) {
+	ctx := context.Background()
+	s.Fake.BackingStores = []string{"rdwr", "aio"}
+	// rdwr takes no size option, so the backing file reports the size
+	image := filepath.Join(c.MkDir(), "vol1.img")
+	c.Assert(os.WriteFile(image, nil, 0600), IsNil)
+	c.Assert(os.Truncate(image, 1073741824), IsNil)
+	dev, err := NewDeviceWithExecutor("vol1", image, "rdwr", "", 180, 15, s.Fake)
+	c.Assert(err, IsNil)
+	dev.Tgtd = s.Tgtd
+	c.Assert(dev.CreateTarget(), IsNil)
+	c.Assert(dev.StartInitator(), IsNil)
+
+	c.Assert(os.Truncate(image, 2147483648), IsNil)
+	c.Assert(dev.ExpandTarget(2147483648), IsNil)
+	c.Assert(dev.BSOpts, Equals, "")
+	target, err := s.Tgtd.GetTargetContext(ctx, dev.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(TargetLunID).SizeMB, Equals, int64(2147))
+	c.Assert(target.LUN(TargetLunID).SCSIID, Equals, dev.Identity.SCSIID)
+	c.Assert(target.LUN(TargetLunID).ThinProvisioning, Equals, true)
+	c.Assert(s.Fake.Sessions(), DeepEquals, []string{dev.Target})
+	rescan, _ := s.Fake.File("/sys/block/" + dev.KernelDevice.Name + "/device/rescan")
+	c.Assert(rescan, Equals, "1")
+
+	c.Assert(dev.StopInitiator(), IsNil)
+	c.Assert(dev.DeleteTarget(), IsNil)
+}
@@ -0,0 +1,378 @@
+// Package iscsitest provides a stateful, in-memory emulation of tgtd and the
+// iSCSI initiator for tests, so the helpers of go-iscsi-helper can be tested
+// without privileges, tgtd or iscsid.
+package iscsitest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+
+	csync "github.com/longhorn/go-common-libs/sync"
+	lhtypes "github.com/longhorn/go-common-libs/types"
+)
+
+const (
+	DefaultInitiatorName = "iqn.1993-08.org.debian:01:iscsitest"
+
+	// iscsiadm exit codes from open-iscsi/include/iscsi_err.h
+	IscsiErrSessExists       = 15
+	IscsiErrNoObjsFound      = 21
+	IscsiErrLoginAuthFailed  = 24
+	IscsiErrTransport        = 8
+	IscsiErrInvalidOperation = 7
+)
+
+// Fake emulates tgtadm, iscsiadm and the block devices created by the
+// initiator. It implements iscsi.ContextExecutor and iscsi.HostInterface.
+//
+// The fake tgtd and the fake initiator share the state, i.e. a login to a
+// target creates an I_T nexus on the target and a block device for each LUN.
+type Fake struct {
+	lock sync.Mutex
+
+	// InitiatorName is the iSCSI name of the fake initiator. The sessions
+	// keep the name at login, so it can be changed to emulate other hosts.
+	InitiatorName string
+	// BackingStores are the backing stores supported by the fake tgtd. The
+	// fake emulates the upstream tgt rather than rancher/tgt without the
+	// longhorn backing store, i.e. it rejects the bsopts param of the LUNs.
+	BackingStores []string
+	// Version is the version of tgt printed by `tgtadm --version`.
+	Version string
+	// ControlPort is the control port of the fake tgtd. Like tgtadm, the
+	// requests to other control ports fail to connect.
+	ControlPort int
+	// LockDirectory is where the lock files of the host are locked, e.g. a
+	// temporary directory. They're locked as they are if it's empty.
+	LockDirectory string
+
+	targets  map[int]*fakeTarget
+	accounts map[string]string
+	portals  []string
+
+	nodes         map[nodeKey]map[string]string
+	discoveryAuth map[string]map[string]string
+	sessions      []*fakeSession
+	nextSID       int
+	nextDevice    int
+	nextCD        int
+
+	files    map[string]string
+	commands [][]string
+	hangs    [][]string
+}
+
+type fakeTarget struct {
+	tid      int
+	name     string
+	state    string
+	luns     map[int]*fakeLUN
+	acls     []string
+	nameACLs []string
+	accounts []iscsi.TargetAccount
+	// redirect holds RedirectAddress, RedirectPort and RedirectReason
+	redirect map[string]string
+}
+
+type fakeLUN struct {
+	id         int
+	path       string
+	bsType     string
+	bsOpts     string
+	bsOFlags   string
+	deviceType string
+	params     map[string]string
+}
+
+type nodeKey struct {
+	target string
+	portal string
+}
+
+type fakeSession struct {
+	sid       int
+	initiator string
+	target    string
+	portal    string
+	address   string
+	devices   map[int]lhtypes.BlockDeviceInfo
+}
+
+// NewFake returns a fake with a running tgtd without any target.
+func NewFake() *Fake {
+	return &Fake{
+		InitiatorName: DefaultInitiatorName,
+		BackingStores: []string{"sheepdog", "bsg", "sg", "null", "ssc", "smc", "mmc", "rdwr", "aio", "longhorn"},
+		Version:       "1.0.85",
+
+		targets:       map[int]*fakeTarget{},
+		accounts:      map[string]string{},
+		portals:       []string{"0.0.0.0:3260", "[::]:3260"},
+		nodes:         map[nodeKey]map[string]string{},
+		discoveryAuth: map[string]map[string]string{},
+		nextSID:       1,
+		files:         map[string]string{},
+	}
+}
+
+// Tgtd returns the fake tgtd as an instance, so the target helpers can manage
+// it by the methods of iscsi.Tgtd, e.g. besides another fake.
+func (f *Fake) Tgtd() *iscsi.Tgtd {
+	return &iscsi.Tgtd{
+		ControlPort: f.ControlPort,
+		Backend:     iscsi.NewExecBackend(f),
+	}
+}
+
+// Hang makes the commands of the binary with all the args hang until the
+// context is done or the timeout expires, e.g. Hang("iscsiadm", "--logout").
+func (f *Fake) Hang(binary string, args ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.hangs = append(f.hangs, append([]string{binary}, args...))
+}
+
+func (f *Fake) hanging(binary string, args []string) bool {
+	for _, hang := range f.hangs {
+		if filepath.Base(binary) != hang[0] {
+			continue
+		}
+		matched := true
+		for _, arg := range hang[1:] {
+			if !slices.Contains(args, arg) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Execute implements iscsi.Executor.
+func (f *Fake) Execute(envs []string, binary string, args []string, timeout time.Duration) (string, error) {
+	return f.ExecuteContext(context.Background(), envs, binary, args, timeout)
+}
+
+// ExecuteContext implements iscsi.ContextExecutor.
+func (f *Fake) ExecuteContext(ctx context.Context, envs []string, binary string, args []string, timeout time.Duration) (string, error) {
+	f.lock.Lock()
+	f.commands = append(f.commands, append([]string{binary}, args...))
+	hanging := f.hanging(binary, args)
+	f.lock.Unlock()
+
+	if hanging {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		<-ctx.Done()
+	}
+	if err := ctx.Err(); err != nil {
+		return "", errors.Wrapf(err, "timeout executing: %v %v", binary, args)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch filepath.Base(binary) {
+	case "tgtadm":
+		return f.tgtadm(args)
+	case "iscsiadm":
+		return f.iscsiadm(args)
+	case "cat":
+		if len(args) == 1 && args[0] == iscsi.InitiatorNameFile {
+			return fmt.Sprintf("InitiatorName=%s\n", f.InitiatorName), nil
+		}
+		return "", newExitError(binary, args, 1, "cat: No such file or directory")
+	case "sg_raw":
+		return "", nil
+	case "blockdev":
+		return f.blockdev(binary, args)
+	}
+	return "", newExitError(binary, args, 127, fmt.Sprintf("%v: command not found", binary))
+}
+
+// blockdev emulates getting and setting the read-only flag of the devices.
+func (f *Fake) blockdev(binary string, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", newExitError(binary, args, 1, "blockdev: invalid arguments")
+	}
+	roFile := filepath.Join("/sys/block", filepath.Base(args[1]), "ro")
+	if _, exists := f.files[roFile]; !exists {
+		return "", newExitError(binary, args, 1, fmt.Sprintf("blockdev: cannot open %v: No such file or directory", args[1]))
+	}
+	switch args[0] {
+	case "--getro":
+		return f.files[roFile] + "\n", nil
+	case "--setro":
+		f.files[roFile] = "1"
+		return "", nil
+	case "--setrw":
+		f.files[roFile] = "0"
+		return "", nil
+	}
+	return "", newExitError(binary, args, 1, fmt.Sprintf("blockdev: unknown command %v", args[0]))
+}
+
+// GetSystemBlockDevices implements iscsi.HostInterface. It returns the block
+// devices of the LUNs attached by the sessions.
+func (f *Fake) GetSystemBlockDevices() (map[string]lhtypes.BlockDeviceInfo, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	devices := map[string]lhtypes.BlockDeviceInfo{}
+	for _, session := range f.sessions {
+		for _, dev := range session.devices {
+			devices[dev.Name] = dev
+		}
+	}
+	return devices, nil
+}
+
+// WriteFile implements iscsi.HostInterface. Like the kernel, scanning a LUN
+// on a SCSI host attaches its device, and deleting a SCSI device detaches it.
+func (f *Fake) WriteFile(filePath, data string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.files[filePath] = data
+
+	var host, channel, id, lun int
+	if _, err := fmt.Sscanf(filePath, "/sys/class/scsi_host/host%d/scan", &host); err == nil {
+		if _, err := fmt.Sscanf(data, "%d %d %d", &channel, &id, &lun); err != nil {
+			return errors.Wrapf(err, "invalid scan %q", data)
+		}
+		for _, session := range f.sessions {
+			if session.sid == host {
+				f.attachDevice(session, lun)
+			}
+		}
+		return nil
+	}
+	if dir, file := filepath.Split(filePath); file == "delete" && strings.HasPrefix(dir, "/sys/block/") {
+		name := filepath.Base(filepath.Dir(filepath.Clean(dir)))
+		for _, session := range f.sessions {
+			for id, dev := range session.devices {
+				if dev.Name == name {
+					delete(session.devices, id)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// LockFile implements iscsi.HostInterface. It locks the file under
+// LockDirectory in the current namespaces rather than the ones of the host.
+func (f *Fake) LockFile(filePath string) (*os.File, error) {
+	filePath = filepath.Join(f.LockDirectory, filePath)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, err
+	}
+	return csync.LockFile(filePath)
+}
+
+// File returns the content written to the file, e.g. the SCSI device timeout.
+func (f *Fake) File(filePath string) (string, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	content, exists := f.files[filePath]
+	return content, exists
+}
+
+// Commands returns all commands executed so far, with the binary as the first
+// element of each command.
+func (f *Fake) Commands() [][]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	commands := make([][]string, len(f.commands))
+	copy(commands, f.commands)
+	return commands
+}
+
+// TargetIDs returns the IDs of all targets of the fake tgtd.
+func (f *Fake) TargetIDs() []int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.sortedTIDs()
+}
+
+// Sessions returns the target names of all sessions of the fake initiator.
+func (f *Fake) Sessions() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	targets := []string{}
+	for _, session := range f.sessions {
+		targets = append(targets, session.target)
+	}
+	return targets
+}
+
+// NodeRecords returns the number of node records of the fake initiator.
+func (f *Fake) NodeRecords() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.nodes)
+}
+
+func (f *Fake) sortedTIDs() []int {
+	tids := []int{}
+	for tid := range f.targets {
+		tids = append(tids, tid)
+	}
+	sort.Ints(tids)
+	return tids
+}
+
+func (f *Fake) targetByName(name string) *fakeTarget {
+	for _, target := range f.targets {
+		if target.name == name {
+			return target
+		}
+	}
+	return nil
+}
+
+// exitError emulates the error returned by lhexec when the command exits with
+// a non-zero status.
+type exitError struct {
+	binary string
+	args   []string
+	code   int
+	stderr string
+}
+
+func newExitError(binary string, args []string, code int, stderr string) *exitError {
+	return &exitError{
+		binary: binary,
+		args:   args,
+		code:   code,
+		stderr: stderr,
+	}
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("failed to execute: %v %v, output , stderr %s\n: exit status %d", e.binary, e.args, e.stderr, e.code)
+}
+
+func (e *exitError) ExitCode() int {
+	return e.code
+}
@@ -0,0 +1,25 @@
+package iscsitest
+
+import (
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+
+	. "gopkg.in/check.v1"
+)
+
+// Fixture is a gocheck fixture with a new fake for every test, to be embedded
+// in the suites. The suites with their own SetUpTest have to call the one of
+// the fixture.
+type Fixture struct {
+	Fake *Fake
+	// Tgtd is the fake tgtd as an instance, so the target helpers manage it
+	// rather than iscsi.DefaultTgtd.
+	Tgtd *iscsi.Tgtd
+}
+
+// SetUpTest creates the fake, which locks the lock files in a temporary
+// directory.
+func (s *Fixture) SetUpTest(c *C) {
+	s.Fake = NewFake()
+	s.Fake.LockDirectory = c.MkDir()
+	s.Tgtd = s.Fake.Tgtd()
+}
@@ -0,0 +1,438 @@
+package iscsitest
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+
+	lhtypes "github.com/longhorn/go-common-libs/types"
+)
+
+type iscsiadmArgs struct {
+	mode      string
+	target    string
+	portal    string
+	op        string
+	name      string
+	value     string
+	print     string
+	login     bool
+	logout    bool
+	rescan    bool
+	discover  bool
+	version   bool
+	hasPortal bool
+}
+
+func parseIscsiadmArgs(args []string) (*iscsiadmArgs, error) {
+	a := &iscsiadmArgs{}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--login", "-l":
+			a.login = true
+			continue
+		case "--logout", "-u":
+			a.logout = true
+			continue
+		case "--rescan", "-R":
+			a.rescan = true
+			continue
+		case "--discover":
+			a.discover = true
+			continue
+		case "--version":
+			a.version = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("option %v requires an argument", args[i])
+		}
+		value := args[i+1]
+		i++
+		switch args[i-1] {
+		case "-m", "--mode":
+			a.mode = value
+		case "-T", "--targetname":
+			a.target = value
+		case "-p", "--portal":
+			portal, err := iscsi.ParsePortal(value)
+			if err != nil {
+				return nil, err
+			}
+			a.portal = portal.String()
+			a.hasPortal = true
+		case "-o", "--op":
+			a.op = value
+		case "-n", "--name":
+			a.name = value
+		case "-v", "--value":
+			a.value = value
+		case "-P", "--print":
+			a.print = value
+		case "-t", "--type":
+		default:
+			return nil, fmt.Errorf("unsupported option %v", args[i-1])
+		}
+	}
+	return a, nil
+}
+
+func (f *Fake) iscsiadmError(args []string, code int, msg string) error {
+	return newExitError("iscsiadm", args, code, "iscsiadm: "+msg)
+}
+
+func (f *Fake) iscsiadm(args []string) (string, error) {
+	a, err := parseIscsiadmArgs(args)
+	if err != nil {
+		return "", f.iscsiadmError(args, IscsiErrInvalidOperation, err.Error())
+	}
+	if a.version {
+		return "iscsiadm version 2.1.9\n", nil
+	}
+
+	switch a.mode {
+	case "discovery":
+		return f.discover(a), nil
+	case "discoverydb":
+		switch {
+		case a.discover:
+			return f.discover(a), nil
+		case a.op == "new":
+			if f.discoveryAuth[a.portal] == nil {
+				f.discoveryAuth[a.portal] = map[string]string{}
+			}
+			return "New discovery record for [" + a.portal + "] added.\n", nil
+		case a.op == "update":
+			if f.discoveryAuth[a.portal] == nil {
+				return "", f.iscsiadmError(args, IscsiErrNoObjsFound, "No records found")
+			}
+			f.discoveryAuth[a.portal][a.name] = a.value
+			return "", nil
+		}
+	case "node":
+		return f.iscsiadmNode(args, a)
+	case "session":
+		if len(f.sessions) == 0 {
+			return "", f.iscsiadmError(args, IscsiErrNoObjsFound, "No active sessions.")
+		}
+		if a.print == "3" {
+			return f.showSessionDetails(), nil
+		}
+		return f.showSessions(), nil
+	}
+	return "", f.iscsiadmError(args, IscsiErrInvalidOperation, "unsupported operation")
+}
+
+// discover creates node records for all targets of the fake tgtd
+func (f *Fake) discover(a *iscsiadmArgs) string {
+	b := &strings.Builder{}
+	for _, tid := range f.sortedTIDs() {
+		target := f.targets[tid]
+		key := nodeKey{target: target.name, portal: a.portal}
+		if f.nodes[key] == nil {
+			f.nodes[key] = map[string]string{
+				"node.name":         target.name,
+				"node.session.scan": "auto",
+			}
+		}
+		fmt.Fprintf(b, "%s,1 %s\n", a.portal, target.name)
+	}
+	return b.String()
+}
+
+func (f *Fake) matchNodes(a *iscsiadmArgs) []nodeKey {
+	keys := []nodeKey{}
+	for key := range f.nodes {
+		if a.target != "" && key.target != a.target {
+			continue
+		}
+		if a.hasPortal && key.portal != a.portal {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].target+keys[i].portal < keys[j].target+keys[j].portal
+	})
+	return keys
+}
+
+func (f *Fake) matchSessions(a *iscsiadmArgs) []*fakeSession {
+	sessions := []*fakeSession{}
+	for _, session := range f.sessions {
+		if a.target != "" && session.target != a.target {
+			continue
+		}
+		if a.hasPortal && session.portal != a.portal {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func (f *Fake) iscsiadmNode(args []string, a *iscsiadmArgs) (string, error) {
+	switch {
+	case a.logout:
+		sessions := f.matchSessions(a)
+		if len(sessions) == 0 {
+			return "", f.iscsiadmError(args, IscsiErrNoObjsFound, "No matching sessions found")
+		}
+		for _, session := range sessions {
+			f.removeSession(session)
+		}
+		return "", nil
+	case a.rescan:
+		sessions := f.matchSessions(a)
+		if len(sessions) == 0 {
+			return "", f.iscsiadmError(args, IscsiErrNoObjsFound, "No session found.")
+		}
+		for _, session := range sessions {
+			f.attachDevices(session)
+		}
+		return "", nil
+	}
+
+	keys := f.matchNodes(a)
+	if len(keys) == 0 {
+		return "", f.iscsiadmError(args, IscsiErrNoObjsFound, "No records found")
+	}
+
+	switch {
+	case a.login:
+		for _, key := range keys {
+			if err := f.login(args, key); err != nil {
+				return "", err
+			}
+		}
+		return "", nil
+	case a.op == "delete":
+		for _, key := range keys {
+			delete(f.nodes, key)
+		}
+		return "", nil
+	case a.op == "update":
+		for _, key := range keys {
+			f.nodes[key][a.name] = a.value
+		}
+		return "", nil
+	case a.op == "" || a.op == "show":
+		b := &strings.Builder{}
+		for _, key := range keys {
+			names := []string{}
+			for name := range f.nodes[key] {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				value := f.nodes[key][name]
+				if strings.Contains(name, "password") {
+					value = "********"
+				}
+				fmt.Fprintf(b, "%s = %s\n", name, value)
+			}
+		}
+		return b.String(), nil
+	}
+	return "", f.iscsiadmError(args, IscsiErrInvalidOperation, "unsupported operation")
+}
+
+func (f *Fake) login(args []string, key nodeKey) error {
+	for _, session := range f.sessions {
+		if session.target == key.target && session.portal == key.portal {
+			return f.iscsiadmError(args, IscsiErrSessExists, "default: 1 session requested, but 1 already present.")
+		}
+	}
+	target := f.targetByName(key.target)
+	if target == nil || target.state == "offline" {
+		return f.iscsiadmError(args, IscsiErrTransport, "Could not login to [iface: default, target: "+key.target+"]")
+	}
+
+	// The fake initiator cannot reach the portals of other hosts
+	if address := target.redirect["RedirectAddress"]; address != "" {
+		return f.iscsiadmError(args, IscsiErrTransport, fmt.Sprintf("Could not login to [iface: default, target: %v]: target moved to %v", key.target, net.JoinHostPort(address, target.redirect["RedirectPort"])))
+	}
+
+	host, _, _ := net.SplitHostPort(key.portal)
+	if !f.allowedByACLs(target, host) || !f.authenticated(target, f.nodes[key]) {
+		return f.iscsiadmError(args, IscsiErrLoginAuthFailed, "Could not login to [iface: default, target: "+key.target+"]: authorization failure")
+	}
+
+	session := &fakeSession{
+		sid:       f.nextSID,
+		initiator: f.InitiatorName,
+		target:    key.target,
+		portal:    key.portal,
+		address:   host,
+		devices:   map[int]lhtypes.BlockDeviceInfo{},
+	}
+	f.nextSID++
+	f.sessions = append(f.sessions, session)
+	f.attachDevices(session)
+	return nil
+}
+
+// allowedByACLs checks the ACLs the same way as tgtd. The address has to
+// match an address ACL, and the initiator name has to match a name ACL if
+// there is any.
+func (f *Fake) allowedByACLs(target *fakeTarget, address string) bool {
+	addressAllowed := false
+	for _, acl := range target.acls {
+		if acl == iscsi.ACLAll || acl == address {
+			addressAllowed = true
+		} else if _, ipNet, err := net.ParseCIDR(acl); err == nil && ipNet.Contains(net.ParseIP(address)) {
+			addressAllowed = true
+		}
+	}
+	return addressAllowed && (len(target.nameACLs) == 0 || slices.Contains(target.nameACLs, f.InitiatorName))
+}
+
+// authenticated checks the CHAP credentials of the node record against the
+// accounts of the target.
+func (f *Fake) authenticated(target *fakeTarget, node map[string]string) bool {
+	const prefix = "node.session.auth."
+	incoming := false
+	for _, account := range target.accounts {
+		if account.Outgoing {
+			if username := node[prefix+"username_in"]; username != "" &&
+				(username != account.User || node[prefix+"password_in"] != f.accounts[account.User]) {
+				return false
+			}
+			continue
+		}
+		incoming = true
+	}
+	if !incoming {
+		return true
+	}
+	if node[prefix+"authmethod"] != "CHAP" {
+		return false
+	}
+	for _, account := range target.accounts {
+		if !account.Outgoing && account.User == node[prefix+"username"] {
+			return node[prefix+"password"] == f.accounts[account.User]
+		}
+	}
+	return false
+}
+
+// attachDevices creates a block device for each LUN of the target, except for
+// the controller LUN 0.
+func (f *Fake) attachDevices(session *fakeSession) {
+	target := f.targetByName(session.target)
+	if target == nil {
+		return
+	}
+	for id := range session.devices {
+		if target.luns[id] == nil {
+			delete(session.devices, id)
+		}
+	}
+	for id := range target.luns {
+		f.attachDevice(session, id)
+	}
+}
+
+// attachDevice creates a block device for the LUN of the target if it
+// doesn't exist yet.
+func (f *Fake) attachDevice(session *fakeSession, id int) {
+	target := f.targetByName(session.target)
+	if id == 0 || target == nil || target.luns[id] == nil {
+		return
+	}
+	if _, exists := session.devices[id]; exists {
+		return
+	}
+	var dev lhtypes.BlockDeviceInfo
+	switch target.luns[id].deviceType {
+	case "disk":
+		f.nextDevice++
+		dev = lhtypes.BlockDeviceInfo{
+			Name:  deviceName(f.nextDevice),
+			Major: 8,
+			Minor: f.nextDevice * 16,
+		}
+	case "cd":
+		dev = lhtypes.BlockDeviceInfo{
+			Name:  fmt.Sprintf("sr%d", f.nextCD),
+			Major: 11,
+			Minor: f.nextCD,
+		}
+		f.nextCD++
+	default:
+		// The tapes and the passthrough devices aren't block devices
+		return
+	}
+	session.devices[id] = dev
+	// Like the kernel, the devices of a write-protected LUN or a CD-ROM are
+	// read-only
+	ro := "0"
+	if yesNo(target.luns[id].params, "readonly") == "Yes" || target.luns[id].deviceType == "cd" {
+		ro = "1"
+	}
+	f.files[filepath.Join("/sys/block", dev.Name, "ro")] = ro
+}
+
+// deviceName returns the SCSI disk name for the index, e.g. sdb, sdz, sdaa
+func deviceName(index int) string {
+	name := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		name = string(rune('a'+(index-1)%26)) + name
+	}
+	return "sd" + name
+}
+
+func (f *Fake) removeSession(session *fakeSession) {
+	for i, s := range f.sessions {
+		if s == session {
+			f.sessions = append(f.sessions[:i], f.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+func (f *Fake) targetSessions(target *fakeTarget) []*fakeSession {
+	sessions := []*fakeSession{}
+	for _, session := range f.sessions {
+		if session.target == target.name {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+func (f *Fake) showSessions() string {
+	b := &strings.Builder{}
+	for _, session := range f.sessions {
+		fmt.Fprintf(b, "tcp: [%d] %s,1 %s (non-flash)\n", session.sid, session.portal, session.target)
+	}
+	return b.String()
+}
+
+func (f *Fake) showSessionDetails() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "iSCSI Transport Class version 2.0-870\nversion 2.1.9\n")
+	for _, session := range f.sessions {
+		fmt.Fprintf(b, "Target: %s (non-flash)\n", session.target)
+		fmt.Fprintf(b, "\tCurrent Portal: %s,1\n", session.portal)
+		fmt.Fprintf(b, "\tPersistent Portal: %s,1\n", session.portal)
+		fmt.Fprintf(b, "\t\t************************\n\t\tAttached SCSI devices:\n\t\t************************\n")
+		fmt.Fprintf(b, "\t\tHost Number: %d\tState: running\n", session.sid)
+		fmt.Fprintf(b, "\t\tscsi%d Channel 00 Id 0 Lun: 0\n", session.sid)
+		ids := []int{}
+		for id := range session.devices {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			fmt.Fprintf(b, "\t\tscsi%d Channel 00 Id 0 Lun: %d\n", session.sid, id)
+			fmt.Fprintf(b, "\t\t\tAttached scsi disk %s\t\tState: running\n", session.devices[id].Name)
+		}
+	}
+	return b.String()
+}
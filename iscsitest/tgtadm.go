@@ -0,0 +1,722 @@
+package iscsitest
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/types"
+)
+
+// tgtadm error codes from tgt/usr/tgtadm_error.h
+const (
+	tgtadmNoDriver             = 3
+	tgtadmNoTarget             = 4
+	tgtadmNoLun                = 5
+	tgtadmNoSession            = 6
+	tgtadmNoConnection         = 7
+	tgtadmNoBinding            = 8
+	tgtadmTargetExist          = 9
+	tgtadmBindingExist         = 10
+	tgtadmLunExist             = 11
+	tgtadmAclExist             = 12
+	tgtadmAclNoexist           = 13
+	tgtadmUserExist            = 14
+	tgtadmNoUser               = 15
+	tgtadmInvalidRequest       = 17
+	tgtadmOutAccountExist      = 18
+	tgtadmTargetActive         = 19
+	tgtadmUnsupportedOperation = 22
+	tgtadmUnknownParam         = 23
+
+	// errnoNotConnected is ENOTCONN, with which tgtadm exits once it fails
+	// to connect to tgtd
+	errnoNotConnected = 107
+)
+
+// deviceTypeNames are the device types shown by tgtadm by the --device-type
+var deviceTypeNames = map[string]string{
+	"disk": "disk",
+	"cd":   "cd/dvd",
+	"pt":   "passthrough",
+	"tape": "tape",
+}
+
+// lunParams are the parameters accepted by `tgtadm --op update --mode logicalunit`
+var lunParams = map[string]bool{
+	"bsopts":            true,
+	"lbppbe":            true,
+	"la_lba":            true,
+	"mode_page":         true,
+	"online":            true,
+	"optimal_xfer_gran": true,
+	"optimal_xfer_len":  true,
+	"path":              true,
+	"product_id":        true,
+	"product_rev":       true,
+	"readonly":          true,
+	"removable":         true,
+	"rotation_rate":     true,
+	"scsi_id":           true,
+	"scsi_sn":           true,
+	"sense_format":      true,
+	"swp":               true,
+	"thin_provisioning": true,
+	"vendor_id":         true,
+}
+
+type tgtadmArgs struct {
+	raw    []string
+	values map[string]string
+	flags  map[string]bool
+}
+
+func (a *tgtadmArgs) get(names ...string) string {
+	for _, name := range names {
+		if value, exists := a.values[name]; exists {
+			return value
+		}
+	}
+	return ""
+}
+
+func (a *tgtadmArgs) int(names ...string) (int, error) {
+	value := a.get(names...)
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", value)
+	}
+	return n, nil
+}
+
+func parseTgtadmArgs(args []string) (*tgtadmArgs, error) {
+	parsed := &tgtadmArgs{
+		raw:    args,
+		values: map[string]string{},
+		flags:  map[string]bool{},
+	}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--outgoing", "-O", "--force", "-F":
+			parsed.flags[args[i]] = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("missing value for %v", args[i])
+		}
+		name := args[i]
+		if name == "--param" || name == "-P" {
+			name = "--params"
+		}
+		if name == "--params" && parsed.values[name] != "" {
+			parsed.values[name] += "," + args[i+1]
+		} else {
+			parsed.values[name] = args[i+1]
+		}
+		i++
+	}
+	return parsed, nil
+}
+
+func (f *Fake) tgtadmError(args []string, code int) error {
+	msg := types.TgtadmUnknown
+	if sentinel := types.TgtadmErrorFromCode(code); sentinel != nil {
+		msg = sentinel.Error()
+	}
+	return newExitError("tgtadm", args, code, "tgtadm: "+msg)
+}
+
+func (f *Fake) tgtadm(args []string) (string, error) {
+	// tgtadm prints the version without connecting to tgtd
+	if slices.Contains(args, "--version") || slices.Contains(args, "-V") {
+		return f.Version + "\n", nil
+	}
+	a, err := parseTgtadmArgs(args)
+	if err != nil {
+		return "", newExitError("tgtadm", args, 22, "tgtadm: "+err.Error())
+	}
+	port := strconv.Itoa(iscsi.DefaultControlPort)
+	if value := a.get("--control-port", "-C"); value != "" {
+		port = value
+	}
+	if port != strconv.Itoa(f.ControlPort) {
+		return "", newExitError("tgtadm", args, errnoNotConnected, "tgtadm: can't send the request to the tgt daemon, Transport endpoint is not connected")
+	}
+	if lld := a.get("--lld", "-L"); lld != "" && lld != "iscsi" {
+		return "", f.tgtadmError(args, tgtadmNoDriver)
+	}
+
+	op := a.get("--op", "-o")
+	mode := a.get("--mode", "-m")
+	code := tgtadmUnsupportedOperation
+	output := ""
+	switch mode {
+	case "system", "sys":
+		switch op {
+		case "show":
+			output, code = f.showSystem(), 0
+		case "delete":
+			// tgtd refuses to shut down with targets unless forced
+			code = 0
+			if len(f.targets) != 0 && !a.flags["--force"] && !a.flags["-F"] {
+				code = tgtadmTargetActive
+			}
+		}
+	case "target", "tgt":
+		output, code = f.tgtadmTarget(op, a)
+	case "logicalunit", "lu":
+		code = f.tgtadmLUN(op, a)
+	case "account":
+		output, code = f.tgtadmAccount(op, a)
+	case "conn", "connection":
+		output, code = f.tgtadmConnection(op, a)
+	case "portal":
+		output, code = f.tgtadmPortal(op, a)
+	}
+	if code != 0 {
+		return "", f.tgtadmError(args, code)
+	}
+	return output, nil
+}
+
+func (f *Fake) showSystem() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "System:\n    State: ready\n    debug: off\nLLDs:\n    iscsi: ready\n    iser: error\nBacking stores:\n")
+	for _, bs := range f.BackingStores {
+		// Like tgtd, the backing stores opening a file show the flags
+		if bs == "rdwr" || bs == "aio" {
+			fmt.Fprintf(b, "    %s (bsoflags sync:direct)\n", bs)
+		} else {
+			fmt.Fprintf(b, "    %s\n", bs)
+		}
+	}
+	fmt.Fprintf(b, "Device types:\n    disk\n    cd/dvd\n    osd\n    controller\n    changer\n    tape\n    passthrough\niSNS:\n    iSNS=Off\n")
+	return b.String()
+}
+
+func (f *Fake) tgtadmTarget(op string, a *tgtadmArgs) (string, int) {
+	if op == "show" && a.get("--tid", "-t") == "" {
+		return f.showTargets(), 0
+	}
+
+	tid, err := a.int("--tid", "-t")
+	if err != nil {
+		return "", tgtadmInvalidRequest
+	}
+	target := f.targets[tid]
+
+	switch op {
+	case "new":
+		name := a.get("-T", "--targetname")
+		if target != nil || f.targetByName(name) != nil {
+			return "", tgtadmTargetExist
+		}
+		f.targets[tid] = &fakeTarget{
+			tid:   tid,
+			name:  name,
+			state: "ready",
+			luns: map[int]*fakeLUN{
+				0: {id: 0, bsType: "null", params: map[string]string{}},
+			},
+		}
+		return "", 0
+	}
+
+	if target == nil {
+		return "", tgtadmNoTarget
+	}
+	switch op {
+	case "delete":
+		if !a.flags["--force"] && !a.flags["-F"] && len(f.targetSessions(target)) != 0 {
+			return "", tgtadmTargetActive
+		}
+		for _, session := range f.targetSessions(target) {
+			f.removeSession(session)
+		}
+		delete(f.targets, tid)
+	case "bind", "unbind":
+		// tgtd keeps the address and the name ACLs in separate lists
+		acls, acl := &target.acls, a.get("-I", "--initiator-address")
+		if acl == "" {
+			acls, acl = &target.nameACLs, a.get("-Q", "--initiator-name")
+		}
+		if acl == "" {
+			return "", tgtadmInvalidRequest
+		}
+		index := slices.Index(*acls, acl)
+		if op == "bind" {
+			if index >= 0 {
+				return "", tgtadmAclExist
+			}
+			*acls = append(*acls, acl)
+		} else {
+			if index < 0 {
+				return "", tgtadmAclNoexist
+			}
+			*acls = slices.Delete(*acls, index, index+1)
+		}
+	case "show":
+		b := &strings.Builder{}
+		if target.redirect["RedirectAddress"] != "" {
+			for _, name := range []string{"RedirectAddress", "RedirectPort", "RedirectReason"} {
+				fmt.Fprintf(b, "%s=%s\n", name, target.redirect[name])
+			}
+		}
+		for _, param := range negotiatedParams {
+			fmt.Fprintf(b, "%s\n", param)
+		}
+		return b.String(), 0
+	case "update":
+		name, value := a.get("--name", "-n"), a.get("--value", "-v")
+		switch name {
+		case "state":
+			if value != iscsi.TargetStateReady && value != iscsi.TargetStateOffline {
+				return "", tgtadmInvalidRequest
+			}
+			target.state = value
+		case "RedirectReason":
+			if value != string(iscsi.RedirectTemporary) && value != string(iscsi.RedirectPermanent) {
+				return "", tgtadmInvalidRequest
+			}
+			fallthrough
+		case "RedirectAddress", "RedirectPort":
+			if target.redirect == nil {
+				target.redirect = map[string]string{}
+			}
+			target.redirect[name] = value
+		default:
+			return "", tgtadmUnknownParam
+		}
+	default:
+		return "", tgtadmUnsupportedOperation
+	}
+	return "", 0
+}
+
+func (f *Fake) tgtadmLUN(op string, a *tgtadmArgs) int {
+	tid, err := a.int("--tid", "-t")
+	if err != nil {
+		return tgtadmInvalidRequest
+	}
+	lunID, err := a.int("--lun", "-l")
+	if err != nil {
+		return tgtadmInvalidRequest
+	}
+	target := f.targets[tid]
+	if target == nil {
+		return tgtadmNoTarget
+	}
+	lun := target.luns[lunID]
+
+	switch op {
+	case "new":
+		if lun != nil {
+			return tgtadmLunExist
+		}
+		bsType := a.get("--bstype", "-E")
+		if bsType == "" {
+			bsType = "rdwr"
+		}
+		supported := false
+		for _, bs := range f.BackingStores {
+			if bs == bsType {
+				supported = true
+			}
+		}
+		if !supported {
+			return tgtadmInvalidRequest
+		}
+		deviceType := a.get("--device-type", "-Y")
+		if deviceType == "" {
+			deviceType = "disk"
+		}
+		if _, exists := deviceTypeNames[deviceType]; !exists {
+			return tgtadmInvalidRequest
+		}
+		params := map[string]string{"online": "1"}
+		if deviceType == "cd" {
+			params["removable"] = "1"
+		}
+		target.luns[lunID] = &fakeLUN{
+			id:         lunID,
+			path:       a.get("-b", "--backing-store"),
+			bsType:     bsType,
+			bsOpts:     a.get("--bsopts", "-S"),
+			bsOFlags:   a.get("--bsoflags", "-f"),
+			deviceType: deviceType,
+			params:     params,
+		}
+	case "delete":
+		if lun == nil {
+			return tgtadmNoLun
+		}
+		delete(target.luns, lunID)
+	case "update":
+		if lun == nil {
+			return tgtadmNoLun
+		}
+		params := a.get("--params", "-P")
+		for _, param := range splitParams(params) {
+			key, value, _ := strings.Cut(param, "=")
+			if !lunParams[key] || key == "bsopts" && !slices.Contains(f.BackingStores, "longhorn") {
+				return tgtadmUnknownParam
+			}
+			if key == "bsopts" {
+				lun.bsOpts = mergeBSOpts(lun.bsOpts, value)
+				continue
+			}
+			lun.params[key] = value
+		}
+	default:
+		return tgtadmUnsupportedOperation
+	}
+	return 0
+}
+
+// splitParams splits the tgtadm parameters by commas, except for the commas
+// inside of the mode_page values which don't contain "=".
+func splitParams(params string) []string {
+	result := []string{}
+	for _, param := range strings.Split(params, ",") {
+		if param == "" {
+			continue
+		}
+		if !strings.Contains(param, "=") && len(result) != 0 {
+			result[len(result)-1] += "," + param
+			continue
+		}
+		result = append(result, param)
+	}
+	return result
+}
+
+// mergeBSOpts updates the backing store options like the longhorn backing
+// store of rancher/tgt, which only updates the specified options.
+func mergeBSOpts(current, update string) string {
+	opts := map[string]string{}
+	keys := []string{}
+	for _, s := range []string{current, update} {
+		for _, opt := range strings.Split(s, ";") {
+			if opt == "" {
+				continue
+			}
+			key, value, _ := strings.Cut(opt, "=")
+			if _, exists := opts[key]; !exists {
+				keys = append(keys, key)
+			}
+			opts[key] = value
+		}
+	}
+	merged := []string{}
+	for _, key := range keys {
+		merged = append(merged, key+"="+opts[key])
+	}
+	return strings.Join(merged, ";")
+}
+
+func (lun *fakeLUN) size() int64 {
+	for _, opt := range strings.Split(lun.bsOpts, ";") {
+		if value, found := strings.CutPrefix(opt, "size="); found {
+			size, _ := strconv.ParseInt(value, 10, 64)
+			return size
+		}
+	}
+	if lun.path == "" {
+		return 0
+	}
+	if info, err := os.Stat(lun.path); err == nil && info.Mode().IsRegular() {
+		return info.Size()
+	}
+	return 0
+}
+
+func yesNo(params map[string]string, key string) string {
+	if params[key] == "1" || params[key] == "yes" || params[key] == "on" {
+		return "Yes"
+	}
+	return "No"
+}
+
+func (f *Fake) showTargets() string {
+	b := &strings.Builder{}
+	for _, tid := range f.sortedTIDs() {
+		target := f.targets[tid]
+		fmt.Fprintf(b, "Target %d: %s\n", target.tid, target.name)
+		fmt.Fprintf(b, "    System information:\n        Driver: iscsi\n        State: %s\n", target.state)
+		fmt.Fprintf(b, "    I_T nexus information:\n")
+		for _, session := range f.targetSessions(target) {
+			fmt.Fprintf(b, "        I_T nexus: %d\n", session.sid)
+			fmt.Fprintf(b, "            Initiator: %s alias: iscsitest\n", session.initiator)
+			fmt.Fprintf(b, "            Connection: 0\n")
+			fmt.Fprintf(b, "                IP Address: %s\n", session.address)
+		}
+		fmt.Fprintf(b, "    LUN information:\n")
+		lunIDs := []int{}
+		for id := range target.luns {
+			lunIDs = append(lunIDs, id)
+		}
+		sort.Ints(lunIDs)
+		for _, id := range lunIDs {
+			lun := target.luns[id]
+			lunType := deviceTypeNames[lun.deviceType]
+			blockSize := 512
+			path := lun.path
+			if id == 0 {
+				lunType, blockSize, path = "controller", 1, "None"
+			}
+			scsiID := fmt.Sprintf("IET     %04x%04x", tid, id)
+			if lun.params["scsi_id"] != "" {
+				scsiID = lun.params["scsi_id"]
+			}
+			scsiSN := fmt.Sprintf("beaf%d%d", tid, id)
+			if lun.params["scsi_sn"] != "" {
+				scsiSN = lun.params["scsi_sn"]
+			}
+			fmt.Fprintf(b, "        LUN: %d\n", id)
+			fmt.Fprintf(b, "            Type: %s\n", lunType)
+			fmt.Fprintf(b, "            SCSI ID: %s\n", scsiID)
+			fmt.Fprintf(b, "            SCSI SN: %s\n", scsiSN)
+			// Like tgtd, the size is in MB of 10^6 bytes and rounded
+			fmt.Fprintf(b, "            Size: %d MB, Block size: %d\n", (lun.size()+500000)/1000000, blockSize)
+			fmt.Fprintf(b, "            Online: %s\n", yesNo(lun.params, "online"))
+			fmt.Fprintf(b, "            Removable media: %s\n", yesNo(lun.params, "removable"))
+			fmt.Fprintf(b, "            Prevent removal: No\n")
+			fmt.Fprintf(b, "            Readonly: %s\n", yesNo(lun.params, "readonly"))
+			fmt.Fprintf(b, "            SWP: %s\n", yesNo(lun.params, "swp"))
+			fmt.Fprintf(b, "            Thin-provisioning: %s\n", yesNo(lun.params, "thin_provisioning"))
+			fmt.Fprintf(b, "            Backing store type: %s\n", lun.bsType)
+			fmt.Fprintf(b, "            Backing store path: %s\n", path)
+			fmt.Fprintf(b, "            Backing store flags: %s\n", lun.bsOFlags)
+		}
+		fmt.Fprintf(b, "    Account information:\n")
+		for _, account := range target.accounts {
+			if account.Outgoing {
+				fmt.Fprintf(b, "        %s (outgoing)\n", account.User)
+			} else {
+				fmt.Fprintf(b, "        %s\n", account.User)
+			}
+		}
+		fmt.Fprintf(b, "    ACL information:\n")
+		for _, acl := range target.acls {
+			fmt.Fprintf(b, "        %s\n", acl)
+		}
+		if len(target.nameACLs) != 0 {
+			fmt.Fprintf(b, "    ACL initiator-name information:\n")
+			for _, name := range target.nameACLs {
+				fmt.Fprintf(b, "        %s\n", name)
+			}
+		}
+	}
+	return b.String()
+}
+
+func (f *Fake) tgtadmAccount(op string, a *tgtadmArgs) (string, int) {
+	if op == "show" {
+		users := []string{}
+		for user := range f.accounts {
+			users = append(users, user)
+		}
+		sort.Strings(users)
+		b := &strings.Builder{}
+		fmt.Fprintf(b, "Account list:\n")
+		for _, user := range users {
+			fmt.Fprintf(b, "    %s\n", user)
+		}
+		return b.String(), 0
+	}
+
+	user := a.get("--user", "-u")
+	if user == "" {
+		return "", tgtadmInvalidRequest
+	}
+	_, exists := f.accounts[user]
+	switch op {
+	case "new":
+		if exists {
+			return "", tgtadmUserExist
+		}
+		f.accounts[user] = a.get("--password")
+		return "", 0
+	case "delete":
+		if !exists {
+			return "", tgtadmNoUser
+		}
+		delete(f.accounts, user)
+		for _, target := range f.targets {
+			for i := len(target.accounts) - 1; i >= 0; i-- {
+				if target.accounts[i].User == user {
+					target.accounts = append(target.accounts[:i], target.accounts[i+1:]...)
+				}
+			}
+		}
+		return "", 0
+	}
+
+	tid, err := a.int("--tid", "-t")
+	if err != nil {
+		return "", tgtadmInvalidRequest
+	}
+	target := f.targets[tid]
+	if target == nil {
+		return "", tgtadmNoTarget
+	}
+	if !exists {
+		return "", tgtadmNoUser
+	}
+	outgoing := a.flags["--outgoing"] || a.flags["-O"]
+	index := -1
+	for i, account := range target.accounts {
+		if account.User == user && account.Outgoing == outgoing {
+			index = i
+		}
+	}
+	switch op {
+	case "bind":
+		if index >= 0 {
+			return "", tgtadmBindingExist
+		}
+		if outgoing {
+			for _, account := range target.accounts {
+				if account.Outgoing {
+					return "", tgtadmOutAccountExist
+				}
+			}
+		}
+		target.accounts = append(target.accounts, iscsi.TargetAccount{User: user, Outgoing: outgoing})
+	case "unbind":
+		if index < 0 {
+			return "", tgtadmNoBinding
+		}
+		target.accounts = append(target.accounts[:index], target.accounts[index+1:]...)
+	default:
+		return "", tgtadmUnsupportedOperation
+	}
+	return "", 0
+}
+
+// negotiatedParams are the params of the fake connections, shown by
+// `tgtadm --op show --mode conn` with the session and connection IDs.
+var negotiatedParams = []string{
+	"HeaderDigest=None",
+	"DataDigest=None",
+	"InitialR2T=Yes",
+	"MaxOutstandingR2T=1",
+	"ImmediateData=Yes",
+	"FirstBurstLength=65536",
+	"MaxBurstLength=262144",
+	"DataPDUInOrder=Yes",
+	"DataSequenceInOrder=Yes",
+	"ErrorRecoveryLevel=0",
+	"IFMarker=No",
+	"OFMarker=No",
+	"DefaultTime2Wait=2",
+	"DefaultTime2Retain=0",
+	"OFMarkInt=Reject",
+	"IFMarkInt=Reject",
+	"MaxConnections=1",
+	"RDMAExtensions=No",
+	"TargetRecvDataSegmentLength=8192",
+	"InitiatorRecvDataSegmentLength=262144",
+	"MaxOutstandingUnexpectedPDUs=0",
+	"MaxRecvDataSegmentLength=262144",
+	"MaxXmitDataSegmentLength=262144",
+}
+
+func (f *Fake) tgtadmConnection(op string, a *tgtadmArgs) (string, int) {
+	tid, err := a.int("--tid", "-t")
+	if err != nil {
+		return "", tgtadmInvalidRequest
+	}
+	target := f.targets[tid]
+	if target == nil {
+		return "", tgtadmNoTarget
+	}
+
+	switch op {
+	case "show":
+		b := &strings.Builder{}
+		if a.get("--sid", "-s") != "" {
+			sid, err := a.int("--sid", "-s")
+			if err != nil {
+				return "", tgtadmInvalidRequest
+			}
+			for _, session := range f.targetSessions(target) {
+				if session.sid != sid {
+					continue
+				}
+				if cid := a.get("--cid", "-c"); cid != "0" {
+					return "", tgtadmNoConnection
+				}
+				for _, param := range negotiatedParams {
+					fmt.Fprintf(b, "%s\n", param)
+				}
+				return b.String(), 0
+			}
+			return "", tgtadmNoSession
+		}
+		for _, session := range f.targetSessions(target) {
+			fmt.Fprintf(b, "Session: %d\n", session.sid)
+			fmt.Fprintf(b, "    Connection: 0\n")
+			fmt.Fprintf(b, "        Initiator: %s\n", session.initiator)
+			fmt.Fprintf(b, "        IP Address: %s\n", session.address)
+		}
+		return b.String(), 0
+	case "delete":
+		sid, err := a.int("--sid", "-s")
+		if err != nil {
+			return "", tgtadmInvalidRequest
+		}
+		for _, session := range f.targetSessions(target) {
+			if session.sid != sid {
+				continue
+			}
+			if cid := a.get("--cid", "-c"); cid != "0" {
+				return "", tgtadmNoConnection
+			}
+			f.removeSession(session)
+			return "", 0
+		}
+		return "", tgtadmNoSession
+	}
+	return "", tgtadmUnsupportedOperation
+}
+
+func (f *Fake) tgtadmPortal(op string, a *tgtadmArgs) (string, int) {
+	if op == "show" {
+		b := &strings.Builder{}
+		for _, portal := range f.portals {
+			fmt.Fprintf(b, "Portal: %s,1\n", portal)
+		}
+		return b.String(), 0
+	}
+
+	portal, found := strings.CutPrefix(a.get("--params"), "portal=")
+	if !found {
+		return "", tgtadmInvalidRequest
+	}
+	index := -1
+	for i, existing := range f.portals {
+		if existing == portal {
+			index = i
+		}
+	}
+	switch op {
+	case "new":
+		if index >= 0 {
+			return "", tgtadmInvalidRequest
+		}
+		f.portals = append(f.portals, portal)
+	case "delete":
+		if index < 0 {
+			return "", tgtadmInvalidRequest
+		}
+		f.portals = append(f.portals[:index], f.portals[index+1:]...)
+	default:
+		return "", tgtadmUnsupportedOperation
+	}
+	return "", 0
+}
@@ -1,19 +1,31 @@
 package longhorndev
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/sirupsen/logrus"
 
+	"github.com/longhorn/go-iscsi-helper/iscsi"
 	"github.com/longhorn/go-iscsi-helper/iscsidev"
 	"github.com/longhorn/go-iscsi-helper/types"
 	"github.com/longhorn/go-iscsi-helper/util"
+
+	lhexec "github.com/longhorn/go-common-libs/exec"
+	lhtypes "github.com/longhorn/go-common-libs/types"
+)
+
+var (
+	// The device node helpers are variables so tests can run without the
+	// privilege to create device nodes.
+	duplicateDevice = util.DuplicateDeviceWithMode
+	removeDevice    = util.RemoveDevice
 )
 
 const (
@@ -22,6 +34,10 @@ const (
 
 	WaitInterval = time.Second
 	WaitCount    = 30
+
+	// The permissions of the device nodes under DevPath
+	DevMode         os.FileMode = 0660
+	ReadOnlyDevMode os.FileMode = 0440
 )
 
 type LonghornDevice struct {
@@ -33,8 +49,21 @@ type LonghornDevice struct {
 	scsiTimeout               int64
 	iscsiAbortTimeout         int64
 	iscsiTargetRequestTimeout int64
+	// allowedInitiators are the initiators allowed to connect to the
+	// target of frontend tgt-iscsi. All initiators are allowed if it's empty.
+	allowedInitiators []iscsi.ACL
+	// readOnly exports the volume write-protected, and creates the device
+	// node with ReadOnlyDevMode.
+	readOnly bool
 
 	scsiDevice *iscsidev.Device
+	executor   iscsi.Executor
+	tgtd       *iscsi.Tgtd
+
+	// socketDirectory and devPath are SocketDirectory and DevPath unless
+	// the creator overrides them
+	socketDirectory string
+	devPath         string
 }
 
 type DeviceService interface {
@@ -53,16 +82,80 @@ type DeviceService interface {
 	Expand(size int64) error
 }
 
+// ContextDeviceService is a DeviceService whose operations can be cancelled
+// by the context. Cancelling the context stops the retries and kills the
+// in-flight commands.
+type ContextDeviceService interface {
+	DeviceService
+
+	InitDeviceContext(ctx context.Context) error
+	StartContext(ctx context.Context) error
+	ShutdownContext(ctx context.Context) error
+	FinishUpgradeContext(ctx context.Context) error
+	ExpandContext(ctx context.Context, size int64) error
+}
+
+// QuiesceDeviceService is a DeviceService which can hold off the I/O of the
+// frontend without detaching it, e.g. while the engine behind the socket is
+// swapped or a consistent snapshot is taken.
+type QuiesceDeviceService interface {
+	DeviceService
+
+	Quiesce() error
+	Resume() error
+	QuiesceContext(ctx context.Context) error
+	ResumeContext(ctx context.Context) error
+}
+
 type DeviceCreator interface {
 	NewDevice(name string, size int64, frontend string) (DeviceService, error)
 }
 
-type LonghornDeviceCreator struct{}
+type LonghornDeviceCreator struct {
+	// Executor runs the commands of the devices, including the initiator
+	// commands which otherwise run in the namespaces of iscsid. The default
+	// executors are used if it's nil. It's mainly for tests, see iscsitest.Fake.
+	Executor iscsi.Executor
+	// Tgtd is the tgtd instance serving the targets of the devices, or
+	// iscsi.DefaultTgtd if nil, e.g. to run the instance managers of an
+	// upgrade side by side, each with its own tgtd.
+	Tgtd *iscsi.Tgtd
+
+	// socketDirectory and devPath override SocketDirectory and DevPath if
+	// they're set, e.g. for tests.
+	socketDirectory string
+	devPath         string
+}
+
+// DeviceOptions are the optional settings of a Longhorn device.
+type DeviceOptions struct {
+	// AllowedInitiators are the initiator IP addresses, CIDRs or iSCSI names
+	// allowed to connect to the target of frontend tgt-iscsi. All initiators
+	// are allowed if it's empty. The target of frontend tgt-blockdev only
+	// allows the local initiator.
+	AllowedInitiators []string
+	// ReadOnly write-protects the LUN, e.g. for inspecting a snapshot without
+	// any chance of modifying it.
+	ReadOnly bool
+}
 
 func (ldc *LonghornDeviceCreator) NewDevice(name string, size int64, frontend string, scsiTimeout, iscsiAbortTimeout, iscsiTargetRequestTimeout int64) (DeviceService, error) {
+	return ldc.NewDeviceWithOptions(name, size, frontend, scsiTimeout, iscsiAbortTimeout, iscsiTargetRequestTimeout, DeviceOptions{})
+}
+
+// NewDeviceWithOptions is like NewDevice but takes the optional settings.
+func (ldc *LonghornDeviceCreator) NewDeviceWithOptions(name string, size int64, frontend string, scsiTimeout, iscsiAbortTimeout, iscsiTargetRequestTimeout int64, options DeviceOptions) (DeviceService, error) {
 	if name == "" || size == 0 {
 		return nil, fmt.Errorf("invalid parameter for creating Longhorn device")
 	}
+	acls := []iscsi.ACL{}
+	for _, initiator := range options.AllowedInitiators {
+		acl, err := iscsi.ParseACL(initiator)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid allowed initiator for Longhorn device %v", name)
+		}
+		acls = append(acls, acl)
+	}
 	dev := &LonghornDevice{
 		RWMutex:                   &sync.RWMutex{},
 		name:                      name,
@@ -70,6 +163,18 @@ func (ldc *LonghornDeviceCreator) NewDevice(name string, size int64, frontend st
 		scsiTimeout:               scsiTimeout,
 		iscsiAbortTimeout:         iscsiAbortTimeout,
 		iscsiTargetRequestTimeout: iscsiTargetRequestTimeout,
+		allowedInitiators:         acls,
+		readOnly:                  options.ReadOnly,
+		executor:                  ldc.Executor,
+		tgtd:                      ldc.Tgtd,
+		socketDirectory:           SocketDirectory,
+		devPath:                   DevPath,
+	}
+	if ldc.socketDirectory != "" {
+		dev.socketDirectory = ldc.socketDirectory
+	}
+	if ldc.devPath != "" {
+		dev.devPath = ldc.devPath
 	}
 	if err := dev.SetFrontend(frontend); err != nil {
 		return nil, err
@@ -78,6 +183,11 @@ func (ldc *LonghornDeviceCreator) NewDevice(name string, size int64, frontend st
 }
 
 func (d *LonghornDevice) InitDevice() error {
+	return d.InitDeviceContext(context.Background())
+}
+
+// InitDeviceContext is like InitDevice but takes a context.
+func (d *LonghornDevice) InitDeviceContext(ctx context.Context) error {
 	d.Lock()
 	defer d.Unlock()
 
@@ -90,34 +200,61 @@ func (d *LonghornDevice) InitDevice() error {
 	}
 
 	// Try to cleanup possible leftovers.
-	return d.shutdownFrontend()
+	return d.shutdownFrontend(ctx)
 }
 
 // call with lock hold
 func (d *LonghornDevice) initScsiDevice() error {
-	bsOpts := fmt.Sprintf("size=%v;request_timeout=%v", d.size, d.iscsiTargetRequestTimeout)
-	scsiDev, err := iscsidev.NewDevice(d.name, d.GetSocketPath(), "longhorn", bsOpts, d.scsiTimeout, d.iscsiAbortTimeout)
+	backingStore := &iscsi.BackingStoreOptions{
+		Type:           "longhorn",
+		Size:           d.size,
+		RequestTimeout: d.iscsiTargetRequestTimeout,
+	}
+	if err := backingStore.Validate(); err != nil {
+		return errors.Wrapf(err, "device %v", d.name)
+	}
+	var (
+		scsiDev *iscsidev.Device
+		err     error
+	)
+	if d.executor != nil {
+		scsiDev, err = iscsidev.NewDeviceWithExecutor(d.name, d.GetSocketPath(), backingStore.Type, backingStore.String(), d.scsiTimeout, d.iscsiAbortTimeout, d.executor)
+	} else {
+		scsiDev, err = iscsidev.NewDevice(d.name, d.GetSocketPath(), backingStore.Type, backingStore.String(), d.scsiTimeout, d.iscsiAbortTimeout)
+	}
 	if err != nil {
 		return err
 	}
+	scsiDev.ReadOnly = d.readOnly
+	scsiDev.Tgtd = d.tgtd
 	d.scsiDevice = scsiDev
 
 	return nil
 }
 
 func (d *LonghornDevice) Start() error {
-	stopCh := make(chan struct{})
-	if err := <-d.WaitForSocket(stopCh); err != nil {
+	return d.StartContext(context.Background())
+}
+
+// StartContext is like Start but takes a context.
+func (d *LonghornDevice) StartContext(ctx context.Context) error {
+	if err := d.WaitForSocketContext(ctx); err != nil {
 		return err
 	}
 
-	return d.startScsiDevice(true)
+	return d.startScsiDevice(ctx, true)
 }
 
-func (d *LonghornDevice) startScsiDevice(startScsiDevice bool) (err error) {
+func (d *LonghornDevice) startScsiDevice(ctx context.Context, startScsiDevice bool) (err error) {
 	d.Lock()
 	defer d.Unlock()
 
+	if startScsiDevice {
+		if err := d.checkFrontend(ctx); err != nil {
+			return err
+		}
+	}
+
 	switch d.frontend {
 	case types.FrontendTGTBlockDev:
 		// If iSCSI device is not started here, e.g., device upgrade,
@@ -126,10 +263,13 @@ func (d *LonghornDevice) startScsiDevice(startScsiDevice bool) (err error) {
 			if d.scsiDevice == nil {
 				return fmt.Errorf("there is no iSCSI device during the frontend %v starts", d.frontend)
 			}
-			if err := d.scsiDevice.CreateTarget(); err != nil {
+			if err := d.scsiDevice.SetLocalInitiatorACLsContext(ctx); err != nil {
+				return err
+			}
+			if err := d.scsiDevice.CreateTargetContext(ctx); err != nil {
 				return err
 			}
-			if err := d.scsiDevice.StartInitator(); err != nil {
+			if err := d.scsiDevice.StartInitatorContext(ctx); err != nil {
 				return err
 			}
 			if err := d.createDev(); err != nil {
@@ -137,10 +277,10 @@ func (d *LonghornDevice) startScsiDevice(startScsiDevice bool) (err error) {
 			}
 			logrus.Infof("device %v: iSCSI device %s created", d.name, d.scsiDevice.KernelDevice.Name)
 		} else {
-			if err := d.scsiDevice.ReloadTargetID(); err != nil {
+			if err := d.scsiDevice.ReloadTargetIDContext(ctx); err != nil {
 				return err
 			}
-			if err := d.scsiDevice.ReloadInitiator(); err != nil {
+			if err := d.scsiDevice.ReloadInitiatorContext(ctx); err != nil {
 				return err
 			}
 			logrus.Infof("device %v: iSCSI device %s reloaded the target and the initiator", d.name, d.scsiDevice.KernelDevice.Name)
@@ -153,12 +293,13 @@ func (d *LonghornDevice) startScsiDevice(startScsiDevice bool) (err error) {
 			if d.scsiDevice == nil {
 				return fmt.Errorf("there is no iSCSI device during the frontend %v starts", d.frontend)
 			}
-			if err := d.scsiDevice.CreateTarget(); err != nil {
+			d.scsiDevice.ACLs = d.allowedInitiators
+			if err := d.scsiDevice.CreateTargetContext(ctx); err != nil {
 				return err
 			}
 			logrus.Infof("device %v: iSCSI target %s created", d.name, d.scsiDevice.Target)
 		} else {
-			if err := d.scsiDevice.ReloadTargetID(); err != nil {
+			if err := d.scsiDevice.ReloadTargetIDContext(ctx); err != nil {
 				return err
 			}
 			logrus.Infof("device %v: iSCSI target %s reloaded the target ID", d.name, d.scsiDevice.Target)
@@ -174,7 +315,33 @@ func (d *LonghornDevice) startScsiDevice(startScsiDevice bool) (err error) {
 	return nil
 }
 
+// checkFrontend fails early if tgtd cannot serve the frontend, since the
+// targets of all frontends are backed by the longhorn backing store of
+// rancher/tgt. tgtd is started first if it's not running.
+func (d *LonghornDevice) checkFrontend(ctx context.Context) error {
+	tgtd := d.tgtd
+	if tgtd == nil {
+		tgtd = iscsi.DefaultTgtd()
+	}
+	if err := tgtd.StartDaemonContext(ctx, false); err != nil {
+		return err
+	}
+	info, err := tgtd.GetSystemInfoContext(ctx)
+	if err != nil {
+		return err
+	}
+	if err := info.CheckLun("longhorn", iscsi.DeviceTypeDisk); err != nil {
+		return errors.Wrapf(err, "device %v: frontend %v is not supported", d.name, d.frontend)
+	}
+	return nil
+}
+
 func (d *LonghornDevice) Shutdown() error {
+	return d.ShutdownContext(context.Background())
+}
+
+// ShutdownContext is like Shutdown but takes a context.
+func (d *LonghornDevice) ShutdownContext(ctx context.Context) error {
 	d.Lock()
 	defer d.Unlock()
 
@@ -182,7 +349,7 @@ func (d *LonghornDevice) Shutdown() error {
 		return nil
 	}
 
-	if err := d.shutdownFrontend(); err != nil {
+	if err := d.shutdownFrontend(ctx); err != nil {
 		return err
 	}
 
@@ -193,22 +360,22 @@ func (d *LonghornDevice) Shutdown() error {
 }
 
 // call with lock hold
-func (d *LonghornDevice) shutdownFrontend() error {
+func (d *LonghornDevice) shutdownFrontend(ctx context.Context) error {
 	switch d.frontend {
 	case types.FrontendTGTBlockDev:
 		dev := d.getDev()
-		if err := util.RemoveDevice(dev); err != nil {
+		if err := removeDevice(dev); err != nil {
 			return errors.Wrapf(err, "device %v: failed to remove device %s", d.name, dev)
 		}
-		if err := d.scsiDevice.StopInitiator(); err != nil {
+		if err := d.scsiDevice.StopInitiatorContext(ctx); err != nil {
 			return errors.Wrapf(err, "device %v: failed to stop iSCSI device", d.name)
 		}
-		if err := d.scsiDevice.DeleteTarget(); err != nil {
+		if err := d.scsiDevice.DeleteTargetContext(ctx); err != nil {
 			return errors.Wrapf(err, "device %v: failed to delete target %v", d.name, d.scsiDevice.Target)
 		}
 		logrus.Infof("device %v: iSCSI device %v shutdown", d.name, dev)
 	case types.FrontendTGTISCSI:
-		if err := d.scsiDevice.DeleteTarget(); err != nil {
+		if err := d.scsiDevice.DeleteTargetContext(ctx); err != nil {
 			return errors.Wrapf(err, "device %v: failed to delete target %v", d.name, d.scsiDevice.Target)
 		}
 		logrus.Infof("device %v: iSCSI target %v ", d.name, d.scsiDevice.Target)
@@ -249,32 +416,52 @@ func (d *LonghornDevice) WaitForSocket(stopCh chan struct{}) chan error {
 	return errCh
 }
 
+// WaitForSocketContext waits until the socket shows up. It gives up once ctx
+// is done or after WaitCount intervals.
+func (d *LonghornDevice) WaitForSocketContext(ctx context.Context) error {
+	socket := d.GetSocketPath()
+	for i := 0; i < WaitCount; i++ {
+		if err := util.SleepContext(ctx, WaitInterval); err != nil {
+			return errors.Wrapf(err, "device %v: failed to wait for socket %v", d.name, socket)
+		}
+		if _, err := os.Stat(socket); err == nil {
+			return nil
+		}
+		logrus.Infof("device %v: waiting for socket %v to show up", d.name, socket)
+	}
+	return fmt.Errorf("device %v: wait for socket %v timed out", d.name, socket)
+}
+
 func (d *LonghornDevice) GetSocketPath() string {
-	return filepath.Join(SocketDirectory, "longhorn-"+d.name+".sock")
+	return filepath.Join(d.socketDirectory, "longhorn-"+d.name+".sock")
 }
 
 // call with lock hold
 func (d *LonghornDevice) getDev() string {
-	return filepath.Join(DevPath, d.name)
+	return filepath.Join(d.devPath, d.name)
 }
 
 // call with lock hold
 func (d *LonghornDevice) createDev() error {
-	if _, err := os.Stat(DevPath); os.IsNotExist(err) {
-		if err := os.MkdirAll(DevPath, 0755); err != nil {
-			logrus.Fatalf("device %v: cannot create directory %v", d.name, DevPath)
+	if _, err := os.Stat(d.devPath); os.IsNotExist(err) {
+		if err := os.MkdirAll(d.devPath, 0755); err != nil {
+			logrus.Fatalf("device %v: cannot create directory %v", d.name, d.devPath)
 		}
 	}
 
 	dev := d.getDev()
 	if _, err := os.Stat(dev); err == nil {
 		logrus.Warnf("Device %s already exists, clean it up", dev)
-		if err := util.RemoveDevice(dev); err != nil {
+		if err := removeDevice(dev); err != nil {
 			return errors.Wrapf(err, "cannot clean up block device file %v", dev)
 		}
 	}
 
-	if err := util.DuplicateDevice(d.scsiDevice.KernelDevice, dev); err != nil {
+	mode := DevMode
+	if d.readOnly {
+		mode = ReadOnlyDevMode
+	}
+	if err := duplicateDevice(d.scsiDevice.KernelDevice, dev, mode); err != nil {
 		return err
 	}
 
@@ -295,27 +482,23 @@ func (d *LonghornDevice) PrepareUpgrade() error {
 }
 
 func (d *LonghornDevice) FinishUpgrade() (err error) {
+	return d.FinishUpgradeContext(context.Background())
+}
+
+// FinishUpgradeContext is like FinishUpgrade but takes a context.
+func (d *LonghornDevice) FinishUpgradeContext(ctx context.Context) (err error) {
 	if d.frontend == "" {
 		return nil
 	}
 
-	stopCh := make(chan struct{})
-	socketError := d.WaitForSocket(stopCh)
-	err = <-socketError
-	if err != nil {
+	if err := d.WaitForSocketContext(ctx); err != nil {
 		err = errors.Wrap(err, "error waiting for the socket")
 		logrus.Error(err)
-	}
-
-	close(stopCh)
-	close(socketError)
-
-	if err != nil {
 		return err
 	}
 
 	// TODO: Need to fix `ReloadSocketConnection` since it doesn't work for frontend `FrontendTGTISCSI`.
-	if err := d.ReloadSocketConnection(); err != nil {
+	if err := d.ReloadSocketConnectionContext(ctx); err != nil {
 		return err
 	}
 
@@ -326,16 +509,31 @@ func (d *LonghornDevice) FinishUpgrade() (err error) {
 	}
 	d.Unlock()
 
-	return d.startScsiDevice(false)
+	return d.startScsiDevice(ctx, false)
 }
 
 func (d *LonghornDevice) ReloadSocketConnection() error {
+	return d.ReloadSocketConnectionContext(context.Background())
+}
+
+// ReloadSocketConnectionContext is like ReloadSocketConnection but takes a context.
+func (d *LonghornDevice) ReloadSocketConnectionContext(ctx context.Context) error {
 	d.RLock()
 	dev := d.getDev()
 	d.RUnlock()
 
-	cmd := exec.Command("sg_raw", dev, "a6", "00", "00", "00", "00", "00")
-	if err := cmd.Run(); err != nil {
+	var executor iscsi.Executor = lhexec.NewExecutor()
+	if d.executor != nil {
+		executor = d.executor
+	}
+	opts := []string{dev, "a6", "00", "00", "00", "00", "00"}
+	var err error
+	if cexec, ok := executor.(iscsi.ContextExecutor); ok {
+		_, err = cexec.ExecuteContext(ctx, nil, "sg_raw", opts, lhtypes.ExecuteDefaultTimeout)
+	} else {
+		_, err = executor.Execute(nil, "sg_raw", opts, lhtypes.ExecuteDefaultTimeout)
+	}
+	if err != nil {
 		return errors.Wrapf(err, "failed to reload socket connection at %v", dev)
 	}
 	logrus.Infof("Reloaded completed for device %v", dev)
@@ -412,6 +610,11 @@ func (d *LonghornDevice) GetFrontend() string {
 }
 
 func (d *LonghornDevice) Expand(size int64) (err error) {
+	return d.ExpandContext(context.Background(), size)
+}
+
+// ExpandContext is like Expand but takes a context.
+func (d *LonghornDevice) ExpandContext(ctx context.Context, size int64) (err error) {
 	d.Lock()
 	defer d.Unlock()
 
@@ -431,25 +634,27 @@ func (d *LonghornDevice) Expand(size int64) (err error) {
 		logrus.Info("Device: No need to do anything for the expansion since the frontend is shutdown")
 		return nil
 	}
-	if err := d.scsiDevice.UpdateScsiBackingStore("longhorn", fmt.Sprintf("size=%v", size)); err != nil {
+	// Only the size is changed, e.g. the request timeout is kept
+	bsOpts := iscsi.SetBackingStoreOption(d.scsiDevice.BSOpts, "size", strconv.FormatInt(size, 10))
+	if err := d.scsiDevice.UpdateScsiBackingStore(d.scsiDevice.BSType, bsOpts); err != nil {
 		return err
 	}
 
 	switch d.frontend {
 	case types.FrontendTGTBlockDev:
 		logrus.Infof("Device %v: Expanding frontend %v target %v", d.name, d.frontend, d.scsiDevice.Target)
-		if err := d.scsiDevice.ExpandTarget(size); err != nil {
-			return fmt.Errorf("device %v: fail to expand target %v: %v", d.name, d.scsiDevice.Target, err)
+		if err := d.scsiDevice.ExpandTargetContext(ctx, size); err != nil {
+			return fmt.Errorf("device %v: fail to expand target %v: %w", d.name, d.scsiDevice.Target, err)
 		}
 		logrus.Infof("Device %v: Refreshing/Rescanning frontend %v initiator for the expansion", d.name, d.frontend)
-		if err := d.scsiDevice.RefreshInitiator(); err != nil {
-			return fmt.Errorf("device %v: fail to refresh iSCSI initiator: %v", d.name, err)
+		if err := d.scsiDevice.RefreshInitiatorContext(ctx); err != nil {
+			return fmt.Errorf("device %v: fail to refresh iSCSI initiator: %w", d.name, err)
 		}
 		logrus.Infof("Device %v: Expanded frontend %v size to %d", d.name, d.frontend, size)
 	case types.FrontendTGTISCSI:
 		logrus.Infof("Device %v: Frontend is expanding the target %v", d.name, d.scsiDevice.Target)
-		if err := d.scsiDevice.ExpandTarget(size); err != nil {
-			return fmt.Errorf("device %v: fail to expand target %v: %v", d.name, d.scsiDevice.Target, err)
+		if err := d.scsiDevice.ExpandTargetContext(ctx, size); err != nil {
+			return fmt.Errorf("device %v: fail to expand target %v: %w", d.name, d.scsiDevice.Target, err)
 		}
 		logrus.Infof("Device %v: Expanded frontend %v size to %d, users need to refresh/rescan the initiator by themselves", d.name, d.frontend, size)
 	case "":
@@ -460,3 +665,40 @@ func (d *LonghornDevice) Expand(size int64) (err error) {
 
 	return nil
 }
+
+// Quiesce holds off the I/O of the frontend, see iscsidev.Device.Quiesce. It's
+// a no-op if the frontend is not started.
+func (d *LonghornDevice) Quiesce() error {
+	return d.QuiesceContext(context.Background())
+}
+
+// QuiesceContext is like Quiesce but takes a context.
+func (d *LonghornDevice) QuiesceContext(ctx context.Context) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.scsiDevice == nil || d.endpoint == "" {
+		logrus.Infof("Device %v: No need to quiesce since the frontend is not started", d.name)
+		return nil
+	}
+	logrus.Infof("Device %v: Quiescing frontend %v target %v", d.name, d.frontend, d.scsiDevice.Target)
+	return d.scsiDevice.QuiesceContext(ctx)
+}
+
+// Resume resumes the I/O of the frontend held off by Quiesce.
+func (d *LonghornDevice) Resume() error {
+	return d.ResumeContext(context.Background())
+}
+
+// ResumeContext is like Resume but takes a context.
+func (d *LonghornDevice) ResumeContext(ctx context.Context) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.scsiDevice == nil || d.endpoint == "" {
+		logrus.Infof("Device %v: No need to resume since the frontend is not started", d.name)
+		return nil
+	}
+	logrus.Infof("Device %v: Resuming frontend %v target %v", d.name, d.frontend, d.scsiDevice.Target)
+	return d.scsiDevice.ResumeContext(ctx)
+}
@@ -0,0 +1,224 @@
+package longhorndev
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/go-iscsi-helper/iscsi"
+	"github.com/longhorn/go-iscsi-helper/iscsidev"
+	"github.com/longhorn/go-iscsi-helper/iscsitest"
+	"github.com/longhorn/go-iscsi-helper/types"
+	"github.com/longhorn/go-iscsi-helper/util"
+
+	lhtypes "github.com/longhorn/go-common-libs/types"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type DeviceSuite struct {
+	iscsitest.Fixture
+	creator *LonghornDeviceCreator
+
+	tidLockFile string
+}
+
+var _ = Suite(&DeviceSuite{})
+
+func (s *DeviceSuite) SetUpTest(c *C) {
+	s.Fixture.SetUpTest(c)
+	s.creator = &LonghornDeviceCreator{
+		Executor:        s.Fake,
+		Tgtd:            s.Tgtd,
+		socketDirectory: c.MkDir(),
+		devPath:         c.MkDir(),
+	}
+
+	s.tidLockFile = iscsi.TargetIDLockFile
+	iscsi.TargetIDLockFile = filepath.Join(c.MkDir(), "tid.lock")
+
+	duplicateDevice = func(dev *lhtypes.BlockDeviceInfo, dest string, mode os.FileMode) error {
+		return os.WriteFile(dest, []byte(dev.Name), mode)
+	}
+	removeDevice = func(dev string) error {
+		if err := os.Remove(dev); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+}
+
+func (s *DeviceSuite) TearDownTest(c *C) {
+	iscsi.TargetIDLockFile = s.tidLockFile
+	duplicateDevice, removeDevice = util.DuplicateDeviceWithMode, util.RemoveDevice
+}
+
+func (s *DeviceSuite) newDevice(c *C, name, frontend string, allowedInitiators []string) *LonghornDevice {
+	dev, err := s.creator.NewDeviceWithOptions(name, 1073741824, frontend, 180, 15, 30, DeviceOptions{AllowedInitiators: allowedInitiators})
+	c.Assert(err, IsNil)
+	c.Assert(dev.InitDevice(), IsNil)
+	return dev.(*LonghornDevice)
+}
+
+func (s *DeviceSuite) createSocket(c *C, dev *LonghornDevice) {
+	c.Assert(os.WriteFile(dev.GetSocketPath(), nil, 0600), IsNil)
+}
+
+func (s *DeviceSuite) TestBlockDevice(c *C) {
+	ctx := context.Background()
+	dev := s.newDevice(c, "vol1", types.FrontendTGTBlockDev, nil)
+	s.createSocket(c, dev)
+	c.Assert(dev.Start(), IsNil)
+	c.Assert(dev.Enabled(), Equals, true)
+	c.Assert(dev.GetEndpoint(), Equals, filepath.Join(s.creator.devPath, "vol1"))
+	c.Assert(s.Fake.Sessions(), DeepEquals, []string{dev.scsiDevice.Target})
+	_, err := os.Stat(dev.GetEndpoint())
+	c.Assert(err, IsNil)
+	c.Assert(dev.scsiDevice.BSOpts, Equals, "size=1073741824;request_timeout=30")
+
+	// The request timeout is kept along with the new size
+	c.Assert(dev.Expand(2147483648), IsNil)
+	target, err := s.Tgtd.GetTargetContext(ctx, dev.scsiDevice.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(iscsidev.TargetLunID).SizeMB, Equals, int64(2147))
+	c.Assert(dev.scsiDevice.BSOpts, Equals, "size=2147483648;request_timeout=30")
+	c.Assert(dev.Expand(1073741824), NotNil)
+
+	c.Assert(dev.Shutdown(), IsNil)
+	c.Assert(dev.Enabled(), Equals, false)
+	c.Assert(s.Fake.Sessions(), HasLen, 0)
+	c.Assert(s.Fake.TargetIDs(), HasLen, 0)
+	_, err = os.Stat(filepath.Join(s.creator.devPath, "vol1"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *DeviceSuite) TestReadOnly(c *C) {
+	ctx := context.Background()
+	device, err := s.creator.NewDeviceWithOptions("vol1", 1073741824, types.FrontendTGTBlockDev, 180, 15, 30, DeviceOptions{ReadOnly: true})
+	c.Assert(err, IsNil)
+	dev := device.(*LonghornDevice)
+	c.Assert(dev.InitDevice(), IsNil)
+	s.createSocket(c, dev)
+	c.Assert(dev.Start(), IsNil)
+
+	info, err := os.Stat(dev.GetEndpoint())
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode().Perm(), Equals, ReadOnlyDevMode)
+	target, err := s.Tgtd.GetTargetContext(ctx, dev.scsiDevice.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.LUN(iscsidev.TargetLunID).Readonly, Equals, true)
+	ro, err := iscsi.IsDeviceReadOnly(dev.scsiDevice.KernelDevice.Name, s.Fake)
+	c.Assert(err, IsNil)
+	c.Assert(ro, Equals, true)
+
+	c.Assert(dev.Shutdown(), IsNil)
+	c.Assert(s.Fake.TargetIDs(), HasLen, 0)
+}
+
+func (s *DeviceSuite) TestUpgrade(c *C) {
+	dev := s.newDevice(c, "vol1", types.FrontendTGTBlockDev, nil)
+	s.createSocket(c, dev)
+	c.Assert(dev.Start(), IsNil)
+	kernelDevice := dev.scsiDevice.KernelDevice.Name
+
+	c.Assert(dev.PrepareUpgrade(), IsNil)
+	_, err := os.Stat(dev.GetSocketPath())
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	s.createSocket(c, dev)
+	c.Assert(dev.FinishUpgrade(), IsNil)
+	c.Assert(dev.scsiDevice.KernelDevice.Name, Equals, kernelDevice)
+	c.Assert(s.Fake.Sessions(), HasLen, 1)
+
+	reloaded := false
+	for _, command := range s.Fake.Commands() {
+		if command[0] == "sg_raw" && command[1] == dev.GetEndpoint() {
+			reloaded = true
+		}
+	}
+	c.Assert(reloaded, Equals, true)
+
+	c.Assert(dev.Shutdown(), IsNil)
+	c.Assert(s.Fake.TargetIDs(), HasLen, 0)
+}
+
+func (s *DeviceSuite) TestISCSITarget(c *C) {
+	ctx := context.Background()
+	dev := s.newDevice(c, "vol1", types.FrontendTGTISCSI, []string{"10.0.0.0/24", "iqn.1993-08.org.debian:01:client"})
+	s.createSocket(c, dev)
+	c.Assert(dev.Start(), IsNil)
+	c.Assert(dev.GetEndpoint(), Equals, "iqn.2019-10.io.longhorn:vol1")
+	c.Assert(s.Fake.Sessions(), HasLen, 0)
+
+	target, err := s.Tgtd.GetTargetContext(ctx, dev.GetEndpoint())
+	c.Assert(err, IsNil)
+	c.Assert(target.ACLs, DeepEquals, []string{"10.0.0.0/24"})
+	c.Assert(target.InitiatorNameACLs, DeepEquals, []string{"iqn.1993-08.org.debian:01:client"})
+
+	c.Assert(dev.Expand(2147483648), IsNil)
+	c.Assert(dev.Shutdown(), IsNil)
+	c.Assert(s.Fake.TargetIDs(), HasLen, 0)
+
+	_, err = s.creator.NewDeviceWithOptions("vol2", 1073741824, types.FrontendTGTISCSI, 180, 15, 30, DeviceOptions{AllowedInitiators: []string{"node-1"}})
+	c.Assert(err, NotNil)
+}
+
+func (s *DeviceSuite) TestUnsupportedFrontend(c *C) {
+	// The upstream tgt without the longhorn backing store
+	s.Fake.BackingStores = []string{"rdwr", "aio"}
+	dev := s.newDevice(c, "vol1", types.FrontendTGTISCSI, nil)
+	s.createSocket(c, dev)
+	err := dev.Start()
+	c.Assert(err, ErrorMatches, "device vol1: frontend tgt-iscsi is not supported: backing-store longhorn is only supported by rancher/tgt: .*")
+	c.Assert(errors.Is(err, types.ErrUnsupportedOperation), Equals, true)
+	c.Assert(s.Fake.TargetIDs(), HasLen, 0)
+	c.Assert(dev.GetEndpoint(), Equals, "")
+}
+
+func (s *DeviceSuite) TestQuiesce(c *C) {
+	ctx := context.Background()
+	dev := s.newDevice(c, "vol1", types.FrontendTGTBlockDev, nil)
+	var _ QuiesceDeviceService = dev
+	c.Assert(dev.Quiesce(), IsNil)
+	s.createSocket(c, dev)
+	c.Assert(dev.Start(), IsNil)
+
+	c.Assert(dev.Quiesce(), IsNil)
+	target, err := s.Tgtd.GetTargetContext(ctx, dev.scsiDevice.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.State, Equals, iscsi.TargetStateOffline)
+	// The initiator stays connected
+	c.Assert(s.Fake.Sessions(), HasLen, 1)
+
+	c.Assert(dev.Resume(), IsNil)
+	target, err = s.Tgtd.GetTargetContext(ctx, dev.scsiDevice.Target)
+	c.Assert(err, IsNil)
+	c.Assert(target.State, Equals, iscsi.TargetStateReady)
+	c.Assert(dev.Shutdown(), IsNil)
+}
+
+func (s *DeviceSuite) TestCancel(c *C) {
+	dev := s.newDevice(c, "vol1", types.FrontendTGTBlockDev, nil)
+
+	// Waiting for the socket stops once the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := dev.StartContext(ctx)
+	c.Assert(errors.Is(err, context.Canceled), Equals, true)
+	c.Assert(s.Fake.TargetIDs(), HasLen, 0)
+
+	s.createSocket(c, dev)
+	c.Assert(dev.Start(), IsNil)
+	s.Fake.Hang("iscsiadm", "-R")
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = dev.ExpandContext(ctx, 2147483648)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Assert(dev.Shutdown(), IsNil)
+}
@@ -1,5 +1,12 @@
 package types
 
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
 // errors are from tgt/usr/tgtadm_error.h and tgt/usr/tgtadm.c
 const (
 	TgtadmSuccess              = "success"
@@ -28,3 +35,137 @@ const (
 	TgtadmUnknownParam         = "unknown parameter"
 	TgtadmPreventRemoval       = "this device has Prevent Removal set"
 )
+
+// Sentinel errors for the tgtadm error codes. Use errors.Is to match them
+// against the error returned by the target helpers.
+var (
+	ErrUnknown              = errors.New(TgtadmUnknown)
+	ErrNomem                = errors.New(TgtadmNomem)
+	ErrNoDriver             = errors.New(TgtadmNoDriver)
+	ErrNoTarget             = errors.New(TgtadmNoTarget)
+	ErrNoLun                = errors.New(TgtadmNoLun)
+	ErrNoSession            = errors.New(TgtadmNoSession)
+	ErrNoConnection         = errors.New(TgtadmNoConnection)
+	ErrNoBinding            = errors.New(TgtadmNoBinding)
+	ErrTargetExist          = errors.New(TgtadmTargetExist)
+	ErrBindingExist         = errors.New(TgtadmBindingExist)
+	ErrLunExist             = errors.New(TgtadmLunExist)
+	ErrAclExist             = errors.New(TgtadmAclExist)
+	ErrAclNoexist           = errors.New(TgtadmAclNoexist)
+	ErrUserExist            = errors.New(TgtadmUserExist)
+	ErrNoUser               = errors.New(TgtadmNoUser)
+	ErrTooManyUser          = errors.New(TgtadmTooManyUser)
+	ErrInvalidRequest       = errors.New(TgtadmInvalidRequest)
+	ErrOutAccountExist      = errors.New(TgtadmOutAccountExist)
+	ErrTargetActive         = errors.New(TgtadmTargetActive)
+	ErrLunActive            = errors.New(TgtadmLunActive)
+	ErrDriverActive         = errors.New(TgtadmDriverActive)
+	ErrUnsupportedOperation = errors.New(TgtadmUnsupportedOperation)
+	ErrUnknownParam         = errors.New(TgtadmUnknownParam)
+	ErrPreventRemoval       = errors.New(TgtadmPreventRemoval)
+)
+
+// tgtadmErrors is indexed by the tgtadm_errno value in tgt/usr/tgtadm_error.h.
+// Index 0 is TGTADM_SUCCESS.
+var tgtadmErrors = []error{
+	nil,
+	ErrUnknown,
+	ErrNomem,
+	ErrNoDriver,
+	ErrNoTarget,
+	ErrNoLun,
+	ErrNoSession,
+	ErrNoConnection,
+	ErrNoBinding,
+	ErrTargetExist,
+	ErrBindingExist,
+	ErrLunExist,
+	ErrAclExist,
+	ErrAclNoexist,
+	ErrUserExist,
+	ErrNoUser,
+	ErrTooManyUser,
+	ErrInvalidRequest,
+	ErrOutAccountExist,
+	ErrTargetActive,
+	ErrLunActive,
+	ErrDriverActive,
+	ErrUnsupportedOperation,
+	ErrUnknownParam,
+	ErrPreventRemoval,
+}
+
+// TgtadmErrorFromCode returns the sentinel error for a tgtadm_errno value
+// reported by tgtd. It returns nil for success and for unknown codes.
+func TgtadmErrorFromCode(code int) error {
+	if code <= 0 || code >= len(tgtadmErrors) {
+		return nil
+	}
+	return tgtadmErrors[code]
+}
+
+// TgtadmErrorFromMessage returns the sentinel error whose message is found in
+// msg, or nil if msg doesn't contain any known tgtadm error message.
+//
+// The exit status of the tgtadm binary is not reliable enough to be used
+// alone, since tgtadm also exits with errno values on usage errors.
+func TgtadmErrorFromMessage(msg string) error {
+	for _, sentinel := range tgtadmErrors[1:] {
+		if strings.Contains(msg, sentinel.Error()) {
+			return sentinel
+		}
+	}
+	return nil
+}
+
+// TgtadmError is returned by the target helpers when a tgtadm operation
+// fails. It matches the sentinel error of the failure with errors.Is, and the
+// underlying execution error with errors.As.
+type TgtadmError struct {
+	// Err is one of the sentinel errors, or nil if the failure cannot be
+	// classified, e.g. a timeout or a missing tgtadm binary.
+	Err error
+	// Args is the tgtadm argument list.
+	Args []string
+	// Output is the raw error output reported by tgtadm.
+	Output string
+	// ExitCode is the exit status of tgtadm, or -1 if it didn't exit.
+	ExitCode int
+
+	cause error
+}
+
+// NewTgtadmError wraps the failure cause of the tgtadm call with args.
+func NewTgtadmError(args []string, output string, exitCode int, cause error) *TgtadmError {
+	return &TgtadmError{
+		Err:      TgtadmErrorFromMessage(output),
+		Args:     args,
+		Output:   output,
+		ExitCode: exitCode,
+		cause:    cause,
+	}
+}
+
+// Error leaves out the args if the cause already shows them, e.g. the errors
+// of lhexec, which carry the command line.
+func (e *TgtadmError) Error() string {
+	args := strings.Join(e.Args, " ")
+	if e.cause != nil {
+		if msg := e.cause.Error(); strings.Contains(msg, args) {
+			return "tgtadm failed: " + msg
+		}
+		return fmt.Sprintf("tgtadm %v failed: %v", args, e.cause)
+	}
+	return fmt.Sprintf("tgtadm %v failed with exit status %v: %v", args, e.ExitCode, e.Output)
+}
+
+func (e *TgtadmError) Unwrap() []error {
+	errs := []error{}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	if e.cause != nil {
+		errs = append(errs, e.cause)
+	}
+	return errs
+}
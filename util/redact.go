@@ -0,0 +1,68 @@
+package util
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+const redactedSecret = "********"
+
+// RedactSecrets replaces all occurrences of the secrets in s.
+func RedactSecrets(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		s = strings.ReplaceAll(s, secret, redactedSecret)
+	}
+	return s
+}
+
+// RedactArgs returns a copy of the command arguments with the secrets
+// replaced, so they can be logged or embedded in errors.
+func RedactArgs(args []string, secrets ...string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		redacted[i] = RedactSecrets(arg, secrets...)
+	}
+	return redacted
+}
+
+type redactedError struct {
+	msg    string
+	causes []error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() []error {
+	return e.causes
+}
+
+// RedactError returns an error with the secrets removed from the message of
+// err. The chain of err is dropped since any error in it may leak the
+// secrets, except for the *exec.ExitError carrying the exit status and the
+// context errors.
+func RedactError(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+	redacted := &redactedError{
+		msg: RedactSecrets(err.Error(), secrets...),
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		redacted.causes = append(redacted.causes, exitErr)
+	}
+	for _, ctxErr := range []error{context.Canceled, context.DeadlineExceeded} {
+		if errors.Is(err, ctxErr) {
+			redacted.causes = append(redacted.causes, ctxErr)
+		}
+	}
+	return redacted
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 
+	csync "github.com/longhorn/go-common-libs/sync"
 	lhtypes "github.com/longhorn/go-common-libs/types"
 )
 
@@ -78,10 +80,16 @@ func RemoveDevice(dev string) error {
 }
 
 func DuplicateDevice(dev *lhtypes.BlockDeviceInfo, dest string) error {
-	if err := mknod(dest, dev.Major, dev.Minor); err != nil {
+	return DuplicateDeviceWithMode(dev, dest, 0660)
+}
+
+// DuplicateDeviceWithMode is like DuplicateDevice but creates the device node
+// with the permissions, e.g. 0440 for a read-only device.
+func DuplicateDeviceWithMode(dev *lhtypes.BlockDeviceInfo, dest string, mode os.FileMode) error {
+	if err := mknod(dest, dev.Major, dev.Minor, mode); err != nil {
 		return errors.Wrapf(err, "cannot create device node %s for device %s", dest, dev.Name)
 	}
-	if err := os.Chmod(dest, 0660); err != nil {
+	if err := os.Chmod(dest, mode); err != nil {
 		return errors.Wrapf(err, "cannot change permission of the device %s", dest)
 	}
 	// We use the group 6 by default because this is common group for disks
@@ -92,9 +100,8 @@ func DuplicateDevice(dev *lhtypes.BlockDeviceInfo, dest string) error {
 	return nil
 }
 
-func mknod(device string, major, minor int) error {
-	var fileMode os.FileMode = 0660
-	fileMode |= unix.S_IFBLK
+func mknod(device string, major, minor int, mode os.FileMode) error {
+	fileMode := mode | unix.S_IFBLK
 	dev := int(unix.Mkdev(uint32(major), uint32(minor)))
 
 	logrus.Infof("Creating device %s %d:%d", device, major, minor)
@@ -119,3 +126,67 @@ func remove(path string) error {
 		return fmt.Errorf("timeout trying to delete %s", path)
 	}
 }
+
+// SleepContext pauses for the duration, or until ctx is done. It returns the
+// error of ctx in the latter case.
+func SleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FileLock is a lock file acquired by LockFileContext.
+type FileLock struct {
+	file *os.File
+}
+
+// Unlock releases the lock file.
+func (lock *FileLock) Unlock() {
+	if err := csync.UnlockFile(lock.file); err != nil {
+		logrus.WithError(err).Warn("Failed to unlock file")
+	}
+}
+
+// LockFileContext acquires the lock file by lockFile within the timeout, or
+// until ctx is done, e.g. lhns.LockFile locks it in the host namespace. The
+// lock is released if it's acquired after giving up.
+func LockFileContext(ctx context.Context, path string, timeout time.Duration, lockFile func(string) (*os.File, error)) (*FileLock, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to lock")
+	}
+	type result struct {
+		file *os.File
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		file, err := lockFile(path)
+		resultCh <- result{file: file, err: err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case r := <-resultCh:
+		if r.err != nil {
+			return nil, errors.Wrap(r.err, "failed to lock")
+		}
+		return &FileLock{file: r.file}, nil
+	case <-timer.C:
+		err = fmt.Errorf("timed out waiting for file to lock %v", path)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	go func() {
+		if r := <-resultCh; r.err == nil {
+			(&FileLock{file: r.file}).Unlock()
+		}
+	}()
+	return nil, errors.Wrap(err, "failed to lock")
+}